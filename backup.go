@@ -0,0 +1,564 @@
+package skv
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// Backup document constants
+const (
+	BackupFormat          = "skv-backup"  // Value of BackupManifest.Format
+	BackupFormatVersion   = 2             // Current backup document version
+	BackupKindFull        = "full"        // Backup containing every key
+	BackupKindIncremental = "incremental" // Backup containing changes since its parent
+)
+
+// ErrBackupChain is returned when backups passed to Restore do not form a valid chain
+var ErrBackupChain = errors.New("broken backup chain")
+
+// ErrBackupCorrupt is returned when a backup is truncated, malformed or
+// doesn't match its checksums
+var ErrBackupCorrupt = errors.New("corrupt backup")
+
+// BackupManifest describes the contents of a backup
+// JSON backups store it at the top of the document, binary backups right
+// after the magic bytes.
+type BackupManifest struct {
+	Format  string    `json:"format"`           // Always BackupFormat
+	Version int       `json:"version"`          // Document version
+	Kind    string    `json:"kind"`             // BackupKindFull or BackupKindIncremental
+	Created time.Time `json:"created"`          // Time the backup was taken
+	Source  string    `json:"source,omitempty"` // Absolute path of the backed-up database
+	Host    string    `json:"host,omitempty"`   // Host the backup was taken on
+	Parent  string    `json:"parent,omitempty"` // SHA-256 of the parent backup file (incremental only)
+	Records int       `json:"records"`          // Number of records
+	Deleted int       `json:"deleted"`          // Number of deleted keys (incremental only)
+
+	// ParentFile is the path of the parent backup file relative to this one
+	// (incremental only). The next incremental backup follows it back to
+	// the full backup to find the keys that changed.
+	ParentFile string `json:"parent_file,omitempty"`
+
+	// Checksum is the SHA-256 of the manifest fields, the records and the
+	// deleted keys of a JSON backup. Binary backups end with a checksum of
+	// the whole file instead and leave it empty.
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// backupDocument is the JSON layout of backups that carry a manifest
+type backupDocument struct {
+	Manifest BackupManifest `json:"manifest"`
+	Records  []BackupRecord `json:"records"`
+	Deleted  []string       `json:"deleted,omitempty"`
+}
+
+// newBackupRecord encodes a value for a JSON backup
+// Values <= 256 bytes that are valid UTF-8 are stored as strings,
+// everything else is base64 encoded
+func newBackupRecord(key string, data []byte) BackupRecord {
+	record := BackupRecord{
+		Key:      key,
+		Checksum: valueChecksum(data),
+	}
+
+	if len(data) <= 256 && utf8.Valid(data) {
+		record.Value = string(data)
+		record.IsBinary = false
+	} else {
+		record.ValueB64 = base64.StdEncoding.EncodeToString(data)
+		record.IsBinary = true
+	}
+
+	return record
+}
+
+// data decodes the value stored in a backup record
+func (r BackupRecord) data() ([]byte, error) {
+	if r.IsBinary {
+		data, err := base64.StdEncoding.DecodeString(r.ValueB64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: error decoding base64 for key %q: %v", ErrBackupCorrupt, r.Key, err)
+		}
+		return data, nil
+	}
+	return []byte(r.Value), nil
+}
+
+// newBackupManifest returns a manifest identifying the database as the source
+// Counts, checksums and the parent are filled in by the caller
+func (s *SKV) newBackupManifest(kind string) BackupManifest {
+	source, err := filepath.Abs(s.filePath)
+	if err != nil {
+		source = s.filePath
+	}
+	host, _ := os.Hostname()
+
+	return BackupManifest{
+		Format:  BackupFormat,
+		Version: BackupFormatVersion,
+		Kind:    kind,
+		Created: time.Now().UTC(),
+		Source:  source,
+		Host:    host,
+	}
+}
+
+// writeBackupDocument computes the document checksum and writes it as indented JSON
+func writeBackupDocument(w io.Writer, doc *backupDocument) error {
+	checksum, err := backupChecksum(&doc.Manifest, doc.Records, doc.Deleted)
+	if err != nil {
+		return err
+	}
+	doc.Manifest.Checksum = checksum
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(doc); err != nil {
+		return fmt.Errorf("error encoding backup to JSON: %w", err)
+	}
+	return nil
+}
+
+// crc64Table is the table used by valueChecksum
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+// valueChecksum returns the checksum used to detect changed values (CRC-64)
+func valueChecksum(data []byte) string {
+	sum := crc64.Checksum(data, crc64Table)
+	return fmt.Sprintf("%016x", sum)
+}
+
+// newValueHash returns a hash computing valueChecksum over streamed data
+func newValueHash() hash.Hash64 {
+	return crc64.New(crc64Table)
+}
+
+// backupChecksum returns the SHA-256 of a backup document
+// Version 1 documents only covered the records and deleted keys, later
+// versions also cover every manifest field except the checksum itself.
+func backupChecksum(m *BackupManifest, records []BackupRecord, deleted []string) (string, error) {
+	h := sha256.New()
+	buf := make([]byte, binary.MaxVarintLen64)
+
+	writeField := func(b []byte) {
+		n := binary.PutUvarint(buf, uint64(len(b)))
+		h.Write(buf[:n])
+		h.Write(b)
+	}
+
+	for _, record := range records {
+		data, err := record.data()
+		if err != nil {
+			return "", err
+		}
+		writeField([]byte(record.Key))
+		writeField(data)
+	}
+	h.Write([]byte{0})
+	for _, key := range deleted {
+		writeField([]byte(key))
+	}
+
+	if m.Version >= 2 {
+		h.Write([]byte{0})
+		for _, field := range []string{
+			m.Format, strconv.Itoa(m.Version), m.Kind, m.Created.UTC().Format(time.RFC3339Nano),
+			m.Source, m.Host, m.Parent, m.ParentFile, strconv.Itoa(m.Records), strconv.Itoa(m.Deleted),
+		} {
+			writeField([]byte(field))
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// loadedBackup is a backup file read into memory
+// Binary backups are only checked, their records are streamed when applied
+type loadedBackup struct {
+	path     string
+	checksum string          // SHA-256 of the whole file
+	manifest *BackupManifest // nil for plain JSON array and version 1 binary backups
+	records  []BackupRecord
+	deleted  []string
+	binary   bool // Binary backup written by BackupTo
+	count    int  // Number of records of a binary backup
+}
+
+// kind returns the kind of the backup
+func (b *loadedBackup) kind() string {
+	if b.manifest == nil {
+		return BackupKindFull
+	}
+	return b.manifest.Kind
+}
+
+// state returns the checksum of every key's value in a full backup
+func (b *loadedBackup) state() (map[string]string, error) {
+	if b.binary {
+		return binaryBackupState(b.path)
+	}
+
+	state := make(map[string]string, len(b.records))
+	for _, record := range b.records {
+		data, err := record.data()
+		if err != nil {
+			return nil, err
+		}
+		state[record.Key] = valueChecksum(data)
+	}
+	return state, nil
+}
+
+// loadBackupFile reads and checks a backup file
+// JSON backups are loaded into memory, binary backups are only checked
+func loadBackupFile(filename string) (*loadedBackup, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening backup file: %w", err)
+	}
+	defer file.Close()
+
+	magic := make([]byte, len(binaryBackupMagic))
+	if n, _ := io.ReadFull(file, magic); n == len(magic) && string(magic) == binaryBackupMagic {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("error seeking backup file: %w", err)
+		}
+		return loadBinaryBackupFile(filename, file)
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading backup file: %w", err)
+	}
+	return parseBackup(filename, data)
+}
+
+// parseBackup decodes and checks a JSON backup
+// Both plain record arrays (written by older versions) and documents with a
+// manifest are accepted
+func parseBackup(filename string, data []byte) (*loadedBackup, error) {
+	sum := sha256.Sum256(data)
+	backup := &loadedBackup{
+		path:     filename,
+		checksum: hex.EncodeToString(sum[:]),
+	}
+
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(data, &backup.records); err != nil {
+			return nil, fmt.Errorf("%w: error decoding backup JSON: %v", ErrBackupCorrupt, err)
+		}
+		if err := checkRecordChecksums(filename, backup.records); err != nil {
+			return nil, err
+		}
+		return backup, nil
+	}
+
+	var doc backupDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%w: error decoding backup JSON: %v", ErrBackupCorrupt, err)
+	}
+	if doc.Manifest.Format != BackupFormat {
+		return nil, fmt.Errorf("invalid backup file %s: unknown format %q", filename, doc.Manifest.Format)
+	}
+	if doc.Manifest.Version > BackupFormatVersion {
+		return nil, fmt.Errorf("unsupported backup version %d in %s", doc.Manifest.Version, filename)
+	}
+	if doc.Manifest.Kind != BackupKindFull && doc.Manifest.Kind != BackupKindIncremental {
+		return nil, fmt.Errorf("invalid backup file %s: unknown kind %q", filename, doc.Manifest.Kind)
+	}
+
+	if len(doc.Records) != doc.Manifest.Records || len(doc.Deleted) != doc.Manifest.Deleted {
+		return nil, fmt.Errorf("%w: %s has %d records and %d deleted keys, manifest says %d and %d",
+			ErrBackupCorrupt, filename, len(doc.Records), len(doc.Deleted), doc.Manifest.Records, doc.Manifest.Deleted)
+	}
+	if err := checkRecordChecksums(filename, doc.Records); err != nil {
+		return nil, err
+	}
+	checksum, err := backupChecksum(&doc.Manifest, doc.Records, doc.Deleted)
+	if err != nil {
+		return nil, err
+	}
+	if checksum != doc.Manifest.Checksum {
+		return nil, fmt.Errorf("%w: %s does not match its checksum", ErrBackupCorrupt, filename)
+	}
+
+	backup.manifest = &doc.Manifest
+	backup.records = doc.Records
+	backup.deleted = doc.Deleted
+	return backup, nil
+}
+
+// BackupInfo describes a backup file checked by VerifyBackup
+type BackupInfo struct {
+	Path     string
+	Binary   bool            // Written by BackupTo
+	Manifest *BackupManifest // nil for backups written without a manifest
+	Records  int             // Number of records
+	Deleted  int             // Number of deleted keys (incremental only)
+	Size     int64           // File size in bytes
+	Checksum string          // SHA-256 of the whole file, referenced by incremental backups
+}
+
+// VerifyBackup checks a backup file without touching any database
+// The manifest, every value checksum and the whole-file or document checksum
+// are verified. A truncated, malformed or modified backup returns ErrBackupCorrupt.
+// Backups written without a manifest are accepted but can only be checked
+// for their structure, their Manifest is nil.
+func VerifyBackup(path string) (*BackupInfo, error) {
+	backup, err := loadBackupFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("error getting backup file info: %w", err)
+	}
+
+	records := len(backup.records)
+	if backup.binary {
+		records = backup.count
+	}
+
+	return &BackupInfo{
+		Path:     path,
+		Binary:   backup.binary,
+		Manifest: backup.manifest,
+		Records:  records,
+		Deleted:  len(backup.deleted),
+		Size:     info.Size(),
+		Checksum: backup.checksum,
+	}, nil
+}
+
+// checkRecordChecksums decodes every record and compares the records holding
+// a checksum with their value
+func checkRecordChecksums(filename string, records []BackupRecord) error {
+	for _, record := range records {
+		data, err := record.data()
+		if err != nil {
+			return err
+		}
+		if record.Checksum != "" && valueChecksum(data) != record.Checksum {
+			return fmt.Errorf("%w: value of key %q in %s does not match its checksum",
+				ErrBackupCorrupt, record.Key, filename)
+		}
+	}
+	return nil
+}
+
+// loadBackupChain reads a full backup followed by incremental backups and
+// checks that each incremental backup was taken on top of the previous file
+func loadBackupChain(filenames []string) ([]*loadedBackup, error) {
+	if len(filenames) == 0 {
+		return nil, fmt.Errorf("no backup files given")
+	}
+
+	chain := make([]*loadedBackup, 0, len(filenames))
+	for i, filename := range filenames {
+		backup, err := loadBackupFile(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		if i == 0 {
+			if backup.kind() != BackupKindFull {
+				return nil, fmt.Errorf("%w: %s is an incremental backup, the chain must start with a full backup",
+					ErrBackupChain, filename)
+			}
+		} else {
+			if backup.kind() != BackupKindIncremental {
+				return nil, fmt.Errorf("%w: %s is a full backup, only incremental backups may follow the first file",
+					ErrBackupChain, filename)
+			}
+			if backup.manifest.Parent != chain[i-1].checksum {
+				return nil, fmt.Errorf("%w: %s was not taken on top of %s",
+					ErrBackupChain, filename, chain[i-1].path)
+			}
+		}
+
+		chain = append(chain, backup)
+	}
+
+	return chain, nil
+}
+
+// forEachBackupRecord calls fn for every record stored in a loaded backup
+// Values of binary backups are streamed from the file
+func forEachBackupRecord(backup *loadedBackup, fn func(key []byte, value io.Reader, size uint64) error) error {
+	if backup.binary {
+		file, err := os.Open(backup.path)
+		if err != nil {
+			return fmt.Errorf("error opening backup file: %w", err)
+		}
+		defer file.Close()
+
+		_, _, err = readBinaryBackup(file, fn)
+		return err
+	}
+
+	for _, record := range backup.records {
+		data, err := record.data()
+		if err != nil {
+			return err
+		}
+		if err := fn([]byte(record.Key), bytes.NewReader(data), uint64(len(data))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chainState returns the checksum of every key's value once the backup in
+// filename is restored, with the backup itself
+// Incremental backups only hold their changes: the chain is followed back to
+// the full backup through the parent file names of the manifests, checking
+// that each parent is the file the incremental backup was taken on top of.
+func chainState(filename string) (*loadedBackup, map[string]string, error) {
+	last, err := loadBackupFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	chain := []*loadedBackup{last}
+	for chain[0].kind() == BackupKindIncremental {
+		child := chain[0]
+		if child.manifest.ParentFile == "" {
+			return nil, nil, fmt.Errorf("%w: %s doesn't name its parent backup", ErrBackupChain, child.path)
+		}
+		path := child.manifest.ParentFile
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(child.path), path)
+		}
+		parent, err := loadBackupFile(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: parent of %s: %w", ErrBackupChain, child.path, err)
+		}
+		if parent.checksum != child.manifest.Parent {
+			return nil, nil, fmt.Errorf("%w: %s was not taken on top of %s", ErrBackupChain, child.path, path)
+		}
+		chain = append([]*loadedBackup{parent}, chain...)
+	}
+
+	state, err := chain[0].state()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, backup := range chain[1:] {
+		for _, key := range backup.deleted {
+			delete(state, key)
+		}
+		for _, record := range backup.records {
+			state[record.Key] = record.Checksum
+		}
+	}
+	return last, state, nil
+}
+
+// BackupIncremental writes to dst only the keys that changed or were deleted
+// since the backup in base, which can be a full or an incremental backup.
+// Restore the database by passing the full backup followed by every
+// incremental backup in order to Restore.
+// The manifest names base relative to dst, so the backups of a chain must
+// be kept together for the next incremental backup.
+func (s *SKV) BackupIncremental(base string, dst string) error {
+	parent, baseState, err := chainState(base)
+	if err != nil {
+		return fmt.Errorf("error loading base backup: %w", err)
+	}
+	parentFile, err := relativeBackupPath(base, dst)
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	if err := s.checkOpen(); err != nil {
+		s.mu.RUnlock()
+		return err
+	}
+	state := make(map[string]string, s.cache.len())
+	records := make([]BackupRecord, 0)
+	err = s.cache.each(func(key string, position int64) error {
+		_, _, data, err := s.readRecordAt(position)
+		if err != nil {
+			return fmt.Errorf("error reading record for key %q: %w", key, err)
+		}
+
+		checksum := valueChecksum(data)
+		state[key] = checksum
+		if baseState[key] != checksum {
+			records = append(records, newBackupRecord(key, data))
+		}
+		return nil
+	})
+	s.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	deleted := make([]string, 0)
+	for key := range baseState {
+		if _, exists := state[key]; !exists {
+			deleted = append(deleted, key)
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool { return records[i].Key < records[j].Key })
+	sort.Strings(deleted)
+
+	doc := backupDocument{
+		Manifest: s.newBackupManifest(BackupKindIncremental),
+		Records:  records,
+		Deleted:  deleted,
+	}
+	doc.Manifest.Parent = parent.checksum
+	doc.Manifest.ParentFile = parentFile
+	doc.Manifest.Records = len(records)
+	doc.Manifest.Deleted = len(deleted)
+
+	file, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("error creating backup file: %w", err)
+	}
+	defer file.Close()
+
+	if err := writeBackupDocument(file, &doc); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// relativeBackupPath returns the path of base relative to the directory of dst
+func relativeBackupPath(base string, dst string) (string, error) {
+	absBase, err := filepath.Abs(base)
+	if err != nil {
+		return "", fmt.Errorf("error resolving backup path: %w", err)
+	}
+	absDst, err := filepath.Abs(dst)
+	if err != nil {
+		return "", fmt.Errorf("error resolving backup path: %w", err)
+	}
+	rel, err := filepath.Rel(filepath.Dir(absDst), absBase)
+	if err != nil {
+		// Different volumes, only the absolute path works
+		return absBase, nil
+	}
+	return rel, nil
+}
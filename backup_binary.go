@@ -0,0 +1,373 @@
+package skv
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Binary backup format
+//
+//	magic "SKVB" (4) + version (1)
+//	manifest:      size (4) + BackupManifest as JSON
+//	for each key:  tag 'R' (1) + key_size (1) + key + value_size (8) + value + CRC-64 of value (8)
+//	trailer:       tag 'E' (1) + record count (8) + SHA-256 of all preceding bytes (32)
+//
+// Version 1 backups have no manifest and no value checksums.
+// Values are copied straight from the database file, so backups and restores
+// stream without holding whole values in memory.
+const (
+	binaryBackupMagic   = "SKVB"
+	binaryBackupVersion = 2
+
+	binaryTagRecord byte = 'R' // A key and its value
+	binaryTagEnd    byte = 'E' // Trailer with record count and checksum
+)
+
+// BackupTo writes a binary backup of all key-value pairs to w
+// The format is compact and streamed, so it works with pipes and with
+// databases larger than memory. Restore it with RestoreFrom or Restore.
+func (s *SKV) BackupTo(w io.Writer) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+
+	// Everything before the checksum is hashed
+	h := sha256.New()
+	bw := bufio.NewWriterSize(io.MultiWriter(w, h), 64*1024)
+
+	manifest := s.newBackupManifest(BackupKindFull)
+	manifest.Records = s.cache.len()
+	manifestJSON, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("error encoding backup manifest: %w", err)
+	}
+
+	header := append([]byte(binaryBackupMagic), binaryBackupVersion)
+	header = binary.LittleEndian.AppendUint32(header, uint32(len(manifestJSON)))
+	header = append(header, manifestJSON...)
+	if _, err := bw.Write(header); err != nil {
+		return fmt.Errorf("error writing backup header: %w", err)
+	}
+
+	var count uint64
+	err = s.cache.each(func(keyStr string, position int64) error {
+		h, value, err := s.recordDataAt(position)
+		if err != nil {
+			return fmt.Errorf("error reading record for key %q: %w", keyStr, err)
+		}
+		key, dataSize := h.key, h.dataSize
+
+		buf := make([]byte, 0, 2+len(key)+8)
+		buf = append(buf, binaryTagRecord, byte(len(key)))
+		buf = append(buf, key...)
+		buf = binary.LittleEndian.AppendUint64(buf, dataSize)
+		if _, err := bw.Write(buf); err != nil {
+			return fmt.Errorf("error writing backup record: %w", err)
+		}
+
+		crc := newValueHash()
+		if _, err := io.Copy(io.MultiWriter(bw, crc), value); err != nil {
+			return fmt.Errorf("error writing value for key %q: %w", keyStr, err)
+		}
+		if _, err := bw.Write(binary.LittleEndian.AppendUint64(nil, crc.Sum64())); err != nil {
+			return fmt.Errorf("error writing value checksum: %w", err)
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	trailer := binary.LittleEndian.AppendUint64([]byte{binaryTagEnd}, count)
+	if _, err := bw.Write(trailer); err != nil {
+		return fmt.Errorf("error writing backup trailer: %w", err)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("error writing backup: %w", err)
+	}
+	if _, err := w.Write(h.Sum(nil)); err != nil {
+		return fmt.Errorf("error writing backup checksum: %w", err)
+	}
+
+	return nil
+}
+
+// RestoreFrom loads key-value pairs from a backup read from r
+// Both binary backups (BackupTo) and full JSON backups (Backup, BackupJSONTo)
+// are accepted. Like Restore, existing keys with the same name are overwritten
+// and other keys are kept.
+// The whole backup is checked before anything is applied: binary backups are
+// first copied to a file next to the database, which is removed afterwards,
+// so a corrupt or truncated stream returns ErrBackupCorrupt and leaves the
+// database unchanged.
+func (s *SKV) RestoreFrom(r io.Reader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+
+	var backup *loadedBackup
+	br := bufio.NewReaderSize(r, 64*1024)
+	if isBinaryBackup(br) {
+		spooled, err := s.spoolBinaryBackup(br)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(spooled.path)
+		backup = spooled
+	} else {
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return fmt.Errorf("error reading backup: %w", err)
+		}
+		backup, err = parseBackup("backup stream", data)
+		if err != nil {
+			return err
+		}
+	}
+	if backup.kind() != BackupKindFull {
+		return fmt.Errorf("%w: cannot restore an incremental backup on its own", ErrBackupChain)
+	}
+
+	_, err := s.restoreChain(context.Background(), []*loadedBackup{backup}, RestoreOptions{})
+	return err
+}
+
+// spoolBinaryBackup copies a binary backup stream to a file next to the
+// database and checks it
+// The file is removed on error, otherwise the caller removes it.
+// Must be called with the write lock held
+func (s *SKV) spoolBinaryBackup(r io.Reader) (*loadedBackup, error) {
+	path := s.filePath + ".restore.spool"
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error creating spool file: %w", err)
+	}
+	defer file.Close()
+
+	backup, err := func() (*loadedBackup, error) {
+		if _, err := io.Copy(file, r); err != nil {
+			return nil, fmt.Errorf("error reading backup: %w", err)
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("error seeking spool file: %w", err)
+		}
+		return loadBinaryBackupFile("backup stream", file)
+	}()
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	backup.path = path
+	return backup, nil
+}
+
+// restoreRecord writes one record read from a backup, replacing any existing value
+// The old record is only deleted once the new one is written.
+// Must be called with the write lock held
+func (s *SKV) restoreRecord(key []byte, value io.Reader, size uint64) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+
+	recordPos, err := s.writeRecordStream(key, nil, value, size)
+	if err != nil {
+		return fmt.Errorf("error restoring key %q: %w", key, err)
+	}
+	if _, exists := s.cache.get(string(key)); exists {
+		if err := s.deleteInternal(key); err != nil {
+			return err
+		}
+	}
+	if err := s.cache.set(string(key), recordPos); err != nil {
+		return err
+	}
+
+	return s.notifyStream(key, recordPos)
+}
+
+// isBinaryBackup reports whether br starts with the binary backup magic bytes
+func isBinaryBackup(br *bufio.Reader) bool {
+	magic, err := br.Peek(len(binaryBackupMagic))
+	return err == nil && string(magic) == binaryBackupMagic
+}
+
+// readBinaryBackup reads a binary backup and calls fn for every record
+// fn receives a reader limited to the value, any part of the value it
+// doesn't read is skipped. Each value's checksum is verified once fn returns,
+// the file checksum once the trailer is reached.
+// Returns the manifest (nil for version 1 backups) and the number of records
+func readBinaryBackup(r io.Reader, fn func(key []byte, value io.Reader, size uint64) error) (*BackupManifest, uint64, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReaderSize(r, 64*1024)
+	}
+
+	// Only bytes read through hr are hashed, the checksum itself is read from br
+	h := sha256.New()
+	hr := io.TeeReader(br, h)
+
+	header := make([]byte, len(binaryBackupMagic)+1)
+	if _, err := io.ReadFull(hr, header); err != nil {
+		return nil, 0, fmt.Errorf("%w: error reading backup header: %v", ErrBackupCorrupt, err)
+	}
+	if string(header[:len(binaryBackupMagic)]) != binaryBackupMagic {
+		return nil, 0, fmt.Errorf("invalid binary backup: expected magic bytes %q", binaryBackupMagic)
+	}
+	version := header[len(binaryBackupMagic)]
+	if version < 1 || version > binaryBackupVersion {
+		return nil, 0, fmt.Errorf("unsupported binary backup version %d", version)
+	}
+
+	var manifest *BackupManifest
+	if version >= 2 {
+		sizeBuf := make([]byte, 4)
+		if _, err := io.ReadFull(hr, sizeBuf); err != nil {
+			return nil, 0, fmt.Errorf("%w: error reading manifest size: %v", ErrBackupCorrupt, err)
+		}
+		manifestJSON := make([]byte, binary.LittleEndian.Uint32(sizeBuf))
+		if _, err := io.ReadFull(hr, manifestJSON); err != nil {
+			return nil, 0, fmt.Errorf("%w: error reading manifest: %v", ErrBackupCorrupt, err)
+		}
+		manifest = &BackupManifest{}
+		if err := json.Unmarshal(manifestJSON, manifest); err != nil {
+			return nil, 0, fmt.Errorf("%w: error decoding manifest: %v", ErrBackupCorrupt, err)
+		}
+		if manifest.Format != BackupFormat || manifest.Kind != BackupKindFull {
+			return nil, 0, fmt.Errorf("%w: invalid manifest (format %q, kind %q)", ErrBackupCorrupt, manifest.Format, manifest.Kind)
+		}
+	}
+
+	var count uint64
+	tag := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(hr, tag); err != nil {
+			return manifest, count, fmt.Errorf("%w: backup truncated after %d records", ErrBackupCorrupt, count)
+		}
+
+		switch tag[0] {
+		case binaryTagRecord:
+			keySize := make([]byte, 1)
+			if _, err := io.ReadFull(hr, keySize); err != nil {
+				return manifest, count, fmt.Errorf("%w: error reading key size: %v", ErrBackupCorrupt, err)
+			}
+			key := make([]byte, keySize[0])
+			if _, err := io.ReadFull(hr, key); err != nil {
+				return manifest, count, fmt.Errorf("%w: error reading key: %v", ErrBackupCorrupt, err)
+			}
+			sizeBuf := make([]byte, 8)
+			if _, err := io.ReadFull(hr, sizeBuf); err != nil {
+				return manifest, count, fmt.Errorf("%w: error reading value size: %v", ErrBackupCorrupt, err)
+			}
+			size := binary.LittleEndian.Uint64(sizeBuf)
+
+			limited := &io.LimitedReader{R: hr, N: int64(size)}
+			crc := newValueHash()
+			value := io.TeeReader(limited, crc)
+			if err := fn(key, value, size); err != nil {
+				return manifest, count, err
+			}
+			// Skip whatever fn didn't read
+			if _, err := io.Copy(io.Discard, value); err != nil {
+				return manifest, count, fmt.Errorf("error skipping value: %w", err)
+			}
+			if limited.N > 0 {
+				return manifest, count, fmt.Errorf("%w: value of key %q truncated", ErrBackupCorrupt, key)
+			}
+			if version >= 2 {
+				if _, err := io.ReadFull(hr, sizeBuf); err != nil {
+					return manifest, count, fmt.Errorf("%w: error reading value checksum: %v", ErrBackupCorrupt, err)
+				}
+				if binary.LittleEndian.Uint64(sizeBuf) != crc.Sum64() {
+					return manifest, count, fmt.Errorf("%w: value of key %q does not match its checksum", ErrBackupCorrupt, key)
+				}
+			}
+			count++
+
+		case binaryTagEnd:
+			countBuf := make([]byte, 8)
+			if _, err := io.ReadFull(hr, countBuf); err != nil {
+				return manifest, count, fmt.Errorf("%w: error reading trailer: %v", ErrBackupCorrupt, err)
+			}
+			sum := h.Sum(nil)
+			expected := make([]byte, len(sum))
+			if _, err := io.ReadFull(br, expected); err != nil {
+				return manifest, count, fmt.Errorf("%w: error reading checksum: %v", ErrBackupCorrupt, err)
+			}
+			if string(sum) != string(expected) {
+				return manifest, count, fmt.Errorf("%w: binary backup checksum does not match", ErrBackupCorrupt)
+			}
+			if binary.LittleEndian.Uint64(countBuf) != count {
+				return manifest, count, fmt.Errorf("%w: trailer announces %d records, found %d",
+					ErrBackupCorrupt, binary.LittleEndian.Uint64(countBuf), count)
+			}
+			if manifest != nil && uint64(manifest.Records) != count {
+				return manifest, count, fmt.Errorf("%w: manifest announces %d records, found %d",
+					ErrBackupCorrupt, manifest.Records, count)
+			}
+			return manifest, count, nil
+
+		default:
+			return manifest, count, fmt.Errorf("%w: unknown tag 0x%02X after %d records", ErrBackupCorrupt, tag[0], count)
+		}
+	}
+}
+
+// loadBinaryBackupFile checks a binary backup file without loading its values
+func loadBinaryBackupFile(filename string, file *os.File) (*loadedBackup, error) {
+	// Hash the whole file while checking it, to link incremental backups
+	h := sha256.New()
+	tee := io.TeeReader(file, h)
+	manifest, count, err := readBinaryBackup(tee, func(key []byte, value io.Reader, size uint64) error {
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", filename, err)
+	}
+	if _, err := io.Copy(io.Discard, tee); err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", filename, err)
+	}
+
+	return &loadedBackup{
+		path:     filename,
+		checksum: fmt.Sprintf("%x", h.Sum(nil)),
+		manifest: manifest,
+		binary:   true,
+		count:    int(count),
+	}, nil
+}
+
+// binaryBackupState returns the checksum of every value in a binary backup file
+func binaryBackupState(filename string) (map[string]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening backup file: %w", err)
+	}
+	defer file.Close()
+
+	state := make(map[string]string)
+	_, _, err = readBinaryBackup(file, func(key []byte, value io.Reader, size uint64) error {
+		h := newValueHash()
+		if _, err := io.Copy(h, value); err != nil {
+			return err
+		}
+		state[string(key)] = fmt.Sprintf("%016x", h.Sum64())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
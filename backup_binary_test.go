@@ -0,0 +1,233 @@
+package skv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupToRestoreFrom(t *testing.T) {
+	dbFile := "test_backup_stream.skv"
+	restoreFile := "test_backup_stream_restore.skv"
+	defer os.Remove(dbFile)
+	defer os.Remove(restoreFile)
+
+	db, err := Open(dbFile)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	large := bytes.Repeat([]byte{0x00, 0xAB, 0xFF}, 100000)
+	db.PutString("text", "hello")
+	db.Put([]byte("binary"), []byte{0x00, 0x01, 0xFF})
+	db.Put([]byte("large"), large)
+	db.Put([]byte("empty"), []byte{})
+
+	var buf bytes.Buffer
+	if err := db.BackupTo(&buf); err != nil {
+		t.Fatalf("BackupTo failed: %v", err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte(binaryBackupMagic)) {
+		t.Fatal("Binary backup should start with the magic bytes")
+	}
+
+	restored, err := Open(restoreFile)
+	if err != nil {
+		t.Fatalf("Failed to open restore database: %v", err)
+	}
+	defer restored.Close()
+	restored.PutString("text", "overwritten")
+	restored.PutString("kept", "local")
+
+	if err := restored.RestoreFrom(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("RestoreFrom failed: %v", err)
+	}
+
+	if restored.Count() != 5 {
+		t.Errorf("Expected 5 keys after restore, got %d", restored.Count())
+	}
+	db.ForEach(func(key []byte, value []byte) error {
+		got, err := restored.Get(key)
+		if err != nil || !bytes.Equal(got, value) {
+			t.Errorf("Key %s: value mismatch after restore (%v)", key, err)
+		}
+		return nil
+	})
+	if value, _ := restored.GetString("kept"); value != "local" {
+		t.Errorf("Keys missing from the backup should be kept, got %q", value)
+	}
+}
+
+func TestRestoreFromJSON(t *testing.T) {
+	dbFile := "test_backup_stream_json.skv"
+	restoreFile := "test_backup_stream_json_restore.skv"
+	defer os.Remove(dbFile)
+	defer os.Remove(restoreFile)
+
+	db, err := Open(dbFile)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	db.PutString("a", "1")
+	db.Put([]byte("b"), []byte{0xFF, 0xFE})
+
+	var buf bytes.Buffer
+	if err := db.BackupJSONTo(&buf); err != nil {
+		t.Fatalf("BackupJSONTo failed: %v", err)
+	}
+
+	restored, err := Open(restoreFile)
+	if err != nil {
+		t.Fatalf("Failed to open restore database: %v", err)
+	}
+	defer restored.Close()
+
+	if err := restored.RestoreFrom(&buf); err != nil {
+		t.Fatalf("RestoreFrom JSON failed: %v", err)
+	}
+	if value, _ := restored.Get([]byte("b")); !bytes.Equal(value, []byte{0xFF, 0xFE}) {
+		t.Errorf("Expected binary value to be restored, got %v", value)
+	}
+}
+
+func TestRestoreFromCorrupt(t *testing.T) {
+	dbFile := "test_backup_stream_corrupt.skv"
+	restoreFile := "test_backup_stream_corrupt_restore.skv"
+	defer os.Remove(dbFile)
+	defer os.Remove(restoreFile)
+
+	db, err := Open(dbFile)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	db.PutString("a", "value a")
+	db.PutString("b", "value b")
+
+	var buf bytes.Buffer
+	db.BackupTo(&buf)
+	data := buf.Bytes()
+
+	restored, err := Open(restoreFile)
+	if err != nil {
+		t.Fatalf("Failed to open restore database: %v", err)
+	}
+	defer restored.Close()
+
+	// Truncated stream
+	err = restored.RestoreFrom(bytes.NewReader(data[:len(data)-40]))
+	if !errors.Is(err, ErrBackupCorrupt) {
+		t.Errorf("Expected ErrBackupCorrupt for a truncated backup, got %v", err)
+	}
+	if restored.Count() != 0 {
+		t.Errorf("Expected nothing restored from a truncated backup, got %d keys", restored.Count())
+	}
+	if _, err := os.Stat(restoreFile + ".restore.spool"); !os.IsNotExist(err) {
+		t.Errorf("Expected the spool file to be removed, got %v", err)
+	}
+
+	// Flipped byte in a value
+	tampered := append([]byte(nil), data...)
+	tampered[bytes.Index(tampered, []byte("value a"))] ^= 0xFF
+	err = restored.RestoreFrom(bytes.NewReader(tampered))
+	if !errors.Is(err, ErrBackupCorrupt) {
+		t.Errorf("Expected ErrBackupCorrupt for a modified backup, got %v", err)
+	}
+}
+
+func TestRestoreFromCorruptKeepsKeys(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(filepath.Join(dir, "source.skv"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	for i := 0; i < 20; i++ {
+		db.PutString(fmt.Sprintf("key-%02d", i), fmt.Sprintf("backed-up value %02d", i))
+	}
+	var buf bytes.Buffer
+	if err := db.BackupTo(&buf); err != nil {
+		t.Fatalf("BackupTo failed: %v", err)
+	}
+
+	target, err := Open(filepath.Join(dir, "target.skv"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer target.Close()
+	for i := 0; i < 20; i += 2 {
+		target.PutString(fmt.Sprintf("key-%02d", i), fmt.Sprintf("current value %02d", i))
+	}
+
+	// Flip one byte of the last value, after the others were read
+	data := buf.Bytes()
+	data[bytes.LastIndex(data, []byte("backed-up value"))] ^= 0x01
+	if err := target.RestoreFrom(bytes.NewReader(data)); !errors.Is(err, ErrBackupCorrupt) {
+		t.Fatalf("Expected ErrBackupCorrupt, got %v", err)
+	}
+
+	if target.Count() != 10 {
+		t.Errorf("Expected 10 keys, got %d", target.Count())
+	}
+	for i := 0; i < 20; i += 2 {
+		key := fmt.Sprintf("key-%02d", i)
+		if got, _ := target.GetString(key); got != fmt.Sprintf("current value %02d", i) {
+			t.Errorf("Key %q changed to %q", key, got)
+		}
+	}
+}
+
+func TestRestoreBinaryBackupFile(t *testing.T) {
+	dbFile := "test_backup_binfile.skv"
+	restoreFile := "test_backup_binfile_restore.skv"
+	fullFile := "test_backup_binfile_full.bin"
+	incrFile := "test_backup_binfile_incr.json"
+	for _, f := range []string{dbFile, restoreFile, fullFile, incrFile} {
+		defer os.Remove(f)
+	}
+
+	db, err := Open(dbFile)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	db.PutString("a", "1")
+	db.PutString("b", "2")
+
+	file, err := os.Create(fullFile)
+	if err != nil {
+		t.Fatalf("Failed to create backup file: %v", err)
+	}
+	if err := db.BackupTo(file); err != nil {
+		t.Fatalf("BackupTo failed: %v", err)
+	}
+	file.Close()
+
+	// Incremental backups can be based on a binary full backup
+	db.UpdateString("a", "changed")
+	db.DeleteString("b")
+	if err := db.BackupIncremental(fullFile, incrFile); err != nil {
+		t.Fatalf("Incremental backup on binary base failed: %v", err)
+	}
+	if doc := readBackupDocument(t, incrFile); doc.Manifest.Records != 1 || doc.Manifest.Deleted != 1 {
+		t.Errorf("Expected 1 record and 1 deletion, got %d and %d", doc.Manifest.Records, doc.Manifest.Deleted)
+	}
+
+	restored, err := Open(restoreFile)
+	if err != nil {
+		t.Fatalf("Failed to open restore database: %v", err)
+	}
+	defer restored.Close()
+
+	if err := restored.Restore(fullFile, incrFile); err != nil {
+		t.Fatalf("Failed to restore binary chain: %v", err)
+	}
+	if value, _ := restored.GetString("a"); value != "changed" || restored.Count() != 1 {
+		t.Errorf("Expected only a=changed after restore, got %q and %d keys", value, restored.Count())
+	}
+}
@@ -0,0 +1,346 @@
+package skv
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readBackupDocument decodes a backup document written with a manifest
+func readBackupDocument(t *testing.T, filename string) backupDocument {
+	t.Helper()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Failed to read backup: %v", err)
+	}
+	var doc backupDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("Backup is not a valid document: %v", err)
+	}
+	return doc
+}
+
+func TestBackupIncremental(t *testing.T) {
+	dbFile := "test_backup_incr.skv"
+	restoreFile := "test_backup_incr_restore.skv"
+	fullFile := "test_backup_incr_full.json"
+	incr1File := "test_backup_incr_1.json"
+	incr2File := "test_backup_incr_2.json"
+	for _, f := range []string{dbFile, restoreFile, fullFile, incr1File, incr2File} {
+		defer os.Remove(f)
+	}
+
+	db, err := Open(dbFile)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	db.PutString("unchanged", "same")
+	db.PutString("updated", "old")
+	db.PutString("deleted", "gone soon")
+	db.Put([]byte("binary"), []byte{0x00, 0x01, 0xFF})
+
+	if err := db.Backup(fullFile); err != nil {
+		t.Fatalf("Full backup failed: %v", err)
+	}
+
+	// First round of changes
+	db.UpdateString("updated", "new")
+	db.DeleteString("deleted")
+	db.PutString("added", "fresh")
+
+	if err := db.BackupIncremental(fullFile, incr1File); err != nil {
+		t.Fatalf("Incremental backup failed: %v", err)
+	}
+
+	doc := readBackupDocument(t, incr1File)
+	if doc.Manifest.Kind != BackupKindIncremental {
+		t.Errorf("Expected incremental kind, got %q", doc.Manifest.Kind)
+	}
+	changed := make([]string, 0)
+	for _, record := range doc.Records {
+		changed = append(changed, record.Key)
+	}
+	if strings.Join(changed, ",") != "added,updated" {
+		t.Errorf("Expected only added and updated keys in incremental backup, got %v", changed)
+	}
+	if len(doc.Deleted) != 1 || doc.Deleted[0] != "deleted" {
+		t.Errorf("Expected deleted key to be recorded, got %v", doc.Deleted)
+	}
+
+	// Second round on top of the first incremental backup
+	db.Update([]byte("binary"), []byte{0xFE})
+	db.DeleteString("added")
+
+	if err := db.BackupIncremental(incr1File, incr2File); err != nil {
+		t.Fatalf("Second incremental backup failed: %v", err)
+	}
+	if doc := readBackupDocument(t, incr2File); doc.Manifest.Records != 1 || doc.Manifest.Deleted != 1 {
+		t.Errorf("Expected 1 record and 1 deletion, got %d and %d", doc.Manifest.Records, doc.Manifest.Deleted)
+	}
+
+	// Restore the chain into an empty database
+	restored, err := Open(restoreFile)
+	if err != nil {
+		t.Fatalf("Failed to open restore database: %v", err)
+	}
+	defer restored.Close()
+
+	if err := restored.Restore(fullFile, incr1File, incr2File); err != nil {
+		t.Fatalf("Failed to restore chain: %v", err)
+	}
+
+	if restored.Count() != db.Count() {
+		t.Errorf("Expected %d keys after restore, got %d", db.Count(), restored.Count())
+	}
+	db.ForEach(func(key []byte, value []byte) error {
+		got, err := restored.Get(key)
+		if err != nil || string(got) != string(value) {
+			t.Errorf("Key %s: expected %v, got %v (%v)", key, value, got, err)
+		}
+		return nil
+	})
+	if restored.ExistsString("deleted") || restored.ExistsString("added") {
+		t.Error("Keys deleted in incremental backups should not be restored")
+	}
+}
+
+func TestBackupIncrementalBrokenChain(t *testing.T) {
+	dbFile := "test_backup_chain.skv"
+	restoreFile := "test_backup_chain_restore.skv"
+	fullFile := "test_backup_chain_full.json"
+	incr1File := "test_backup_chain_1.json"
+	incr2File := "test_backup_chain_2.json"
+	for _, f := range []string{dbFile, restoreFile, fullFile, incr1File, incr2File} {
+		defer os.Remove(f)
+	}
+
+	db, err := Open(dbFile)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	db.PutString("a", "1")
+	db.Backup(fullFile)
+	db.PutString("b", "2")
+	db.BackupIncremental(fullFile, incr1File)
+	db.PutString("c", "3")
+	db.BackupIncremental(incr1File, incr2File)
+
+	restored, err := Open(restoreFile)
+	if err != nil {
+		t.Fatalf("Failed to open restore database: %v", err)
+	}
+	defer restored.Close()
+	restored.PutString("existing", "untouched")
+
+	// Missing link
+	err = restored.Restore(fullFile, incr2File)
+	if !errors.Is(err, ErrBackupChain) {
+		t.Errorf("Expected ErrBackupChain for a missing incremental, got %v", err)
+	}
+
+	// Chain must start with a full backup
+	err = restored.Restore(incr1File, incr2File)
+	if !errors.Is(err, ErrBackupChain) {
+		t.Errorf("Expected ErrBackupChain for a chain without full backup, got %v", err)
+	}
+
+	// Tampered incremental backup
+	data, _ := os.ReadFile(incr2File)
+	os.WriteFile(incr2File, []byte(strings.Replace(string(data), `"value": "3"`, `"value": "4"`, 1)), 0644)
+	err = restored.Restore(fullFile, incr1File, incr2File)
+	if !errors.Is(err, ErrBackupCorrupt) {
+		t.Errorf("Expected ErrBackupCorrupt for a modified backup, got %v", err)
+	}
+
+	// Nothing was applied by the failed restores
+	if restored.Count() != 1 || !restored.ExistsString("existing") {
+		t.Errorf("Failed restores must not modify the database, got %d keys", restored.Count())
+	}
+}
+
+func TestBackupIncrementalFollowsParents(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(filepath.Join(dir, "test.skv"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 1000; i++ {
+		db.PutString(fmt.Sprintf("key-%04d", i), "value")
+	}
+	backups := filepath.Join(dir, "backups")
+	os.Mkdir(backups, 0755)
+	full := filepath.Join(backups, "full.json")
+	incr1 := filepath.Join(backups, "incr1.json")
+	incr2 := filepath.Join(backups, "incr2.json")
+	incr3 := filepath.Join(backups, "incr3.json")
+	db.Backup(full)
+
+	// Incremental backups only hold their changes, whatever the key count
+	db.UpdateString("key-0001", "changed")
+	if err := db.BackupIncremental(full, incr1); err != nil {
+		t.Fatalf("Incremental backup failed: %v", err)
+	}
+	db.DeleteString("key-0002")
+	if err := db.BackupIncremental(incr1, incr2); err != nil {
+		t.Fatalf("Second incremental backup failed: %v", err)
+	}
+	for _, path := range []string{incr1, incr2} {
+		if info, _ := os.Stat(path); info.Size() > 2048 {
+			t.Errorf("Expected a small incremental backup, %s has %d bytes", path, info.Size())
+		}
+	}
+	if doc := readBackupDocument(t, incr2); doc.Manifest.ParentFile != "incr1.json" {
+		t.Errorf("Expected the parent file relative to the backup, got %q", doc.Manifest.ParentFile)
+	}
+
+	// The chain is found wherever it is moved
+	moved := filepath.Join(dir, "moved")
+	os.Rename(backups, moved)
+	db.UpdateString("key-0001", "changed again")
+	if err := db.BackupIncremental(filepath.Join(moved, "incr2.json"), filepath.Join(moved, "incr3.json")); err != nil {
+		t.Fatalf("Incremental backup of a moved chain failed: %v", err)
+	}
+	doc := readBackupDocument(t, filepath.Join(moved, "incr3.json"))
+	if doc.Manifest.Records != 1 || doc.Manifest.Deleted != 0 {
+		t.Errorf("Expected only the changed key, got %d records and %d deletions", doc.Manifest.Records, doc.Manifest.Deleted)
+	}
+
+	// A missing parent breaks the chain
+	os.Remove(filepath.Join(moved, "incr1.json"))
+	if err := db.BackupIncremental(filepath.Join(moved, "incr2.json"), incr3); !errors.Is(err, ErrBackupChain) {
+		t.Errorf("Expected ErrBackupChain without the parent backup, got %v", err)
+	}
+}
+
+func TestVerifyBackup(t *testing.T) {
+	dbFile := "test_verify_backup.skv"
+	jsonFile := "test_verify_backup.json"
+	binFile := "test_verify_backup.skvb"
+	incrFile := "test_verify_backup_incr.json"
+	for _, f := range []string{dbFile, jsonFile, binFile, incrFile} {
+		defer os.Remove(f)
+	}
+
+	db, err := Open(dbFile)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	db.PutString("a", "1")
+	db.Put([]byte("b"), []byte{0x00, 0xFF})
+
+	if err := db.Backup(jsonFile); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	file, _ := os.Create(binFile)
+	if err := db.BackupTo(file); err != nil {
+		t.Fatalf("BackupTo failed: %v", err)
+	}
+	file.Close()
+	db.DeleteString("a")
+	if err := db.BackupIncremental(jsonFile, incrFile); err != nil {
+		t.Fatalf("BackupIncremental failed: %v", err)
+	}
+
+	for _, tt := range []struct {
+		path    string
+		binary  bool
+		kind    string
+		records int
+		deleted int
+	}{
+		{jsonFile, false, BackupKindFull, 2, 0},
+		{binFile, true, BackupKindFull, 2, 0},
+		{incrFile, false, BackupKindIncremental, 0, 1},
+	} {
+		info, err := VerifyBackup(tt.path)
+		if err != nil {
+			t.Errorf("%s: verify failed: %v", tt.path, err)
+			continue
+		}
+		if info.Binary != tt.binary || info.Records != tt.records || info.Deleted != tt.deleted {
+			t.Errorf("%s: unexpected info %+v", tt.path, info)
+		}
+		if info.Manifest == nil {
+			t.Errorf("%s: expected a manifest", tt.path)
+			continue
+		}
+		if info.Manifest.Kind != tt.kind || info.Manifest.Version != BackupFormatVersion {
+			t.Errorf("%s: unexpected manifest %+v", tt.path, info.Manifest)
+		}
+		if !strings.HasSuffix(info.Manifest.Source, dbFile) || info.Manifest.Created.IsZero() {
+			t.Errorf("%s: manifest should identify the source and time, got %q at %v",
+				tt.path, info.Manifest.Source, info.Manifest.Created)
+		}
+	}
+
+	// Backups written without a manifest are still accepted
+	legacyFile := "test_verify_backup_legacy.json"
+	defer os.Remove(legacyFile)
+	os.WriteFile(legacyFile, []byte(`[{"key": "k", "value": "v", "is_binary": false}]`), 0644)
+	if info, err := VerifyBackup(legacyFile); err != nil || info.Manifest != nil || info.Records != 1 {
+		t.Errorf("Expected legacy backup to verify without manifest, got %+v (%v)", info, err)
+	}
+}
+
+func TestVerifyBackupCorrupt(t *testing.T) {
+	dbFile := "test_verify_corrupt.skv"
+	jsonFile := "test_verify_corrupt.json"
+	binFile := "test_verify_corrupt.skvb"
+	badFile := "test_verify_corrupt_bad"
+	for _, f := range []string{dbFile, jsonFile, binFile, badFile} {
+		defer os.Remove(f)
+	}
+
+	db, err := Open(dbFile)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	db.PutString("alpha", "first value")
+	db.PutString("beta", "second value")
+	db.Backup(jsonFile)
+	file, _ := os.Create(binFile)
+	db.BackupTo(file)
+	file.Close()
+
+	jsonData, _ := os.ReadFile(jsonFile)
+	binData, _ := os.ReadFile(binFile)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"edited value", []byte(strings.Replace(string(jsonData), "second value", "second VALUE", 1))},
+		{"edited manifest", []byte(strings.Replace(string(jsonData), `"records": 2`, `"records": 1`, 1))},
+		{"edited source", []byte(strings.Replace(string(jsonData), dbFile, "other.skv", 1))},
+		{"truncated json", jsonData[:len(jsonData)/2]},
+		{"truncated binary", binData[:len(binData)-10]},
+		{"edited binary value", bytes.Replace(binData, []byte("first value"), []byte("first VALUE"), 1)},
+	}
+
+	for _, tt := range tests {
+		os.WriteFile(badFile, tt.data, 0644)
+		if _, err := VerifyBackup(badFile); !errors.Is(err, ErrBackupCorrupt) {
+			t.Errorf("%s: expected ErrBackupCorrupt, got %v", tt.name, err)
+		}
+	}
+
+	// Record checksums name the damaged key
+	os.WriteFile(badFile, tests[0].data, 0644)
+	if _, err := VerifyBackup(badFile); err == nil || !strings.Contains(err.Error(), `"beta"`) {
+		t.Errorf("Expected error to name the damaged key, got %v", err)
+	}
+}
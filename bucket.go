@@ -0,0 +1,495 @@
+package skv
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Buckets
+//
+// A bucket is a separate keyspace inside the database file. Its records carry
+// the bucket's numeric ID in their metadata block (1-2 bytes for the first
+// thousands of buckets) instead of a name prefix, and a definition record
+// maps the name to the ID. Keys of different buckets and of the default
+// keyspace never collide.
+
+// ErrBucketNotFound is returned when a bucket doesn't exist or was deleted
+var ErrBucketNotFound = errors.New("bucket not found")
+
+// bucketState is the in-memory state of a bucket
+type bucketState struct {
+	id       uint64
+	name     string
+	position int64      // Position of the definition record
+	cache    memoryKeys // Cache: key -> file position
+}
+
+// bucketKey identifies a key across buckets, 0 is the default keyspace
+type bucketKey struct {
+	bucket uint64
+	key    string
+}
+
+// loadBucket returns the bucket with id, adding it to buckets if missing
+func loadBucket(buckets map[uint64]*bucketState, id uint64) *bucketState {
+	b, ok := buckets[id]
+	if !ok {
+		b = &bucketState{id: id, cache: make(memoryKeys)}
+		buckets[id] = b
+	}
+	return b
+}
+
+// Bucket is a handle on a named bucket
+// It offers the key/value API of the database, scoped to the bucket. Handles
+// are cheap and safe for concurrent use; once the bucket is deleted every
+// method returns ErrBucketNotFound.
+type Bucket struct {
+	db   *SKV
+	name string
+	id   uint64
+}
+
+// Bucket returns the bucket with the given name, creating it if needed
+// Returns ErrReadOnly if the bucket doesn't exist and the database is read-only
+func (s *SKV) Bucket(name string) (*Bucket, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	if len(name) == 0 {
+		return nil, fmt.Errorf("bucket name cannot be empty")
+	}
+	if len(name) > 255 {
+		return nil, fmt.Errorf("bucket name too long (max 255 bytes)")
+	}
+
+	if b, exists := s.buckets[name]; exists {
+		return &Bucket{db: s, name: name, id: b.id}, nil
+	}
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	b, err := s.createBucket(name)
+	if err != nil {
+		return nil, err
+	}
+	return &Bucket{db: s, name: name, id: b.id}, nil
+}
+
+// createBucket writes the definition of a new bucket
+// Must be called with the write lock held
+func (s *SKV) createBucket(name string) (*bucketState, error) {
+	id := s.lastBucketID + 1
+	position, err := s.writeRecord([]byte(name), &recordMeta{bucketDef: id}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating bucket: %w", err)
+	}
+	s.lastBucketID = id
+
+	if s.buckets == nil {
+		s.buckets = make(map[string]*bucketState)
+	}
+	b := &bucketState{id: id, name: name, position: position, cache: make(memoryKeys)}
+	s.buckets[name] = b
+	s.notifyBucket(opCreateBucket, name, nil, nil)
+
+	return b, nil
+}
+
+// ListBuckets returns the sorted names of all buckets, none once the
+// database is closed
+func (s *SKV) ListBuckets() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil
+	}
+
+	names := make([]string, 0, len(s.buckets))
+	for name := range s.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DeleteBucket deletes a bucket and all its keys
+// Returns ErrBucketNotFound if the bucket doesn't exist
+func (s *SKV) DeleteBucket(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+	return s.deleteBucket(name)
+}
+
+// deleteBucket is the internal implementation of DeleteBucket without locking
+// Must be called with the write lock held
+func (s *SKV) deleteBucket(name string) error {
+	b, exists := s.buckets[name]
+	if !exists {
+		return ErrBucketNotFound
+	}
+
+	// Keys first, so an interrupted delete leaves a smaller bucket rather
+	// than orphaned records
+	for key := range b.cache {
+		if err := s.deleteFrom(b.cache, []byte(key)); err != nil {
+			return err
+		}
+	}
+
+	definition := memoryKeys{name: b.position}
+	if err := s.deleteFrom(definition, []byte(name)); err != nil {
+		return err
+	}
+	delete(s.buckets, name)
+	s.notifyBucket(opDeleteBucket, name, nil, nil)
+
+	return nil
+}
+
+// Name returns the name of the bucket
+func (b *Bucket) Name() string {
+	return b.name
+}
+
+// state returns the state of the bucket
+// Must be called with the lock held
+func (b *Bucket) state() (*bucketState, error) {
+	state, exists := b.db.buckets[b.name]
+	if !exists || state.id != b.id {
+		return nil, ErrBucketNotFound
+	}
+	return state, nil
+}
+
+// write stores a record in the bucket, replacing an existing one
+// Must be called with the write lock held
+func (b *Bucket) write(state *bucketState, key []byte, data []byte) error {
+	if len(key) > 255 {
+		return ErrKeyTooLong
+	}
+	if err := b.db.checkBucketPut(state, key, uint64(len(data))); err != nil {
+		return err
+	}
+	if _, exists := state.cache[string(key)]; exists {
+		if err := b.db.deleteFrom(state.cache, key); err != nil {
+			return err
+		}
+	}
+
+	recordPos, err := b.db.writeRecord(key, &recordMeta{bucket: state.id}, data)
+	if err != nil {
+		return err
+	}
+	state.cache[string(key)] = recordPos
+	b.db.notifyBucket(opSet, state.name, key, data)
+	return nil
+}
+
+// lockForWrite takes the write lock and returns the state of the bucket
+// The lock is held only if the error is nil.
+func (b *Bucket) lockForWrite(key []byte) (*bucketState, error) {
+	b.db.mu.Lock()
+
+	if err := b.db.checkWritable(); err != nil {
+		b.db.mu.Unlock()
+		return nil, err
+	}
+	if len(key) == 0 {
+		b.db.mu.Unlock()
+		return nil, ErrEmptyKey
+	}
+	state, err := b.state()
+	if err != nil {
+		b.db.mu.Unlock()
+		return nil, err
+	}
+	return state, nil
+}
+
+// Put stores a new key with its value
+// Returns ErrKeyExists if the key already exists in the bucket
+func (b *Bucket) Put(key []byte, data []byte) error {
+	state, err := b.lockForWrite(key)
+	if err != nil {
+		return err
+	}
+	defer b.db.mu.Unlock()
+
+	if _, exists := state.cache[string(key)]; exists {
+		return ErrKeyExists
+	}
+	return b.write(state, key, data)
+}
+
+// Update modifies the value of an existing key
+// Returns ErrKeyNotFound if the key doesn't exist in the bucket
+func (b *Bucket) Update(key []byte, data []byte) error {
+	state, err := b.lockForWrite(key)
+	if err != nil {
+		return err
+	}
+	defer b.db.mu.Unlock()
+
+	if _, exists := state.cache[string(key)]; !exists {
+		return ErrKeyNotFound
+	}
+	return b.write(state, key, data)
+}
+
+// Set stores a value for a key, creating the key or replacing its value
+func (b *Bucket) Set(key []byte, data []byte) error {
+	state, err := b.lockForWrite(key)
+	if err != nil {
+		return err
+	}
+	defer b.db.mu.Unlock()
+
+	return b.write(state, key, data)
+}
+
+// Delete deletes a key
+// Returns ErrKeyNotFound if the key doesn't exist in the bucket
+func (b *Bucket) Delete(key []byte) error {
+	state, err := b.lockForWrite(key)
+	if err != nil {
+		return err
+	}
+	defer b.db.mu.Unlock()
+
+	if err := b.db.deleteFrom(state.cache, key); err != nil {
+		return err
+	}
+	b.db.notifyBucket(opDelete, state.name, key, nil)
+	return nil
+}
+
+// Get retrieves the value associated with a key
+// Returns ErrKeyNotFound if the key doesn't exist in the bucket
+func (b *Bucket) Get(key []byte) ([]byte, error) {
+	b.db.mu.RLock()
+	defer b.db.mu.RUnlock()
+
+	if err := b.db.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+	state, err := b.state()
+	if err != nil {
+		return nil, err
+	}
+
+	position, exists := state.cache[string(key)]
+	if !exists {
+		return nil, ErrKeyNotFound
+	}
+	return b.db.valueAt(position)
+}
+
+// Exists checks if a key exists in the bucket
+func (b *Bucket) Exists(key []byte) bool {
+	b.db.mu.RLock()
+	defer b.db.mu.RUnlock()
+
+	if b.db.closed {
+		return false
+	}
+	state, err := b.state()
+	if err != nil {
+		return false
+	}
+	_, exists := state.cache[string(key)]
+	return exists
+}
+
+// Keys returns the sorted keys of the bucket
+func (b *Bucket) Keys() ([][]byte, error) {
+	b.db.mu.RLock()
+	defer b.db.mu.RUnlock()
+
+	if err := b.db.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	state, err := b.state()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(state.cache))
+	for key := range state.cache {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+	return toByteKeys(names), nil
+}
+
+// Count returns the number of keys in the bucket, 0 if it was deleted or
+// the database is closed
+func (b *Bucket) Count() int {
+	b.db.mu.RLock()
+	defer b.db.mu.RUnlock()
+
+	if b.db.closed {
+		return 0
+	}
+	state, err := b.state()
+	if err != nil {
+		return 0
+	}
+	return len(state.cache)
+}
+
+// ForEach iterates over all keys and values of the bucket in key order
+// If fn returns an error, iteration stops and that error is returned.
+// fn must not modify the database.
+func (b *Bucket) ForEach(fn func(key []byte, value []byte) error) error {
+	b.db.mu.RLock()
+	defer b.db.mu.RUnlock()
+
+	if err := b.db.checkOpen(); err != nil {
+		return err
+	}
+
+	state, err := b.state()
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(state.cache))
+	for key := range state.cache {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		data, err := b.db.valueAt(state.cache[key])
+		if err != nil {
+			return err
+		}
+		if err := fn([]byte(key), data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PutString is a convenience wrapper for Put using strings
+func (b *Bucket) PutString(key string, value string) error {
+	return b.Put([]byte(key), []byte(value))
+}
+
+// UpdateString is a convenience wrapper for Update using strings
+func (b *Bucket) UpdateString(key string, value string) error {
+	return b.Update([]byte(key), []byte(value))
+}
+
+// SetString is a convenience wrapper for Set using strings
+func (b *Bucket) SetString(key string, value string) error {
+	return b.Set([]byte(key), []byte(value))
+}
+
+// GetString is a convenience wrapper for Get using strings
+func (b *Bucket) GetString(key string) (string, error) {
+	data, err := b.Get([]byte(key))
+	return string(data), err
+}
+
+// DeleteString is a convenience wrapper for Delete using strings
+func (b *Bucket) DeleteString(key string) error {
+	return b.Delete([]byte(key))
+}
+
+// ExistsString is a convenience wrapper for Exists using strings
+func (b *Bucket) ExistsString(key string) bool {
+	return b.Exists([]byte(key))
+}
+
+// KeysString returns the sorted keys of the bucket as strings
+func (b *Bucket) KeysString() ([]string, error) {
+	keys, err := b.Keys()
+	return toStringKeys(keys), err
+}
+
+// ForEachString iterates over all keys and values of the bucket as strings
+func (b *Bucket) ForEachString(fn func(key string, value string) error) error {
+	return b.ForEach(func(key []byte, value []byte) error {
+		return fn(string(key), string(value))
+	})
+}
+
+// livePositions returns the positions of all live records: keys of the
+// default keyspace and of every bucket, and bucket and index definitions
+// Must be called with the lock held
+func (s *SKV) livePositions() ([]int64, error) {
+	positions := make([]int64, 0, s.cache.len())
+	err := s.cache.each(func(_ string, position int64) error {
+		positions = append(positions, position)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range s.buckets {
+		positions = append(positions, b.position)
+		for _, position := range b.cache {
+			positions = append(positions, position)
+		}
+	}
+	for _, idx := range s.indexes {
+		positions = append(positions, idx.position)
+	}
+	return positions, nil
+}
+
+// copyBuckets writes every bucket with its keys to dst
+// Must be called with the lock held
+func (s *SKV) copyBuckets(dst *SKV) error {
+	for name, b := range s.buckets {
+		copied := &bucketState{id: b.id, name: name, cache: make(memoryKeys)}
+
+		position, err := s.copyRecord(dst, b.position)
+		if err != nil {
+			return fmt.Errorf("error copying bucket %q: %w", name, err)
+		}
+		copied.position = position
+
+		for key, position := range b.cache {
+			if copied.cache[key], err = s.copyRecord(dst, position); err != nil {
+				return fmt.Errorf("error copying key %q of bucket %q: %w", key, name, err)
+			}
+		}
+
+		if dst.buckets == nil {
+			dst.buckets = make(map[string]*bucketState)
+		}
+		dst.buckets[name] = copied
+	}
+
+	return nil
+}
+
+// copyRecord writes the record at position to dst unchanged
+// Returns the position of the copy
+func (s *SKV) copyRecord(dst *SKV, position int64) (int64, error) {
+	h, value, err := s.recordDataAt(position)
+	if err != nil {
+		return 0, fmt.Errorf("error reading record: %w", err)
+	}
+	return dst.writeRecordStream(h.key, &h.meta, value, h.dataSize)
+}
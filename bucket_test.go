@@ -0,0 +1,138 @@
+package skv
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBuckets(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.skv")
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	sessions, err := db.Bucket("sessions")
+	if err != nil {
+		t.Fatalf("Bucket failed: %v", err)
+	}
+	config, _ := db.Bucket("config")
+
+	// The same key lives independently in each keyspace
+	db.PutString("id", "default")
+	sessions.PutString("id", "session")
+	config.PutString("id", "config")
+	sessions.PutString("other", "x")
+
+	if err := sessions.PutString("id", "again"); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("Expected ErrKeyExists, got %v", err)
+	}
+	sessions.UpdateString("id", "session v2")
+
+	if value, _ := db.GetString("id"); value != "default" {
+		t.Errorf("Default keyspace returned %q", value)
+	}
+	if value, _ := sessions.GetString("id"); value != "session v2" {
+		t.Errorf("Bucket sessions returned %q", value)
+	}
+	if db.Count() != 1 || sessions.Count() != 2 || config.Count() != 1 {
+		t.Errorf("Unexpected counts: %d, %d, %d", db.Count(), sessions.Count(), config.Count())
+	}
+	if keys, _ := sessions.KeysString(); !reflect.DeepEqual(keys, []string{"id", "other"}) {
+		t.Errorf("Unexpected bucket keys: %v", keys)
+	}
+	if names := db.ListBuckets(); !reflect.DeepEqual(names, []string{"config", "sessions"}) {
+		t.Errorf("Unexpected buckets: %v", names)
+	}
+
+	stats, err := db.Verify()
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if s := stats.Buckets["sessions"]; s == nil || s.ActiveRecords != 2 || s.DeletedRecords != 1 {
+		t.Errorf("Unexpected bucket stats: %+v", s)
+	}
+
+	// Buckets survive compaction and a reopen
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	db.Close()
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+
+	sessions, _ = db.Bucket("sessions")
+	if value, _ := sessions.GetString("id"); value != "session v2" {
+		t.Errorf("Bucket sessions returned %q after reopen", value)
+	}
+	if value, _ := db.GetString("id"); value != "default" {
+		t.Errorf("Default keyspace returned %q after reopen", value)
+	}
+
+	// Deleting a bucket removes its keys and invalidates its handles
+	if err := db.DeleteBucket("sessions"); err != nil {
+		t.Fatalf("DeleteBucket failed: %v", err)
+	}
+	if _, err := sessions.GetString("id"); !errors.Is(err, ErrBucketNotFound) {
+		t.Errorf("Expected ErrBucketNotFound, got %v", err)
+	}
+	if err := db.DeleteBucket("sessions"); !errors.Is(err, ErrBucketNotFound) {
+		t.Errorf("Expected ErrBucketNotFound, got %v", err)
+	}
+	recreated, _ := db.Bucket("sessions")
+	if recreated.Count() != 0 {
+		t.Errorf("Expected a recreated bucket to be empty, got %d keys", recreated.Count())
+	}
+	if err := sessions.PutString("id", "x"); !errors.Is(err, ErrBucketNotFound) {
+		t.Errorf("Expected old handle to stay invalid, got %v", err)
+	}
+
+	db.Close()
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	if names := db.ListBuckets(); !reflect.DeepEqual(names, []string{"config", "sessions"}) {
+		t.Errorf("Unexpected buckets after reopen: %v", names)
+	}
+	sessions, _ = db.Bucket("sessions")
+	if sessions.Count() != 0 {
+		t.Errorf("Expected deleted keys to stay deleted, got %d keys", sessions.Count())
+	}
+}
+
+func TestRestoreKeepsBuckets(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(filepath.Join(dir, "test.skv"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	jobs, _ := db.Bucket("jobs")
+	jobs.PutString("1", "queued")
+	db.PutString("name", "before")
+
+	backup := filepath.Join(dir, "backup.skvb")
+	if err := db.Backup(backup); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	db.UpdateString("name", "after")
+
+	if err := db.Restore(backup); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if value, _ := db.GetString("name"); value != "before" {
+		t.Errorf("Expected restored value, got %q", value)
+	}
+	if value, err := jobs.GetString("1"); err != nil || value != "queued" {
+		t.Errorf("Expected bucket to survive restore, got %q (%v)", value, err)
+	}
+}
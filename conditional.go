@@ -0,0 +1,217 @@
+package skv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrValueMismatch is returned by UpdateIfEquals and DeleteIfEquals when the
+// key holds a different value than expected
+var ErrValueMismatch = errors.New("value mismatch")
+
+// Set stores a value for a key, creating the key or replacing its value
+func (s *SKV) Set(key []byte, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+	return s.putInternal(key, data)
+}
+
+// SetString is a convenience wrapper for Set using string keys
+func (s *SKV) SetString(key string, value string) error {
+	return s.Set([]byte(key), []byte(value))
+}
+
+// Upsert is an alias for Set
+func (s *SKV) Upsert(key []byte, data []byte) error {
+	return s.Set(key, data)
+}
+
+// UpsertString is a convenience wrapper for Upsert using string keys
+func (s *SKV) UpsertString(key string, value string) error {
+	return s.Set([]byte(key), []byte(value))
+}
+
+// PutIfAbsent stores a value only if the key doesn't exist yet
+// If the key exists, its current value is returned with loaded set to true
+// and nothing is written.
+func (s *SKV) PutIfAbsent(key []byte, data []byte) (actual []byte, loaded bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkWritable(); err != nil {
+		return nil, false, err
+	}
+
+	if position, exists := s.cache.get(string(key)); exists {
+		actual, err := s.valueAt(position)
+		if err != nil {
+			return nil, false, err
+		}
+		return actual, true, nil
+	}
+
+	if err := s.putInternal(key, data); err != nil {
+		return nil, false, err
+	}
+	return data, false, nil
+}
+
+// PutIfAbsentString is a convenience wrapper for PutIfAbsent using string keys
+func (s *SKV) PutIfAbsentString(key string, value string) (string, bool, error) {
+	actual, loaded, err := s.PutIfAbsent([]byte(key), []byte(value))
+	return string(actual), loaded, err
+}
+
+// UpdateIfEquals replaces the value of an existing key only if it currently
+// equals old
+// Returns ErrValueMismatch if the value differs, ErrKeyNotFound if the key
+// doesn't exist
+func (s *SKV) UpdateIfEquals(key []byte, old []byte, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+	if err := s.checkValue(key, old); err != nil {
+		return err
+	}
+	return s.putInternal(key, data)
+}
+
+// UpdateIfEqualsString is a convenience wrapper for UpdateIfEquals using string keys
+func (s *SKV) UpdateIfEqualsString(key string, old string, value string) error {
+	return s.UpdateIfEquals([]byte(key), []byte(old), []byte(value))
+}
+
+// DeleteIfEquals deletes a key only if its value currently equals old
+// Returns ErrValueMismatch if the value differs, ErrKeyNotFound if the key
+// doesn't exist
+func (s *SKV) DeleteIfEquals(key []byte, old []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+	if err := s.checkValue(key, old); err != nil {
+		return err
+	}
+	if err := s.deleteInternal(key); err != nil {
+		return err
+	}
+	s.notify(opDelete, key, nil)
+
+	return nil
+}
+
+// DeleteIfEqualsString is a convenience wrapper for DeleteIfEquals using string keys
+func (s *SKV) DeleteIfEqualsString(key string, old string) error {
+	return s.DeleteIfEquals([]byte(key), []byte(old))
+}
+
+// GetAndDelete deletes a key and returns the value it had
+// Returns ErrKeyNotFound if the key doesn't exist
+func (s *SKV) GetAndDelete(key []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+
+	position, exists := s.cache.get(string(key))
+	if !exists {
+		return nil, ErrKeyNotFound
+	}
+	data, err := s.valueAt(position)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.deleteInternal(key); err != nil {
+		return nil, err
+	}
+	s.notify(opDelete, key, nil)
+
+	return data, nil
+}
+
+// GetAndDeleteString is a convenience wrapper for GetAndDelete using string keys
+func (s *SKV) GetAndDeleteString(key string) (string, error) {
+	data, err := s.GetAndDelete([]byte(key))
+	return string(data), err
+}
+
+// GetAndSet stores a value for a key and returns the value it replaced
+// loaded is false if the key didn't exist before.
+func (s *SKV) GetAndSet(key []byte, data []byte) (old []byte, loaded bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkWritable(); err != nil {
+		return nil, false, err
+	}
+
+	if position, exists := s.cache.get(string(key)); exists {
+		if old, err = s.valueAt(position); err != nil {
+			return nil, false, err
+		}
+		loaded = true
+	}
+
+	if err := s.putInternal(key, data); err != nil {
+		return nil, false, err
+	}
+	return old, loaded, nil
+}
+
+// GetAndSetString is a convenience wrapper for GetAndSet using string keys
+func (s *SKV) GetAndSetString(key string, value string) (string, bool, error) {
+	old, loaded, err := s.GetAndSet([]byte(key), []byte(value))
+	return string(old), loaded, err
+}
+
+// checkValue returns ErrValueMismatch unless key holds expected
+// Must be called with the lock held
+func (s *SKV) checkValue(key []byte, expected []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+
+	position, exists := s.cache.get(string(key))
+	if !exists {
+		return ErrKeyNotFound
+	}
+	data, err := s.valueAt(position)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(data, expected) {
+		return fmt.Errorf("%w: key %q", ErrValueMismatch, key)
+	}
+	return nil
+}
+
+// valueAt reads the value of the record at position without moving the
+// shared file offset
+func (s *SKV) valueAt(position int64) ([]byte, error) {
+	h, value, err := s.recordDataAt(position)
+	if err != nil {
+		return nil, fmt.Errorf("error reading record: %w", err)
+	}
+	data := make([]byte, h.dataSize)
+	if _, err := io.ReadFull(value, data); err != nil {
+		return nil, fmt.Errorf("error reading data: %w", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,107 @@
+package skv
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestSetAndConditionalWrites(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.skv"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	// Set creates and replaces
+	if err := db.SetString("k", "one"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := db.UpsertString("k", "two"); err != nil {
+		t.Fatalf("Upsert failed: %v", err)
+	}
+	if value, _ := db.GetString("k"); value != "two" {
+		t.Errorf("Expected two, got %q", value)
+	}
+
+	// PutIfAbsent
+	actual, loaded, err := db.PutIfAbsentString("k", "three")
+	if err != nil || !loaded || actual != "two" {
+		t.Errorf("Expected existing value, got %q, %v (%v)", actual, loaded, err)
+	}
+	actual, loaded, err = db.PutIfAbsentString("new", "fresh")
+	if err != nil || loaded || actual != "fresh" {
+		t.Errorf("Expected value to be stored, got %q, %v (%v)", actual, loaded, err)
+	}
+
+	// UpdateIfEquals and DeleteIfEquals
+	if err := db.UpdateIfEqualsString("k", "one", "x"); !errors.Is(err, ErrValueMismatch) {
+		t.Errorf("Expected ErrValueMismatch, got %v", err)
+	}
+	if err := db.UpdateIfEqualsString("k", "two", "three"); err != nil {
+		t.Errorf("UpdateIfEquals failed: %v", err)
+	}
+	if err := db.UpdateIfEqualsString("missing", "", "x"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+	if err := db.DeleteIfEqualsString("new", "stale"); !errors.Is(err, ErrValueMismatch) {
+		t.Errorf("Expected ErrValueMismatch, got %v", err)
+	}
+	if err := db.DeleteIfEqualsString("new", "fresh"); err != nil {
+		t.Errorf("DeleteIfEquals failed: %v", err)
+	}
+
+	// GetAndSet and GetAndDelete
+	old, loaded, err := db.GetAndSetString("k", "four")
+	if err != nil || !loaded || old != "three" {
+		t.Errorf("Expected previous value three, got %q, %v (%v)", old, loaded, err)
+	}
+	if _, loaded, _ := db.GetAndSetString("other", "x"); loaded {
+		t.Error("Expected loaded to be false for a new key")
+	}
+	value, err := db.GetAndDeleteString("k")
+	if err != nil || value != "four" {
+		t.Errorf("Expected four, got %q (%v)", value, err)
+	}
+	if db.ExistsString("k") {
+		t.Error("Key should be deleted")
+	}
+	if _, err := db.GetAndDeleteString("k"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestPutIfAbsentConcurrent(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.skv"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	winners := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, loaded, err := db.PutIfAbsentString("lock", fmt.Sprintf("owner-%d", i))
+			if err != nil {
+				t.Errorf("PutIfAbsent failed: %v", err)
+				return
+			}
+			if !loaded {
+				mu.Lock()
+				winners++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if winners != 1 {
+		t.Errorf("Expected exactly one writer to win, got %d", winners)
+	}
+}
@@ -0,0 +1,99 @@
+package skv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// cancelReader cancels its context once n bytes have been read
+type cancelReader struct {
+	r      io.Reader
+	n      int
+	cancel context.CancelFunc
+}
+
+func (c *cancelReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n -= n
+	if c.n <= 0 {
+		c.cancel()
+	}
+	return n, err
+}
+
+func TestPutStreamContextCancel(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.skv")
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	db.PutString("a", "1")
+	info, _ := os.Stat(dbPath)
+	sizeBefore := info.Size()
+
+	// Appended record, cut off the file
+	ctx, cancel := context.WithCancel(context.Background())
+	value := make([]byte, 300*1024)
+	reader := &cancelReader{r: bytes.NewReader(value), n: 100 * 1024, cancel: cancel}
+	err = db.PutStreamContext(ctx, []byte("big"), reader, int64(len(value)))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if db.Exists([]byte("big")) {
+		t.Error("A cancelled PutStream must not add the key")
+	}
+	if info, _ := os.Stat(dbPath); info.Size() != sizeBefore {
+		t.Errorf("Expected the partial record to be removed, size %d, was %d", info.Size(), sizeBefore)
+	}
+
+	// Record in a free slot, marked deleted
+	if err := db.Put([]byte("slot"), make([]byte, 200*1024)); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	db.PutString("b", "2")
+	db.DeleteString("slot")
+	ctx, cancel = context.WithCancel(context.Background())
+	value = make([]byte, 150*1024)
+	reader = &cancelReader{r: bytes.NewReader(value), n: 64 * 1024, cancel: cancel}
+	err = db.PutStreamContext(ctx, []byte("big"), reader, int64(len(value)))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	info, _ = os.Stat(dbPath)
+	sizeBefore = info.Size()
+	if err := db.PutStream([]byte("c"), bytes.NewReader(make([]byte, 150*1024)), 150*1024); err != nil {
+		t.Fatalf("PutStream after a cancelled PutStream failed: %v", err)
+	}
+	if info, _ := os.Stat(dbPath); info.Size() != sizeBefore {
+		t.Errorf("Expected the free slot to be reused, size %d, was %d", info.Size(), sizeBefore)
+	}
+	db.Close()
+
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	stats, err := db.Verify()
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if stats.ActiveRecords != 3 || db.Exists([]byte("big")) {
+		t.Errorf("Expected a, b and c only, got %d records", stats.ActiveRecords)
+	}
+	for key, want := range map[string]string{"a": "1", "b": "2"} {
+		if got, err := db.GetString(key); err != nil || got != want {
+			t.Errorf("Key %q: got %q (%v), want %q", key, got, err, want)
+		}
+	}
+	if value, err := db.Get([]byte("c")); err != nil || len(value) != 150*1024 {
+		t.Errorf("Key c: got %d bytes (%v)", len(value), err)
+	}
+}
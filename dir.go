@@ -0,0 +1,497 @@
+package skv
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Directory trees
+//
+// PutDir stores every entry below a directory under prefix + relative path,
+// using "/" as separator on every platform:
+//
+//	regular files  value is the file contents
+//	directories    key ends with "/", value is empty
+//	symlinks       value is the link target
+//
+// Each record keeps the mode and modification time of its entry, see StatFile.
+
+// DirOptions configures PutDirWithOptions and GetDirWithOptions
+type DirOptions struct {
+	// Sync only copies entries whose size, mode or modification time differ
+	// from the destination. Unchanged entries are counted but not rewritten.
+	Sync bool
+
+	// Delete removes destination entries that don't exist in the source:
+	// keys under the prefix for PutDir, files and directories for GetDir
+	Delete bool
+}
+
+// DirStats reports the outcome of PutDir and GetDir
+type DirStats struct {
+	Files     int   // Regular files copied
+	Dirs      int   // Directories copied
+	Links     int   // Symlinks copied
+	Unchanged int   // Entries skipped by Sync because they were up to date
+	Removed   int   // Entries removed by Delete
+	Skipped   int   // Entries of other types, such as devices, left out
+	Bytes     int64 // Bytes of file contents copied
+}
+
+// storeCond selects what storeValue requires of an existing key
+type storeCond int
+
+const (
+	storeCreate  storeCond = iota // The key must not exist (Put)
+	storeReplace                  // The key must exist (Update)
+	storeUpsert                   // Either
+)
+
+// storeValue streams a value with metadata into key
+func (s *SKV) storeValue(key []byte, meta *recordMeta, reader io.Reader, size int64, cond storeCond) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	_, exists := s.cache.get(string(key))
+	switch {
+	case exists && cond == storeCreate:
+		return ErrKeyExists
+	case !exists && cond == storeReplace:
+		return ErrKeyNotFound
+	}
+	if err := s.checkPut(key, meta, uint64(size)); err != nil {
+		return err
+	}
+
+	if exists {
+		if err := s.deleteInternal(key); err != nil {
+			return err
+		}
+	}
+
+	recordPos, err := s.writeRecordStream(key, meta, reader, uint64(size))
+	if err != nil {
+		return err
+	}
+	if err := s.cache.set(string(key), recordPos); err != nil {
+		return err
+	}
+
+	return s.notifyStream(key, recordPos)
+}
+
+// storeFile streams the regular file at path into key with its mode and
+// modification time
+func (s *SKV) storeFile(key []byte, path string, cond storeCond) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("error reading file %s: %w", path, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("error reading file %s: %w", path, err)
+	}
+	if !info.Mode().IsRegular() {
+		return 0, fmt.Errorf("error reading file %s: not a regular file", path)
+	}
+
+	if err := s.storeValue(key, fileMeta(info), file, info.Size(), cond); err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// restoreFile writes the value of key to path and applies the stored mode
+// and modification time. Values without metadata are written with mode 0644.
+func (s *SKV) restoreFile(key string, path string) (*FileMeta, error) {
+	info, err := s.StatFile(key)
+	if err != nil {
+		return nil, err
+	}
+
+	perm := filePerm(info.Mode)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error writing file %s: %w", path, err)
+	}
+
+	if _, err := s.GetStream([]byte(key), file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, fmt.Errorf("error writing file %s: %w", path, err)
+	}
+
+	// Chmod isn't subject to the umask, unlike the mode passed to OpenFile
+	if err := os.Chmod(path, perm); err != nil {
+		return nil, fmt.Errorf("error setting mode of %s: %w", path, err)
+	}
+	if !info.ModTime.IsZero() {
+		if err := os.Chtimes(path, info.ModTime, info.ModTime); err != nil {
+			return nil, fmt.Errorf("error setting modification time of %s: %w", path, err)
+		}
+	}
+
+	return info, nil
+}
+
+// filePerm returns the permission bits to apply for a stored mode
+func filePerm(mode fs.FileMode) fs.FileMode {
+	if mode == 0 {
+		return 0644
+	}
+	return mode & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+}
+
+// PutDir stores every file, directory and symlink below dir under prefix
+// Keys are prefix followed by the slash-separated path relative to dir, so
+// the prefix usually ends with a separator such as "/" or ":".
+// Returns ErrKeyExists if any key already exists, see PutDirWithOptions
+func (s *SKV) PutDir(prefix string, dir string) (*DirStats, error) {
+	return s.PutDirWithOptions(prefix, dir, DirOptions{})
+}
+
+// dirEntry is an entry found while walking a directory
+type dirEntry struct {
+	key  string
+	path string
+	info fs.FileInfo
+}
+
+// PutDirWithOptions stores the tree below dir under prefix
+// Without Sync every key must be new and nothing is written if one exists.
+// With Sync existing keys are overwritten when the entry changed.
+// Entries stored before an error remain stored.
+// Other file types, such as sockets and devices, are skipped and counted.
+func (s *SKV) PutDirWithOptions(prefix string, dir string, opts DirOptions) (*DirStats, error) {
+	entries := make([]dirEntry, 0)
+	skipped := 0
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() && !info.IsDir() && info.Mode()&fs.ModeSymlink == 0 {
+			skipped++
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		key := prefix + filepath.ToSlash(rel)
+		if info.IsDir() {
+			key += "/"
+		}
+		if len(key) > 255 {
+			return fmt.Errorf("key for %s: %w", path, ErrKeyTooLong)
+		}
+
+		entries = append(entries, dirEntry{key: key, path: path, info: info})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading directory %s: %w", dir, err)
+	}
+
+	// Check for existing keys before writing anything
+	if !opts.Sync {
+		for _, entry := range entries {
+			if s.Exists([]byte(entry.key)) {
+				return nil, fmt.Errorf("%w: %s", ErrKeyExists, entry.key)
+			}
+		}
+	}
+
+	stats := &DirStats{Skipped: skipped}
+	present := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		present[entry.key] = true
+
+		if opts.Sync {
+			if stored, err := s.StatFile(entry.key); err == nil && sameFile(stored, entry.info) {
+				stats.Unchanged++
+				continue
+			}
+		}
+
+		key := []byte(entry.key)
+		meta := fileMeta(entry.info)
+		switch {
+		case entry.info.IsDir():
+			err = s.storeValue(key, meta, bytes.NewReader(nil), 0, storeUpsert)
+			stats.Dirs++
+		case entry.info.Mode()&fs.ModeSymlink != 0:
+			var target string
+			target, err = os.Readlink(entry.path)
+			if err == nil {
+				err = s.storeValue(key, meta, strings.NewReader(target), int64(len(target)), storeUpsert)
+			}
+			stats.Links++
+		default:
+			var size int64
+			size, err = s.storeFile(key, entry.path, storeUpsert)
+			stats.Files++
+			stats.Bytes += size
+		}
+		if err != nil {
+			return stats, fmt.Errorf("error storing %s: %w", entry.path, err)
+		}
+	}
+
+	if opts.Delete {
+		keys, err := s.keysWithPrefix(prefix)
+		if err != nil {
+			return stats, err
+		}
+		for _, key := range keys {
+			if present[key] {
+				continue
+			}
+			if err := s.Delete([]byte(key)); err != nil {
+				return stats, fmt.Errorf("error removing key %q: %w", key, err)
+			}
+			stats.Removed++
+		}
+	}
+
+	return stats, nil
+}
+
+// sameFile reports whether a stored entry matches a file on disk
+func sameFile(stored *FileMeta, info fs.FileInfo) bool {
+	size := info.Size()
+	if info.IsDir() {
+		size = 0
+	}
+	return stored.Mode == info.Mode() && stored.ModTime.Equal(info.ModTime()) && stored.Size == size
+}
+
+// keysWithPrefix returns the sorted keys starting with prefix
+func (s *SKV) keysWithPrefix(prefix string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	return indexKeys(s.cache, prefix)
+}
+
+// GetDir writes every key under prefix below dir, recreating the tree
+// stored by PutDir. Existing files are overwritten.
+// Keys without file metadata are written as regular files with mode 0644,
+// so any prefix can be extracted.
+func (s *SKV) GetDir(prefix string, dir string) (*DirStats, error) {
+	return s.GetDirWithOptions(prefix, dir, DirOptions{})
+}
+
+// GetDirWithOptions writes the keys under prefix below dir
+// Keys whose relative path would leave dir, or pass through a symlink, are
+// rejected before anything is written. Directory modes and modification
+// times are applied last, after their contents have been written.
+func (s *SKV) GetDirWithOptions(prefix string, dir string, opts DirOptions) (*DirStats, error) {
+	keys, err := s.keysWithPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check every path before writing anything
+	wanted := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		rel := strings.TrimSuffix(key[len(prefix):], "/")
+		if rel == "" {
+			continue
+		}
+		if !filepath.IsLocal(filepath.FromSlash(rel)) {
+			return nil, fmt.Errorf("key %q is not a local path", key)
+		}
+		wanted[rel] = true
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating directory %s: %w", dir, err)
+	}
+
+	stats := &DirStats{}
+	if opts.Delete {
+		removed, err := removeUnwanted(dir, wanted)
+		stats.Removed = removed
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	type dirTimes struct {
+		path string
+		info *FileMeta
+	}
+	dirs := make([]dirTimes, 0)
+
+	for _, key := range keys {
+		rel := strings.TrimSuffix(key[len(prefix):], "/")
+		if rel == "" {
+			continue
+		}
+		path := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := checkNoSymlinks(dir, rel); err != nil {
+			return stats, err
+		}
+
+		info, err := s.StatFile(key)
+		if err == ErrKeyNotFound {
+			continue // Deleted while extracting
+		}
+		if err != nil {
+			return stats, err
+		}
+
+		unchanged := false
+		if opts.Sync {
+			local, err := os.Lstat(path)
+			unchanged = err == nil && sameFile(info, local)
+		}
+
+		switch {
+		case info.Mode.IsDir() || strings.HasSuffix(key, "/"):
+			// Directory times are reapplied even when unchanged, since
+			// writing their contents below may modify them
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return stats, fmt.Errorf("error creating directory %s: %w", path, err)
+			}
+			dirs = append(dirs, dirTimes{path: path, info: info})
+			if unchanged {
+				stats.Unchanged++
+			} else {
+				stats.Dirs++
+			}
+
+		case unchanged:
+			stats.Unchanged++
+
+		case info.Mode&fs.ModeSymlink != 0:
+			target, err := s.Get([]byte(key))
+			if err != nil {
+				return stats, err
+			}
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return stats, fmt.Errorf("error creating directory %s: %w", filepath.Dir(path), err)
+			}
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return stats, fmt.Errorf("error replacing %s: %w", path, err)
+			}
+			if err := os.Symlink(string(target), path); err != nil {
+				return stats, fmt.Errorf("error creating symlink %s: %w", path, err)
+			}
+			stats.Links++
+
+		default:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return stats, fmt.Errorf("error creating directory %s: %w", filepath.Dir(path), err)
+			}
+			if _, err := s.restoreFile(key, path); err != nil {
+				return stats, err
+			}
+			stats.Files++
+			stats.Bytes += info.Size
+		}
+	}
+
+	// Deepest directories first, so setting a parent's time isn't undone
+	// by changes to its children
+	for i := len(dirs) - 1; i >= 0; i-- {
+		d := dirs[i]
+		if d.info.Mode != 0 {
+			if err := os.Chmod(d.path, filePerm(d.info.Mode)); err != nil {
+				return stats, fmt.Errorf("error setting mode of %s: %w", d.path, err)
+			}
+		}
+		if !d.info.ModTime.IsZero() {
+			if err := os.Chtimes(d.path, d.info.ModTime, d.info.ModTime); err != nil {
+				return stats, fmt.Errorf("error setting modification time of %s: %w", d.path, err)
+			}
+		}
+	}
+
+	return stats, nil
+}
+
+// checkNoSymlinks makes sure no parent directory of rel below dir is a
+// symlink, so a stored link can't redirect later entries outside dir
+func checkNoSymlinks(dir string, rel string) error {
+	parts := strings.Split(rel, "/")
+	path := dir
+	for _, part := range parts[:len(parts)-1] {
+		path = filepath.Join(path, part)
+		info, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("path %s passes through symlink %s", rel, path)
+		}
+	}
+	return nil
+}
+
+// removeUnwanted removes the entries below dir whose relative paths aren't
+// in wanted and returns how many were removed
+func removeUnwanted(dir string, wanted map[string]bool) (int, error) {
+	removed := 0
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if wanted[filepath.ToSlash(rel)] {
+			return nil
+		}
+
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+		removed++
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return removed, fmt.Errorf("error removing entries from %s: %w", dir, err)
+	}
+	return removed, nil
+}
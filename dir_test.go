@@ -0,0 +1,225 @@
+package skv
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestTree creates a small tree with modes and modification times:
+//
+//	a.txt (0600), bin/run.sh (0755), bin/ (0750), link -> a.txt
+func writeTestTree(t *testing.T, dir string) time.Time {
+	t.Helper()
+
+	modTime := time.Date(2024, 3, 1, 12, 30, 0, 123456789, time.UTC)
+	if err := os.MkdirAll(filepath.Join(dir, "bin"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	files := map[string]os.FileMode{"a.txt": 0600, "bin/run.sh": 0755}
+	for name, mode := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("contents of "+name), mode); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+		os.Chmod(path, mode)
+		os.Chtimes(path, modTime, modTime)
+	}
+	if err := os.Symlink("a.txt", filepath.Join(dir, "link")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	os.Chmod(filepath.Join(dir, "bin"), 0750)
+	os.Chtimes(filepath.Join(dir, "bin"), modTime, modTime)
+
+	return modTime
+}
+
+func TestPutDirGetDir(t *testing.T) {
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "src")
+	dst := filepath.Join(tmpDir, "dst")
+	modTime := writeTestTree(t, src)
+
+	db, err := Open(filepath.Join(tmpDir, "test.skv"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	stats, err := db.PutDir("site/", src)
+	if err != nil {
+		t.Fatalf("PutDir failed: %v", err)
+	}
+	if stats.Files != 2 || stats.Dirs != 1 || stats.Links != 1 {
+		t.Errorf("Expected 2 files, 1 dir and 1 link, got %+v", stats)
+	}
+	for _, key := range []string{"site/a.txt", "site/bin/", "site/bin/run.sh", "site/link"} {
+		if !db.ExistsString(key) {
+			t.Errorf("Expected key %q", key)
+		}
+	}
+
+	// Storing the same tree again conflicts without writing anything
+	if _, err := db.PutDir("site/", src); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("Expected ErrKeyExists, got %v", err)
+	}
+
+	info, err := db.StatFile("site/bin/run.sh")
+	if err != nil {
+		t.Fatalf("StatFile failed: %v", err)
+	}
+	if info.Mode.Perm() != 0755 || !info.ModTime.Equal(modTime) {
+		t.Errorf("Expected mode 0755 and time %v, got %v and %v", modTime, info.Mode, info.ModTime)
+	}
+
+	// Compaction keeps the metadata
+	db.PutString("tmp", "x")
+	db.DeleteString("tmp")
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+
+	if _, err := db.GetDir("site/", dst); err != nil {
+		t.Fatalf("GetDir failed: %v", err)
+	}
+
+	for name, mode := range map[string]os.FileMode{"a.txt": 0600, "bin/run.sh": 0755, "bin": 0750 | os.ModeDir} {
+		fi, err := os.Lstat(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatalf("Missing %s: %v", name, err)
+		}
+		if fi.Mode() != mode {
+			t.Errorf("%s: expected mode %v, got %v", name, mode, fi.Mode())
+		}
+		if !fi.ModTime().Equal(modTime) {
+			t.Errorf("%s: expected time %v, got %v", name, modTime, fi.ModTime())
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(dst, "link")); err != nil || target != "a.txt" {
+		t.Errorf("Expected link to a.txt, got %q (%v)", target, err)
+	}
+	data, _ := os.ReadFile(filepath.Join(dst, "bin", "run.sh"))
+	if string(data) != "contents of bin/run.sh" {
+		t.Errorf("Unexpected contents %q", data)
+	}
+}
+
+func TestPutDirSync(t *testing.T) {
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "src")
+	dst := filepath.Join(tmpDir, "dst")
+	writeTestTree(t, src)
+
+	db, err := Open(filepath.Join(tmpDir, "test.skv"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	sync := DirOptions{Sync: true, Delete: true}
+	if _, err := db.PutDirWithOptions("site/", src, sync); err != nil {
+		t.Fatalf("PutDir failed: %v", err)
+	}
+	db.PutString("site/stale.txt", "gone")
+
+	// Change one file and remove another
+	later := time.Now().Add(time.Hour)
+	os.WriteFile(filepath.Join(src, "a.txt"), []byte("changed"), 0600)
+	os.Chtimes(filepath.Join(src, "a.txt"), later, later)
+	os.Remove(filepath.Join(src, "link"))
+
+	stats, err := db.PutDirWithOptions("site/", src, sync)
+	if err != nil {
+		t.Fatalf("PutDir sync failed: %v", err)
+	}
+	if stats.Files != 1 || stats.Unchanged != 2 || stats.Removed != 2 {
+		t.Errorf("Expected 1 file, 2 unchanged and 2 removed, got %+v", stats)
+	}
+	if value, _ := db.GetString("site/a.txt"); value != "changed" {
+		t.Errorf("Expected updated value, got %q", value)
+	}
+	if db.ExistsString("site/link") || db.ExistsString("site/stale.txt") {
+		t.Error("Keys missing from the directory should be removed")
+	}
+
+	// Extracting twice only writes the first time
+	if _, err := db.GetDirWithOptions("site/", dst, sync); err != nil {
+		t.Fatalf("GetDir failed: %v", err)
+	}
+	os.WriteFile(filepath.Join(dst, "extra.txt"), []byte("extra"), 0644)
+	stats, err = db.GetDirWithOptions("site/", dst, sync)
+	if err != nil {
+		t.Fatalf("GetDir sync failed: %v", err)
+	}
+	if stats.Files != 0 || stats.Unchanged != 3 || stats.Removed != 1 {
+		t.Errorf("Expected 3 unchanged and 1 removed, got %+v", stats)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "extra.txt")); !os.IsNotExist(err) {
+		t.Error("Files missing from the database should be removed")
+	}
+}
+
+func TestGetDirRejectsUnsafePaths(t *testing.T) {
+	tmpDir := t.TempDir()
+	dst := filepath.Join(tmpDir, "dst")
+
+	db, err := Open(filepath.Join(tmpDir, "test.skv"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	db.PutString("evil/../escape.txt", "x")
+	if _, err := db.GetDir("evil/", dst); err == nil {
+		t.Error("Expected error for a path leaving the directory")
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "escape.txt")); !os.IsNotExist(err) {
+		t.Error("Nothing should be written outside the directory")
+	}
+}
+
+func TestGetFileKeepsMetadata(t *testing.T) {
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "src.sh")
+	dst := filepath.Join(tmpDir, "dst.sh")
+	modTime := time.Date(2023, 6, 15, 8, 0, 0, 0, time.UTC)
+	os.WriteFile(src, []byte("#!/bin/sh\n"), 0755)
+	os.Chmod(src, 0755)
+	os.Chtimes(src, modTime, modTime)
+
+	db, err := Open(filepath.Join(tmpDir, "test.skv"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.PutFile("script", src); err != nil {
+		t.Fatalf("PutFile failed: %v", err)
+	}
+	if err := db.GetFile("script", dst); err != nil {
+		t.Fatalf("GetFile failed: %v", err)
+	}
+	fi, err := os.Stat(dst)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if fi.Mode().Perm() != 0755 || !fi.ModTime().Equal(modTime) {
+		t.Errorf("Expected mode 0755 and time %v, got %v and %v", modTime, fi.Mode(), fi.ModTime())
+	}
+
+	// Metadata survives a reopen
+	db.Close()
+	db, err = Open(filepath.Join(tmpDir, "test.skv"))
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	value, _ := db.Get([]byte("script"))
+	info, _ := db.StatFile("script")
+	if !bytes.Equal(value, []byte("#!/bin/sh\n")) || info.Mode.Perm() != 0755 {
+		t.Errorf("Expected value and mode after reopen, got %q and %v", value, info.Mode)
+	}
+}
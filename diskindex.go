@@ -0,0 +1,668 @@
+package skv
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// On-disk key index format
+//
+// The file is a hash table of fixed-size pages. Page 0 is the header:
+//
+//	magic (6) | format version (1) | clean (1) | key count (8) |
+//	bucket count (8) | page count (8) | data file size (8) | data file mtime (8)
+//
+// Pages 1 to bucket count are the primary pages of the hash buckets, overflow
+// pages are appended after them. Every other page is:
+//
+//	next overflow page (8) | used bytes (2) | entries
+//
+// and every entry is key size (1) | key | record position (8). All integers
+// are little-endian.
+//
+// The database file is the source of truth. The index is marked dirty when
+// it's opened for writing and only marked clean, together with the size and
+// modification time of the database file, once both are synced on Close.
+// An index that is dirty, or whose database file changed since, is rebuilt.
+const (
+	diskIndexMagic       = "SKVIDX"
+	diskIndexVersion     = 1
+	diskIndexPageSize    = 4096
+	diskIndexPageHeader  = 10      // next page + used bytes
+	diskIndexBuckets     = 64      // Primary pages of a new index
+	diskIndexCacheSize   = 4 << 20 // Default page cache size in bytes
+	diskIndexMinPages    = 16      // Smallest page cache, in pages
+	diskIndexEntryHeader = 1 + 8   // key size + position
+)
+
+// ErrKeyIndexCorrupt is returned when an on-disk key index can't be read
+var ErrKeyIndexCorrupt = errors.New("key index is corrupt")
+
+// cachedPage is a page of the index held in the page cache
+type cachedPage struct {
+	number uint64
+	data   []byte
+	dirty  bool // Changed since it was read or last written
+}
+
+func (p *cachedPage) next() uint64 {
+	return binary.LittleEndian.Uint64(p.data[0:8])
+}
+
+func (p *cachedPage) setNext(n uint64) {
+	binary.LittleEndian.PutUint64(p.data[0:8], n)
+	p.dirty = true
+}
+
+func (p *cachedPage) used() int {
+	return int(binary.LittleEndian.Uint16(p.data[8:10]))
+}
+
+func (p *cachedPage) setUsed(n int) {
+	binary.LittleEndian.PutUint16(p.data[8:10], uint16(n))
+	p.dirty = true
+}
+
+// entries calls fn with the offset, key and position of every entry,
+// stopping when fn returns false
+func (p *cachedPage) entries(fn func(offset int, key []byte, position int64) bool) error {
+	end := diskIndexPageHeader + p.used()
+	if end > len(p.data) {
+		return fmt.Errorf("%w: page %d overflows", ErrKeyIndexCorrupt, p.number)
+	}
+	for offset := diskIndexPageHeader; offset < end; {
+		keyEnd := offset + 1 + int(p.data[offset])
+		if keyEnd+8 > end {
+			return fmt.Errorf("%w: truncated entry in page %d", ErrKeyIndexCorrupt, p.number)
+		}
+		position := int64(binary.LittleEndian.Uint64(p.data[keyEnd:]))
+		if !fn(offset, p.data[offset+1:keyEnd], position) {
+			return nil
+		}
+		offset = keyEnd + 8
+	}
+	return nil
+}
+
+// diskKeys is a keyIndex kept in a hash file (see the format above)
+// Pages are read through an LRU page cache and a bloom filter answers most
+// lookups of missing keys without reading a page. It has its own lock, as
+// lookups change the page cache and may run under the database's read lock.
+type diskKeys struct {
+	mu        sync.Mutex
+	file      *os.File
+	path      string
+	readOnly  bool // Opened read-only, never marked clean
+	temporary bool // Removed on close (a rebuilt index of a read-only database)
+
+	count   uint64 // Number of keys
+	buckets uint64 // Number of primary pages, a power of two
+	pages   uint64 // Number of pages, including the header
+
+	cacheLimit int                      // Pages kept in the page cache
+	cached     map[uint64]*list.Element // Page number -> element holding a *cachedPage
+	order      *list.List               // Front is the most recently used
+
+	bloom bloomFilter
+
+	err error // First error of a lookup, returned by the next change
+}
+
+// openDiskKeys opens the key index at path for a database file
+// trusted reports whether the index matches the database file, otherwise the
+// index is empty and must be rebuilt from the database file. An index that
+// doesn't match a read-only database is rebuilt in a temporary file instead.
+func openDiskKeys(path string, readOnly bool, cacheSize int64, data os.FileInfo) (d *diskKeys, trusted bool, err error) {
+	if cacheSize <= 0 {
+		cacheSize = diskIndexCacheSize
+	}
+	d = &diskKeys{
+		path:       path,
+		readOnly:   readOnly,
+		cacheLimit: max(int(cacheSize/diskIndexPageSize), diskIndexMinPages),
+		cached:     make(map[uint64]*list.Element),
+		order:      list.New(),
+	}
+
+	flag := os.O_RDWR | os.O_CREATE
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	d.file, err = os.OpenFile(path, flag, 0644)
+	if err == nil {
+		trusted = d.loadHeader(data)
+	} else if !readOnly || !errors.Is(err, os.ErrNotExist) {
+		return nil, false, fmt.Errorf("error opening key index %s: %w", path, err)
+	}
+
+	if trusted {
+		if err := d.rebuildBloom(d.count); err != nil {
+			d.file.Close()
+			return nil, false, err
+		}
+	} else if readOnly {
+		if d.file != nil {
+			d.file.Close()
+		}
+		if d.file, err = os.CreateTemp("", "skv-*.idx"); err != nil {
+			return nil, false, fmt.Errorf("error creating temporary key index: %w", err)
+		}
+		d.path = d.file.Name()
+		d.readOnly = false
+		d.temporary = true
+	}
+
+	if !trusted {
+		if err := d.resetLocked(diskIndexBuckets, 0); err != nil {
+			d.close()
+			return nil, false, err
+		}
+	}
+
+	// Any change from now on leaves the index dirty until Close
+	if !d.readOnly {
+		if err := d.writeHeader(false, nil); err != nil {
+			d.close()
+			return nil, false, err
+		}
+		if err := d.file.Sync(); err != nil {
+			d.close()
+			return nil, false, fmt.Errorf("error syncing key index: %w", err)
+		}
+	}
+	return d, trusted, nil
+}
+
+// loadHeader reads the header and reports whether the index was closed
+// cleanly with the database file as it is now
+func (d *diskKeys) loadHeader(data os.FileInfo) bool {
+	header := make([]byte, diskIndexPageSize)
+	if _, err := d.file.ReadAt(header, 0); err != nil {
+		return false
+	}
+	if string(header[0:6]) != diskIndexMagic || header[6] != diskIndexVersion || header[7] != 1 {
+		return false
+	}
+	if int64(binary.LittleEndian.Uint64(header[32:40])) != data.Size() ||
+		int64(binary.LittleEndian.Uint64(header[40:48])) != data.ModTime().UnixNano() {
+		return false
+	}
+
+	d.count = binary.LittleEndian.Uint64(header[8:16])
+	d.buckets = binary.LittleEndian.Uint64(header[16:24])
+	d.pages = binary.LittleEndian.Uint64(header[24:32])
+	info, err := d.file.Stat()
+	if err != nil || d.buckets == 0 || d.buckets&(d.buckets-1) != 0 ||
+		d.pages <= d.buckets || info.Size() < int64(d.pages)*diskIndexPageSize {
+		return false
+	}
+	return true
+}
+
+// writeHeader writes the header page, marking the index clean if data is
+// the database file it was synced with
+func (d *diskKeys) writeHeader(clean bool, data os.FileInfo) error {
+	header := make([]byte, diskIndexPageSize)
+	copy(header[0:6], diskIndexMagic)
+	header[6] = diskIndexVersion
+	binary.LittleEndian.PutUint64(header[8:16], d.count)
+	binary.LittleEndian.PutUint64(header[16:24], d.buckets)
+	binary.LittleEndian.PutUint64(header[24:32], d.pages)
+	if clean {
+		header[7] = 1
+		binary.LittleEndian.PutUint64(header[32:40], uint64(data.Size()))
+		binary.LittleEndian.PutUint64(header[40:48], uint64(data.ModTime().UnixNano()))
+	}
+	if _, err := d.file.WriteAt(header, 0); err != nil {
+		return fmt.Errorf("error writing key index header: %w", err)
+	}
+	return nil
+}
+
+// hashKey returns the hash of a key used for buckets and the bloom filter
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	io.WriteString(h, key)
+	return h.Sum64()
+}
+
+// page returns a page through the page cache
+func (d *diskKeys) page(n uint64) (*cachedPage, error) {
+	if elem, ok := d.cached[n]; ok {
+		d.order.MoveToFront(elem)
+		return elem.Value.(*cachedPage), nil
+	}
+	if n == 0 || n >= d.pages {
+		return nil, fmt.Errorf("%w: page %d out of range", ErrKeyIndexCorrupt, n)
+	}
+	p := &cachedPage{number: n, data: make([]byte, diskIndexPageSize)}
+	if _, err := d.file.ReadAt(p.data, int64(n)*diskIndexPageSize); err != nil {
+		return nil, fmt.Errorf("error reading key index page %d: %w", n, err)
+	}
+	return p, d.cachePage(p)
+}
+
+// newPage appends an empty page to the file
+func (d *diskKeys) newPage() (*cachedPage, error) {
+	p := &cachedPage{number: d.pages, data: make([]byte, diskIndexPageSize), dirty: true}
+	d.pages++
+	return p, d.cachePage(p)
+}
+
+// cachePage adds a page to the cache, writing back the least recently used
+// pages beyond the limit
+func (d *diskKeys) cachePage(p *cachedPage) error {
+	d.cached[p.number] = d.order.PushFront(p)
+	for d.order.Len() > d.cacheLimit {
+		old := d.order.Remove(d.order.Back()).(*cachedPage)
+		delete(d.cached, old.number)
+		if err := d.writePage(old); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePage writes a page back if it changed
+func (d *diskKeys) writePage(p *cachedPage) error {
+	if !p.dirty {
+		return nil
+	}
+	if _, err := d.file.WriteAt(p.data, int64(p.number)*diskIndexPageSize); err != nil {
+		return fmt.Errorf("error writing key index page %d: %w", p.number, err)
+	}
+	p.dirty = false
+	return nil
+}
+
+// flush writes back every changed page and the header, and syncs the file
+func (d *diskKeys) flush(clean bool, data os.FileInfo) error {
+	for elem := d.order.Front(); elem != nil; elem = elem.Next() {
+		if err := d.writePage(elem.Value.(*cachedPage)); err != nil {
+			return err
+		}
+	}
+	if err := d.writeHeader(clean, data); err != nil {
+		return err
+	}
+	if err := d.file.Sync(); err != nil {
+		return fmt.Errorf("error syncing key index: %w", err)
+	}
+	return nil
+}
+
+// find returns the page and offset of a key's entry, nil if it's missing
+func (d *diskKeys) find(key string, hash uint64) (*cachedPage, int, int64, error) {
+	for n := 1 + hash&(d.buckets-1); n != 0; {
+		p, err := d.page(n)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		found, offset, position := false, 0, int64(0)
+		err = p.entries(func(o int, k []byte, pos int64) bool {
+			if string(k) == key {
+				found, offset, position = true, o, pos
+			}
+			return !found
+		})
+		if err != nil || found {
+			return p, offset, position, err
+		}
+		n = p.next()
+	}
+	return nil, 0, 0, nil
+}
+
+func (d *diskKeys) get(key string) (int64, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	hash := hashKey(key)
+	if !d.bloom.mayContain(hash) {
+		return 0, false
+	}
+	p, _, position, err := d.find(key, hash)
+	if err != nil {
+		if d.err == nil {
+			d.err = err
+		}
+		return 0, false
+	}
+	return position, p != nil
+}
+
+func (d *diskKeys) set(key string, position int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.err != nil {
+		return d.err
+	}
+	hash := hashKey(key)
+	p, offset, _, err := d.find(key, hash)
+	if err != nil {
+		return err
+	}
+	if p != nil {
+		binary.LittleEndian.PutUint64(p.data[offset+1+len(key):], uint64(position))
+		p.dirty = true
+		return nil
+	}
+
+	if err := d.insert(key, hash, position); err != nil {
+		return err
+	}
+
+	// Keep chains short and the bloom filter's false positive rate low
+	if d.pages-1-d.buckets > d.buckets/2 {
+		return d.grow()
+	}
+	if d.count > d.bloom.capacity {
+		return d.rebuildBloom(2 * d.count)
+	}
+	return nil
+}
+
+// insert adds an entry for a key that isn't in the index
+func (d *diskKeys) insert(key string, hash uint64, position int64) error {
+	size := diskIndexEntryHeader + len(key)
+	p, err := d.page(1 + hash&(d.buckets-1))
+	if err != nil {
+		return err
+	}
+	for diskIndexPageHeader+p.used()+size > diskIndexPageSize {
+		next := p.next()
+		if next == 0 {
+			last := p
+			if p, err = d.newPage(); err != nil {
+				return err
+			}
+			last.setNext(p.number)
+			break
+		}
+		if p, err = d.page(next); err != nil {
+			return err
+		}
+	}
+
+	offset := diskIndexPageHeader + p.used()
+	p.data[offset] = byte(len(key))
+	copy(p.data[offset+1:], key)
+	binary.LittleEndian.PutUint64(p.data[offset+1+len(key):], uint64(position))
+	p.setUsed(p.used() + size)
+	d.count++
+	d.bloom.add(hash)
+	return nil
+}
+
+func (d *diskKeys) remove(key string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.err != nil {
+		return d.err
+	}
+	hash := hashKey(key)
+	if !d.bloom.mayContain(hash) {
+		return nil
+	}
+	p, offset, _, err := d.find(key, hash)
+	if err != nil || p == nil {
+		return err
+	}
+
+	// The bloom filter keeps the key's bits until it's rebuilt
+	size := diskIndexEntryHeader + len(key)
+	end := diskIndexPageHeader + p.used()
+	copy(p.data[offset:], p.data[offset+size:end])
+	clear(p.data[end-size : end])
+	p.setUsed(p.used() - size)
+	d.count--
+	return nil
+}
+
+func (d *diskKeys) len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return int(d.count)
+}
+
+// each reads one page at a time, so fn may look up keys
+func (d *diskKeys) each(fn func(key string, position int64) error) error {
+	type entry struct {
+		key      string
+		position int64
+	}
+	var entries []entry
+	for n := uint64(1); ; n++ {
+		d.mu.Lock()
+		if n >= d.pages {
+			d.mu.Unlock()
+			return nil
+		}
+		entries = entries[:0]
+		p, err := d.page(n)
+		if err == nil {
+			err = p.entries(func(offset int, key []byte, position int64) bool {
+				entries = append(entries, entry{string(key), position})
+				return true
+			})
+		}
+		d.mu.Unlock()
+		if err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			if err := fn(e.key, e.position); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (d *diskKeys) reset() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.resetLocked(diskIndexBuckets, 0)
+}
+
+// resetLocked truncates the file to an empty index with the given number of
+// buckets and a bloom filter sized for capacity keys
+func (d *diskKeys) resetLocked(buckets uint64, capacity uint64) error {
+	d.cached = make(map[uint64]*list.Element)
+	d.order.Init()
+	d.count = 0
+	d.buckets = buckets
+	d.pages = 1 + buckets
+	d.err = nil
+	d.bloom = newBloomFilter(capacity)
+
+	if err := d.file.Truncate(0); err != nil {
+		return fmt.Errorf("error truncating key index: %w", err)
+	}
+	if err := d.file.Truncate(int64(d.pages) * diskIndexPageSize); err != nil {
+		return fmt.Errorf("error sizing key index: %w", err)
+	}
+	return d.writeHeader(false, nil)
+}
+
+// grow doubles the number of buckets by rehashing into a new file that
+// replaces the index
+func (d *diskKeys) grow() error {
+	next := &diskKeys{
+		path:       d.path + ".grow",
+		temporary:  d.temporary,
+		cacheLimit: d.cacheLimit,
+		cached:     make(map[uint64]*list.Element),
+		order:      list.New(),
+	}
+	var err error
+	if next.file, err = os.OpenFile(next.path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644); err != nil {
+		return fmt.Errorf("error creating key index: %w", err)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			next.file.Close()
+			os.Remove(next.path)
+		}
+	}()
+
+	if err := next.resetLocked(2*d.buckets, 2*d.count); err != nil {
+		return err
+	}
+
+	for n := uint64(1); n < d.pages; n++ {
+		p, err := d.page(n)
+		if err != nil {
+			return err
+		}
+		err = p.entries(func(offset int, key []byte, position int64) bool {
+			err = next.insert(string(key), hashKey(string(key)), position)
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := next.flush(false, nil); err != nil {
+		return err
+	}
+	if err := os.Rename(next.path, d.path); err != nil {
+		return fmt.Errorf("error replacing key index: %w", err)
+	}
+	committed = true
+
+	d.file.Close()
+	d.file = next.file
+	d.count = next.count
+	d.buckets = next.buckets
+	d.pages = next.pages
+	d.cached = next.cached
+	d.order = next.order
+	d.bloom = next.bloom
+	return nil
+}
+
+// scratch returns an empty temporary index next to this one
+func (d *diskKeys) scratch() (*diskKeys, error) {
+	file, err := os.CreateTemp(filepath.Dir(d.path), "skv-*.idx")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temporary key index: %w", err)
+	}
+	scratch := &diskKeys{
+		file:       file,
+		path:       file.Name(),
+		temporary:  true,
+		cacheLimit: d.cacheLimit,
+		cached:     make(map[uint64]*list.Element),
+		order:      list.New(),
+	}
+	if err := scratch.resetLocked(diskIndexBuckets, 0); err != nil {
+		scratch.close()
+		return nil, err
+	}
+	return scratch, nil
+}
+
+// rebuildBloom sizes the bloom filter for capacity keys and adds every key
+func (d *diskKeys) rebuildBloom(capacity uint64) error {
+	d.bloom = newBloomFilter(capacity)
+	for n := uint64(1); n < d.pages; n++ {
+		p, err := d.page(n)
+		if err != nil {
+			return err
+		}
+		err = p.entries(func(offset int, key []byte, position int64) bool {
+			d.bloom.add(hashKey(string(key)))
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markClean records that the index matches the synced database file data
+func (d *diskKeys) markClean(data os.FileInfo) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.readOnly || d.temporary {
+		return nil
+	}
+	if d.err != nil {
+		return d.err
+	}
+	return d.flush(true, data)
+}
+
+func (d *diskKeys) close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.file == nil {
+		return nil
+	}
+	err := d.file.Close()
+	if d.temporary {
+		os.Remove(d.path)
+	}
+	d.file = nil
+	return err
+}
+
+// bloomFilter tells whether a key hash may be in a set, with false positives
+type bloomFilter struct {
+	bits     []uint64
+	capacity uint64 // Number of keys it's sized for
+}
+
+const (
+	bloomBitsPerKey = 10
+	bloomHashes     = 7
+	bloomMinKeys    = 1024
+)
+
+// newBloomFilter returns a filter sized for capacity keys
+func newBloomFilter(capacity uint64) bloomFilter {
+	capacity = max(capacity, bloomMinKeys)
+	return bloomFilter{
+		bits:     make([]uint64, (capacity*bloomBitsPerKey+63)/64),
+		capacity: capacity,
+	}
+}
+
+// locations calls fn with the bit positions of a hash (double hashing)
+func (b *bloomFilter) locations(hash uint64, fn func(bit uint64)) {
+	size := uint64(len(b.bits)) * 64
+	h1, h2 := hash, hash>>33|hash<<31|1
+	for i := uint64(0); i < bloomHashes; i++ {
+		fn((h1 + i*h2) % size)
+	}
+}
+
+func (b *bloomFilter) add(hash uint64) {
+	b.locations(hash, func(bit uint64) {
+		b.bits[bit/64] |= 1 << (bit % 64)
+	})
+}
+
+func (b *bloomFilter) mayContain(hash uint64) bool {
+	found := true
+	b.locations(hash, func(bit uint64) {
+		found = found && b.bits[bit/64]&(1<<(bit%64)) != 0
+	})
+	return found
+}
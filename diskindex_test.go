@@ -0,0 +1,161 @@
+package skv
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// checkKeys fails unless db holds exactly want
+func checkKeys(t *testing.T, db *SKV, want map[string]string) {
+	t.Helper()
+	if db.Count() != len(want) {
+		t.Errorf("Expected %d keys, got %d", len(want), db.Count())
+	}
+	for key, value := range want {
+		if got, err := db.GetString(key); err != nil || got != value {
+			t.Fatalf("Key %q: got %q (%v), want %q", key, got, err, value)
+		}
+	}
+	if db.ExistsString("missing") {
+		t.Error("Missing key reported as existing")
+	}
+}
+
+func TestDiskKeyIndex(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.skv")
+	opts := Options{DiskKeyIndex: true, KeyIndexCacheSize: 1}
+	db, err := OpenWithOptions(dbPath, opts)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+
+	// Enough keys to grow the table and evict pages from the smallest cache
+	want := make(map[string]string)
+	for i := 0; i < 20000; i++ {
+		key, value := fmt.Sprintf("key-%05d", i), fmt.Sprintf("value-%d", i)
+		if err := db.PutString(key, value); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		want[key] = value
+	}
+	for i := 0; i < 20000; i += 3 {
+		key := fmt.Sprintf("key-%05d", i)
+		if i%2 == 0 {
+			db.DeleteString(key)
+			delete(want, key)
+		} else {
+			db.UpdateString(key, "updated")
+			want[key] = "updated"
+		}
+	}
+	checkKeys(t, db, want)
+	if keys := db.cache.(*diskKeys); keys.buckets <= diskIndexBuckets {
+		t.Errorf("Expected the index to grow, still has %d buckets", keys.buckets)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if _, err := os.Stat(dbPath + ".idx"); err != nil {
+		t.Fatalf("Expected the key index file: %v", err)
+	}
+
+	// A clean index is used as it is
+	info, _ := os.Stat(dbPath)
+	keys, trusted, err := openDiskKeys(dbPath+".idx", true, 0, info)
+	if err != nil || !trusted || keys.len() != len(want) {
+		t.Fatalf("Expected a clean index with %d keys, got trusted=%v len=%d (%v)", len(want), trusted, keys.len(), err)
+	}
+	keys.close()
+
+	db, err = OpenWithOptions(dbPath, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	checkKeys(t, db, want)
+	db.PutString("after-reopen", "x")
+	want["after-reopen"] = "x"
+
+	// A crash leaves the index dirty, it's rebuilt from the database file
+	db.cache.close()
+	db.file.Close()
+	info, _ = os.Stat(dbPath)
+	if _, trusted, _ := openDiskKeys(dbPath+".idx", true, 0, info); trusted {
+		t.Fatal("Index of a crashed database must not be trusted")
+	}
+	db, err = OpenWithOptions(dbPath, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	checkKeys(t, db, want)
+	db.Close()
+
+	// Changes made without the index are noticed
+	db, _ = Open(dbPath)
+	db.UpdateString("after-reopen", "y")
+	want["after-reopen"] = "y"
+	db.Close()
+	db, err = OpenWithOptions(dbPath, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	checkKeys(t, db, want)
+}
+
+func TestDiskKeyIndexRebuilds(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "test.skv")
+	db, err := OpenWithOptions(dbPath, Options{DiskKeyIndex: true})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+
+	want := map[string]string{"a": "1", "b": "2", "c": "3"}
+	for key, value := range want {
+		db.PutString(key, value)
+	}
+	backup := filepath.Join(dir, "backup.json")
+	if err := db.Backup(backup); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	db.DeleteString("a")
+	db.PutString("d", "4")
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	checkKeys(t, db, map[string]string{"b": "2", "c": "3", "d": "4"})
+
+	if _, err := db.RestoreWithOptions(RestoreOptions{Mode: RestoreReplace}, backup); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	checkKeys(t, db, want)
+	if matches, _ := filepath.Glob(filepath.Join(dir, "skv-*.idx")); len(matches) != 0 {
+		t.Errorf("Temporary key index left behind: %v", matches)
+	}
+
+	if err := db.Clear(); err != nil {
+		t.Fatalf("Clear failed: %v", err)
+	}
+	db.PutString("e", "5")
+	checkKeys(t, db, map[string]string{"e": "5"})
+	db.Close()
+
+	// A read-only database without a usable index gets a temporary one
+	os.Remove(dbPath + ".idx")
+	db, err = OpenWithOptions(dbPath, Options{DiskKeyIndex: true, ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to open read-only database: %v", err)
+	}
+	checkKeys(t, db, map[string]string{"e": "5"})
+	tmpPath := db.cache.(*diskKeys).path
+	db.Close()
+	if _, err := os.Stat(tmpPath); !os.IsNotExist(err) {
+		t.Errorf("Temporary key index %s not removed: %v", tmpPath, err)
+	}
+	if _, err := os.Stat(dbPath + ".idx"); !os.IsNotExist(err) {
+		t.Errorf("Read-only open must not create the key index: %v", err)
+	}
+}
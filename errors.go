@@ -0,0 +1,85 @@
+package skv
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors
+//
+// Every error the package returns for a condition callers may want to act on
+// matches one of the sentinels below with errors.Is, possibly wrapped with
+// more context. Damaged records are reported as a *CorruptionError.
+
+// ErrEmptyKey is returned when a key is empty
+var ErrEmptyKey = errors.New("key cannot be empty")
+
+// ErrKeyTooLong is returned when a key is longer than 255 bytes
+var ErrKeyTooLong = errors.New("key too long (max 255 bytes)")
+
+// ErrClosed is returned when a database is used after Close
+var ErrClosed = errors.New("database is closed")
+
+// ErrSizeMismatch is returned when a reader provides less or more data than
+// the size it was announced with
+var ErrSizeMismatch = errors.New("size mismatch")
+
+// maxKeySize is the longest key a record can hold
+const maxKeySize = 255
+
+// CorruptionError describes a damaged record of the database file
+type CorruptionError struct {
+	Offset int64  // Position of the record in the file
+	Key    string // Key of the record, empty if it couldn't be read
+	Reason string // What is wrong with the record
+}
+
+func (e *CorruptionError) Error() string {
+	if e.Key != "" {
+		return fmt.Sprintf("corrupt record at offset %d (key %q): %s", e.Offset, e.Key, e.Reason)
+	}
+	return fmt.Sprintf("corrupt record at offset %d: %s", e.Offset, e.Reason)
+}
+
+// corruptAt sets the offset of the *CorruptionError in err, which was read
+// by readRecordHeader from a reader that doesn't know its position
+func corruptAt(err error, offset int64) error {
+	var corruptErr *CorruptionError
+	if errors.As(err, &corruptErr) {
+		corruptErr.Offset = offset
+	}
+	return err
+}
+
+// checkKey returns ErrEmptyKey or ErrKeyTooLong if key can't be stored
+func checkKey(key []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if len(key) > maxKeySize {
+		return ErrKeyTooLong
+	}
+	return nil
+}
+
+// checkOpen returns ErrClosed once the database has been closed
+// Must be called with the lock held
+func (s *SKV) checkOpen() error {
+	if s.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// checkWritable returns ErrClosed once the database has been closed and
+// ErrReadOnly if it was opened read-only
+// Must be called with the write lock held
+func (s *SKV) checkWritable() error {
+	if s.closed {
+		return ErrClosed
+	}
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
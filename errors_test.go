@@ -1,7 +1,11 @@
 package skv
 
 import (
+	"bytes"
+	"errors"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -82,9 +86,9 @@ func TestCloseError(t *testing.T) {
 		t.Errorf("First close failed: %v", err)
 	}
 
-	// Close again should fail
-	if err := db.Close(); err == nil {
-		t.Error("Expected error when closing already closed database")
+	// Closing again does nothing
+	if err := db.Close(); err != nil {
+		t.Errorf("Second close failed: %v", err)
 	}
 }
 
@@ -379,3 +383,145 @@ func TestVerifyFileError(t *testing.T) {
 		t.Error("Expected error when verifying closed file")
 	}
 }
+
+// Test the sentinel errors returned for invalid arguments
+func TestErrorSentinels(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.skv"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.Put(nil, []byte("x")); !errors.Is(err, ErrEmptyKey) {
+		t.Errorf("Expected ErrEmptyKey, got %v", err)
+	}
+	if _, err := db.GetString(""); !errors.Is(err, ErrEmptyKey) {
+		t.Errorf("Expected ErrEmptyKey from Get, got %v", err)
+	}
+	long := strings.Repeat("k", 256)
+	if err := db.PutString(long, "x"); !errors.Is(err, ErrKeyTooLong) {
+		t.Errorf("Expected ErrKeyTooLong, got %v", err)
+	}
+	if err := db.PutBatchString(map[string]string{long: "x"}); !errors.Is(err, ErrKeyTooLong) {
+		t.Errorf("Expected ErrKeyTooLong from PutBatch, got %v", err)
+	}
+
+	if err := db.PutStreamString("short", strings.NewReader("abc"), 10); !errors.Is(err, ErrSizeMismatch) {
+		t.Errorf("Expected ErrSizeMismatch for a short reader, got %v", err)
+	}
+	if err := db.PutStreamString("long", strings.NewReader("abcdef"), 3); !errors.Is(err, ErrSizeMismatch) {
+		t.Errorf("Expected ErrSizeMismatch for a long reader, got %v", err)
+	}
+	if db.Exists([]byte("short")) || db.Exists([]byte("long")) {
+		t.Error("A stream of the wrong size must not store the key")
+	}
+}
+
+// Test that a closed database rejects every call instead of using the closed file
+func TestClosedDatabase(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(filepath.Join(dir, "test.skv"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	db.PutString("key1", "value1")
+	bucket, _ := db.Bucket("b")
+	bucket.PutString("k", "v")
+	db.CreateFieldIndex("by-name", "name")
+	users := Typed(db, JSONCodec[testUser]())
+	reader, _ := db.OpenString("key1")
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Errorf("Close isn't idempotent: %v", err)
+	}
+	if err := db.CloseWithCompact(); err != nil {
+		t.Errorf("CloseWithCompact of a closed database failed: %v", err)
+	}
+
+	checks := map[string]error{
+		"Put":    db.PutString("key2", "value2"),
+		"Update": db.UpdateString("key1", "x"),
+		"Delete": db.DeleteString("key1"),
+		"Clear":  db.Clear(),
+		"ForEach": db.ForEach(func(key, value []byte) error {
+			return nil
+		}),
+		"Compact":   db.Compact(),
+		"Backup":    db.Backup(filepath.Join(dir, "backup.json")),
+		"BackupTo":  db.BackupTo(&bytes.Buffer{}),
+		"BucketPut": bucket.PutString("k", "v"),
+	}
+	_, checks["Get"] = db.GetString("key1")
+	_, checks["Keys"] = db.Keys()
+	_, checks["KeysString"] = db.KeysString()
+	_, checks["Verify"] = db.Verify()
+	_, checks["GetStream"] = db.GetStreamString("key1", &bytes.Buffer{})
+	_, checks["GetRange"] = db.GetRangeString("key1", 0, 1)
+	_, checks["Version"] = db.VersionString("key1")
+	_, checks["BucketGet"] = bucket.GetString("k")
+	_, checks["ValueReader"] = reader.Read(make([]byte, 1))
+	_, checks["TypedAll"] = users.All()
+	for name, err := range checks {
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("%s: expected ErrClosed, got %v", name, err)
+		}
+	}
+	if db.Exists([]byte("key1")) || db.Count() != 0 {
+		t.Error("A closed database must not report keys")
+	}
+	if bucket.ExistsString("k") || bucket.Count() != 0 {
+		t.Error("A closed database must not report bucket keys")
+	}
+	if db.ListBuckets() != nil || db.ListIndexes() != nil {
+		t.Errorf("A closed database must not list buckets or indexes, got %v and %v", db.ListBuckets(), db.ListIndexes())
+	}
+}
+
+// Test that damaged records are reported as *CorruptionError with their offset
+func TestCorruptionError(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.skv")
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	db.PutString("key1", "value1")
+	db.PutString("key2", "value2")
+	second, _ := db.cache.get("key2")
+	db.Close()
+
+	data, _ := os.ReadFile(dbPath)
+
+	// Unknown record type
+	damaged := bytes.Clone(data)
+	damaged[second] = 0x03
+	os.WriteFile(dbPath, damaged, 0644)
+	_, err = Open(dbPath)
+	var corruptErr *CorruptionError
+	if !errors.As(err, &corruptErr) {
+		t.Fatalf("Expected a *CorruptionError, got %v", err)
+	}
+	if corruptErr.Offset != second || !strings.Contains(corruptErr.Reason, "record type") {
+		t.Errorf("Unexpected corruption details: %+v", corruptErr)
+	}
+
+	// Truncated data is found by Verify
+	os.WriteFile(dbPath, data[:len(data)-3], 0644)
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open truncated database: %v", err)
+	}
+	defer db.Close()
+	_, err = db.Verify()
+	if !errors.As(err, &corruptErr) {
+		t.Fatalf("Expected a *CorruptionError, got %v", err)
+	}
+	if corruptErr.Offset != second || corruptErr.Key != "key2" {
+		t.Errorf("Unexpected corruption details: %+v", corruptErr)
+	}
+	if _, err := db.GetString("key2"); !errors.As(err, &corruptErr) || corruptErr.Offset != second {
+		t.Errorf("Expected Get to report the truncated record, got %v", err)
+	}
+}
@@ -0,0 +1,288 @@
+package skv
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// ExportFormat selects the text format used by Export and Import
+type ExportFormat string
+
+const (
+	// FormatNDJSON writes one JSON object per line:
+	// {"key":"...","value":"...","encoding":"utf8|base64|hex"}
+	FormatNDJSON ExportFormat = "ndjson"
+
+	// FormatCSV writes a header row "key,value,encoding" followed by one row per key
+	FormatCSV ExportFormat = "csv"
+)
+
+// Value encodings used in exported records
+const (
+	EncodingUTF8   = "utf8"
+	EncodingBase64 = "base64"
+	EncodingHex    = "hex"
+)
+
+// BinaryMode selects how Export handles values that aren't valid UTF-8
+type BinaryMode int
+
+const (
+	BinaryBase64 BinaryMode = iota // Encode as base64 (default)
+	BinaryHex                      // Encode as hex
+	BinarySkip                     // Leave the key out of the export
+	BinaryError                    // Stop the export with ErrBinaryValue
+)
+
+// ErrBinaryValue is returned by Export with BinaryError when a value isn't valid UTF-8
+var ErrBinaryValue = errors.New("binary value")
+
+// ExportOptions configures ExportWithOptions
+type ExportOptions struct {
+	Prefix string     // Only export keys starting with Prefix
+	Binary BinaryMode // Handling of values that aren't valid UTF-8
+}
+
+// ImportOptions configures Import
+type ImportOptions struct {
+	Prefix       string // Only import keys starting with Prefix, others are skipped
+	SkipExisting bool   // Keep existing keys instead of overwriting them
+}
+
+// ImportStats reports the outcome of Import
+type ImportStats struct {
+	Imported int // Keys written
+	Skipped  int // Records left out by the prefix filter or SkipExisting
+}
+
+// exportRecord is one exported key-value pair
+type exportRecord struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Encoding string `json:"encoding"`
+}
+
+// csvHeader is the first row of CSV exports
+var csvHeader = []string{"key", "value", "encoding"}
+
+// Export writes all key-value pairs to w in the given format, sorted by key
+// Values that aren't valid UTF-8 are base64 encoded. Keys must be valid UTF-8.
+func (s *SKV) Export(w io.Writer, format ExportFormat) error {
+	return s.ExportWithOptions(w, format, ExportOptions{})
+}
+
+// ExportWithOptions writes the key-value pairs selected by opts to w
+// Records are written one at a time, so memory use doesn't depend on the
+// database size.
+func (s *SKV) ExportWithOptions(w io.Writer, format ExportFormat, opts ExportOptions) error {
+	if format != FormatNDJSON && format != FormatCSV {
+		return fmt.Errorf("unknown export format %q", format)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+
+	keys, err := indexKeys(s.cache, opts.Prefix)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bw)
+	encoder.SetEscapeHTML(false)
+	csvWriter := csv.NewWriter(bw)
+	if format == FormatCSV {
+		if err := csvWriter.Write(csvHeader); err != nil {
+			return fmt.Errorf("error writing CSV header: %w", err)
+		}
+	}
+
+	for _, key := range keys {
+		position, _ := s.cache.get(key)
+		_, _, data, err := s.readRecordAt(position)
+		if err != nil {
+			return fmt.Errorf("error reading record for key %q: %w", key, err)
+		}
+
+		record, ok, err := newExportRecord(key, data, opts.Binary)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		if format == FormatCSV {
+			err = csvWriter.Write([]string{record.Key, record.Value, record.Encoding})
+		} else {
+			err = encoder.Encode(record)
+		}
+		if err != nil {
+			return fmt.Errorf("error writing key %q: %w", key, err)
+		}
+	}
+
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return fmt.Errorf("error writing CSV: %w", err)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("error writing export: %w", err)
+	}
+	return nil
+}
+
+// newExportRecord encodes a key-value pair for export
+// Returns false if the record must be skipped
+func newExportRecord(key string, data []byte, mode BinaryMode) (exportRecord, bool, error) {
+	if !utf8.ValidString(key) {
+		if mode == BinarySkip {
+			return exportRecord{}, false, nil
+		}
+		return exportRecord{}, false, fmt.Errorf("%w: key %q is not valid UTF-8", ErrBinaryValue, key)
+	}
+
+	if utf8.Valid(data) {
+		return exportRecord{Key: key, Value: string(data), Encoding: EncodingUTF8}, true, nil
+	}
+
+	switch mode {
+	case BinaryBase64:
+		return exportRecord{Key: key, Value: base64.StdEncoding.EncodeToString(data), Encoding: EncodingBase64}, true, nil
+	case BinaryHex:
+		return exportRecord{Key: key, Value: hex.EncodeToString(data), Encoding: EncodingHex}, true, nil
+	case BinarySkip:
+		return exportRecord{}, false, nil
+	default:
+		return exportRecord{}, false, fmt.Errorf("%w: value of key %q is not valid UTF-8", ErrBinaryValue, key)
+	}
+}
+
+// data decodes the value of an imported record
+func (r exportRecord) data() ([]byte, error) {
+	switch r.Encoding {
+	case "", EncodingUTF8:
+		return []byte(r.Value), nil
+	case EncodingBase64:
+		return base64.StdEncoding.DecodeString(r.Value)
+	case EncodingHex:
+		return hex.DecodeString(r.Value)
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", r.Encoding)
+	}
+}
+
+// Import reads key-value pairs in the given format from r and stores them
+// Records are read and written one at a time. Existing keys are overwritten
+// unless opts.SkipExisting is set. CSV input must start with a header row
+// naming the key and value columns, the encoding column is optional.
+// On error the records imported so far remain stored.
+func (s *SKV) Import(r io.Reader, format ExportFormat, opts ImportOptions) (*ImportStats, error) {
+	var next func() (exportRecord, error)
+
+	switch format {
+	case FormatNDJSON:
+		decoder := json.NewDecoder(bufio.NewReader(r))
+		next = func() (exportRecord, error) {
+			var record exportRecord
+			err := decoder.Decode(&record)
+			return record, err
+		}
+
+	case FormatCSV:
+		csvReader := csv.NewReader(bufio.NewReader(r))
+		csvReader.FieldsPerRecord = -1
+		header, err := csvReader.Read()
+		if err != nil {
+			return nil, fmt.Errorf("error reading CSV header: %w", err)
+		}
+		columns := map[string]int{"encoding": -1}
+		for i, name := range header {
+			columns[strings.TrimSpace(strings.ToLower(name))] = i
+		}
+		keyCol, hasKey := columns["key"]
+		valueCol, hasValue := columns["value"]
+		if !hasKey || !hasValue {
+			return nil, fmt.Errorf("CSV header must name the key and value columns, got %v", header)
+		}
+		encodingCol := columns["encoding"]
+
+		next = func() (exportRecord, error) {
+			row, err := csvReader.Read()
+			if err != nil {
+				return exportRecord{}, err
+			}
+			if keyCol >= len(row) || valueCol >= len(row) {
+				return exportRecord{}, fmt.Errorf("row has %d columns", len(row))
+			}
+			record := exportRecord{Key: row[keyCol], Value: row[valueCol]}
+			if encodingCol >= 0 && encodingCol < len(row) {
+				record.Encoding = row[encodingCol]
+			}
+			return record, nil
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown import format %q", format)
+	}
+
+	stats := &ImportStats{}
+	for n := 1; ; n++ {
+		record, err := next()
+		if err == io.EOF {
+			return stats, nil
+		}
+		if err != nil {
+			return stats, fmt.Errorf("error reading record %d: %w", n, err)
+		}
+
+		if !strings.HasPrefix(record.Key, opts.Prefix) {
+			stats.Skipped++
+			continue
+		}
+		data, err := record.data()
+		if err != nil {
+			return stats, fmt.Errorf("error decoding record %d (key %q): %w", n, record.Key, err)
+		}
+
+		written, err := s.importRecord([]byte(record.Key), data, opts.SkipExisting)
+		if err != nil {
+			return stats, fmt.Errorf("error importing record %d: %w", n, err)
+		}
+		if written {
+			stats.Imported++
+		} else {
+			stats.Skipped++
+		}
+	}
+}
+
+// importRecord stores one imported key-value pair
+// Returns false if the key exists and skipExisting is set
+func (s *SKV) importRecord(key []byte, data []byte, skipExisting bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkWritable(); err != nil {
+		return false, err
+	}
+	if _, exists := s.cache.get(string(key)); exists && skipExisting {
+		return false, nil
+	}
+	if err := s.putInternal(key, data); err != nil {
+		return false, err
+	}
+	return true, nil
+}
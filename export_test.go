@@ -0,0 +1,150 @@
+package skv
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExportImportRoundTrip(t *testing.T) {
+	for _, format := range []ExportFormat{FormatNDJSON, FormatCSV} {
+		t.Run(string(format), func(t *testing.T) {
+			srcFile := "test_export_src_" + string(format) + ".skv"
+			dstFile := "test_export_dst_" + string(format) + ".skv"
+			defer os.Remove(srcFile)
+			defer os.Remove(dstFile)
+
+			src, err := Open(srcFile)
+			if err != nil {
+				t.Fatalf("Failed to open database: %v", err)
+			}
+			defer src.Close()
+
+			values := map[string][]byte{
+				"user:1":  []byte("alice"),
+				"user:2":  []byte("line one\nline \"two\", with comma"),
+				"bin":     {0x00, 0xFF, 0xFE, 0x80},
+				"empty":   {},
+				"unicode": []byte("héllo wörld ✓"),
+			}
+			for key, value := range values {
+				src.Put([]byte(key), value)
+			}
+
+			var buf bytes.Buffer
+			if err := src.Export(&buf, format); err != nil {
+				t.Fatalf("Export failed: %v", err)
+			}
+
+			dst, err := Open(dstFile)
+			if err != nil {
+				t.Fatalf("Failed to open database: %v", err)
+			}
+			defer dst.Close()
+			dst.PutString("user:1", "old")
+
+			stats, err := dst.Import(&buf, format, ImportOptions{})
+			if err != nil {
+				t.Fatalf("Import failed: %v", err)
+			}
+			if stats.Imported != len(values) || stats.Skipped != 0 {
+				t.Errorf("Expected %d imported, got %+v", len(values), stats)
+			}
+			for key, value := range values {
+				got, err := dst.Get([]byte(key))
+				if err != nil || !bytes.Equal(got, value) {
+					t.Errorf("Key %s: expected %v, got %v (%v)", key, value, got, err)
+				}
+			}
+		})
+	}
+}
+
+func TestExportFormats(t *testing.T) {
+	dbFile := "test_export_formats.skv"
+	defer os.Remove(dbFile)
+
+	db, err := Open(dbFile)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	db.PutString("b", "2")
+	db.PutString("a", "1")
+	db.Put([]byte("c"), []byte{0xFF})
+	db.PutString("other", "x")
+
+	var buf bytes.Buffer
+	db.ExportWithOptions(&buf, FormatNDJSON, ExportOptions{Prefix: ""})
+	expected := `{"key":"a","value":"1","encoding":"utf8"}
+{"key":"b","value":"2","encoding":"utf8"}
+{"key":"c","value":"/w==","encoding":"base64"}
+{"key":"other","value":"x","encoding":"utf8"}
+`
+	if buf.String() != expected {
+		t.Errorf("Unexpected NDJSON export:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	db.ExportWithOptions(&buf, FormatCSV, ExportOptions{Binary: BinaryHex})
+	expected = "key,value,encoding\na,1,utf8\nb,2,utf8\nc,ff,hex\nother,x,utf8\n"
+	if buf.String() != expected {
+		t.Errorf("Unexpected CSV export:\n%s", buf.String())
+	}
+
+	// Prefix filter and skipped binary values
+	buf.Reset()
+	db.PutString("cat", "meow")
+	db.ExportWithOptions(&buf, FormatCSV, ExportOptions{Prefix: "c", Binary: BinarySkip})
+	if buf.String() != "key,value,encoding\ncat,meow,utf8\n" {
+		t.Errorf("Unexpected filtered export:\n%s", buf.String())
+	}
+
+	if err := db.ExportWithOptions(&bytes.Buffer{}, FormatNDJSON, ExportOptions{Binary: BinaryError}); !errors.Is(err, ErrBinaryValue) {
+		t.Errorf("Expected ErrBinaryValue, got %v", err)
+	}
+	if err := db.Export(&bytes.Buffer{}, "xml"); err == nil {
+		t.Error("Expected error for unknown format")
+	}
+}
+
+func TestImportOptions(t *testing.T) {
+	dbFile := "test_import_options.skv"
+	defer os.Remove(dbFile)
+
+	db, err := Open(dbFile)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	db.PutString("user:1", "existing")
+
+	// CSV written by hand: columns in any order, no encoding column
+	input := "value,key\nnew,user:1\nbob,user:2\nx,tmp:1\n"
+	stats, err := db.Import(strings.NewReader(input), FormatCSV, ImportOptions{Prefix: "user:", SkipExisting: true})
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if stats.Imported != 1 || stats.Skipped != 2 {
+		t.Errorf("Expected 1 imported and 2 skipped, got %+v", stats)
+	}
+	if value, _ := db.GetString("user:1"); value != "existing" {
+		t.Errorf("SkipExisting should keep the existing value, got %q", value)
+	}
+	if db.ExistsString("tmp:1") {
+		t.Error("Keys outside the prefix should not be imported")
+	}
+
+	// Errors report the failing record, earlier records stay imported
+	input = `{"key":"ok","value":"1"}
+{"key":"bad","value":"zz","encoding":"hex"}
+`
+	if _, err := db.Import(strings.NewReader(input), FormatNDJSON, ImportOptions{}); err == nil || !strings.Contains(err.Error(), "record 2") {
+		t.Errorf("Expected error for record 2, got %v", err)
+	}
+	if !db.ExistsString("ok") {
+		t.Error("Records before the error should be imported")
+	}
+}
@@ -0,0 +1,495 @@
+package skv
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Secondary indexes
+//
+// An index maps terms extracted from values to the keys holding them. Indexes
+// live in memory and are kept up to date on every change of the default
+// keyspace, including Restore and Clear. Their definitions are stored in the
+// file as records flagged with metaTagIndexDef, so they survive a reopen:
+// field indexes are rebuilt on Open, extractor indexes are rebuilt as soon as
+// CreateIndex hands them their extractor again.
+
+// ErrIndexNotFound is returned when an index doesn't exist, or its extractor
+// hasn't been registered since the database was opened
+var ErrIndexNotFound = errors.New("index not found")
+
+// ErrIndexExists is returned by CreateIndex and CreateFieldIndex when an index
+// with the same name but another definition exists
+var ErrIndexExists = errors.New("index already exists")
+
+// IndexExtractor returns the terms a value is indexed under
+// Returning no terms leaves the key out of the index. Extractors are called
+// with the write lock held and must not use the database.
+type IndexExtractor func(key []byte, value []byte) [][]byte
+
+// indexDefinition is the stored form of an index definition
+type indexDefinition struct {
+	Field string `json:"field,omitempty"` // JSON field path, empty for extractor indexes
+}
+
+// index is the in-memory state of a secondary index
+type index struct {
+	definition indexDefinition
+	position   int64          // Position of the definition record
+	extractor  IndexExtractor // nil until registered after Open
+
+	terms    map[string]map[string]struct{} // term -> keys
+	keyTerms map[string][]string            // key -> terms
+	sorted   []string                       // Sorted terms, nil when stale
+}
+
+// CreateIndex creates an index whose terms are computed by extractor
+// Creating an index that already exists replaces its extractor and rebuilds
+// it; this is how an extractor index is brought back after Open.
+// Returns ErrIndexExists if name is a field index
+func (s *SKV) CreateIndex(name string, extractor IndexExtractor) error {
+	if extractor == nil {
+		return fmt.Errorf("index extractor cannot be nil")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+
+	return s.createIndex(name, indexDefinition{}, extractor)
+}
+
+// CreateFieldIndex creates an index on a field of JSON object values
+// field is a dot-separated path such as "user.id". Strings are indexed as
+// they are, numbers as FloatTerm, booleans as "true" or "false", and each
+// element of an array on its own. Values that aren't JSON, or lack the
+// field, are left out. Field indexes are rebuilt automatically on Open.
+// Returns ErrIndexExists if name is an index with another definition
+func (s *SKV) CreateFieldIndex(name string, field string) error {
+	if field == "" {
+		return fmt.Errorf("index field cannot be empty")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+
+	return s.createIndex(name, indexDefinition{Field: field}, fieldExtractor(field))
+}
+
+// createIndex stores the definition of an index if it is new and builds it
+// Must be called with the write lock held
+func (s *SKV) createIndex(name string, definition indexDefinition, extractor IndexExtractor) error {
+	if len(name) == 0 {
+		return fmt.Errorf("index name cannot be empty")
+	}
+	if len(name) > 255 {
+		return fmt.Errorf("index name too long (max 255 bytes)")
+	}
+
+	idx, exists := s.indexes[name]
+	switch {
+	case exists && idx.definition != definition:
+		return fmt.Errorf("%w: %q is defined differently", ErrIndexExists, name)
+	case exists && definition.Field != "":
+		return nil
+	case !exists:
+		if err := s.checkWritable(); err != nil {
+			return err
+		}
+		data, err := json.Marshal(definition)
+		if err != nil {
+			return fmt.Errorf("error encoding index definition: %w", err)
+		}
+		position, err := s.writeRecord([]byte(name), &recordMeta{indexDef: true}, data)
+		if err != nil {
+			return fmt.Errorf("error storing index definition: %w", err)
+		}
+		idx = &index{definition: definition, position: position}
+		if s.indexes == nil {
+			s.indexes = make(map[string]*index)
+		}
+		s.indexes[name] = idx
+	}
+
+	idx.extractor = extractor
+	return s.buildIndex(idx)
+}
+
+// DropIndex deletes an index and its definition
+// Returns ErrIndexNotFound if the index doesn't exist
+func (s *SKV) DropIndex(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+
+	idx, exists := s.indexes[name]
+	if !exists {
+		return fmt.Errorf("%w: %q", ErrIndexNotFound, name)
+	}
+	definition := memoryKeys{name: idx.position}
+	if err := s.deleteFrom(definition, []byte(name)); err != nil {
+		return err
+	}
+	delete(s.indexes, name)
+
+	return nil
+}
+
+// ListIndexes returns the sorted names of all indexes, including extractor
+// indexes whose extractor hasn't been registered since Open, none once the
+// database is closed
+func (s *SKV) ListIndexes() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil
+	}
+
+	names := make([]string, 0, len(s.indexes))
+	for name := range s.indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LookupIndex returns the sorted keys indexed under term
+// Returns ErrIndexNotFound if the index doesn't exist
+func (s *SKV) LookupIndex(name string, term []byte) ([][]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	idx, err := s.readyIndex(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return toByteKeys(idx.lookup(term)), nil
+}
+
+// LookupIndexString is a convenience wrapper for LookupIndex using strings
+func (s *SKV) LookupIndexString(name string, term string) ([]string, error) {
+	keys, err := s.LookupIndex(name, []byte(term))
+	return toStringKeys(keys), err
+}
+
+// ScanIndex returns the keys indexed under terms from start (inclusive) to
+// end (exclusive), ordered by term and then by key. A nil start or end leaves
+// that side of the range open. A key indexed under several terms in the range
+// is returned once, at its lowest term.
+// Returns ErrIndexNotFound if the index doesn't exist
+func (s *SKV) ScanIndex(name string, start []byte, end []byte) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	idx, err := s.readyIndex(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return toByteKeys(idx.scan(start, end)), nil
+}
+
+// ScanIndexString is a convenience wrapper for ScanIndex using strings
+// An empty start or end leaves that side of the range open.
+func (s *SKV) ScanIndexString(name string, start string, end string) ([]string, error) {
+	var from, to []byte
+	if start != "" {
+		from = []byte(start)
+	}
+	if end != "" {
+		to = []byte(end)
+	}
+	keys, err := s.ScanIndex(name, from, to)
+	return toStringKeys(keys), err
+}
+
+// FloatTerm returns the term under which field indexes store a number
+// Terms of numbers sort in numeric order, so ScanIndex can search ranges:
+//
+//	db.ScanIndex("by-age", skv.FloatTerm(18), skv.FloatTerm(65))
+func FloatTerm(f float64) []byte {
+	bits := math.Float64bits(f)
+	if f < 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	return binary.BigEndian.AppendUint64(nil, bits)
+}
+
+// readyIndex returns an index that can be searched
+// Must be called with the lock held
+func (s *SKV) readyIndex(name string) (*index, error) {
+	idx, exists := s.indexes[name]
+	if !exists {
+		return nil, fmt.Errorf("%w: %q", ErrIndexNotFound, name)
+	}
+	if idx.extractor == nil {
+		return nil, fmt.Errorf("%w: %q needs its extractor, call CreateIndex after Open", ErrIndexNotFound, name)
+	}
+	return idx, nil
+}
+
+// loadIndexes reads the index definitions found by rebuildCache and builds
+// the field indexes
+func (s *SKV) loadIndexes(positions map[string]int64) error {
+	s.indexes = nil
+	for name, position := range positions {
+		data, err := s.valueAt(position)
+		if err != nil {
+			return fmt.Errorf("error reading definition of index %q: %w", name, err)
+		}
+		idx := &index{position: position}
+		if err := json.Unmarshal(data, &idx.definition); err != nil {
+			return fmt.Errorf("error decoding definition of index %q: %w", name, err)
+		}
+
+		if s.indexes == nil {
+			s.indexes = make(map[string]*index)
+		}
+		s.indexes[name] = idx
+
+		if idx.definition.Field != "" {
+			idx.extractor = fieldExtractor(idx.definition.Field)
+			if err := s.buildIndex(idx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeIndexDefinitions stores the definitions of all indexes again, after
+// Clear truncated the file
+// Must be called with the write lock held
+func (s *SKV) writeIndexDefinitions() error {
+	for name, idx := range s.indexes {
+		data, err := json.Marshal(idx.definition)
+		if err != nil {
+			return fmt.Errorf("error encoding index definition: %w", err)
+		}
+		position, err := s.writeRecord([]byte(name), &recordMeta{indexDef: true}, data)
+		if err != nil {
+			return fmt.Errorf("error storing index definition: %w", err)
+		}
+		idx.position = position
+	}
+	return nil
+}
+
+// buildIndex fills an index from all keys
+// Must be called with the lock held
+func (s *SKV) buildIndex(idx *index) error {
+	idx.terms = make(map[string]map[string]struct{})
+	idx.keyTerms = make(map[string][]string)
+	idx.sorted = nil
+
+	return s.cache.each(func(key string, position int64) error {
+		data, err := s.valueAt(position)
+		if err != nil {
+			return fmt.Errorf("error indexing key %q: %w", key, err)
+		}
+		idx.add(key, data)
+		return nil
+	})
+}
+
+// updateIndexes applies a committed change to all indexes
+// Must be called with the write lock held
+func (s *SKV) updateIndexes(op byte, key []byte, value []byte) {
+	for _, idx := range s.indexes {
+		if idx.extractor == nil {
+			continue
+		}
+		switch op {
+		case opSet:
+			idx.remove(string(key))
+			idx.add(string(key), value)
+		case opDelete:
+			idx.remove(string(key))
+		case opClear:
+			idx.terms = make(map[string]map[string]struct{})
+			idx.keyTerms = make(map[string][]string)
+			idx.sorted = nil
+		}
+	}
+}
+
+// lookup returns the sorted keys indexed under term
+func (idx *index) lookup(term []byte) []string {
+	keys := make([]string, 0, len(idx.terms[string(term)]))
+	for key := range idx.terms[string(term)] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// scan returns the keys indexed under terms in [start, end), see ScanIndex
+// Must be called with the write lock held, the sorted terms are cached
+func (idx *index) scan(start []byte, end []byte) []string {
+	if idx.sorted == nil {
+		idx.sorted = make([]string, 0, len(idx.terms))
+		for term := range idx.terms {
+			idx.sorted = append(idx.sorted, term)
+		}
+		sort.Strings(idx.sorted)
+	}
+
+	from := 0
+	if start != nil {
+		from = sort.SearchStrings(idx.sorted, string(start))
+	}
+
+	seen := make(map[string]bool)
+	result := make([]string, 0)
+	for _, term := range idx.sorted[from:] {
+		if end != nil && term >= string(end) {
+			break
+		}
+		keys := make([]string, 0, len(idx.terms[term]))
+		for key := range idx.terms[term] {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		result = append(result, keys...)
+	}
+	return result
+}
+
+// add indexes a key under the terms of its value
+func (idx *index) add(key string, value []byte) {
+	for _, t := range idx.extractor([]byte(key), value) {
+		term := string(t)
+		keys, exists := idx.terms[term]
+		if !exists {
+			keys = make(map[string]struct{})
+			idx.terms[term] = keys
+			idx.sorted = nil
+		}
+		if _, dup := keys[key]; dup {
+			continue
+		}
+		keys[key] = struct{}{}
+		idx.keyTerms[key] = append(idx.keyTerms[key], term)
+	}
+}
+
+// remove removes a key from the index
+func (idx *index) remove(key string) {
+	for _, term := range idx.keyTerms[key] {
+		delete(idx.terms[term], key)
+		if len(idx.terms[term]) == 0 {
+			delete(idx.terms, term)
+			idx.sorted = nil
+		}
+	}
+	delete(idx.keyTerms, key)
+}
+
+// fieldExtractor returns an extractor for a field of JSON object values
+func fieldExtractor(field string) IndexExtractor {
+	path := strings.Split(field, ".")
+	return func(key []byte, value []byte) [][]byte {
+		v, ok := jsonField(value, path)
+		if !ok {
+			return nil
+		}
+		if items, isArray := v.([]any); isArray {
+			terms := make([][]byte, 0, len(items))
+			for _, item := range items {
+				if term := jsonTerm(item); term != nil {
+					terms = append(terms, term)
+				}
+			}
+			return terms
+		}
+		if term := jsonTerm(v); term != nil {
+			return [][]byte{term}
+		}
+		return nil
+	}
+}
+
+// jsonField returns the value at path in a JSON document
+func jsonField(data []byte, path []string) (any, bool) {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, false
+	}
+	for _, name := range path {
+		object, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = object[name]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// jsonTerm returns the index term of a JSON scalar, nil for other values
+func jsonTerm(v any) []byte {
+	switch v := v.(type) {
+	case string:
+		return []byte(v)
+	case float64:
+		return FloatTerm(v)
+	case bool:
+		if v {
+			return []byte("true")
+		}
+		return []byte("false")
+	}
+	return nil
+}
+
+// toByteKeys converts string keys to byte slices
+func toByteKeys(keys []string) [][]byte {
+	result := make([][]byte, len(keys))
+	for i, key := range keys {
+		result[i] = []byte(key)
+	}
+	return result
+}
+
+// toStringKeys converts byte slice keys to strings
+func toStringKeys(keys [][]byte) []string {
+	if keys == nil {
+		return nil
+	}
+	result := make([]string, len(keys))
+	for i, key := range keys {
+		result[i] = string(key)
+	}
+	return result
+}
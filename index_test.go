@@ -0,0 +1,125 @@
+package skv
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestIndexes(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.skv")
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	db.PutString("s1", `{"user": "alice", "age": 30, "tags": ["a", "b"]}`)
+	db.PutString("s2", `{"user": "bob", "age": 17}`)
+	db.PutString("s3", `{"user": "alice", "age": 65}`)
+	db.PutString("raw", "not json")
+
+	if err := db.CreateFieldIndex("by-user", "user"); err != nil {
+		t.Fatalf("CreateFieldIndex failed: %v", err)
+	}
+	db.CreateFieldIndex("by-age", "age")
+	db.CreateFieldIndex("by-tag", "tags")
+	byLength := func(key []byte, value []byte) [][]byte {
+		return [][]byte{{byte(len(value))}}
+	}
+	if err := db.CreateIndex("by-length", byLength); err != nil {
+		t.Fatalf("CreateIndex failed: %v", err)
+	}
+
+	if keys, _ := db.LookupIndexString("by-user", "alice"); !reflect.DeepEqual(keys, []string{"s1", "s3"}) {
+		t.Errorf("Unexpected lookup result: %v", keys)
+	}
+	if keys, _ := db.LookupIndexString("by-tag", "b"); !reflect.DeepEqual(keys, []string{"s1"}) {
+		t.Errorf("Unexpected array lookup result: %v", keys)
+	}
+	keys, _ := db.ScanIndex("by-age", FloatTerm(18), FloatTerm(65))
+	if len(keys) != 1 || string(keys[0]) != "s1" {
+		t.Errorf("Unexpected range scan result: %q", keys)
+	}
+	if keys, _ := db.ScanIndex("by-age", nil, nil); len(keys) != 3 || string(keys[0]) != "s2" {
+		t.Errorf("Expected all keys in numeric order, got %q", keys)
+	}
+
+	// Writes keep indexes up to date
+	db.UpdateString("s3", `{"user": "carol", "age": 40}`)
+	db.DeleteString("s1")
+	db.SetString("s4", `{"user": "alice"}`)
+	if keys, _ := db.LookupIndexString("by-user", "alice"); !reflect.DeepEqual(keys, []string{"s4"}) {
+		t.Errorf("Unexpected lookup result after writes: %v", keys)
+	}
+	if err := db.WriteAtString("s4", 10, []byte("b")); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if keys, _ := db.LookupIndexString("by-user", "blice"); !reflect.DeepEqual(keys, []string{"s4"}) {
+		t.Errorf("Expected in-place write to update the index, got %v", keys)
+	}
+
+	if err := db.CreateFieldIndex("by-user", "name"); !errors.Is(err, ErrIndexExists) {
+		t.Errorf("Expected ErrIndexExists, got %v", err)
+	}
+	if _, err := db.LookupIndexString("missing", "x"); !errors.Is(err, ErrIndexNotFound) {
+		t.Errorf("Expected ErrIndexNotFound, got %v", err)
+	}
+
+	// Definitions survive compaction and a reopen, field indexes come back
+	// on their own, extractor indexes once the extractor is registered
+	db.Compact()
+	db.Close()
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+
+	if names := db.ListIndexes(); !reflect.DeepEqual(names, []string{"by-age", "by-length", "by-tag", "by-user"}) {
+		t.Errorf("Unexpected indexes after reopen: %v", names)
+	}
+	if keys, _ := db.LookupIndexString("by-user", "carol"); !reflect.DeepEqual(keys, []string{"s3"}) {
+		t.Errorf("Unexpected lookup result after reopen: %v", keys)
+	}
+	if _, err := db.LookupIndex("by-length", []byte{8}); !errors.Is(err, ErrIndexNotFound) {
+		t.Errorf("Expected ErrIndexNotFound before the extractor is registered, got %v", err)
+	}
+	db.CreateIndex("by-length", byLength)
+	if keys, _ := db.LookupIndexString("by-length", "\x08"); !reflect.DeepEqual(keys, []string{"raw"}) {
+		t.Errorf("Unexpected lookup result: %v", keys)
+	}
+
+	// Clear keeps the definitions, DropIndex removes them
+	db.Clear()
+	db.PutString("s5", `{"user": "dave"}`)
+	if keys, _ := db.LookupIndexString("by-user", "dave"); !reflect.DeepEqual(keys, []string{"s5"}) {
+		t.Errorf("Unexpected lookup result after Clear: %v", keys)
+	}
+	if err := db.DropIndex("by-tag"); err != nil {
+		t.Fatalf("DropIndex failed: %v", err)
+	}
+	db.Close()
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	if names := db.ListIndexes(); !reflect.DeepEqual(names, []string{"by-age", "by-length", "by-user"}) {
+		t.Errorf("Unexpected indexes after DropIndex: %v", names)
+	}
+	if db.Count() != 1 {
+		t.Errorf("Index definitions must not count as keys, got %d", db.Count())
+	}
+}
+
+func TestFloatTermOrder(t *testing.T) {
+	values := []float64{-1e9, -2.5, -1, 0, 0.5, 1, 17, 1e9}
+	for i := 1; i < len(values); i++ {
+		if bytes.Compare(FloatTerm(values[i-1]), FloatTerm(values[i])) >= 0 {
+			t.Errorf("FloatTerm(%v) should sort before FloatTerm(%v)", values[i-1], values[i])
+		}
+	}
+}
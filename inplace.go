@@ -0,0 +1,317 @@
+package skv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrSlotTooSmall is returned by Extend when the record has no room to grow
+// in place
+var ErrSlotTooSmall = errors.New("record slot too small")
+
+// WriteAt overwrites part of the value of an existing key in place
+// The range off to off+len(data) must lie within the current value, use
+// Extend first to make room. Open ValueReaders stay valid and see the new bytes,
+// except for a record written before versions existed: its first in-place
+// change moves it to a new record with a version.
+// Only the written range is reported to replicas, the value isn't read back
+// unless an index has to be updated: indexes read the whole value.
+// Returns ErrKeyNotFound if the key doesn't exist
+func (s *SKV) WriteAt(key []byte, off int64, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+	return s.writeAt(key, off, data)
+}
+
+// writeAt is WriteAt without the read-only check
+// Must be called with the write lock held
+func (s *SKV) writeAt(key []byte, off int64, data []byte) error {
+	position, h, err := s.lookupForWrite(key)
+	if err != nil {
+		return err
+	}
+	if off < 0 || uint64(off)+uint64(len(data)) > h.dataSize {
+		return fmt.Errorf("range %d-%d outside value of %d bytes", off, off+int64(len(data)), h.dataSize)
+	}
+
+	dataOffset := position + int64(h.headerSize)
+	if _, err := s.file.WriteAt(data, dataOffset+off); err != nil {
+		return fmt.Errorf("error writing data: %w", err)
+	}
+	if err := s.bumpVersion(position, h); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("error syncing to disk: %w", err)
+	}
+
+	change := append(binary.LittleEndian.AppendUint64(nil, uint64(off)), data...)
+	return s.notifyInPlace(opWriteAt, key, h.dataSize, h.dataSize, change)
+}
+
+// WriteAtString is a convenience wrapper for WriteAt using string keys
+func (s *SKV) WriteAtString(key string, off int64, data []byte) error {
+	return s.WriteAt([]byte(key), off, data)
+}
+
+// Truncate shrinks the value of an existing key to size bytes in place
+// The freed bytes become padding. Open ValueReaders on the key become stale.
+// Returns ErrKeyNotFound if the key doesn't exist
+func (s *SKV) Truncate(key []byte, size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+	return s.truncate(key, size)
+}
+
+// truncate is Truncate without the read-only check
+// Must be called with the write lock held
+func (s *SKV) truncate(key []byte, size int64) error {
+	position, h, err := s.lookupForWrite(key)
+	if err != nil {
+		return err
+	}
+	if size < 0 || uint64(size) > h.dataSize {
+		return fmt.Errorf("cannot truncate value of %d bytes to %d bytes", h.dataSize, size)
+	}
+	if uint64(size) == h.dataSize {
+		return nil
+	}
+
+	// Pad the tail before shrinking the record, so the file stays readable
+	// if the second write never happens
+	dataOffset := position + int64(h.headerSize)
+	tail := bytes.Repeat([]byte{PaddingByte}, int(h.dataSize-uint64(size)))
+	if _, err := s.file.WriteAt(tail, dataOffset+size); err != nil {
+		return fmt.Errorf("error writing padding: %w", err)
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("error syncing padding: %w", err)
+	}
+	if err := s.bumpVersion(position, h); err != nil {
+		return err
+	}
+	if err := s.writeDataSize(position, h, uint64(size)); err != nil {
+		return err
+	}
+
+	s.invalidateReaders(position)
+	return s.notifyInPlace(opResize, key, h.dataSize, uint64(size), binary.LittleEndian.AppendUint64(nil, uint64(size)))
+}
+
+// TruncateString is a convenience wrapper for Truncate using string keys
+func (s *SKV) TruncateString(key string, size int64) error {
+	return s.Truncate([]byte(key), size)
+}
+
+// Extend grows the value of an existing key to size bytes in place, filling
+// the new bytes with zeros. The record can grow into the padding and free
+// space that follow it, or without limit at the end of the file, but its data
+// size field keeps its width (see Type Field Details).
+// Returns ErrSlotTooSmall if there isn't enough room, ErrKeyNotFound if the
+// key doesn't exist
+func (s *SKV) Extend(key []byte, size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+	return s.extend(key, size)
+}
+
+// extend is Extend without the read-only check
+// Must be called with the write lock held
+func (s *SKV) extend(key []byte, size int64) error {
+	position, h, err := s.lookupForWrite(key)
+	if err != nil {
+		return err
+	}
+	if size < 0 || uint64(size) < h.dataSize {
+		return fmt.Errorf("cannot extend value of %d bytes to %d bytes", h.dataSize, size)
+	}
+	if uint64(size) == h.dataSize {
+		return nil
+	}
+	if uint64(size) > maxDataSize(h.recordType) {
+		return fmt.Errorf("%w: %d bytes exceed the record's size field", ErrSlotTooSmall, size)
+	}
+
+	end := position + int64(h.size())
+	padding, err := s.paddingAt(end)
+	if err != nil {
+		return err
+	}
+	grow := uint64(size) - h.dataSize
+
+	fileInfo, err := s.file.Stat()
+	if err != nil {
+		return fmt.Errorf("error getting file info: %w", err)
+	}
+	atEnd := end+padding == fileInfo.Size()
+
+	// Room after the padding taken from an adjacent free slot
+	freeIdx := -1
+	if !atEnd && grow > uint64(padding) {
+		for i, free := range s.freeSpace {
+			if free.position == end+padding {
+				freeIdx = i
+				break
+			}
+		}
+		if freeIdx < 0 || grow > uint64(padding)+s.freeSpace[freeIdx].size {
+			return fmt.Errorf("%w: %d more bytes needed", ErrSlotTooSmall, grow)
+		}
+	}
+	var growth int64
+	if atEnd && grow > uint64(padding) {
+		growth = int64(grow) - padding
+	}
+	limits := s.newLimitCheck()
+	if err := limits.resize(key, h.dataSize, uint64(size), growth); err != nil {
+		return err
+	}
+	if err := limits.check(); err != nil {
+		return err
+	}
+
+	// Make sure everything the record grows into is padding before growing
+	// it, so the file stays readable if a later write never happens. The
+	// free slot loses its record header, so all of it becomes padding.
+	var padFrom, padTo int64
+	switch {
+	case freeIdx >= 0:
+		free := s.freeSpace[freeIdx]
+		padFrom, padTo = free.position, free.position+int64(free.size)
+	case atEnd && grow > uint64(padding):
+		padFrom, padTo = end+padding, end+int64(grow)
+	}
+	if padTo > padFrom {
+		if _, err := s.file.WriteAt(bytes.Repeat([]byte{PaddingByte}, int(padTo-padFrom)), padFrom); err != nil {
+			return fmt.Errorf("error writing padding: %w", err)
+		}
+		if err := s.file.Sync(); err != nil {
+			return fmt.Errorf("error syncing padding: %w", err)
+		}
+	}
+	if freeIdx >= 0 {
+		s.freeSpace = append(s.freeSpace[:freeIdx], s.freeSpace[freeIdx+1:]...)
+	}
+
+	// Grow the record over the padding first, then clear the new bytes
+	if err := s.writeDataSize(position, h, uint64(size)); err != nil {
+		return err
+	}
+	zeros := make([]byte, grow)
+	if _, err := s.file.WriteAt(zeros, end); err != nil {
+		return fmt.Errorf("error writing data: %w", err)
+	}
+	if err := s.bumpVersion(position, h); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("error syncing to disk: %w", err)
+	}
+
+	s.invalidateReaders(position)
+	return s.notifyInPlace(opResize, key, h.dataSize, uint64(size), binary.LittleEndian.AppendUint64(nil, uint64(size)))
+}
+
+// ExtendString is a convenience wrapper for Extend using string keys
+func (s *SKV) ExtendString(key string, size int64) error {
+	return s.Extend([]byte(key), size)
+}
+
+// lookupForWrite returns the position and header of an existing key for an
+// in-place modification
+// A record without a version is rewritten with one first, see versionRecord.
+// Must be called with the write lock held
+func (s *SKV) lookupForWrite(key []byte) (int64, recordHeader, error) {
+	if len(key) == 0 {
+		return 0, recordHeader{}, ErrEmptyKey
+	}
+
+	position, exists := s.cache.get(string(key))
+	if !exists {
+		return 0, recordHeader{}, ErrKeyNotFound
+	}
+
+	h, err := s.recordHeaderAt(position)
+	if err != nil {
+		return 0, recordHeader{}, fmt.Errorf("error reading record: %w", err)
+	}
+	if h.versionOffset() == 0 {
+		return s.versionRecord(key, position, h)
+	}
+	return position, h, nil
+}
+
+// writeDataSize rewrites the data size field of the record at position
+func (s *SKV) writeDataSize(position int64, h recordHeader, size uint64) error {
+	var field []byte
+	switch getBaseType(h.recordType) {
+	case Type1Byte:
+		field = []byte{byte(size)}
+	case Type2Bytes:
+		field = binary.LittleEndian.AppendUint16(nil, uint16(size))
+	case Type4Bytes:
+		field = binary.LittleEndian.AppendUint32(nil, uint32(size))
+	default:
+		field = binary.LittleEndian.AppendUint64(nil, size)
+	}
+
+	fieldPos := position + int64(h.headerSize) - int64(len(field))
+	if _, err := s.file.WriteAt(field, fieldPos); err != nil {
+		return fmt.Errorf("error writing data size: %w", err)
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("error syncing to disk: %w", err)
+	}
+	return nil
+}
+
+// maxDataSize returns the largest data size the size field of a record type holds
+func maxDataSize(recordType byte) uint64 {
+	switch getBaseType(recordType) {
+	case Type1Byte:
+		return 0xFF
+	case Type2Bytes:
+		return 0xFFFF
+	case Type4Bytes:
+		return 0xFFFFFFFF
+	default:
+		return ^uint64(0)
+	}
+}
+
+// paddingAt counts the padding bytes starting at position without moving
+// the shared file offset
+func (s *SKV) paddingAt(position int64) (int64, error) {
+	var count int64
+	buf := make([]byte, 4096)
+	for {
+		n, err := s.file.ReadAt(buf, position+count)
+		for _, b := range buf[:n] {
+			if b != PaddingByte {
+				return count, nil
+			}
+			count++
+		}
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, fmt.Errorf("error reading padding: %w", err)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package skv
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestWriteAt(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.skv")
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	value := bytes.Repeat([]byte{0xAA}, 100000)
+	db.Put([]byte("image"), value)
+	db.PutString("after", "next record")
+	sizeBefore := fileSize(t, dbPath)
+
+	if err := db.WriteAtString("image", 50000, []byte("0123456789ABCDEF")); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	copy(value[50000:], "0123456789ABCDEF")
+
+	got, _ := db.Get([]byte("image"))
+	if !bytes.Equal(got, value) {
+		t.Error("WriteAt produced wrong value")
+	}
+	if fileSize(t, dbPath) != sizeBefore {
+		t.Error("WriteAt must not grow the file")
+	}
+	if err := db.WriteAtString("image", 99990, make([]byte, 20)); err == nil {
+		t.Error("Expected error writing past the end of the value")
+	}
+	if err := db.WriteAtString("missing", 0, []byte("x")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+
+	// The change survives a reopen
+	db.Close()
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	got, _ = db.Get([]byte("image"))
+	if !bytes.Equal(got, value) {
+		t.Error("WriteAt change lost after reopen")
+	}
+}
+
+func TestTruncateExtend(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.skv")
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	db.PutString("a", "0123456789")
+	db.PutString("b", "between")
+	db.PutString("c", "free slot to grow into")
+	db.PutString("d", "last")
+	db.DeleteString("c")
+
+	// Shrink, then grow back into the freed bytes
+	if err := db.TruncateString("a", 4); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if value, _ := db.GetString("a"); value != "0123" {
+		t.Errorf("Expected truncated value, got %q", value)
+	}
+	if err := db.ExtendString("a", 10); err != nil {
+		t.Fatalf("Extend into padding failed: %v", err)
+	}
+	if value, _ := db.Get([]byte("a")); !bytes.Equal(value, []byte("0123\x00\x00\x00\x00\x00\x00")) {
+		t.Errorf("Expected zero-filled extension, got %q", value)
+	}
+
+	// b can't grow, c's free slot follows it
+	if err := db.ExtendString("a", 11); !errors.Is(err, ErrSlotTooSmall) {
+		t.Errorf("Expected ErrSlotTooSmall, got %v", err)
+	}
+	if err := db.ExtendString("b", 20); err != nil {
+		t.Fatalf("Extend into free slot failed: %v", err)
+	}
+	if err := db.ExtendString("b", 200); !errors.Is(err, ErrSlotTooSmall) {
+		t.Errorf("Expected ErrSlotTooSmall beyond the free slot, got %v", err)
+	}
+
+	// The last record grows at the end of the file, up to its size field
+	if err := db.ExtendString("d", 255); err != nil {
+		t.Fatalf("Extend at end of file failed: %v", err)
+	}
+	if err := db.ExtendString("d", 256); !errors.Is(err, ErrSlotTooSmall) {
+		t.Errorf("Expected ErrSlotTooSmall past the size field, got %v", err)
+	}
+
+	expected := dumpStrings(db)
+	if _, err := db.Verify(); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	db.Close()
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	got := dumpStrings(db)
+	for key, value := range expected {
+		if got[key] != value {
+			t.Errorf("Key %s changed after reopen: %q != %q", key, got[key], value)
+		}
+	}
+	if len(got) != 3 || len(got["b"]) != 20 || len(got["d"]) != 255 {
+		t.Errorf("Unexpected contents after reopen: %d keys", len(got))
+	}
+}
+
+func TestWriteAtDoesNotReadValue(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.skv"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	// A replication primary observes every change
+	primary, err := NewPrimary(db)
+	if err != nil {
+		t.Fatalf("Failed to create primary: %v", err)
+	}
+	defer primary.Close()
+
+	const size = 8 << 20
+	if err := db.PutStream([]byte("big"), bytes.NewReader(make([]byte, size)), size); err != nil {
+		t.Fatalf("PutStream failed: %v", err)
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if err := db.WriteAtString("big", size/2, []byte("0123456789ABCDEF")); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if err := db.ExtendString("big", size+16); err != nil {
+		t.Fatalf("Extend failed: %v", err)
+	}
+	if err := db.TruncateString("big", size); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	runtime.ReadMemStats(&after)
+
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("In-place changes allocated %d bytes, the value must not be read back", allocated)
+	}
+}
+
+// fileSize returns the size of a file
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat %s: %v", path, err)
+	}
+	return info.Size()
+}
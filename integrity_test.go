@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"io"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -312,6 +313,51 @@ func TestFileHeader(t *testing.T) {
 		string(header[0:3]), header[3], header[4], header[5])
 }
 
+func TestHeaderVersionUpgrade(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.skv")
+	readMinor := func() byte {
+		header := make([]byte, HeaderSize)
+		file, err := os.Open(dbPath)
+		if err != nil {
+			t.Fatalf("Error opening file: %v", err)
+		}
+		defer file.Close()
+		if _, err := io.ReadFull(file, header); err != nil {
+			t.Fatalf("Error reading header: %v", err)
+		}
+		return header[4]
+	}
+
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	if minor := readMinor(); minor != versionMinorPlain {
+		t.Errorf("Expected minor version %d before any record, got %d", versionMinorPlain, minor)
+	}
+
+	// Records carry a version in their metadata block
+	db.PutString("key", "value")
+	if minor := readMinor(); minor != VersionMinor {
+		t.Errorf("Expected minor version %d after a metadata record, got %d", VersionMinor, minor)
+	}
+	db.Close()
+
+	// Headers newer than this version are rejected
+	for _, version := range [][2]byte{{VersionMajor, VersionMinor + 1}, {VersionMajor + 1, 0}} {
+		file, err := os.OpenFile(dbPath, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatalf("Error opening file: %v", err)
+		}
+		file.WriteAt(version[:], 3)
+		file.Close()
+		if db, err := Open(dbPath); err == nil {
+			db.Close()
+			t.Errorf("Expected Open to reject version %d.%d", version[0], version[1])
+		}
+	}
+}
+
 func TestHeaderInNewFile(t *testing.T) {
 	// Create a temporary file
 	tempFile, err := os.CreateTemp("", "test_new_header_*.skv")
@@ -584,7 +630,7 @@ func TestRebuildCacheWithFreeSpace(t *testing.T) {
 
 	// Check cache has 2 entries
 	db.mu.RLock()
-	cacheSize := len(db.cache)
+	cacheSize := db.cache.len()
 	freeSpaceSize := len(db.freeSpace)
 	db.mu.RUnlock()
 
@@ -0,0 +1,104 @@
+package skv
+
+import "sort"
+
+// keyIndex maps the keys of a keyspace to the positions of their records
+// The default keyspace uses memoryKeys, or diskKeys with Options.DiskKeyIndex
+type keyIndex interface {
+	// get returns the position of a key's record
+	get(key string) (int64, bool)
+	// set adds a key or moves it to another position
+	set(key string, position int64) error
+	// remove drops a key, removing a missing key is not an error
+	remove(key string) error
+	// len returns the number of keys
+	len() int
+	// each calls fn for every key in no particular order, stopping at the
+	// first error. fn must not modify the index.
+	each(fn func(key string, position int64) error) error
+	// reset drops every key
+	reset() error
+	// close releases the index, the database file must be synced first
+	close() error
+}
+
+// memoryKeys is a keyIndex held in a map, used unless the key index is on disk
+type memoryKeys map[string]int64
+
+func (m memoryKeys) get(key string) (int64, bool) {
+	position, ok := m[key]
+	return position, ok
+}
+
+func (m memoryKeys) set(key string, position int64) error {
+	m[key] = position
+	return nil
+}
+
+func (m memoryKeys) remove(key string) error {
+	delete(m, key)
+	return nil
+}
+
+func (m memoryKeys) len() int {
+	return len(m)
+}
+
+func (m memoryKeys) each(fn func(key string, position int64) error) error {
+	for key, position := range m {
+		if err := fn(key, position); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m memoryKeys) reset() error {
+	clear(m)
+	return nil
+}
+
+func (m memoryKeys) close() error {
+	return nil
+}
+
+// indexKeys returns the keys of an index starting with prefix, sorted
+func indexKeys(idx keyIndex, prefix string) ([]string, error) {
+	keys := make([]string, 0)
+	err := idx.each(func(key string, position int64) error {
+		if len(key) >= len(prefix) && key[:len(prefix)] == prefix {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
+// scratchKeys returns an empty index of the same kind as the database's,
+// for a database being rebuilt in a temporary file
+func (s *SKV) scratchKeys() (keyIndex, error) {
+	if keys, ok := s.cache.(*diskKeys); ok {
+		scratch, err := keys.scratch()
+		if err != nil {
+			return nil, err
+		}
+		return scratch, nil
+	}
+	return make(memoryKeys), nil
+}
+
+// replaceKeys makes the keys of an index from scratchKeys the keys of the
+// database, closing it
+func (s *SKV) replaceKeys(keys keyIndex) error {
+	if _, ok := keys.(memoryKeys); ok {
+		s.cache = keys
+		return nil
+	}
+	defer keys.close()
+
+	if err := s.cache.reset(); err != nil {
+		return err
+	}
+	return keys.each(s.cache.set)
+}
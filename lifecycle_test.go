@@ -228,10 +228,11 @@ func TestBackupRestore(t *testing.T) {
 		t.Fatalf("Failed to read backup file: %v", err)
 	}
 
-	var records []BackupRecord
-	if err := json.Unmarshal(backupData, &records); err != nil {
+	var doc backupDocument
+	if err := json.Unmarshal(backupData, &doc); err != nil {
 		t.Fatalf("Backup file is not valid JSON: %v", err)
 	}
+	records := doc.Records
 
 	if len(records) != len(testData) {
 		t.Errorf("Expected %d records in backup, got %d", len(testData), len(records))
@@ -312,10 +313,11 @@ func TestBackupStringVsBinary(t *testing.T) {
 		t.Fatalf("Failed to read backup file: %v", err)
 	}
 
-	var records []BackupRecord
-	if err := json.Unmarshal(backupData, &records); err != nil {
+	var doc backupDocument
+	if err := json.Unmarshal(backupData, &doc); err != nil {
 		t.Fatalf("Failed to parse backup JSON: %v", err)
 	}
+	records := doc.Records
 
 	// Create a map for easy lookup
 	recordMap := make(map[string]BackupRecord)
@@ -433,10 +435,11 @@ func TestBackupEmptyDatabase(t *testing.T) {
 		t.Fatalf("Failed to read backup file: %v", err)
 	}
 
-	var records []BackupRecord
-	if err := json.Unmarshal(backupData, &records); err != nil {
+	var doc backupDocument
+	if err := json.Unmarshal(backupData, &doc); err != nil {
 		t.Fatalf("Failed to parse backup JSON: %v", err)
 	}
+	records := doc.Records
 
 	if len(records) != 0 {
 		t.Errorf("Expected empty backup, got %d records", len(records))
@@ -0,0 +1,398 @@
+package skv
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Limits and quotas
+//
+// Limits are checked before a write touches the file, so a rejected write
+// leaves the database unchanged. Batches and restores are checked as a whole
+// before their first record is written. Limits apply to the default keyspace.
+// Bucket values are also held to the value size and file size limits, and
+// index definitions count toward the file size.
+
+// ErrQuotaExceeded is returned when a write would exceed a limit, the error
+// is a *QuotaError with the details
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Limits restricts what the database accepts, zero values mean no limit
+type Limits struct {
+	MaxValueSize int64            // Largest value in bytes
+	MaxKeys      int              // Most keys in the default keyspace
+	MaxFileSize  int64            // Largest database file in bytes
+	PrefixQuotas map[string]int64 // Bytes of values of the keys starting with each prefix
+}
+
+// Kinds of limits reported in QuotaError.Limit
+const (
+	LimitValueSize = "value size"
+	LimitKeys      = "key count"
+	LimitFileSize  = "file size"
+	LimitPrefix    = "prefix quota"
+)
+
+// QuotaError describes the limit a write would exceed
+type QuotaError struct {
+	Limit  string // One of LimitValueSize, LimitKeys, LimitFileSize or LimitPrefix
+	Prefix string // Prefix of the quota, for LimitPrefix
+	Key    string // Key being written
+	Max    int64  // The configured limit
+	Used   int64  // Usage the write would reach
+}
+
+func (e *QuotaError) Error() string {
+	limit := e.Limit
+	if e.Prefix != "" {
+		limit = fmt.Sprintf("%s of %q", e.Limit, e.Prefix)
+	}
+	return fmt.Sprintf("%v: writing key %q would bring the %s to %d, the limit is %d", ErrQuotaExceeded, e.Key, limit, e.Used, e.Max)
+}
+
+// Unwrap makes errors.Is(err, ErrQuotaExceeded) match
+func (e *QuotaError) Unwrap() error {
+	return ErrQuotaExceeded
+}
+
+// QuotaUsage is the usage of one limit
+type QuotaUsage struct {
+	Used int64 // Current usage
+	Max  int64 // The configured limit, 0 if there is none
+}
+
+// Usage reports the database's usage of its limits
+type Usage struct {
+	Keys      QuotaUsage            // Keys of the default keyspace
+	FileSize  QuotaUsage            // Size of the database file
+	ValueSize QuotaUsage            // Largest value of the default keyspace
+	Prefixes  map[string]QuotaUsage // Bytes of values per quota prefix
+}
+
+// count adds a key with a value of size bytes to the usage
+func (u *Usage) count(key string, size int64) {
+	u.Keys.Used++
+	u.ValueSize.Used = max(u.ValueSize.Used, size)
+	for prefix, quota := range u.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			quota.Used += size
+			u.Prefixes[prefix] = quota
+		}
+	}
+}
+
+// enabled reports whether any limit is set
+func (l Limits) enabled() bool {
+	return l.MaxValueSize > 0 || l.MaxKeys > 0 || l.MaxFileSize > 0 || len(l.PrefixQuotas) > 0
+}
+
+// Limits returns the limits the database was opened with
+func (s *SKV) Limits() Limits {
+	return s.limits
+}
+
+// Usage returns the current usage of the database's limits
+// Every key's record header is read to find the largest value.
+func (s *SKV) Usage() (*Usage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	info, err := s.file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("error getting file info: %w", err)
+	}
+	usage := &Usage{
+		Keys:      QuotaUsage{Max: int64(s.limits.MaxKeys)},
+		FileSize:  QuotaUsage{Used: info.Size(), Max: s.limits.MaxFileSize},
+		ValueSize: QuotaUsage{Max: s.limits.MaxValueSize},
+		Prefixes:  make(map[string]QuotaUsage),
+	}
+	for prefix, quota := range s.limits.PrefixQuotas {
+		usage.Prefixes[prefix] = QuotaUsage{Max: quota}
+	}
+
+	err = s.cache.each(func(key string, position int64) error {
+		h, err := s.recordHeaderAt(position)
+		if err != nil {
+			return fmt.Errorf("error reading record for key %q: %w", key, err)
+		}
+		usage.count(key, int64(h.dataSize))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// loadUsage computes the bytes used under every quota prefix, unless they
+// are already known
+// Must be called with the write lock held
+func (s *SKV) loadUsage() error {
+	if s.prefixUsage != nil || len(s.limits.PrefixQuotas) == 0 {
+		return nil
+	}
+
+	usage := make(map[string]int64, len(s.limits.PrefixQuotas))
+	for prefix := range s.limits.PrefixQuotas {
+		usage[prefix] = 0
+	}
+	err := s.cache.each(func(key string, position int64) error {
+		for prefix := range usage {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			h, err := s.recordHeaderAt(position)
+			if err != nil {
+				return fmt.Errorf("error reading record for key %q: %w", key, err)
+			}
+			usage[prefix] += int64(h.dataSize)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.prefixUsage = usage
+	return nil
+}
+
+// trackUsage adds delta bytes to the quota prefixes of key, once their usage
+// has been loaded
+func (s *SKV) trackUsage(key []byte, delta int64) {
+	for prefix := range s.prefixUsage {
+		if strings.HasPrefix(string(key), prefix) {
+			s.prefixUsage[prefix] += delta
+		}
+	}
+}
+
+// limitCheck adds up the effect of the records of a write on the limits
+// A nil limitCheck, for a database without limits, accepts everything.
+type limitCheck struct {
+	s       *SKV
+	keys    int              // Keys added
+	growth  int64            // Bytes appended to the file
+	prefix  map[string]int64 // Bytes added under each quota prefix
+	claimed map[int]bool     // Free space slots taken by the records
+	lastKey string           // Key reported if a total is exceeded
+}
+
+// newLimitCheck starts checking a write, nil if the database has no limits
+// Must be called with the write lock held
+func (s *SKV) newLimitCheck() *limitCheck {
+	if !s.limits.enabled() {
+		return nil
+	}
+	return &limitCheck{s: s, prefix: make(map[string]int64), claimed: make(map[int]bool)}
+}
+
+// checkPut checks the limits for writing one record
+// Must be called with the write lock held
+func (s *SKV) checkPut(key []byte, meta *recordMeta, size uint64) error {
+	c := s.newLimitCheck()
+	if err := c.put(key, meta, size); err != nil {
+		return err
+	}
+	return c.check()
+}
+
+// checkBucketPut checks the limits for writing one record of a bucket
+// Must be called with the write lock held
+func (s *SKV) checkBucketPut(state *bucketState, key []byte, size uint64) error {
+	c := s.newLimitCheck()
+	if err := c.putBucket(state, key, size); err != nil {
+		return err
+	}
+	return c.check()
+}
+
+// put adds a record replacing the value of key, or adding it
+func (c *limitCheck) put(key []byte, meta *recordMeta, size uint64) error {
+	if c == nil {
+		return nil
+	}
+	needed, err := c.recordSize(key, meta, size)
+	if err != nil {
+		return err
+	}
+
+	var oldSize uint64
+	if position, exists := c.s.cache.get(string(key)); exists {
+		h, err := c.s.recordHeaderAt(position)
+		if err != nil {
+			return fmt.Errorf("error reading record: %w", err)
+		}
+		oldSize = h.dataSize
+		if h.size() >= needed {
+			needed = 0 // The record's own slot is freed first
+		}
+	} else {
+		c.keys++
+	}
+	return c.add(key, oldSize, size, needed)
+}
+
+// putBucket adds a record replacing the value of key in a bucket, or adding
+// it. Only the value size and file size limits apply to buckets.
+func (c *limitCheck) putBucket(state *bucketState, key []byte, size uint64) error {
+	if c == nil {
+		return nil
+	}
+	needed, err := c.recordSize(key, &recordMeta{bucket: state.id}, size)
+	if err != nil {
+		return err
+	}
+
+	if position, exists := state.cache[string(key)]; exists {
+		h, err := c.s.recordHeaderAt(position)
+		if err != nil {
+			return fmt.Errorf("error reading record: %w", err)
+		}
+		if h.size() >= needed {
+			needed = 0 // The record's own slot is freed first
+		}
+	}
+	c.lastKey = string(key)
+	c.claim(needed)
+	return nil
+}
+
+// recordSize checks the value size limit and returns the largest size the
+// record of a value of size bytes can take
+func (c *limitCheck) recordSize(key []byte, meta *recordMeta, size uint64) (uint64, error) {
+	if limit := c.s.limits.MaxValueSize; limit > 0 && size > uint64(limit) {
+		return 0, &QuotaError{Limit: LimitValueSize, Key: string(key), Max: limit, Used: int64(min(size, math.MaxInt64))}
+	}
+
+	// The largest header the record can get, its version isn't known yet
+	stamped := recordMeta{}
+	if meta != nil {
+		stamped = *meta
+	}
+	stamped.version = math.MaxUint64
+	header, err := encodeRecordHeader(key, &stamped, size)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(len(header)) + size, nil
+}
+
+// resize adds the in-place resize of the value of key, growing the file by
+// growth bytes
+func (c *limitCheck) resize(key []byte, oldSize uint64, size uint64, growth int64) error {
+	if c == nil {
+		return nil
+	}
+	if limit := c.s.limits.MaxValueSize; limit > 0 && size > uint64(limit) {
+		return &QuotaError{Limit: LimitValueSize, Key: string(key), Max: limit, Used: int64(min(size, math.MaxInt64))}
+	}
+	c.growth += growth
+	return c.add(key, oldSize, size, 0)
+}
+
+// remove adds the deletion of key
+func (c *limitCheck) remove(key []byte) error {
+	if c == nil {
+		return nil
+	}
+	position, exists := c.s.cache.get(string(key))
+	if !exists {
+		return nil
+	}
+	h, err := c.s.recordHeaderAt(position)
+	if err != nil {
+		return fmt.Errorf("error reading record: %w", err)
+	}
+	c.keys--
+	for prefix := range c.s.limits.PrefixQuotas {
+		if strings.HasPrefix(string(key), prefix) {
+			c.prefix[prefix] -= int64(h.dataSize)
+		}
+	}
+	return nil
+}
+
+// add records a value of key going from oldSize to size bytes, with needed
+// bytes of record that must find room in the file
+func (c *limitCheck) add(key []byte, oldSize uint64, size uint64, needed uint64) error {
+	c.lastKey = string(key)
+	for prefix := range c.s.limits.PrefixQuotas {
+		if strings.HasPrefix(string(key), prefix) {
+			c.prefix[prefix] += int64(size) - int64(oldSize)
+		}
+	}
+	c.claim(needed)
+	return nil
+}
+
+// claim finds room in the file for needed bytes of record
+func (c *limitCheck) claim(needed uint64) {
+	if needed == 0 {
+		return
+	}
+
+	// Take the smallest unclaimed free slot that fits, as writeRecord does
+	best := -1
+	for i, free := range c.s.freeSpace {
+		if !c.claimed[i] && free.size >= needed && (best < 0 || free.size < c.s.freeSpace[best].size) {
+			best = i
+		}
+	}
+	if best >= 0 {
+		c.claimed[best] = true
+	} else {
+		c.growth += int64(needed)
+	}
+}
+
+// check compares the totals of the write with the limits
+func (c *limitCheck) check() error {
+	if c == nil {
+		return nil
+	}
+	limits := c.s.limits
+
+	if limits.MaxKeys > 0 && c.keys > 0 {
+		if keys := c.s.cache.len() + c.keys; keys > limits.MaxKeys {
+			return &QuotaError{Limit: LimitKeys, Key: c.lastKey, Max: int64(limits.MaxKeys), Used: int64(keys)}
+		}
+	}
+
+	if limits.MaxFileSize > 0 && c.growth > 0 {
+		info, err := c.s.file.Stat()
+		if err != nil {
+			return fmt.Errorf("error getting file info: %w", err)
+		}
+		size := max(info.Size(), HeaderSize) + c.growth
+		if size > limits.MaxFileSize {
+			return &QuotaError{Limit: LimitFileSize, Key: c.lastKey, Max: limits.MaxFileSize, Used: size}
+		}
+	}
+
+	if len(c.prefix) == 0 {
+		return nil
+	}
+	if err := c.s.loadUsage(); err != nil {
+		return err
+	}
+	prefixes := make([]string, 0, len(c.prefix))
+	for prefix := range c.prefix {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		used := c.s.prefixUsage[prefix] + c.prefix[prefix]
+		if quota := limits.PrefixQuotas[prefix]; c.prefix[prefix] > 0 && used > quota {
+			return &QuotaError{Limit: LimitPrefix, Prefix: prefix, Key: c.lastKey, Max: quota, Used: used}
+		}
+	}
+	return nil
+}
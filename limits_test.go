@@ -0,0 +1,211 @@
+package skv
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// quotaError returns the *QuotaError of err, failing the test unless err is one
+func quotaError(t *testing.T, err error, limit string) *QuotaError {
+	t.Helper()
+	var quotaErr *QuotaError
+	if !errors.Is(err, ErrQuotaExceeded) || !errors.As(err, &quotaErr) {
+		t.Fatalf("Expected a quota error, got %v", err)
+	}
+	if quotaErr.Limit != limit {
+		t.Fatalf("Expected the %s limit to be exceeded, got %v", limit, quotaErr)
+	}
+	return quotaErr
+}
+
+func TestLimits(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.skv")
+	opts := Options{Limits: Limits{
+		MaxValueSize: 100,
+		MaxKeys:      5,
+		PrefixQuotas: map[string]int64{"user/": 50},
+	}}
+	db, err := OpenWithOptions(dbPath, opts)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	sizeBefore := func() int64 {
+		info, _ := os.Stat(dbPath)
+		return info.Size()
+	}
+
+	// Value size
+	db.PutString("a", "1")
+	size := sizeBefore()
+	quotaErr := quotaError(t, db.Put([]byte("big"), make([]byte, 101)), LimitValueSize)
+	if quotaErr.Key != "big" || quotaErr.Max != 100 || quotaErr.Used != 101 {
+		t.Errorf("Unexpected error details: %+v", quotaErr)
+	}
+	quotaError(t, db.PutStream([]byte("big"), bytes.NewReader(make([]byte, 200)), 200), LimitValueSize)
+	quotaError(t, db.Update([]byte("a"), make([]byte, 101)), LimitValueSize)
+	quotaError(t, db.Extend([]byte("a"), 101), LimitValueSize)
+	if got, _ := db.GetString("a"); got != "1" || sizeBefore() != size {
+		t.Fatalf("Rejected writes must leave the database unchanged, a=%q", got)
+	}
+
+	// Prefix quota, across updates and deletes
+	if err := db.PutString("user/1", strings.Repeat("x", 30)); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	quotaErr = quotaError(t, db.PutString("user/2", strings.Repeat("x", 30)), LimitPrefix)
+	if quotaErr.Prefix != "user/" || quotaErr.Used != 60 || quotaErr.Max != 50 {
+		t.Errorf("Unexpected error details: %+v", quotaErr)
+	}
+	if err := db.UpdateString("user/1", strings.Repeat("x", 10)); err != nil {
+		t.Fatalf("Shrinking update failed: %v", err)
+	}
+	if err := db.PutString("user/2", strings.Repeat("x", 30)); err != nil {
+		t.Fatalf("Put within the quota failed: %v", err)
+	}
+	quotaError(t, db.SetString("user/3", strings.Repeat("x", 11)), LimitPrefix)
+	db.DeleteString("user/2")
+	if err := db.SetString("user/3", strings.Repeat("x", 11)); err != nil {
+		t.Fatalf("Put after delete failed: %v", err)
+	}
+
+	// Key count, batches are checked as a whole
+	err = db.PutBatchString(map[string]string{"b": "2", "c": "3", "d": "4"})
+	quotaError(t, err, LimitKeys)
+	if db.Exists([]byte("b")) || db.Exists([]byte("c")) {
+		t.Error("A rejected batch must not write any key")
+	}
+	if err := db.PutBatchString(map[string]string{"b": "2", "c": "3"}); err != nil {
+		t.Fatalf("Batch within the limit failed: %v", err)
+	}
+	quotaError(t, db.PutString("e", "5"), LimitKeys)
+	if err := db.UpdateString("b", "updated"); err != nil {
+		t.Fatalf("Updates don't add keys: %v", err)
+	}
+
+	stats, err := db.Verify()
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	usage, err := db.Usage()
+	if err != nil {
+		t.Fatalf("Usage failed: %v", err)
+	}
+	for _, u := range []*Usage{stats.Usage, usage} {
+		if u.Keys != (QuotaUsage{Used: 5, Max: 5}) || u.Prefixes["user/"] != (QuotaUsage{Used: 21, Max: 50}) || u.ValueSize.Used != 11 {
+			t.Errorf("Unexpected usage: %+v", u)
+		}
+	}
+
+	// Usage is computed again from the file once the database is reopened
+	db.Close()
+	db, err = OpenWithOptions(dbPath, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	quotaError(t, db.PutString("user/4", strings.Repeat("x", 30)), LimitKeys)
+	db.DeleteString("a")
+	quotaError(t, db.PutString("user/4", strings.Repeat("x", 30)), LimitPrefix)
+}
+
+func TestFileSizeLimit(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "test.skv")
+	db, err := OpenWithOptions(dbPath, Options{Limits: Limits{MaxFileSize: 1000}})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.Put([]byte("a"), make([]byte, 500)); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	backup := filepath.Join(dir, "backup.json")
+	db.Backup(backup)
+
+	quotaErr := quotaError(t, db.Put([]byte("b"), make([]byte, 500)), LimitFileSize)
+	if quotaErr.Max != 1000 || quotaErr.Used <= 1000 {
+		t.Errorf("Unexpected error details: %+v", quotaErr)
+	}
+
+	// Freed space can be reused without growing the file
+	if err := db.Update([]byte("a"), make([]byte, 400)); err != nil {
+		t.Fatalf("Update into the record's own slot failed: %v", err)
+	}
+	if err := db.Delete([]byte("a")); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := db.Put([]byte("b"), make([]byte, 450)); err != nil {
+		t.Fatalf("Put into free space failed: %v", err)
+	}
+
+	// Restores are checked before anything is written
+	_, err = db.RestoreWithOptions(RestoreOptions{Mode: RestoreMerge}, backup)
+	quotaError(t, err, LimitFileSize)
+	if db.Exists([]byte("a")) {
+		t.Error("A rejected restore must not write any key")
+	}
+}
+
+func TestBucketLimits(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.skv")
+	db, err := OpenWithOptions(dbPath, Options{Limits: Limits{MaxValueSize: 100, MaxFileSize: 1000, MaxKeys: 1}})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	bucket, _ := db.Bucket("files")
+	quotaError(t, bucket.Put([]byte("big"), make([]byte, 101)), LimitValueSize)
+	for i := 0; i < 8; i++ {
+		if err := bucket.Put([]byte{'a' + byte(i)}, make([]byte, 100)); err != nil {
+			t.Fatalf("Put %d failed: %v", i, err)
+		}
+	}
+	info, _ := os.Stat(dbPath)
+	sizeBefore := info.Size()
+	quotaError(t, bucket.Put([]byte("full"), make([]byte, 100)), LimitFileSize)
+	if info, _ := os.Stat(dbPath); info.Size() != sizeBefore || bucket.Exists([]byte("full")) {
+		t.Error("A rejected bucket write must not touch the file")
+	}
+
+	// Rewriting a value in its own slot doesn't grow the file, and bucket
+	// keys don't count toward the key limit
+	if err := bucket.Set([]byte("a"), make([]byte, 90)); err != nil {
+		t.Errorf("Set into the record's own slot failed: %v", err)
+	}
+	if err := db.Put([]byte("key"), []byte("value")); err != nil {
+		t.Errorf("Put in the default keyspace failed: %v", err)
+	}
+}
+
+func TestRestoreFromLimits(t *testing.T) {
+	dir := t.TempDir()
+	source, err := Open(filepath.Join(dir, "source.skv"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer source.Close()
+	source.PutString("small", "value")
+	source.Put([]byte("large"), make([]byte, 200))
+	var buf bytes.Buffer
+	if err := source.BackupTo(&buf); err != nil {
+		t.Fatalf("BackupTo failed: %v", err)
+	}
+
+	db, err := OpenWithOptions(filepath.Join(dir, "test.skv"), Options{Limits: Limits{MaxValueSize: 100}})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	quotaError(t, db.RestoreFrom(bytes.NewReader(buf.Bytes())), LimitValueSize)
+	if db.Count() != 0 {
+		t.Errorf("A rejected restore must not write any key, got %d", db.Count())
+	}
+}
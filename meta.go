@@ -0,0 +1,334 @@
+package skv
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+)
+
+// Record metadata
+//
+// Records with MetaFlag set in their type carry a metadata block between the
+// key and the data size:
+//
+//	meta_size (1) + entries, each: tag (1) + length (1) + value
+//
+// Entries with unknown tags are kept as they are when a record is rewritten.
+
+// Metadata entry tags
+const (
+	metaTagMode      byte = 0x01 // File mode (uint32)
+	metaTagModTime   byte = 0x02 // File modification time (int64, Unix nanoseconds)
+	metaTagVersion   byte = 0x03 // Record version (uint64)
+	metaTagBucket    byte = 0x04 // ID of the bucket the record belongs to (uvarint)
+	metaTagBucketDef byte = 0x05 // The record defines the bucket named by its key (uvarint ID)
+	metaTagIndexDef  byte = 0x06 // The record defines the index named by its key (no value)
+)
+
+// maxMetaSize is the largest metadata block, excluding its size byte
+const maxMetaSize = 0xFF
+
+// recordMeta holds the metadata of a record
+type recordMeta struct {
+	version    uint64 // Version of the record, 0 if unknown
+	versionPos int    // Offset of the version value in the decoded entries
+
+	bucket    uint64 // Bucket of the record, 0 for the default keyspace
+	bucketDef uint64 // ID of the bucket the record defines, 0 for data records
+	indexDef  bool   // The record defines an index
+
+	hasFile bool   // mode and modTime are set
+	mode    uint32 // fs.FileMode bits
+	modTime int64  // Unix nanoseconds
+
+	unknown []byte // Encoded entries with tags this version doesn't know
+}
+
+// fileMeta returns the metadata describing a file
+func fileMeta(info fs.FileInfo) *recordMeta {
+	return &recordMeta{
+		hasFile: true,
+		mode:    uint32(info.Mode()),
+		modTime: info.ModTime().UnixNano(),
+	}
+}
+
+// encode returns the metadata block including its size byte
+// Returns nil if there is no metadata
+func (m *recordMeta) encode() ([]byte, error) {
+	if m == nil {
+		return nil, nil
+	}
+
+	block := []byte{0}
+	if m.version != 0 {
+		// Fixed size, so in-place writes can update it
+		block = append(block, metaTagVersion, 8)
+		block = binary.LittleEndian.AppendUint64(block, m.version)
+	}
+	if m.bucket != 0 {
+		block = appendMetaUvarint(block, metaTagBucket, m.bucket)
+	}
+	if m.bucketDef != 0 {
+		block = appendMetaUvarint(block, metaTagBucketDef, m.bucketDef)
+	}
+	if m.indexDef {
+		block = append(block, metaTagIndexDef, 0)
+	}
+	if m.hasFile {
+		block = append(block, metaTagMode, 4)
+		block = binary.LittleEndian.AppendUint32(block, m.mode)
+		block = append(block, metaTagModTime, 8)
+		block = binary.LittleEndian.AppendUint64(block, uint64(m.modTime))
+	}
+	block = append(block, m.unknown...)
+
+	if len(block) == 1 {
+		return nil, nil
+	}
+	if len(block)-1 > maxMetaSize {
+		return nil, fmt.Errorf("record metadata too large (%d bytes, max %d)", len(block)-1, maxMetaSize)
+	}
+	block[0] = byte(len(block) - 1)
+	return block, nil
+}
+
+// appendMetaUvarint appends an entry holding a uvarint
+func appendMetaUvarint(block []byte, tag byte, value uint64) []byte {
+	encoded := binary.AppendUvarint(nil, value)
+	block = append(block, tag, byte(len(encoded)))
+	return append(block, encoded...)
+}
+
+// metaUvarint decodes the value of an entry holding a uvarint
+// Returns 0 if the value is malformed
+func metaUvarint(value []byte) uint64 {
+	v, n := binary.Uvarint(value)
+	if n != len(value) {
+		return 0
+	}
+	return v
+}
+
+// decodeRecordMeta parses the entries of a metadata block
+func decodeRecordMeta(entries []byte) (recordMeta, error) {
+	var m recordMeta
+
+	offset := 0
+	for len(entries) > 0 {
+		if len(entries) < 2 || len(entries) < 2+int(entries[1]) {
+			return m, fmt.Errorf("truncated metadata entry")
+		}
+		tag, value := entries[0], entries[2:2+int(entries[1])]
+
+		switch {
+		case tag == metaTagVersion && len(value) == 8:
+			m.version = binary.LittleEndian.Uint64(value)
+			m.versionPos = offset + 2
+		case tag == metaTagBucket && metaUvarint(value) != 0:
+			m.bucket = metaUvarint(value)
+		case tag == metaTagBucketDef && metaUvarint(value) != 0:
+			m.bucketDef = metaUvarint(value)
+		case tag == metaTagIndexDef && len(value) == 0:
+			m.indexDef = true
+		case tag == metaTagMode && len(value) == 4:
+			m.hasFile = true
+			m.mode = binary.LittleEndian.Uint32(value)
+		case tag == metaTagModTime && len(value) == 8:
+			m.hasFile = true
+			m.modTime = int64(binary.LittleEndian.Uint64(value))
+		default:
+			m.unknown = append(m.unknown, entries[:2+len(value)]...)
+		}
+
+		entries = entries[2+len(value):]
+		offset += 2 + len(value)
+	}
+
+	return m, nil
+}
+
+// recordHeader describes a record up to the start of its data
+type recordHeader struct {
+	recordType byte
+	key        []byte
+	meta       recordMeta
+	headerSize uint64 // Bytes before the data
+	dataSize   uint64
+}
+
+// versionOffset returns the offset of the version value within the record,
+// or 0 if the record has no version
+func (h recordHeader) versionOffset() int64 {
+	if h.meta.version == 0 {
+		return 0
+	}
+	// type + key size + key + meta size
+	return int64(2+len(h.key)+1) + int64(h.meta.versionPos)
+}
+
+// size returns the total size of the record
+func (h recordHeader) size() uint64 {
+	return h.headerSize + h.dataSize
+}
+
+// encodeRecordHeader returns the bytes written before the data of a record
+func encodeRecordHeader(key []byte, meta *recordMeta, dataSize uint64) ([]byte, error) {
+	block, err := meta.encode()
+	if err != nil {
+		return nil, err
+	}
+
+	recordType := getRecordType(dataSize)
+	if block != nil {
+		recordType |= MetaFlag
+	}
+
+	header := make([]byte, 0, 2+len(key)+len(block)+8)
+	header = append(header, recordType, byte(len(key)))
+	header = append(header, key...)
+	header = append(header, block...)
+
+	switch getBaseType(recordType) {
+	case Type1Byte:
+		header = append(header, byte(dataSize))
+	case Type2Bytes:
+		header = binary.LittleEndian.AppendUint16(header, uint16(dataSize))
+	case Type4Bytes:
+		header = binary.LittleEndian.AppendUint32(header, uint32(dataSize))
+	default:
+		header = binary.LittleEndian.AppendUint64(header, dataSize)
+	}
+
+	return header, nil
+}
+
+// readRecordHeader reads a record up to the start of its data
+// Returns io.EOF if r is at the end, and a *CorruptionError without offset
+// if the header is damaged or cut short
+func readRecordHeader(r io.Reader) (recordHeader, error) {
+	var h recordHeader
+
+	// Read type and key size
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		if err == io.EOF {
+			return h, io.EOF // Return EOF directly
+		}
+		return h, fmt.Errorf("error reading type: %w", err)
+	}
+	h.recordType = buf[0]
+
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return h, headerError(h, "key size", err)
+	}
+	keySize := buf[0]
+
+	// Read key
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(r, key); err != nil {
+		return h, headerError(h, "key", err)
+	}
+	h.key = key
+
+	// Read metadata block
+	var metaSize uint64
+	if h.recordType&MetaFlag != 0 {
+		if _, err := io.ReadFull(r, buf[:1]); err != nil {
+			return h, headerError(h, "metadata size", err)
+		}
+		entries := make([]byte, buf[0])
+		if _, err := io.ReadFull(r, entries); err != nil {
+			return h, headerError(h, "metadata", err)
+		}
+		meta, err := decodeRecordMeta(entries)
+		if err != nil {
+			return h, &CorruptionError{Key: string(h.key), Reason: fmt.Sprintf("invalid metadata: %v", err)}
+		}
+		h.meta = meta
+		metaSize = 1 + uint64(len(entries))
+	}
+
+	// Read data size
+	switch getBaseType(h.recordType) {
+	case Type1Byte:
+		if _, err := io.ReadFull(r, buf[:1]); err != nil {
+			return h, headerError(h, "data size", err)
+		}
+		h.dataSize = uint64(buf[0])
+	case Type2Bytes:
+		if _, err := io.ReadFull(r, buf[:2]); err != nil {
+			return h, headerError(h, "data size", err)
+		}
+		h.dataSize = uint64(binary.LittleEndian.Uint16(buf))
+	case Type4Bytes:
+		size := make([]byte, 4)
+		if _, err := io.ReadFull(r, size); err != nil {
+			return h, headerError(h, "data size", err)
+		}
+		h.dataSize = uint64(binary.LittleEndian.Uint32(size))
+	case Type8Bytes:
+		size := make([]byte, 8)
+		if _, err := io.ReadFull(r, size); err != nil {
+			return h, headerError(h, "data size", err)
+		}
+		h.dataSize = binary.LittleEndian.Uint64(size)
+	default:
+		return h, &CorruptionError{Key: string(h.key), Reason: fmt.Sprintf("unknown record type 0x%02X", h.recordType)}
+	}
+
+	h.headerSize = calculateRecordSize(keySize, 0, h.recordType) + metaSize
+	return h, nil
+}
+
+// headerError reports an error reading part of a record header, a header
+// cut short by the end of the file is a *CorruptionError
+func headerError(h recordHeader, part string, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return &CorruptionError{Key: string(h.key), Reason: "truncated record, missing " + part}
+	}
+	return fmt.Errorf("error reading %s: %w", part, err)
+}
+
+// FileMeta describes a value stored from a file
+type FileMeta struct {
+	Mode    fs.FileMode // Mode of the original file, 0 if unknown
+	ModTime time.Time   // Modification time of the original file, zero if unknown
+	Size    int64       // Size of the value
+}
+
+// StatFile returns the file metadata stored with a key by PutFile, UpdateFile
+// or PutDir. Keys stored without metadata report a zero Mode and ModTime.
+// Returns ErrKeyNotFound if the key doesn't exist
+func (s *SKV) StatFile(key string) (*FileMeta, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	position, exists := s.cache.get(key)
+	if !exists {
+		return nil, ErrKeyNotFound
+	}
+
+	h, err := s.recordHeaderAt(position)
+	if err != nil {
+		return nil, fmt.Errorf("error reading record: %w", err)
+	}
+
+	return newFileMeta(h), nil
+}
+
+// newFileMeta returns the file metadata of a record
+func newFileMeta(h recordHeader) *FileMeta {
+	info := &FileMeta{Size: int64(h.dataSize)}
+	if h.meta.hasFile {
+		info.Mode = fs.FileMode(h.meta.mode)
+		info.ModTime = time.Unix(0, h.meta.modTime)
+	}
+	return info
+}
@@ -0,0 +1,554 @@
+package skv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Queries
+//
+// A query filters the JSON object values of the default keyspace with an
+// expression such as:
+//
+//	status == "failed" && (attempts > 3 || user.name ^= "adm")
+//
+// Operands on the left are dot-separated field paths, _key is the key itself.
+// Operands on the right are JSON literals: strings, numbers, true, false and
+// null. The operators are == != < <= > >= and ^= (starts with); && (and),
+// || (or) and ! (not) combine them, with parentheses for grouping.
+//
+// Comparisons between different types are false. A missing field equals null.
+// If a field holds an array, a comparison is true if it holds for any element.
+// Values that aren't JSON only have _key.
+
+// ErrQuerySyntax is returned when a query filter can't be parsed
+var ErrQuerySyntax = errors.New("invalid query")
+
+// Query selects key-value pairs for SKV.Query
+type Query struct {
+	Filter string   // Filter expression, empty matches every key
+	Prefix string   // Only keys starting with Prefix
+	Fields []string // If set, values are replaced by JSON objects with only these fields
+	Limit  int      // Maximum number of results, 0 for no limit
+}
+
+// Query calls fn for each key-value pair matching q, in key order
+// Comparisons on fields with a field index (see CreateFieldIndex) use the
+// index instead of reading every value. If fn returns an error, the query
+// stops and that error is returned. fn must not modify the database.
+func (s *SKV) Query(q Query, fn func(key []byte, value []byte) error) error {
+	filter, err := parseFilter(q.Filter)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+
+	keys, indexed := s.queryCandidates(filter)
+	if !indexed {
+		var err error
+		if keys, err = indexKeys(s.cache, q.Prefix); err != nil {
+			return err
+		}
+	}
+	sort.Strings(keys)
+
+	matches := 0
+	for _, key := range keys {
+		if !strings.HasPrefix(key, q.Prefix) {
+			continue
+		}
+		position, exists := s.cache.get(key)
+		if !exists {
+			continue
+		}
+		data, err := s.valueAt(position)
+		if err != nil {
+			return fmt.Errorf("error reading key %q: %w", key, err)
+		}
+
+		doc := newQueryDoc(key, data)
+		if filter != nil && !filter.eval(doc) {
+			continue
+		}
+		if q.Fields != nil {
+			if data, err = doc.project(q.Fields); err != nil {
+				return fmt.Errorf("error projecting key %q: %w", key, err)
+			}
+		}
+
+		if err := fn([]byte(key), data); err != nil {
+			return err
+		}
+		matches++
+		if q.Limit > 0 && matches >= q.Limit {
+			break
+		}
+	}
+
+	return nil
+}
+
+// QueryString is a convenience wrapper for Query using strings
+func (s *SKV) QueryString(q Query, fn func(key string, value string) error) error {
+	return s.Query(q, func(key []byte, value []byte) error {
+		return fn(string(key), string(value))
+	})
+}
+
+// queryCandidates returns the keys that may match filter according to the
+// field indexes, or false if the indexes can't narrow the query down
+// Must be called with the write lock held
+func (s *SKV) queryCandidates(filter queryNode) ([]string, bool) {
+	set, ok := s.candidateSet(filter)
+	if !ok {
+		return nil, false
+	}
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	return keys, true
+}
+
+// candidateSet returns a superset of the keys matching node
+func (s *SKV) candidateSet(node queryNode) (map[string]struct{}, bool) {
+	switch n := node.(type) {
+	case *queryAnd:
+		var result map[string]struct{}
+		for _, child := range n.children {
+			set, ok := s.candidateSet(child)
+			if !ok {
+				continue
+			}
+			if result == nil {
+				result = set
+				continue
+			}
+			for key := range result {
+				if _, found := set[key]; !found {
+					delete(result, key)
+				}
+			}
+		}
+		return result, result != nil
+	case *queryOr:
+		result := make(map[string]struct{})
+		for _, child := range n.children {
+			set, ok := s.candidateSet(child)
+			if !ok {
+				return nil, false
+			}
+			for key := range set {
+				result[key] = struct{}{}
+			}
+		}
+		return result, true
+	case *queryCompare:
+		return s.compareCandidates(n)
+	}
+	return nil, false
+}
+
+// compareCandidates returns the keys a field index holds for a comparison
+func (s *SKV) compareCandidates(c *queryCompare) (map[string]struct{}, bool) {
+	var idx *index
+	for _, candidate := range s.indexes {
+		if candidate.definition.Field == strings.Join(c.path, ".") && candidate.extractor != nil {
+			idx = candidate
+			break
+		}
+	}
+	term := jsonTerm(c.value)
+	if idx == nil || term == nil {
+		return nil, false
+	}
+
+	var keys []string
+	switch c.op {
+	case "==":
+		keys = idx.lookup(term)
+	case "<":
+		keys = idx.scan(nil, term)
+	case "<=":
+		keys = idx.scan(nil, append(term, 0))
+	case ">", ">=":
+		keys = idx.scan(term, nil)
+	case "^=":
+		if _, isString := c.value.(string); !isString {
+			return nil, false
+		}
+		keys = idx.scan(term, prefixEnd(term))
+	default:
+		return nil, false
+	}
+
+	set := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		set[key] = struct{}{}
+	}
+	return set, true
+}
+
+// prefixEnd returns the smallest term greater than every term starting with
+// prefix, or nil if there is none
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// queryDoc is a value being evaluated by a filter
+type queryDoc struct {
+	key   string
+	value any  // Decoded JSON value
+	valid bool // The value is JSON
+}
+
+// newQueryDoc decodes a value for evaluation
+func newQueryDoc(key string, data []byte) *queryDoc {
+	doc := &queryDoc{key: key}
+	doc.valid = json.Unmarshal(data, &doc.value) == nil
+	return doc
+}
+
+// field returns the value at path
+func (d *queryDoc) field(path []string) (any, bool) {
+	if len(path) == 1 && path[0] == "_key" {
+		return d.key, true
+	}
+	if !d.valid {
+		return nil, false
+	}
+	v := d.value
+	for _, name := range path {
+		object, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = object[name]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// project returns a JSON object holding only fields
+func (d *queryDoc) project(fields []string) ([]byte, error) {
+	object := make(map[string]any, len(fields))
+	for _, field := range fields {
+		if v, ok := d.field(strings.Split(field, ".")); ok {
+			object[field] = v
+		}
+	}
+	return json.Marshal(object)
+}
+
+// queryNode is a node of a parsed filter
+type queryNode interface {
+	eval(doc *queryDoc) bool
+}
+
+type queryAnd struct{ children []queryNode }
+type queryOr struct{ children []queryNode }
+type queryNot struct{ child queryNode }
+
+type queryCompare struct {
+	path  []string
+	op    string
+	value any // string, float64, bool or nil
+}
+
+func (n *queryAnd) eval(doc *queryDoc) bool {
+	for _, child := range n.children {
+		if !child.eval(doc) {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *queryOr) eval(doc *queryDoc) bool {
+	for _, child := range n.children {
+		if child.eval(doc) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *queryNot) eval(doc *queryDoc) bool {
+	return !n.child.eval(doc)
+}
+
+func (c *queryCompare) eval(doc *queryDoc) bool {
+	v, _ := doc.field(c.path)
+	if c.op == "!=" {
+		return !(&queryCompare{path: c.path, op: "==", value: c.value}).eval(doc)
+	}
+	if items, isArray := v.([]any); isArray {
+		for _, item := range items {
+			if compareValues(item, c.op, c.value) {
+				return true
+			}
+		}
+		return false
+	}
+	return compareValues(v, c.op, c.value)
+}
+
+// compareValues applies op to a field value and a literal
+func compareValues(v any, op string, literal any) bool {
+	switch literal := literal.(type) {
+	case nil:
+		return op == "==" && v == nil
+	case bool:
+		b, ok := v.(bool)
+		return ok && op == "==" && b == literal
+	case float64:
+		f, ok := v.(float64)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "==":
+			return f == literal
+		case "<":
+			return f < literal
+		case "<=":
+			return f <= literal
+		case ">":
+			return f > literal
+		case ">=":
+			return f >= literal
+		}
+	case string:
+		str, ok := v.(string)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "==":
+			return str == literal
+		case "<":
+			return str < literal
+		case "<=":
+			return str <= literal
+		case ">":
+			return str > literal
+		case ">=":
+			return str >= literal
+		case "^=":
+			return strings.HasPrefix(str, literal)
+		}
+	}
+	return false
+}
+
+// parseFilter parses a filter expression, nil for an empty one
+func parseFilter(expr string) (queryNode, error) {
+	p := &queryParser{input: expr}
+	p.next()
+	if p.tok == "" {
+		return nil, p.err
+	}
+	node := p.parseOr()
+	if p.err == nil && p.tok != "" {
+		p.fail("unexpected %q", p.tok)
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	return node, nil
+}
+
+// queryParser is a recursive descent parser for filter expressions
+type queryParser struct {
+	input string
+	pos   int    // Offset after the current token
+	start int    // Offset of the current token
+	tok   string // Current token, empty at the end
+	err   error
+}
+
+func (p *queryParser) fail(format string, args ...any) {
+	if p.err == nil {
+		p.err = fmt.Errorf("%w at offset %d: %s", ErrQuerySyntax, p.start, fmt.Sprintf(format, args...))
+	}
+	p.tok = ""
+}
+
+// next reads the next token
+func (p *queryParser) next() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+	p.start = p.pos
+	if p.pos >= len(p.input) {
+		p.tok = ""
+		return
+	}
+
+	rest := p.input[p.pos:]
+	for _, op := range []string{"&&", "||", "==", "!=", "<=", ">=", "^=", "<", ">", "!", "(", ")"} {
+		if strings.HasPrefix(rest, op) {
+			p.tok = op
+			p.pos += len(op)
+			return
+		}
+	}
+
+	if rest[0] == '"' {
+		// Find the closing quote, skipping escaped characters
+		end := 1
+		for end < len(rest) && rest[end] != '"' {
+			if rest[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(rest) {
+			p.fail("unterminated string")
+			return
+		}
+		p.tok = rest[:end+1]
+		p.pos += end + 1
+		return
+	}
+
+	end := 0
+	for end < len(rest) && (isWordByte(rest[end])) {
+		end++
+	}
+	if end == 0 {
+		p.fail("unexpected character %q", rest[0])
+		return
+	}
+	p.tok = rest[:end]
+	p.pos += end
+}
+
+// isWordByte reports whether c can be part of a field path, number or keyword
+func isWordByte(c byte) bool {
+	return c == '_' || c == '.' || c == '-' || c == '+' || c >= '0' && c <= '9' ||
+		c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+func (p *queryParser) parseOr() queryNode {
+	children := []queryNode{p.parseAnd()}
+	for p.tok == "||" || strings.EqualFold(p.tok, "or") {
+		p.next()
+		children = append(children, p.parseAnd())
+	}
+	if len(children) == 1 {
+		return children[0]
+	}
+	return &queryOr{children: children}
+}
+
+func (p *queryParser) parseAnd() queryNode {
+	children := []queryNode{p.parseUnary()}
+	for p.tok == "&&" || strings.EqualFold(p.tok, "and") {
+		p.next()
+		children = append(children, p.parseUnary())
+	}
+	if len(children) == 1 {
+		return children[0]
+	}
+	return &queryAnd{children: children}
+}
+
+func (p *queryParser) parseUnary() queryNode {
+	switch {
+	case p.tok == "!" || strings.EqualFold(p.tok, "not"):
+		p.next()
+		return &queryNot{child: p.parseUnary()}
+	case p.tok == "(":
+		p.next()
+		node := p.parseOr()
+		if p.tok != ")" {
+			p.fail("expected )")
+			return node
+		}
+		p.next()
+		return node
+	}
+	return p.parseCompare()
+}
+
+func (p *queryParser) parseCompare() queryNode {
+	field := p.tok
+	if field == "" || !isFieldPath(field) {
+		p.fail("expected a field, got %q", field)
+		return nil
+	}
+	p.next()
+
+	op := p.tok
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=", "^=":
+	default:
+		p.fail("expected a comparison after %s, got %q", field, op)
+		return nil
+	}
+	p.next()
+
+	value, ok := parseLiteral(p.tok)
+	if !ok {
+		p.fail("expected a value after %s, got %q", op, p.tok)
+		return nil
+	}
+	p.next()
+
+	return &queryCompare{path: strings.Split(field, "."), op: op, value: value}
+}
+
+// isFieldPath reports whether tok is a dot-separated field path
+func isFieldPath(tok string) bool {
+	for _, part := range strings.Split(tok, ".") {
+		if part == "" || part[0] >= '0' && part[0] <= '9' || part[0] == '-' || part[0] == '+' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseLiteral parses a JSON literal token
+func parseLiteral(tok string) (any, bool) {
+	switch {
+	case tok == "":
+		return nil, false
+	case tok == "true":
+		return true, true
+	case tok == "false":
+		return false, true
+	case tok == "null":
+		return nil, true
+	case tok[0] == '"':
+		var s string
+		if err := json.Unmarshal([]byte(tok), &s); err != nil {
+			return nil, false
+		}
+		return s, true
+	}
+	f, err := strconv.ParseFloat(tok, 64)
+	if err != nil {
+		return nil, false
+	}
+	return f, true
+}
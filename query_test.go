@@ -0,0 +1,124 @@
+package skv
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// queryKeys runs a query and returns the matching keys
+func queryKeys(t *testing.T, db *SKV, q Query) []string {
+	t.Helper()
+	keys := make([]string, 0)
+	err := db.QueryString(q, func(key string, value string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Query %q failed: %v", q.Filter, err)
+	}
+	return keys
+}
+
+func TestQuery(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.skv"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	db.PutString("job:1", `{"status": "failed", "attempts": 5, "owner": {"name": "admin"}}`)
+	db.PutString("job:2", `{"status": "failed", "attempts": 1, "tags": ["urgent", "db"]}`)
+	db.PutString("job:3", `{"status": "done", "attempts": 4}`)
+	db.PutString("job:4", `{"status": "queued"}`)
+	db.PutString("user:1", `{"status": "failed", "attempts": 9}`)
+	db.PutString("blob", "not json")
+
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		{`status == "failed" && attempts > 3`, []string{"job:1", "user:1"}},
+		{`status == "done" || attempts >= 9`, []string{"job:3", "user:1"}},
+		{`status == "failed" and not (attempts < 3)`, []string{"job:1", "user:1"}},
+		{`owner.name ^= "adm"`, []string{"job:1"}},
+		{`tags == "db"`, []string{"job:2"}},
+		{`attempts == null`, []string{"blob", "job:4"}},
+		{`status != "failed"`, []string{"blob", "job:3", "job:4"}},
+		{`_key ^= "user:"`, []string{"user:1"}},
+		{`attempts > "3"`, []string{}},
+		{``, []string{"blob", "job:1", "job:2", "job:3", "job:4", "user:1"}},
+	}
+	for _, tt := range tests {
+		if got := queryKeys(t, db, Query{Filter: tt.filter}); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Query %q returned %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+
+	// Prefix and limit
+	got := queryKeys(t, db, Query{Filter: `status == "failed"`, Prefix: "job:", Limit: 1})
+	if !reflect.DeepEqual(got, []string{"job:1"}) {
+		t.Errorf("Unexpected result with prefix and limit: %v", got)
+	}
+
+	// Projection
+	var projected string
+	db.QueryString(Query{Filter: `attempts == 4`, Fields: []string{"status", "owner.name"}}, func(key string, value string) error {
+		projected = value
+		return nil
+	})
+	if projected != `{"status":"done"}` {
+		t.Errorf("Unexpected projection: %s", projected)
+	}
+
+	for _, bad := range []string{`status ==`, `== 1`, `(a == 1`, `a == "x`, `a = 1`, `a == 1 b`} {
+		if err := db.Query(Query{Filter: bad}, func(key []byte, value []byte) error { return nil }); !errors.Is(err, ErrQuerySyntax) {
+			t.Errorf("Expected ErrQuerySyntax for %q, got %v", bad, err)
+		}
+	}
+}
+
+func TestQueryUsesIndexes(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.skv"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	db.PutString("a", `{"status": "failed", "attempts": 5}`)
+	db.PutString("b", `{"status": "done", "attempts": 1}`)
+	db.PutString("c", `{"status": "failed", "attempts": 2}`)
+	db.CreateFieldIndex("by-status", "status")
+	db.CreateFieldIndex("by-attempts", "attempts")
+
+	candidates := func(filter string) ([]string, bool) {
+		node, err := parseFilter(filter)
+		if err != nil {
+			t.Fatalf("parseFilter failed: %v", err)
+		}
+		keys, ok := db.queryCandidates(node)
+		sort.Strings(keys)
+		return keys, ok
+	}
+
+	if keys, ok := candidates(`status == "failed" && attempts > 3`); !ok || !reflect.DeepEqual(keys, []string{"a"}) {
+		t.Errorf("Expected the indexes to narrow down to [a], got %v (%v)", keys, ok)
+	}
+	if keys, ok := candidates(`status == "done" || attempts <= 2`); !ok || !reflect.DeepEqual(keys, []string{"b", "c"}) {
+		t.Errorf("Expected union of index lookups, got %v (%v)", keys, ok)
+	}
+	if _, ok := candidates(`status == "failed" || other == 1`); ok {
+		t.Error("An OR with an unindexed branch must scan every key")
+	}
+
+	// Results are the same with and without indexes
+	if got := queryKeys(t, db, Query{Filter: `status == "failed" && attempts > 3`}); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("Unexpected indexed query result: %v", got)
+	}
+	db.UpdateString("b", `{"status": "failed", "attempts": 7}`)
+	if got := queryKeys(t, db, Query{Filter: `status == "failed" && attempts > 3`}); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("Unexpected indexed query result after update: %v", got)
+	}
+}
@@ -0,0 +1,364 @@
+package skv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// Repair
+//
+// Repair reads a damaged database file record by record. Where no record can
+// be read, it moves forward one byte at a time until a plausible record
+// starts again: a header that parses, a non-empty key, data inside the file,
+// and padding, another plausible header or the end of the file right after
+// it. The bytes skipped are copied to a quarantine file. The live records
+// found are copied unchanged, with their metadata, to a new database file,
+// keeping the newest version of every key as Open does.
+
+// RepairOptions configures Repair
+type RepairOptions struct {
+	// QuarantinePath is the file the unreadable regions of the source are
+	// copied to, one after the other, see RepairReport.Damaged. Defaults to
+	// dst + ".quarantine". The file is only created if a region is damaged.
+	QuarantinePath string
+}
+
+// DamagedRegion is a part of the source file Repair couldn't read
+type DamagedRegion struct {
+	Offset int64  // Position of the region in the source file
+	Size   int64  // Length of the region in bytes
+	Reason string // Why no record could be read at Offset
+}
+
+// RepairReport describes what Repair salvaged
+type RepairReport struct {
+	Records      int             // Readable records found, live or deleted
+	Salvaged     int             // Live records written to the repaired file
+	Superseded   int             // Live records replaced by a newer one of the same key
+	Orphaned     int             // Records of buckets whose definition was lost
+	Damaged      []DamagedRegion // Unreadable regions, in file order
+	DamagedBytes int64           // Total size of the unreadable regions
+	Quarantine   string          // Path of the quarantine file, empty if nothing was damaged
+}
+
+// errImplausible rejects a record found while looking for the end of a
+// damaged region, which isn't followed by another record
+var errImplausible = errors.New("record isn't followed by another record")
+
+// repairKey identifies the records holding versions of the same entry
+type repairKey struct {
+	bucket    uint64 // Bucket of the key, 0 for the default keyspace
+	bucketDef bool   // The record defines a bucket
+	indexDef  bool   // The record defines an index
+	key       string
+}
+
+// repairRecord is a live record found in the source file
+type repairRecord struct {
+	position  int64
+	size      uint64
+	version   uint64
+	bucket    uint64 // Bucket of the key, 0 for the default keyspace
+	bucketDef uint64 // ID of the bucket the record defines
+	meta      bool   // The record has a metadata block
+}
+
+// repairScan reads the records of a damaged file
+type repairScan struct {
+	file *os.File
+	size int64
+}
+
+// Repair salvages the readable records of the database file src into a new
+// database file dst, which must not exist
+// Every live record is copied unchanged; when a key has several live
+// records, the newest version wins, then the last one in the file. The
+// unreadable regions of src are copied to a quarantine file and listed in
+// the report. src is only read, so Repair can be run on a file Open rejects.
+func Repair(src string, dst string, opts RepairOptions) (*RepairReport, error) {
+	if _, err := os.Stat(dst); err == nil {
+		return nil, fmt.Errorf("%s already exists", dst)
+	}
+	file, err := os.Open(src)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %w", src, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("error getting file info: %w", err)
+	}
+	scan := &repairScan{file: file, size: info.Size()}
+
+	if opts.QuarantinePath == "" {
+		opts.QuarantinePath = dst + ".quarantine"
+	}
+	report := &RepairReport{}
+	var quarantine *os.File
+	defer func() {
+		if quarantine != nil {
+			quarantine.Close()
+		}
+	}()
+
+	// addDamaged quarantines the region [offset, end) of the source file
+	addDamaged := func(offset int64, end int64, reason string) error {
+		if quarantine == nil {
+			out, err := os.OpenFile(opts.QuarantinePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+			if err != nil {
+				return fmt.Errorf("error creating quarantine file: %w", err)
+			}
+			quarantine = out
+			report.Quarantine = opts.QuarantinePath
+		}
+		if _, err := io.Copy(quarantine, io.NewSectionReader(file, offset, end-offset)); err != nil {
+			return fmt.Errorf("error writing quarantine file: %w", err)
+		}
+		report.Damaged = append(report.Damaged, DamagedRegion{Offset: offset, Size: end - offset, Reason: reason})
+		report.DamagedBytes += end - offset
+		return nil
+	}
+
+	header := make([]byte, HeaderSize)
+	if _, err := file.ReadAt(header, 0); scan.size > 0 && (err != nil || string(header[0:3]) != HeaderMagic) {
+		if err := addDamaged(0, min(HeaderSize, scan.size), "invalid file header"); err != nil {
+			return nil, err
+		}
+	}
+
+	// Find the live records, the newest of every key
+	latest := make(map[repairKey]*repairRecord)
+	live := 0
+	err = scan.walk(scanVisitor{
+		record: func(position int64, h recordHeader) error {
+			report.Records++
+			if !isDeleted(h.recordType) {
+				live++
+				id := recordKeyOf(h)
+				if seen, ok := latest[id]; !ok || h.meta.version >= seen.version {
+					latest[id] = &repairRecord{position: position, size: h.size(), version: h.meta.version, bucket: h.meta.bucket, bucketDef: h.meta.bucketDef, meta: h.recordType&MetaFlag != 0}
+				}
+			}
+			return nil
+		},
+		damaged: addDamaged,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if quarantine != nil {
+		err := quarantine.Close()
+		quarantine = nil
+		if err != nil {
+			return nil, fmt.Errorf("error writing quarantine file: %w", err)
+		}
+	}
+	report.Superseded = live - len(latest)
+
+	// Records of buckets without a definition are left out, as Open does
+	buckets := make(map[uint64]bool)
+	for _, record := range latest {
+		if record.bucketDef != 0 {
+			buckets[record.bucketDef] = true
+		}
+	}
+	records := make([]*repairRecord, 0, len(latest))
+	for _, record := range latest {
+		if record.bucket != 0 && !buckets[record.bucket] {
+			report.Orphaned++
+			continue
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].position < records[j].position
+	})
+
+	if err := writeRepaired(file, dst, records); err != nil {
+		return nil, err
+	}
+	report.Salvaged = len(records)
+
+	// The repaired file must open cleanly
+	db, err := Open(dst)
+	if err != nil {
+		return nil, fmt.Errorf("error opening repaired file: %w", err)
+	}
+	if err := db.Close(); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// recordKeyOf returns the entry a live record holds a version of
+func recordKeyOf(h recordHeader) repairKey {
+	if h.meta.bucketDef != 0 {
+		return repairKey{bucketDef: true, key: string(h.key)}
+	}
+	if h.meta.indexDef {
+		return repairKey{indexDef: true, key: string(h.key)}
+	}
+	return repairKey{bucket: h.meta.bucket, key: string(h.key)}
+}
+
+// writeRepaired creates the database file dst holding the given records of
+// src, copied as they are
+// On error dst is removed.
+func writeRepaired(src *os.File, dst string, records []*repairRecord) (err error) {
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("error creating repaired file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			out.Close()
+			os.Remove(dst)
+		}
+	}()
+
+	minor := byte(versionMinorPlain)
+	for _, record := range records {
+		if record.meta {
+			minor = VersionMinor
+			break
+		}
+	}
+	if _, err := out.Write(fileHeader(minor)); err != nil {
+		return fmt.Errorf("error writing header: %w", err)
+	}
+	for _, record := range records {
+		if _, err := io.Copy(out, io.NewSectionReader(src, record.position, int64(record.size))); err != nil {
+			return fmt.Errorf("error copying record at offset %d: %w", record.position, err)
+		}
+	}
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("error syncing repaired file: %w", err)
+	}
+	return out.Close()
+}
+
+// scanVisitor receives what repairScan.walk finds, in file order
+type scanVisitor struct {
+	record  func(position int64, h recordHeader) error
+	damaged func(offset int64, end int64, reason string) error
+	padding func(offset int64, end int64) error // Optional
+}
+
+// walk reads the records of the file after its header, moving past padding
+// and damaged regions
+// A damaged region ends where a plausible record starts that is followed by
+// padding, another plausible record or the end of the file.
+func (r *repairScan) walk(v scanVisitor) error {
+	damagedAt, paddingAt := int64(-1), int64(-1)
+	var damagedReason string
+	for position := int64(HeaderSize); position < r.size; {
+		if damagedAt < 0 {
+			padding, err := r.isPadding(position)
+			if err != nil {
+				return err
+			}
+			if padding {
+				if paddingAt < 0 {
+					paddingAt = position
+				}
+				position++
+				continue
+			}
+			if paddingAt >= 0 && v.padding != nil {
+				if err := v.padding(paddingAt, position); err != nil {
+					return err
+				}
+			}
+			paddingAt = -1
+		}
+
+		h, err := r.recordAt(position)
+		if err == nil && damagedAt >= 0 {
+			// A record found by chance in damaged bytes is unlikely to be
+			// followed by another one
+			end := position + int64(h.size())
+			if ok, boundaryErr := r.isBoundary(end); boundaryErr != nil {
+				return boundaryErr
+			} else if !ok {
+				err = errImplausible
+			}
+		}
+		if err != nil {
+			var corruptErr *CorruptionError
+			if !errors.As(err, &corruptErr) && err != errImplausible {
+				return err
+			}
+			if damagedAt < 0 {
+				damagedAt, damagedReason = position, corruptErr.Reason
+			}
+			position++
+			continue
+		}
+
+		if damagedAt >= 0 {
+			if err := v.damaged(damagedAt, position, damagedReason); err != nil {
+				return err
+			}
+			damagedAt = -1
+		}
+		if err := v.record(position, h); err != nil {
+			return err
+		}
+		position += int64(h.size())
+	}
+
+	if damagedAt >= 0 {
+		return v.damaged(damagedAt, r.size, damagedReason)
+	}
+	if paddingAt >= 0 && v.padding != nil {
+		return v.padding(paddingAt, r.size)
+	}
+	return nil
+}
+
+// isPadding reports whether the byte at position is a padding byte
+func (r *repairScan) isPadding(position int64) (bool, error) {
+	buf := make([]byte, 1)
+	if _, err := r.file.ReadAt(buf, position); err != nil {
+		return false, fmt.Errorf("error reading offset %d: %w", position, err)
+	}
+	return buf[0] == PaddingByte, nil
+}
+
+// recordAt returns the header of the record at position, or a
+// *CorruptionError if no plausible record starts there
+func (r *repairScan) recordAt(position int64) (recordHeader, error) {
+	h, err := readRecordHeader(io.NewSectionReader(r.file, position, r.size-position))
+	if err != nil {
+		return h, corruptAt(err, position)
+	}
+	if len(h.key) == 0 {
+		return h, &CorruptionError{Offset: position, Reason: "empty key"}
+	}
+	if h.size() > uint64(r.size-position) {
+		return h, &CorruptionError{Offset: position, Key: string(h.key), Reason: "truncated record, missing data"}
+	}
+	return h, nil
+}
+
+// isBoundary reports whether padding, a plausible record or the end of the
+// file starts at position
+func (r *repairScan) isBoundary(position int64) (bool, error) {
+	if position >= r.size {
+		return true, nil
+	}
+	if padding, err := r.isPadding(position); err != nil || padding {
+		return padding, err
+	}
+	_, err := r.recordAt(position)
+	var corruptErr *CorruptionError
+	if errors.As(err, &corruptErr) {
+		return false, nil
+	}
+	return err == nil, err
+}
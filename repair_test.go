@@ -0,0 +1,179 @@
+package skv
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// recordSpan is the part of the file holding a record
+type recordSpan struct {
+	start, end int64
+}
+
+// writeRepairTestDB creates a database with keys, updates, deletes and a
+// bucket, and returns the expected values and the record of every key
+func writeRepairTestDB(t *testing.T, path string) (map[string]string, map[string]recordSpan) {
+	t.Helper()
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	want := make(map[string]string)
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+		want[key] = fmt.Sprintf("value of %s", key)
+		if err := db.PutString(key, want[key]); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	for i := 0; i < 200; i += 7 {
+		key := fmt.Sprintf("key-%03d", i)
+		want[key] = fmt.Sprintf("updated value of %s", key)
+		db.UpdateString(key, want[key])
+	}
+	for i := 3; i < 200; i += 11 {
+		key := fmt.Sprintf("key-%03d", i)
+		delete(want, key)
+		db.DeleteString(key)
+	}
+	bucket, _ := db.Bucket("users")
+	bucket.PutString("alice", "admin")
+
+	records := make(map[string]recordSpan)
+	db.cache.each(func(key string, position int64) error {
+		h, err := db.recordHeaderAt(position)
+		records[key] = recordSpan{position, position + int64(h.size())}
+		return err
+	})
+	return want, records
+}
+
+func TestRepair(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "damaged.skv")
+	want, records := writeRepairTestDB(t, src)
+
+	// An unknown record type in the middle makes Open fail
+	data, _ := os.ReadFile(src)
+	damaged := records["key-100"].start
+	data[damaged] = 0x03
+	os.WriteFile(src, data, 0644)
+	if _, err := Open(src); err == nil {
+		t.Fatal("Expected Open to fail on the damaged file")
+	}
+
+	dst := filepath.Join(dir, "repaired.skv")
+	report, err := Repair(src, dst, RepairOptions{})
+	if err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	if len(report.Damaged) != 1 || report.Damaged[0].Offset != damaged || report.DamagedBytes != records["key-100"].end-damaged {
+		t.Fatalf("Expected one damaged region at offset %d, got %+v", damaged, report.Damaged)
+	}
+	if report.Salvaged != len(want)-1+2 || report.Superseded != 0 || report.Orphaned != 0 {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+	quarantined, err := os.ReadFile(report.Quarantine)
+	if err != nil || int64(len(quarantined)) != report.DamagedBytes || quarantined[0] != 0x03 {
+		t.Errorf("Expected the damaged record in the quarantine file, got %d bytes (%v)", len(quarantined), err)
+	}
+
+	db, err := Open(dst)
+	if err != nil {
+		t.Fatalf("Failed to open repaired file: %v", err)
+	}
+	defer db.Close()
+	for key, value := range want {
+		got, err := db.GetString(key)
+		if key == "key-100" {
+			if err != ErrKeyNotFound {
+				t.Errorf("Expected the damaged key to be lost, got %q (%v)", got, err)
+			}
+			continue
+		}
+		if err != nil || got != value {
+			t.Errorf("Key %q: got %q (%v), want %q", key, got, err, value)
+		}
+	}
+	if db.Count() != len(want)-1 {
+		t.Errorf("Expected %d keys, got %d", len(want)-1, db.Count())
+	}
+	bucket, _ := db.Bucket("users")
+	if got, _ := bucket.GetString("alice"); got != "admin" {
+		t.Errorf("Expected the bucket to be salvaged, got %q", got)
+	}
+
+	if _, err := Repair(src, dst, RepairOptions{}); err == nil {
+		t.Error("Expected Repair to refuse an existing destination")
+	}
+}
+
+func TestRepairRandomDamage(t *testing.T) {
+	dir := t.TempDir()
+	clean := filepath.Join(dir, "clean.skv")
+	want, records := writeRepairTestDB(t, clean)
+	original, _ := os.ReadFile(clean)
+
+	var intact, salvaged int
+	for round := 0; round < 20; round++ {
+		rng := rand.New(rand.NewSource(int64(round)))
+		data := append([]byte(nil), original...)
+
+		// Overwrite a few short runs of bytes after the header
+		var spans []recordSpan
+		for i := 0; i < 3; i++ {
+			start := HeaderSize + rng.Int63n(int64(len(data)-HeaderSize))
+			end := min(start+1+rng.Int63n(16), int64(len(data)))
+			rng.Read(data[start:end])
+			spans = append(spans, recordSpan{start, end})
+		}
+		src := filepath.Join(dir, fmt.Sprintf("damaged-%d.skv", round))
+		os.WriteFile(src, data, 0644)
+
+		dst := filepath.Join(dir, fmt.Sprintf("repaired-%d.skv", round))
+		report, err := Repair(src, dst, RepairOptions{})
+		if err != nil {
+			t.Fatalf("Round %d: Repair failed: %v", round, err)
+		}
+		db, err := Open(dst)
+		if err != nil {
+			t.Fatalf("Round %d: failed to open repaired file: %v", round, err)
+		}
+		if _, err := db.Verify(); err != nil {
+			t.Errorf("Round %d: repaired file doesn't verify: %v", round, err)
+		}
+
+		// Count the keys whose record wasn't touched, and how many of them
+		// came back with their value
+		for key, value := range want {
+			record := records[key]
+			touched := false
+			for _, s := range spans {
+				if s.start < record.end && s.end > record.start {
+					touched = true
+				}
+			}
+			if touched {
+				continue
+			}
+			intact++
+			if got, err := db.GetString(key); err == nil && got == value {
+				salvaged++
+			}
+		}
+		db.Close()
+		if report.Salvaged == 0 {
+			t.Errorf("Round %d: nothing salvaged: %+v", round, report)
+		}
+	}
+
+	t.Logf("Salvaged %d of %d intact keys", salvaged, intact)
+	if salvaged < intact*95/100 {
+		t.Errorf("Expected at least 95%% of the intact keys to be salvaged, got %d of %d", salvaged, intact)
+	}
+}
@@ -0,0 +1,1097 @@
+package skv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Replication protocol constants
+//
+// After connecting, the replica sends a hello (magic, version, log ID, last
+// applied sequence number) and the primary answers with its own hello (magic,
+// version, log ID, current sequence number). The primary then sends frames:
+//
+//	type (1) + seq (8) + bucket_size (1) + bucket + key_size (1) + key + value_size (8) + value
+//
+// The bucket is empty for the default keyspace.
+//
+// If the replica's position is still in the primary's in-memory log, only the
+// missing mutations are sent. Otherwise the primary sends a full snapshot
+// (frameSnapshotBegin, one frameSet per key, one frameCreateBucket per bucket
+// followed by a frameSet per key of the bucket, frameSnapshotEnd) followed by
+// live mutations. The replica builds the snapshot in a temporary file and
+// swaps it in at frameSnapshotEnd, it keeps serving its old data until then.
+const (
+	replMagic     = "SKVR" // Magic bytes of the replication handshake
+	replVersion   = 3      // Protocol version, 2 added buckets to frames, 3 in-place changes
+	replLogIDSize = 16     // Size of the primary's log ID
+	replHelloSize = len(replMagic) + 1 + replLogIDSize + 8
+
+	frameSet                = opSet          // Key written
+	frameDelete             = opDelete       // Key deleted
+	frameClear              = opClear        // All keys and buckets removed
+	frameCreateBucket       = opCreateBucket // Bucket created
+	frameDeleteBucket       = opDeleteBucket // Bucket deleted with its keys
+	frameWriteAt            = opWriteAt      // Part of a value overwritten, value is offset (8) + data
+	frameResize             = opResize       // Value truncated or extended, value is the new size (8)
+	frameHeartbeat     byte = 0x10           // Keep-alive carrying the primary's sequence number
+	frameSnapshotBegin byte = 0x20           // Full snapshot follows, replacing the replica's data at its end
+	frameSnapshotEnd   byte = 0x21           // Snapshot complete, seq is the snapshot position
+)
+
+// Replication defaults
+const (
+	DefaultReplicationLogBytes = 64 * 1024 * 1024 // Mutations kept in memory for resuming replicas
+	DefaultHeartbeatInterval   = time.Second      // Interval between heartbeats on an idle stream
+	replicaRetryInterval       = 500 * time.Millisecond
+	replicaReadTimeout         = 30 * time.Second
+)
+
+// ErrPrimaryClosed is returned by Primary.Serve after Close has been called
+var ErrPrimaryClosed = errors.New("replication primary closed")
+
+// replEntry is one mutation in the primary's replication log
+type replEntry struct {
+	seq    uint64
+	op     byte
+	bucket string // Empty for the default keyspace
+	key    []byte
+	value  []byte
+}
+
+// Primary serves the ordered stream of mutations of a database to replicas
+type Primary struct {
+	// MaxLogBytes bounds the memory used to keep recent mutations for
+	// replicas that reconnect. Replicas that fall further behind are
+	// bootstrapped with a full snapshot. Defaults to DefaultReplicationLogBytes.
+	MaxLogBytes int64
+
+	// HeartbeatInterval is how often an idle stream sends a heartbeat.
+	// Defaults to DefaultHeartbeatInterval.
+	HeartbeatInterval time.Duration
+
+	db         *SKV
+	observerID uint64
+	logID      [replLogIDSize]byte
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	log       []replEntry // Retained mutations, oldest first
+	logBytes  int64       // Approximate memory used by log
+	head      uint64      // Sequence number of the last mutation
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+}
+
+// NewPrimary starts recording the mutations of db so they can be served to
+// replicas. Call Serve or ListenAndServe to accept replica connections.
+// The log ID is random, so replicas re-bootstrap after a primary restart.
+func NewPrimary(db *SKV) (*Primary, error) {
+	p := &Primary{
+		db:        db,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	if _, err := rand.Read(p.logID[:]); err != nil {
+		return nil, fmt.Errorf("error generating log ID: %w", err)
+	}
+
+	p.observerID = db.addObserver(p.record)
+	return p, nil
+}
+
+// record appends a mutation to the replication log
+// Called by the database with its write lock held
+func (p *Primary) record(op byte, bucket string, key []byte, value []byte) {
+	entry := replEntry{
+		op:     op,
+		bucket: bucket,
+		key:    append([]byte(nil), key...),
+		value:  append([]byte(nil), value...),
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.head++
+	entry.seq = p.head
+	p.log = append(p.log, entry)
+	p.logBytes += replEntrySize(entry)
+
+	// Drop the oldest entries once over budget, always keeping the newest one
+	maxBytes := p.MaxLogBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultReplicationLogBytes
+	}
+	for p.logBytes > maxBytes && len(p.log) > 1 {
+		p.logBytes -= replEntrySize(p.log[0])
+		p.log[0] = replEntry{}
+		p.log = p.log[1:]
+	}
+
+	p.cond.Broadcast()
+}
+
+// replEntrySize returns the approximate memory used by a log entry
+func replEntrySize(e replEntry) int64 {
+	return int64(len(e.bucket)+len(e.key)+len(e.value)) + 48
+}
+
+// Seq returns the sequence number of the last recorded mutation
+func (p *Primary) Seq() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.head
+}
+
+// ListenAndServe listens on the TCP address addr and serves replicas
+func (p *Primary) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("error listening on %s: %w", addr, err)
+	}
+	return p.Serve(ln)
+}
+
+// Serve accepts replica connections on ln until Close is called
+// Always returns a non-nil error, ErrPrimaryClosed after Close
+func (p *Primary) Serve(ln net.Listener) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		ln.Close()
+		return ErrPrimaryClosed
+	}
+	p.listeners[ln] = struct{}{}
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		delete(p.listeners, ln)
+		p.mu.Unlock()
+		ln.Close()
+	}()
+
+	// Wake up idle streams periodically so they send heartbeats
+	stop := make(chan struct{})
+	defer close(stop)
+	go p.heartbeat(stop)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			p.mu.Lock()
+			closed := p.closed
+			p.mu.Unlock()
+			if closed {
+				return ErrPrimaryClosed
+			}
+			return fmt.Errorf("error accepting replica connection: %w", err)
+		}
+
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			conn.Close()
+			return ErrPrimaryClosed
+		}
+		p.conns[conn] = struct{}{}
+		p.mu.Unlock()
+
+		go p.handle(conn)
+	}
+}
+
+// heartbeat wakes up all streams at every heartbeat interval
+func (p *Primary) heartbeat(stop chan struct{}) {
+	ticker := time.NewTicker(p.heartbeatInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			p.mu.Lock()
+			p.cond.Broadcast()
+			p.mu.Unlock()
+		}
+	}
+}
+
+// heartbeatInterval returns the configured heartbeat interval or the default
+func (p *Primary) heartbeatInterval() time.Duration {
+	if p.HeartbeatInterval > 0 {
+		return p.HeartbeatInterval
+	}
+	return DefaultHeartbeatInterval
+}
+
+// handle serves a single replica connection
+func (p *Primary) handle(conn net.Conn) {
+	defer func() {
+		p.mu.Lock()
+		delete(p.conns, conn)
+		p.mu.Unlock()
+		conn.Close()
+	}()
+
+	// Read the replica's position
+	conn.SetReadDeadline(time.Now().Add(replicaReadTimeout))
+	replicaID, replicaSeq, err := readReplHello(conn)
+	if err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	// Decide whether the replica can resume from the log
+	p.mu.Lock()
+	head := p.head
+	firstSeq := head + 1
+	if len(p.log) > 0 {
+		firstSeq = p.log[0].seq
+	}
+	resume := replicaID == p.logID && replicaSeq <= head && replicaSeq+1 >= firstSeq
+	p.mu.Unlock()
+
+	w := bufio.NewWriter(conn)
+	if err := writeReplHello(w, p.logID, head); err != nil {
+		return
+	}
+
+	next := replicaSeq + 1
+	if !resume {
+		snapshotSeq, err := p.sendSnapshot(conn, w)
+		if err != nil {
+			return
+		}
+		next = snapshotSeq + 1
+	}
+	if err := p.flush(conn, w); err != nil {
+		return
+	}
+
+	for {
+		p.mu.Lock()
+		if next > p.head && !p.closed {
+			p.cond.Wait()
+		}
+		if p.closed {
+			p.mu.Unlock()
+			return
+		}
+
+		// The replica fell out of the log, drop it so it reconnects and
+		// gets a snapshot
+		if len(p.log) > 0 && next < p.log[0].seq {
+			p.mu.Unlock()
+			return
+		}
+
+		var pending []replEntry
+		if next <= p.head {
+			start := int(next - p.log[0].seq)
+			pending = append(pending, p.log[start:]...)
+		}
+		head := p.head
+		p.mu.Unlock()
+
+		if len(pending) == 0 {
+			err = writeFrame(w, frameHeartbeat, head, "", nil, nil)
+		}
+		for _, e := range pending {
+			if err = writeFrame(w, e.op, e.seq, e.bucket, e.key, e.value); err != nil {
+				break
+			}
+			next = e.seq + 1
+		}
+		if err == nil {
+			err = p.flush(conn, w)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// flush writes buffered frames to the connection with a deadline
+func (p *Primary) flush(conn net.Conn, w *bufio.Writer) error {
+	conn.SetWriteDeadline(time.Now().Add(replicaReadTimeout))
+	return w.Flush()
+}
+
+// sendSnapshot sends every key and bucket of the database to the replica
+// The snapshot is written to a temporary file first, so a slow replica
+// doesn't hold the database lock
+func (p *Primary) sendSnapshot(conn net.Conn, w *bufio.Writer) (uint64, error) {
+	file, seq, err := p.writeSnapshot()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		file.Close()
+		os.Remove(file.Name())
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			conn.SetWriteDeadline(time.Now().Add(replicaReadTimeout))
+			if _, err := w.Write(buf[:n]); err != nil {
+				return 0, err
+			}
+		}
+		if err == io.EOF {
+			return seq, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("error reading snapshot: %w", err)
+		}
+	}
+}
+
+// writeSnapshot writes the frames of a snapshot to a temporary file next to
+// the database, rewound for reading
+// The read lock is held while writing so the snapshot matches the returned
+// sequence number exactly
+func (p *Primary) writeSnapshot() (*os.File, uint64, error) {
+	p.db.mu.RLock()
+	defer p.db.mu.RUnlock()
+
+	if err := p.db.checkOpen(); err != nil {
+		return nil, 0, err
+	}
+
+	// Mutations are recorded with the database write lock held, so the head
+	// cannot move while we hold the read lock
+	seq := p.Seq()
+
+	file, err := os.CreateTemp(filepath.Dir(p.db.filePath), filepath.Base(p.db.filePath)+".snapshot-*")
+	if err != nil {
+		return nil, 0, fmt.Errorf("error creating snapshot file: %w", err)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
+
+	w := bufio.NewWriter(file)
+	if err := writeFrame(w, frameSnapshotBegin, seq, "", nil, nil); err != nil {
+		return nil, 0, err
+	}
+	err = p.db.cache.each(func(_ string, position int64) error {
+		_, key, data, err := p.db.readRecordAt(position)
+		if err != nil {
+			return fmt.Errorf("error reading record: %w", err)
+		}
+		return writeFrame(w, frameSet, seq, "", key, data)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	for name, b := range p.db.buckets {
+		// Empty buckets are created too
+		if err := writeFrame(w, frameCreateBucket, seq, name, nil, nil); err != nil {
+			return nil, 0, err
+		}
+		for _, position := range b.cache {
+			_, key, data, err := p.db.readRecordAt(position)
+			if err != nil {
+				return nil, 0, fmt.Errorf("error reading record: %w", err)
+			}
+			if err := writeFrame(w, frameSet, seq, name, key, data); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+	if err := writeFrame(w, frameSnapshotEnd, seq, "", nil, nil); err != nil {
+		return nil, 0, err
+	}
+
+	if err := w.Flush(); err != nil {
+		return nil, 0, fmt.Errorf("error writing snapshot: %w", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, fmt.Errorf("error seeking snapshot: %w", err)
+	}
+	committed = true
+	return file, seq, nil
+}
+
+// Close stops serving replicas, disconnects them and stops recording mutations
+// The database itself is not closed
+func (p *Primary) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	for ln := range p.listeners {
+		ln.Close()
+	}
+	for conn := range p.conns {
+		conn.Close()
+	}
+	p.log = nil
+	p.logBytes = 0
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	// Connections are closed first so snapshots in progress stop sending
+	p.db.removeObserver(p.observerID)
+	return nil
+}
+
+// ReplicaStatus describes the replication state of a replica
+type ReplicaStatus struct {
+	Connected   bool      // True while connected to the primary
+	AppliedSeq  uint64    // Sequence number of the last applied mutation
+	PrimarySeq  uint64    // Last sequence number announced by the primary
+	Lag         uint64    // Mutations known to exist on the primary but not applied yet
+	LastContact time.Time // Time the last frame was received from the primary
+	Snapshots   int       // Number of full snapshots applied since the replica was opened
+	LastError   error     // Last connection or apply error, nil if none
+}
+
+// replicaPosition is persisted next to the replica database so it can resume
+type replicaPosition struct {
+	LogID string `json:"log_id"`
+	Seq   uint64 `json:"seq"`
+}
+
+// Replica keeps a read-only copy of a primary's database up to date
+type Replica struct {
+	db       *SKV
+	addr     string
+	posPath  string
+	ctx      context.Context    // Canceled by Close to abort dialing
+	cancel   context.CancelFunc // Cancels ctx
+	closed   chan struct{}
+	done     chan struct{}
+	closeErr error
+	snapshot *SKV // Snapshot being received, nil if none. Only used by run
+
+	mu        sync.Mutex
+	conn      net.Conn
+	logID     [replLogIDSize]byte
+	status    ReplicaStatus
+	savedSeq  uint64 // Sequence number last written to the position file
+	savedID   [replLogIDSize]byte
+	closeOnce sync.Once
+}
+
+// OpenReplica opens (or creates) the database name as a replica of the
+// primary listening at primaryAddr and starts replicating in the background.
+// The database rejects all modifications with ErrReadOnly, only the
+// replication stream writes to it. The last applied position is kept in
+// name + ".repl" so the replica resumes where it left off after a restart.
+func OpenReplica(name string, primaryAddr string) (*Replica, error) {
+	// The file is opened for writing, the replication stream applies changes
+	// to it and swaps snapshots in. A ReadOnly open has no write access and
+	// refuses to create a new replica, so only the API is made read-only,
+	// before the database is handed out.
+	db, err := Open(name)
+	if err != nil {
+		return nil, err
+	}
+	db.readOnly = true
+
+	r := &Replica{
+		db:      db,
+		addr:    primaryAddr,
+		posPath: db.filePath + ".repl",
+		closed:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+
+	if err := r.loadPosition(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	go r.run()
+	return r, nil
+}
+
+// DB returns the replicated database for reading
+func (r *Replica) DB() *SKV {
+	return r.db
+}
+
+// Status returns the current replication state
+func (r *Replica) Status() ReplicaStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := r.status
+	if status.PrimarySeq > status.AppliedSeq {
+		status.Lag = status.PrimarySeq - status.AppliedSeq
+	}
+	return status
+}
+
+// Close stops replicating, saves the position and closes the database
+func (r *Replica) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+		r.cancel()
+
+		r.mu.Lock()
+		if r.conn != nil {
+			r.conn.Close()
+		}
+		r.mu.Unlock()
+
+		<-r.done
+		if err := r.savePosition(); err != nil {
+			r.closeErr = err
+		}
+		if err := r.db.Close(); err != nil && r.closeErr == nil {
+			r.closeErr = err
+		}
+	})
+	return r.closeErr
+}
+
+// loadPosition reads the last applied position from the position file
+func (r *Replica) loadPosition() error {
+	data, err := os.ReadFile(r.posPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("error reading replica position: %w", err)
+	}
+
+	var pos replicaPosition
+	if err := json.Unmarshal(data, &pos); err != nil {
+		return fmt.Errorf("error decoding replica position: %w", err)
+	}
+	id, err := hex.DecodeString(pos.LogID)
+	if err != nil || (len(id) != 0 && len(id) != replLogIDSize) {
+		return fmt.Errorf("invalid log ID in replica position: %q", pos.LogID)
+	}
+
+	copy(r.logID[:], id)
+	r.savedID = r.logID
+	r.savedSeq = pos.Seq
+	r.status.AppliedSeq = pos.Seq
+	return nil
+}
+
+// savePosition writes the last applied position if it changed
+// The file is replaced atomically. Replaying a few mutations after a crash is
+// harmless because applying a mutation is idempotent.
+func (r *Replica) savePosition() error {
+	r.mu.Lock()
+	id := r.logID
+	seq := r.status.AppliedSeq
+	unchanged := id == r.savedID && seq == r.savedSeq
+	r.mu.Unlock()
+
+	if unchanged {
+		return nil
+	}
+
+	pos := replicaPosition{Seq: seq}
+	if id != ([replLogIDSize]byte{}) {
+		pos.LogID = hex.EncodeToString(id[:])
+	}
+	data, err := json.Marshal(pos)
+	if err != nil {
+		return fmt.Errorf("error encoding replica position: %w", err)
+	}
+
+	tmpPath := r.posPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("error writing replica position: %w", err)
+	}
+	if err := os.Rename(tmpPath, r.posPath); err != nil {
+		return fmt.Errorf("error replacing replica position: %w", err)
+	}
+
+	r.mu.Lock()
+	r.savedID = id
+	r.savedSeq = seq
+	r.mu.Unlock()
+	return nil
+}
+
+// run connects to the primary and reconnects after errors until closed
+func (r *Replica) run() {
+	defer close(r.done)
+
+	for {
+		err := r.session()
+		r.discardSnapshot()
+
+		r.mu.Lock()
+		r.status.Connected = false
+		r.conn = nil
+		if err != nil {
+			r.status.LastError = err
+		}
+		r.mu.Unlock()
+
+		select {
+		case <-r.closed:
+			return
+		case <-time.After(replicaRetryInterval):
+		}
+	}
+}
+
+// session runs one connection to the primary until it fails or is closed
+func (r *Replica) session() error {
+	dialer := net.Dialer{Timeout: replicaReadTimeout}
+	conn, err := dialer.DialContext(r.ctx, "tcp", r.addr)
+	if err != nil {
+		return fmt.Errorf("error connecting to primary: %w", err)
+	}
+	defer conn.Close()
+
+	r.mu.Lock()
+	select {
+	case <-r.closed:
+		r.mu.Unlock()
+		return nil
+	default:
+	}
+	r.conn = conn
+	logID := r.logID
+	applied := r.status.AppliedSeq
+	r.mu.Unlock()
+
+	w := bufio.NewWriter(conn)
+	if err := writeReplHello(w, logID, applied); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("error sending hello: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(replicaReadTimeout))
+	primaryID, primarySeq, err := readReplHello(br)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.status.Connected = true
+	r.status.PrimarySeq = primarySeq
+	r.status.LastContact = time.Now()
+	r.status.LastError = nil
+	r.mu.Unlock()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(replicaReadTimeout))
+		frameType, seq, bucket, key, value, err := readFrame(br)
+		if err != nil {
+			return err
+		}
+		if err := r.apply(primaryID, frameType, seq, bucket, key, value); err != nil {
+			return err
+		}
+
+		// Persist the position once we have caught up with what was received
+		if br.Buffered() == 0 {
+			if err := r.savePosition(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// apply applies one frame received from the primary
+func (r *Replica) apply(primaryID [replLogIDSize]byte, frameType byte, seq uint64, bucket string, key []byte, value []byte) error {
+	var err error
+	switch frameType {
+	case frameHeartbeat:
+		// Nothing to apply
+	case frameSnapshotBegin:
+		// Forget the old position first, an interrupted snapshot must be
+		// restarted from scratch
+		r.mu.Lock()
+		r.logID = [replLogIDSize]byte{}
+		r.status.AppliedSeq = 0
+		r.mu.Unlock()
+		if err := r.savePosition(); err != nil {
+			return err
+		}
+		r.discardSnapshot()
+		r.snapshot, err = r.db.beginSnapshot()
+	case frameSnapshotEnd:
+		if r.snapshot == nil {
+			return errors.New("snapshot end without a snapshot")
+		}
+		err = r.db.adoptSnapshot(r.snapshot)
+		r.snapshot = nil
+		if err != nil {
+			break
+		}
+		r.mu.Lock()
+		r.logID = primaryID
+		r.status.AppliedSeq = seq
+		r.status.Snapshots++
+		r.mu.Unlock()
+	case frameSet, frameDelete, frameClear, frameCreateBucket, frameDeleteBucket, frameWriteAt, frameResize:
+		if r.snapshot != nil {
+			err = r.snapshot.applyReplicated(frameType, bucket, key, value)
+			break
+		}
+		err = r.db.applyReplicated(frameType, bucket, key, value)
+		if err == nil {
+			r.mu.Lock()
+			// Snapshot frames carry the snapshot position, only live
+			// mutations move the applied position
+			if r.logID == primaryID {
+				r.status.AppliedSeq = seq
+			}
+			r.mu.Unlock()
+		}
+	default:
+		return fmt.Errorf("unknown replication frame type: 0x%02X", frameType)
+	}
+	if err != nil {
+		return fmt.Errorf("error applying replicated change: %w", err)
+	}
+
+	r.mu.Lock()
+	if frameType == frameHeartbeat || seq > r.status.PrimarySeq {
+		r.status.PrimarySeq = seq
+	}
+	r.status.LastContact = time.Now()
+	r.mu.Unlock()
+	return nil
+}
+
+// discardSnapshot drops a snapshot that didn't complete
+func (r *Replica) discardSnapshot() {
+	if r.snapshot != nil {
+		r.snapshot.abandon()
+		r.snapshot = nil
+	}
+}
+
+// beginSnapshot creates the temporary database a snapshot received from a
+// primary is built in, next to the database file
+func (s *SKV) beginSnapshot() (*SKV, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	tmpPath := s.filePath + ".snapshot.tmp"
+	file, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error creating temporary file: %w", err)
+	}
+	keys, err := s.scratchKeys()
+	if err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	tmp := &SKV{
+		file:      file,
+		filePath:  tmpPath,
+		cache:     keys,
+		freeSpace: make([]FreeSpace, 0),
+		revision:  s.revision,
+	}
+	if err := tmp.writeHeader(); err != nil {
+		tmp.abandon()
+		return nil, err
+	}
+	return tmp, nil
+}
+
+// abandon closes and removes a temporary database that won't be used
+func (s *SKV) abandon() {
+	s.cache.close()
+	s.file.Close()
+	os.Remove(s.filePath)
+}
+
+// adoptSnapshot replaces the database with a complete snapshot from
+// beginSnapshot, which can't be used afterwards
+func (s *SKV) adoptSnapshot(tmp *SKV) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkOpen(); err != nil {
+		tmp.abandon()
+		return err
+	}
+	if err := tmp.file.Sync(); err != nil {
+		tmp.abandon()
+		return fmt.Errorf("error syncing temporary file: %w", err)
+	}
+	if err := os.Rename(tmp.filePath, s.filePath); err != nil {
+		tmp.abandon()
+		return fmt.Errorf("error replacing database file: %w", err)
+	}
+
+	// The renamed file stays open and becomes the database file
+	s.file.Close()
+	s.file = tmp.file
+	if err := s.replaceKeys(tmp.cache); err != nil {
+		return err
+	}
+	s.freeSpace = tmp.freeSpace
+	s.revision = tmp.revision
+	s.buckets = tmp.buckets
+	s.lastBucketID = tmp.lastBucketID
+	s.invalidateAllReaders()
+	s.values.purge()
+	s.prefixUsage = nil
+
+	// Indexes stay defined and are rebuilt from the new keys
+	if err := s.writeIndexDefinitions(); err != nil {
+		return err
+	}
+	for _, idx := range s.indexes {
+		if idx.extractor == nil {
+			continue
+		}
+		if err := s.buildIndex(idx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyReplicated applies a change received from a primary, bypassing the
+// read-only check of replica databases
+func (s *SKV) applyReplicated(op byte, bucket string, key []byte, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if op != frameClear && bucket != "" {
+		return s.applyReplicatedBucket(op, bucket, key, value)
+	}
+
+	switch op {
+	case frameSet:
+		return s.putInternal(key, value)
+	case frameDelete:
+		// Deleting a missing key is not an error, the delete may be replayed
+		if err := s.deleteInternal(key); err != nil && err != ErrKeyNotFound {
+			return err
+		}
+		s.notify(opDelete, key, nil)
+		return nil
+	case frameClear:
+		return s.clearInternal()
+	case frameWriteAt, frameResize:
+		return s.applyReplicatedInPlace(op, key, value)
+	}
+	return fmt.Errorf("unknown replicated operation: 0x%02X", op)
+}
+
+// applyReplicatedInPlace applies a WriteAt, Truncate or Extend received from
+// a primary. A replayed change may no longer fit the value, a write is
+// clipped to it. The replica's record may have less room than the primary's,
+// a value that can't be extended in place is rewritten with the new size.
+// Must be called with the write lock held
+func (s *SKV) applyReplicatedInPlace(op byte, key []byte, value []byte) error {
+	if len(value) < 8 || (op == frameResize && len(value) != 8) {
+		return fmt.Errorf("invalid in-place change of %d bytes", len(value))
+	}
+	position, h, err := s.lookupForWrite(key)
+	if err == ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	arg := binary.LittleEndian.Uint64(value)
+	if op == frameWriteAt {
+		data := value[8:]
+		if arg >= h.dataSize {
+			return nil
+		}
+		if uint64(len(data)) > h.dataSize-arg {
+			data = data[:h.dataSize-arg]
+		}
+		return s.writeAt(key, int64(arg), data)
+	}
+
+	switch {
+	case arg < h.dataSize:
+		return s.truncate(key, int64(arg))
+	case arg == h.dataSize:
+		return nil
+	}
+	err = s.extend(key, int64(arg))
+	if !errors.Is(err, ErrSlotTooSmall) {
+		return err
+	}
+	data := io.MultiReader(
+		io.NewSectionReader(s.file, position+int64(h.headerSize), int64(h.dataSize)),
+		bytes.NewReader(make([]byte, arg-h.dataSize)),
+	)
+	return s.restoreRecord(key, data, arg)
+}
+
+// applyReplicatedBucket applies a change of a bucket received from a primary
+// Buckets are matched by name, their IDs may differ from the primary's. A
+// key written to a missing bucket creates it, so replaying is harmless.
+// Must be called with the write lock held
+func (s *SKV) applyReplicatedBucket(op byte, bucket string, key []byte, value []byte) error {
+	state, exists := s.buckets[bucket]
+	switch op {
+	case frameDeleteBucket:
+		if !exists {
+			return nil
+		}
+		return s.deleteBucket(bucket)
+	case frameDelete:
+		if !exists {
+			return nil
+		}
+		if err := s.deleteFrom(state.cache, key); err != nil && err != ErrKeyNotFound {
+			return err
+		}
+		s.notifyBucket(opDelete, bucket, key, nil)
+		return nil
+	case frameCreateBucket, frameSet:
+		if !exists {
+			var err error
+			if state, err = s.createBucket(bucket); err != nil {
+				return err
+			}
+		}
+		if op == frameCreateBucket {
+			return nil
+		}
+		return (&Bucket{db: s, name: bucket, id: state.id}).write(state, key, value)
+	}
+	return fmt.Errorf("unknown replicated bucket operation: 0x%02X", op)
+}
+
+// writeReplHello writes a handshake message
+func writeReplHello(w io.Writer, logID [replLogIDSize]byte, seq uint64) error {
+	buf := make([]byte, 0, replHelloSize)
+	buf = append(buf, replMagic...)
+	buf = append(buf, replVersion)
+	buf = append(buf, logID[:]...)
+	buf = binary.LittleEndian.AppendUint64(buf, seq)
+	if _, err := w.Write(buf); err != nil {
+		return fmt.Errorf("error writing hello: %w", err)
+	}
+	return nil
+}
+
+// readReplHello reads a handshake message
+func readReplHello(r io.Reader) (logID [replLogIDSize]byte, seq uint64, err error) {
+	buf := make([]byte, replHelloSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return logID, 0, fmt.Errorf("error reading hello: %w", err)
+	}
+	if string(buf[:len(replMagic)]) != replMagic {
+		return logID, 0, fmt.Errorf("invalid replication hello: expected magic bytes %q", replMagic)
+	}
+	if buf[len(replMagic)] != replVersion {
+		return logID, 0, fmt.Errorf("unsupported replication protocol version %d", buf[len(replMagic)])
+	}
+	copy(logID[:], buf[len(replMagic)+1:])
+	seq = binary.LittleEndian.Uint64(buf[len(replMagic)+1+replLogIDSize:])
+	return logID, seq, nil
+}
+
+// writeFrame writes a single replication frame
+func writeFrame(w io.Writer, frameType byte, seq uint64, bucket string, key []byte, value []byte) error {
+	buf := make([]byte, 0, 1+8+1+len(bucket)+1+len(key)+8)
+	buf = append(buf, frameType)
+	buf = binary.LittleEndian.AppendUint64(buf, seq)
+	buf = append(buf, byte(len(bucket)))
+	buf = append(buf, bucket...)
+	buf = append(buf, byte(len(key)))
+	buf = append(buf, key...)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(len(value)))
+	if _, err := w.Write(buf); err != nil {
+		return fmt.Errorf("error writing frame: %w", err)
+	}
+	if len(value) > 0 {
+		if _, err := w.Write(value); err != nil {
+			return fmt.Errorf("error writing frame value: %w", err)
+		}
+	}
+	return nil
+}
+
+// readFrame reads a single replication frame
+func readFrame(r io.Reader) (frameType byte, seq uint64, bucket string, key []byte, value []byte, err error) {
+	header := make([]byte, 1+8+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, 0, "", nil, nil, fmt.Errorf("error reading frame: %w", err)
+	}
+	frameType = header[0]
+	seq = binary.LittleEndian.Uint64(header[1:9])
+
+	name := make([]byte, int(header[9])+1)
+	if _, err := io.ReadFull(r, name); err != nil {
+		return 0, 0, "", nil, nil, fmt.Errorf("error reading frame bucket: %w", err)
+	}
+	bucket = string(name[:header[9]])
+
+	key = make([]byte, name[header[9]])
+	if _, err := io.ReadFull(r, key); err != nil {
+		return 0, 0, "", nil, nil, fmt.Errorf("error reading frame key: %w", err)
+	}
+
+	sizeBuf := make([]byte, 8)
+	if _, err := io.ReadFull(r, sizeBuf); err != nil {
+		return 0, 0, "", nil, nil, fmt.Errorf("error reading frame value size: %w", err)
+	}
+	valueSize := binary.LittleEndian.Uint64(sizeBuf)
+
+	// Read the value in chunks so a corrupt size cannot exhaust memory
+	var buf []byte
+	const chunkSize = 64 * 1024
+	for remaining := valueSize; remaining > 0; {
+		n := uint64(chunkSize)
+		if remaining < n {
+			n = remaining
+		}
+		chunk := make([]byte, n)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return 0, 0, "", nil, nil, fmt.Errorf("error reading frame value: %w", err)
+		}
+		buf = append(buf, chunk...)
+		remaining -= n
+	}
+	value = buf
+	if value == nil {
+		value = []byte{}
+	}
+
+	return frameType, seq, bucket, key, value, nil
+}
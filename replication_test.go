@@ -0,0 +1,549 @@
+package skv
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startPrimary opens a primary database and serves it on a localhost port
+func startPrimary(t *testing.T, dbFile string, maxLogBytes int64) (*SKV, *Primary, string) {
+	t.Helper()
+
+	db, err := Open(dbFile)
+	if err != nil {
+		t.Fatalf("Failed to open primary database: %v", err)
+	}
+
+	primary, err := NewPrimary(db)
+	if err != nil {
+		t.Fatalf("Failed to create primary: %v", err)
+	}
+	primary.MaxLogBytes = maxLogBytes
+	primary.HeartbeatInterval = 50 * time.Millisecond
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go primary.Serve(ln)
+
+	return db, primary, ln.Addr().String()
+}
+
+// waitForReplica waits until the replica has applied the given sequence number
+func waitForReplica(t *testing.T, replica *Replica, seq uint64) ReplicaStatus {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		status := replica.Status()
+		if status.Connected && status.AppliedSeq >= seq && status.Lag == 0 {
+			return status
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Replica did not reach seq %d: %+v", seq, replica.Status())
+	return ReplicaStatus{}
+}
+
+// removeReplicaFiles removes a replica database and its position file
+func removeReplicaFiles(dbFile string) {
+	os.Remove(dbFile)
+	os.Remove(dbFile + ".repl")
+	os.Remove(dbFile + ".repl.tmp")
+}
+
+func TestReplicationStream(t *testing.T) {
+	primaryFile := "test_repl_primary.skv"
+	replicaFile := "test_repl_replica.skv"
+	defer os.Remove(primaryFile)
+	defer removeReplicaFiles(replicaFile)
+
+	db, primary, addr := startPrimary(t, primaryFile, 0)
+	defer db.Close()
+	defer primary.Close()
+
+	// Data written before the replica connects arrives through the snapshot
+	db.PutString("before1", "value1")
+	db.Put([]byte("before2"), []byte{0x00, 0xFF, 0x10})
+
+	replica, err := OpenReplica(replicaFile, addr)
+	if err != nil {
+		t.Fatalf("Failed to open replica: %v", err)
+	}
+	defer replica.Close()
+
+	status := waitForReplica(t, replica, primary.Seq())
+	if status.Snapshots != 1 {
+		t.Errorf("Expected 1 snapshot for a new replica, got %d", status.Snapshots)
+	}
+
+	// Live mutations
+	db.PutString("live", "v1")
+	db.UpdateString("before1", "updated")
+	db.DeleteString("before2")
+	db.PutStream([]byte("stream"), bytes.NewReader([]byte("streamed")), 8)
+	waitForReplica(t, replica, primary.Seq())
+
+	rdb := replica.DB()
+	expected := map[string]string{"before1": "updated", "live": "v1", "stream": "streamed"}
+	if rdb.Count() != len(expected) {
+		t.Errorf("Expected %d keys on replica, got %d", len(expected), rdb.Count())
+	}
+	for key, value := range expected {
+		got, err := rdb.GetString(key)
+		if err != nil || got != value {
+			t.Errorf("Replica key %s: expected %q, got %q (%v)", key, value, got, err)
+		}
+	}
+	if rdb.ExistsString("before2") {
+		t.Error("Deleted key should not exist on replica")
+	}
+
+	// Clear is replicated too
+	db.Clear()
+	waitForReplica(t, replica, primary.Seq())
+	if rdb.Count() != 0 {
+		t.Errorf("Expected empty replica after clear, got %d keys", rdb.Count())
+	}
+
+	// The replica database rejects writes
+	if err := rdb.PutString("local", "x"); err != ErrReadOnly {
+		t.Errorf("Expected ErrReadOnly writing to replica, got %v", err)
+	}
+	if err := rdb.Compact(); err != ErrReadOnly {
+		t.Errorf("Expected ErrReadOnly compacting replica, got %v", err)
+	}
+}
+
+func TestReplicationBuckets(t *testing.T) {
+	dir := t.TempDir()
+	db, primary, addr := startPrimary(t, filepath.Join(dir, "primary.skv"), 0)
+	defer db.Close()
+	defer primary.Close()
+
+	replica, err := OpenReplica(filepath.Join(dir, "replica.skv"), addr)
+	if err != nil {
+		t.Fatalf("Failed to open replica: %v", err)
+	}
+	defer replica.Close()
+	waitForReplica(t, replica, primary.Seq())
+
+	users, _ := db.Bucket("users")
+	users.PutString("alice", "user")
+	users.PutString("bob", "user")
+	users.SetString("alice", "admin")
+	users.DeleteString("bob")
+	db.Bucket("empty")
+	gone, _ := db.Bucket("gone")
+	gone.PutString("x", "1")
+	db.DeleteBucket("gone")
+	db.PutString("alice", "default keyspace")
+	waitForReplica(t, replica, primary.Seq())
+
+	rdb := replica.DB()
+	if got := fmt.Sprint(rdb.ListBuckets()); got != "[empty users]" {
+		t.Errorf("Expected buckets [empty users] on replica, got %s", got)
+	}
+	rusers, err := rdb.Bucket("users")
+	if err != nil {
+		t.Fatalf("Bucket failed on replica: %v", err)
+	}
+	if got, _ := rusers.GetString("alice"); got != "admin" {
+		t.Errorf("Expected alice to be admin on replica, got %q", got)
+	}
+	if rusers.ExistsString("bob") || rusers.Count() != 1 {
+		t.Errorf("Expected only alice in the replica bucket, got %d keys", rusers.Count())
+	}
+	if got, _ := rdb.GetString("alice"); got != "default keyspace" {
+		t.Errorf("Expected the default keyspace key on replica, got %q", got)
+	}
+	if err := rusers.PutString("carol", "x"); err != ErrReadOnly {
+		t.Errorf("Expected ErrReadOnly writing to a replica bucket, got %v", err)
+	}
+}
+
+func TestReplicationInPlace(t *testing.T) {
+	dir := t.TempDir()
+	db, primary, addr := startPrimary(t, filepath.Join(dir, "primary.skv"), 0)
+	defer db.Close()
+	defer primary.Close()
+
+	// doc keeps padding on the primary, the replica gets it without any
+	// through the snapshot
+	db.Put([]byte("doc"), bytes.Repeat([]byte("a"), 100))
+	db.TruncateString("doc", 40)
+
+	replica, err := OpenReplica(filepath.Join(dir, "replica.skv"), addr)
+	if err != nil {
+		t.Fatalf("Failed to open replica: %v", err)
+	}
+	defer replica.Close()
+	waitForReplica(t, replica, primary.Seq())
+
+	db.PutString("later", "keeps doc from growing at the end of the replica")
+	if err := db.WriteAtString("doc", 10, []byte("xyz")); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if err := db.ExtendString("doc", 80); err != nil {
+		t.Fatalf("Extend failed: %v", err)
+	}
+	if err := db.WriteAtString("doc", 70, []byte("end")); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	if err := db.TruncateString("doc", 75); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	waitForReplica(t, replica, primary.Seq())
+
+	expected, _ := db.Get([]byte("doc"))
+	got, err := replica.DB().Get([]byte("doc"))
+	if err != nil || !bytes.Equal(got, expected) {
+		t.Errorf("Replica doc: expected %q, got %q (%v)", expected, got, err)
+	}
+	if err := replica.DB().WriteAtString("doc", 0, []byte("x")); err != ErrReadOnly {
+		t.Errorf("Expected ErrReadOnly writing in place to a replica, got %v", err)
+	}
+}
+
+func TestReplicationResume(t *testing.T) {
+	primaryFile := "test_repl_resume_primary.skv"
+	replicaFile := "test_repl_resume_replica.skv"
+	defer os.Remove(primaryFile)
+	defer removeReplicaFiles(replicaFile)
+
+	db, primary, addr := startPrimary(t, primaryFile, 0)
+	defer db.Close()
+	defer primary.Close()
+
+	db.PutString("a", "1")
+
+	replica, err := OpenReplica(replicaFile, addr)
+	if err != nil {
+		t.Fatalf("Failed to open replica: %v", err)
+	}
+	waitForReplica(t, replica, primary.Seq())
+	if err := replica.Close(); err != nil {
+		t.Fatalf("Failed to close replica: %v", err)
+	}
+
+	// Write while the replica is down
+	for i := 0; i < 10; i++ {
+		db.PutString(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+	}
+
+	replica, err = OpenReplica(replicaFile, addr)
+	if err != nil {
+		t.Fatalf("Failed to reopen replica: %v", err)
+	}
+	defer replica.Close()
+
+	status := waitForReplica(t, replica, primary.Seq())
+	if status.Snapshots != 0 {
+		t.Errorf("Expected replica to resume from the log without a snapshot, got %d snapshots", status.Snapshots)
+	}
+	if replica.DB().Count() != 11 {
+		t.Errorf("Expected 11 keys on replica, got %d", replica.DB().Count())
+	}
+	if value, _ := replica.DB().GetString("key9"); value != "value9" {
+		t.Errorf("Expected value9, got %q", value)
+	}
+}
+
+func TestReplicationSnapshotWhenBehind(t *testing.T) {
+	primaryFile := "test_repl_behind_primary.skv"
+	replicaFile := "test_repl_behind_replica.skv"
+	defer os.Remove(primaryFile)
+	defer removeReplicaFiles(replicaFile)
+
+	// A tiny log only keeps the most recent mutation
+	db, primary, addr := startPrimary(t, primaryFile, 1)
+	defer db.Close()
+	defer primary.Close()
+
+	db.PutString("a", "1")
+
+	replica, err := OpenReplica(replicaFile, addr)
+	if err != nil {
+		t.Fatalf("Failed to open replica: %v", err)
+	}
+	waitForReplica(t, replica, primary.Seq())
+	replica.Close()
+
+	for i := 0; i < 5; i++ {
+		db.PutString(fmt.Sprintf("key%d", i), "x")
+	}
+	db.DeleteString("a")
+	users, _ := db.Bucket("users")
+	users.PutString("alice", "admin")
+	db.Bucket("empty")
+
+	replica, err = OpenReplica(replicaFile, addr)
+	if err != nil {
+		t.Fatalf("Failed to reopen replica: %v", err)
+	}
+	defer replica.Close()
+
+	status := waitForReplica(t, replica, primary.Seq())
+	if status.Snapshots != 1 {
+		t.Errorf("Expected a snapshot bootstrap for a replica that fell behind, got %d", status.Snapshots)
+	}
+	if replica.DB().Count() != 5 {
+		t.Errorf("Expected 5 keys on replica, got %d", replica.DB().Count())
+	}
+	if replica.DB().ExistsString("a") {
+		t.Error("Key deleted on the primary should not survive the snapshot")
+	}
+	if got := fmt.Sprint(replica.DB().ListBuckets()); got != "[empty users]" {
+		t.Errorf("Expected buckets [empty users] from the snapshot, got %s", got)
+	}
+	if rusers, err := replica.DB().Bucket("users"); err != nil {
+		t.Errorf("Bucket failed on replica: %v", err)
+	} else if got, _ := rusers.GetString("alice"); got != "admin" {
+		t.Errorf("Expected alice to be admin after the snapshot, got %q", got)
+	}
+}
+
+func TestReplicationSnapshotDoesNotBlock(t *testing.T) {
+	dir := t.TempDir()
+	db, primary, addr := startPrimary(t, filepath.Join(dir, "primary.skv"), 0)
+	defer db.Close()
+	defer primary.Close()
+
+	// A snapshot much larger than the socket buffers
+	value := bytes.Repeat([]byte("x"), 256*1024)
+	for i := 0; i < 64; i++ {
+		db.Put([]byte(fmt.Sprintf("key%d", i)), value)
+	}
+
+	// A replica that never reads the snapshot
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	if err := writeReplHello(conn, [replLogIDSize]byte{}, 0); err != nil {
+		t.Fatalf("Failed to send hello: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- db.PutString("during", "snapshot")
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("A stalled snapshot blocked writes on the primary")
+	}
+}
+
+func TestReplicationInterruptedSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	replicaFile := filepath.Join(dir, "replica.skv")
+	db, err := Open(replicaFile)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	db.PutString("old", "value")
+	db.Close()
+
+	// A primary that drops the connection in the middle of a snapshot
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go func() {
+		conn, err := ln.Accept()
+		ln.Close()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, _, err := readReplHello(conn); err != nil {
+			return
+		}
+		writeReplHello(conn, [replLogIDSize]byte{1}, 5)
+		writeFrame(conn, frameSnapshotBegin, 5, "", nil, nil)
+		writeFrame(conn, frameSet, 5, "", []byte("new"), []byte("value"))
+		writeFrame(conn, frameCreateBucket, 5, "users", nil, nil)
+	}()
+
+	replica, err := OpenReplica(replicaFile, ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to open replica: %v", err)
+	}
+	defer replica.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for replica.Status().LastError == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if replica.Status().LastError == nil {
+		t.Fatal("Expected the dropped connection to be reported")
+	}
+
+	rdb := replica.DB()
+	if got, _ := rdb.GetString("old"); got != "value" || rdb.Count() != 1 {
+		t.Errorf("Expected the old data to stay until the snapshot completes, got %d keys", rdb.Count())
+	}
+	if len(rdb.ListBuckets()) != 0 {
+		t.Errorf("Expected no buckets from the incomplete snapshot, got %v", rdb.ListBuckets())
+	}
+	if _, err := os.Stat(replicaFile + ".snapshot.tmp"); !os.IsNotExist(err) {
+		t.Errorf("Expected the incomplete snapshot to be removed, got %v", err)
+	}
+}
+
+func TestReplicaRejectsWrites(t *testing.T) {
+	dir := t.TempDir()
+	db, primary, addr := startPrimary(t, filepath.Join(dir, "primary.skv"), 0)
+	defer db.Close()
+	defer primary.Close()
+	db.PutString("key", "primary")
+	db.Bucket("users")
+
+	replicaFile := filepath.Join(dir, "replica.skv")
+	for run := 0; run < 2; run++ {
+		replica, err := OpenReplica(replicaFile, addr)
+		if err != nil {
+			t.Fatalf("Failed to open replica: %v", err)
+		}
+		waitForReplica(t, replica, primary.Seq())
+
+		// Every modification is rejected, also after the replica restarts
+		rdb := replica.DB()
+		users, _ := rdb.Bucket("users")
+		checks := map[string]error{
+			"Put":      rdb.PutString("other", "x"),
+			"Set":      rdb.SetString("key", "replica"),
+			"Delete":   rdb.DeleteString("key"),
+			"WriteAt":  rdb.WriteAtString("key", 0, []byte("x")),
+			"Truncate": rdb.TruncateString("key", 1),
+			"Clear":    rdb.Clear(),
+			"Compact":  rdb.Compact(),
+		}
+		_, checks["Bucket"] = rdb.Bucket("new")
+		_, checks["CompareAndSwap"] = rdb.CompareAndSwap([]byte("key"), 0, []byte("x"))
+		checks["BucketPut"] = users.PutString("alice", "x")
+		for name, err := range checks {
+			if err != ErrReadOnly {
+				t.Errorf("Run %d, %s: expected ErrReadOnly, got %v", run, name, err)
+			}
+		}
+		if value, _ := rdb.GetString("key"); value != "primary" || rdb.Count() != 1 {
+			t.Errorf("Run %d: replica changed by rejected writes: %q, %d keys", run, value, rdb.Count())
+		}
+
+		// The replication stream still writes
+		db.SetString("key", fmt.Sprintf("primary %d", run))
+		waitForReplica(t, replica, primary.Seq())
+		if value, _ := rdb.GetString("key"); value != fmt.Sprintf("primary %d", run) {
+			t.Errorf("Run %d: replica didn't apply the primary's write, got %q", run, value)
+		}
+		db.SetString("key", "primary")
+		waitForReplica(t, replica, primary.Seq())
+		replica.Close()
+	}
+}
+
+func TestReplicationLag(t *testing.T) {
+	primaryFile := "test_repl_lag_primary.skv"
+	replicaFile := "test_repl_lag_replica.skv"
+	defer os.Remove(primaryFile)
+	defer removeReplicaFiles(replicaFile)
+
+	db, primary, addr := startPrimary(t, primaryFile, 0)
+	defer db.Close()
+	defer primary.Close()
+
+	replica, err := OpenReplica(replicaFile, addr)
+	if err != nil {
+		t.Fatalf("Failed to open replica: %v", err)
+	}
+	defer replica.Close()
+	waitForReplica(t, replica, 0)
+
+	// Stop the primary, the replica keeps its data and reports the disconnect
+	db.PutString("k", "v")
+	waitForReplica(t, replica, primary.Seq())
+	primary.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for replica.Status().Connected && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	status := replica.Status()
+	if status.Connected {
+		t.Error("Replica should report disconnected after the primary closed")
+	}
+	if status.AppliedSeq != 1 || status.Lag != 0 {
+		t.Errorf("Expected applied seq 1 with no lag, got %+v", status)
+	}
+	if status.LastContact.IsZero() {
+		t.Error("LastContact should be set")
+	}
+	if value, _ := replica.DB().GetString("k"); value != "v" {
+		t.Errorf("Expected replicated value to survive disconnect, got %q", value)
+	}
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	dbFile := "test_readonly.skv"
+	defer os.Remove(dbFile)
+
+	db, err := Open(dbFile)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	db.PutString("key", "value")
+	db.Close()
+
+	ro, err := OpenWithOptions(dbFile, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to open read-only: %v", err)
+	}
+	defer ro.Close()
+
+	if value, err := ro.GetString("key"); err != nil || value != "value" {
+		t.Errorf("Expected to read value, got %q (%v)", value, err)
+	}
+
+	if err := ro.PutString("other", "x"); err != ErrReadOnly {
+		t.Errorf("Put: expected ErrReadOnly, got %v", err)
+	}
+	if err := ro.UpdateString("key", "x"); err != ErrReadOnly {
+		t.Errorf("Update: expected ErrReadOnly, got %v", err)
+	}
+	if err := ro.DeleteString("key"); err != ErrReadOnly {
+		t.Errorf("Delete: expected ErrReadOnly, got %v", err)
+	}
+	if err := ro.Clear(); err != ErrReadOnly {
+		t.Errorf("Clear: expected ErrReadOnly, got %v", err)
+	}
+	if err := ro.PutBatchString(map[string]string{"a": "b"}); err != ErrReadOnly {
+		t.Errorf("PutBatch: expected ErrReadOnly, got %v", err)
+	}
+
+	// Nothing to compact, the file is closed all the same
+	if err := ro.CloseWithCompact(); err != nil {
+		t.Errorf("CloseWithCompact: expected nil, got %v", err)
+	}
+	if _, err := ro.GetString("key"); err != ErrClosed {
+		t.Errorf("Expected ErrClosed after CloseWithCompact, got %v", err)
+	}
+
+	// Read-only databases are never created
+	if _, err := OpenWithOptions("test_readonly_missing.skv", Options{ReadOnly: true}); err == nil {
+		os.Remove("test_readonly_missing.skv")
+		t.Error("Expected error opening a missing database read-only")
+	}
+}
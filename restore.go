@@ -0,0 +1,418 @@
+package skv
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// RestoreMode selects how a restore treats keys already in the database
+type RestoreMode int
+
+const (
+	// RestoreMerge overwrites keys present in the backup and keeps the others
+	// This is what Restore does
+	RestoreMerge RestoreMode = iota
+
+	// RestoreReplace makes the database hold exactly the backed-up keys:
+	// keys missing from the backup are removed. The new contents are written
+	// to a temporary file that replaces the database file only once complete,
+	// so a failed restore leaves the database untouched.
+	RestoreReplace
+
+	// RestoreSkipExisting only adds keys that don't exist yet
+	// Existing keys are never modified or removed
+	RestoreSkipExisting
+)
+
+// String returns the name of the restore mode
+func (m RestoreMode) String() string {
+	switch m {
+	case RestoreMerge:
+		return "merge"
+	case RestoreReplace:
+		return "replace"
+	case RestoreSkipExisting:
+		return "skip-existing"
+	default:
+		return fmt.Sprintf("RestoreMode(%d)", int(m))
+	}
+}
+
+// RestoreOptions configures RestoreWithOptions
+type RestoreOptions struct {
+	// Mode selects how existing keys are treated (default RestoreMerge)
+	Mode RestoreMode
+
+	// DryRun computes the report without modifying the database
+	DryRun bool
+
+	// KeyFilter limits the restore to the keys it returns true for
+	// Other keys are neither restored nor removed. nil selects every key.
+	KeyFilter func(key []byte) bool
+}
+
+// matches reports whether a key is selected by the key filter
+func (o RestoreOptions) matches(key []byte) bool {
+	return o.KeyFilter == nil || o.KeyFilter(key)
+}
+
+// RestoreReport lists the keys affected by a restore, each list sorted
+type RestoreReport struct {
+	Added       []string // Keys that didn't exist before
+	Overwritten []string // Existing keys replaced with the backed-up value
+	Skipped     []string // Existing keys left untouched (RestoreSkipExisting)
+	Removed     []string // Keys deleted because the backup doesn't contain them
+}
+
+// RestoreWithOptions loads key-value pairs from a backup chain (see Restore)
+// using the given mode and returns what changed, or with DryRun what would change.
+// The whole chain is checked before anything is applied.
+func (s *SKV) RestoreWithOptions(opts RestoreOptions, filenames ...string) (*RestoreReport, error) {
+	return s.RestoreWithOptionsContext(context.Background(), opts, filenames...)
+}
+
+// RestoreWithOptionsContext is RestoreWithOptions, stopping with the
+// context's error once ctx is done. The context is checked between records.
+// RestoreReplace leaves the database unchanged when cancelled; the other
+// modes write the keys one after the other and keep those restored so far.
+func (s *SKV) RestoreWithOptionsContext(ctx context.Context, opts RestoreOptions, filenames ...string) (*RestoreReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	if s.readOnly && !opts.DryRun {
+		return nil, ErrReadOnly
+	}
+
+	// Load and check every backup before touching the database
+	chain, err := loadBackupChain(filenames)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.restoreChain(ctx, chain, opts)
+}
+
+// restoreChain applies a checked backup chain
+// Must be called with the write lock held
+func (s *SKV) restoreChain(ctx context.Context, chain []*loadedBackup, opts RestoreOptions) (*RestoreReport, error) {
+	report, write, err := s.planRestore(ctx, chain, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.DryRun {
+		return report, nil
+	}
+	if err := s.checkRestore(chain, write, report.Removed); err != nil {
+		return nil, err
+	}
+
+	if opts.Mode == RestoreReplace {
+		staged, err := s.stageReplace(ctx, chain, write, report.Removed, opts)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.commitReplace(staged); err != nil {
+			return nil, err
+		}
+		return report, nil
+	}
+
+	// Merge and skip-existing write in place
+	for i, backup := range chain {
+		err := forEachBackupRecord(backup, func(key []byte, value io.Reader, size uint64) error {
+			if from, ok := write[string(key)]; !ok || from != i {
+				return nil
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return s.restoreRecord(key, value, size)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, keyStr := range report.Removed {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		key := []byte(keyStr)
+		if err := s.deleteInternal(key); err != nil {
+			return nil, fmt.Errorf("error removing key %q: %w", keyStr, err)
+		}
+		s.notify(opDelete, key, nil)
+	}
+
+	return report, nil
+}
+
+// planRestore works out the changes of a restore without applying them: the
+// report, and for each key to write the index in chain of the backup holding
+// its final value
+// Must be called with the lock held
+func (s *SKV) planRestore(ctx context.Context, chain []*loadedBackup, opts RestoreOptions) (*RestoreReport, map[string]int, error) {
+	if opts.Mode != RestoreMerge && opts.Mode != RestoreReplace && opts.Mode != RestoreSkipExisting {
+		return nil, nil, fmt.Errorf("unknown restore mode %v", opts.Mode)
+	}
+
+	// Resolve the final state described by the chain: which backup holds the
+	// last value of each key, and which keys end up deleted
+	source := make(map[string]int)
+	deleted := make(map[string]bool)
+	for i, backup := range chain {
+		err := forEachBackupRecord(backup, func(key []byte, value io.Reader, size uint64) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if opts.matches(key) {
+				source[string(key)] = i
+				delete(deleted, string(key))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, keyStr := range backup.deleted {
+			if opts.matches([]byte(keyStr)) {
+				delete(source, keyStr)
+				deleted[keyStr] = true
+			}
+		}
+	}
+
+	// Plan the changes
+	report := &RestoreReport{
+		Added:       make([]string, 0),
+		Overwritten: make([]string, 0),
+		Skipped:     make([]string, 0),
+		Removed:     make([]string, 0),
+	}
+	write := make(map[string]int)
+	for keyStr, i := range source {
+		_, exists := s.cache.get(keyStr)
+		switch {
+		case !exists:
+			report.Added = append(report.Added, keyStr)
+		case opts.Mode == RestoreSkipExisting:
+			report.Skipped = append(report.Skipped, keyStr)
+			continue
+		default:
+			report.Overwritten = append(report.Overwritten, keyStr)
+		}
+		write[keyStr] = i
+	}
+	err := s.cache.each(func(keyStr string, position int64) error {
+		if _, restored := source[keyStr]; restored || !opts.matches([]byte(keyStr)) {
+			return nil
+		}
+		if opts.Mode == RestoreReplace || (opts.Mode == RestoreMerge && deleted[keyStr]) {
+			report.Removed = append(report.Removed, keyStr)
+		} else if opts.Mode == RestoreSkipExisting && deleted[keyStr] {
+			report.Skipped = append(report.Skipped, keyStr)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(report.Added)
+	sort.Strings(report.Overwritten)
+	sort.Strings(report.Skipped)
+	sort.Strings(report.Removed)
+
+	return report, write, nil
+}
+
+// checkRestore checks the limits for writing the keys in write from the
+// chain and removing the keys in removed, before anything is applied
+// Must be called with the write lock held
+func (s *SKV) checkRestore(chain []*loadedBackup, write map[string]int, removed []string) error {
+	limits := s.newLimitCheck()
+	if limits == nil {
+		return nil
+	}
+	for i, backup := range chain {
+		err := forEachBackupRecord(backup, func(key []byte, value io.Reader, size uint64) error {
+			if from, ok := write[string(key)]; !ok || from != i {
+				return nil
+			}
+			return limits.put(key, nil, size)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, keyStr := range removed {
+		if err := limits.remove([]byte(keyStr)); err != nil {
+			return err
+		}
+	}
+	return limits.check()
+}
+
+// stagedReplace is a RestoreReplace written to a temporary file, waiting
+// for commitReplace to rename it over the database file
+type stagedReplace struct {
+	tmp            *SKV
+	indexPositions map[string]int64 // Positions of the index definitions in tmp
+	write          map[string]int   // Keys restored from the chain
+	removed        []string         // Keys removed by the restore
+}
+
+// discard removes the temporary file of a restore that won't be committed
+func (st *stagedReplace) discard() {
+	st.tmp.cache.close()
+	st.tmp.file.Close()
+	os.Remove(st.tmp.filePath)
+}
+
+// stageReplace rebuilds the database in a temporary file holding the keys
+// outside the filter and the keys in write. The database is left unchanged,
+// commitReplace swaps the file in, discard drops it.
+// Must be called with the write lock held
+func (s *SKV) stageReplace(ctx context.Context, chain []*loadedBackup, write map[string]int, removed []string, opts RestoreOptions) (*stagedReplace, error) {
+	tmpPath := s.filePath + ".restore.tmp"
+	file, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error creating temporary file: %w", err)
+	}
+	keys, err := s.scratchKeys()
+	if err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	staged := &stagedReplace{
+		tmp: &SKV{
+			file:      file,
+			filePath:  tmpPath,
+			cache:     keys,
+			freeSpace: make([]FreeSpace, 0),
+			revision:  s.revision,
+		},
+		write:   write,
+		removed: removed,
+	}
+	if err := s.writeReplace(ctx, staged, chain, opts); err != nil {
+		staged.discard()
+		return nil, err
+	}
+	return staged, nil
+}
+
+// writeReplace writes the records of a staged restore to its temporary file
+// Must be called with the write lock held
+func (s *SKV) writeReplace(ctx context.Context, staged *stagedReplace, chain []*loadedBackup, opts RestoreOptions) error {
+	tmp, write := staged.tmp, staged.write
+	if err := tmp.writeHeader(); err != nil {
+		return err
+	}
+
+	// Keys outside the filter are carried over unchanged
+	err := s.cache.each(func(keyStr string, position int64) error {
+		if opts.matches([]byte(keyStr)) {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		h, value, err := s.recordDataAt(position)
+		if err != nil {
+			return fmt.Errorf("error reading record for key %q: %w", keyStr, err)
+		}
+		recordPos, err := tmp.writeRecordStream(h.key, &h.meta, value, h.dataSize)
+		if err != nil {
+			return fmt.Errorf("error copying key %q: %w", keyStr, err)
+		}
+		return tmp.cache.set(keyStr, recordPos)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Backups only hold the default keyspace, buckets are carried over too
+	if err := s.copyBuckets(tmp); err != nil {
+		return err
+	}
+	// The indexes keep their positions in the database file until the
+	// temporary file replaces it
+	staged.indexPositions = make(map[string]int64, len(s.indexes))
+	for name, idx := range s.indexes {
+		position, err := s.copyRecord(tmp, idx.position)
+		if err != nil {
+			return fmt.Errorf("error copying definition of index %q: %w", name, err)
+		}
+		staged.indexPositions[name] = position
+	}
+
+	for i, backup := range chain {
+		err := forEachBackupRecord(backup, func(key []byte, value io.Reader, size uint64) error {
+			if from, ok := write[string(key)]; !ok || from != i {
+				return nil
+			}
+			recordPos, err := tmp.writeRecordStreamContext(ctx, key, nil, value, size)
+			if err != nil {
+				return fmt.Errorf("error restoring key %q: %w", key, err)
+			}
+			if err := tmp.cache.set(string(key), recordPos); err != nil {
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tmp.file.Sync(); err != nil {
+		return fmt.Errorf("error syncing temporary file: %w", err)
+	}
+	return nil
+}
+
+// commitReplace renames the temporary file of a staged restore over the
+// database file and reports the changes. If the rename fails the restore is
+// discarded and the database left unchanged.
+// Must be called with the write lock held
+func (s *SKV) commitReplace(staged *stagedReplace) error {
+	tmp := staged.tmp
+	if err := os.Rename(tmp.filePath, s.filePath); err != nil {
+		staged.discard()
+		return fmt.Errorf("error replacing database file: %w", err)
+	}
+
+	// The renamed file stays open and becomes the database file
+	s.file.Close()
+	s.file = tmp.file
+	if err := s.replaceKeys(tmp.cache); err != nil {
+		return err
+	}
+	s.freeSpace = tmp.freeSpace
+	s.revision = tmp.revision
+	s.buckets = tmp.buckets
+	for name, position := range staged.indexPositions {
+		s.indexes[name].position = position
+	}
+	s.invalidateAllReaders()
+	s.values.purge()
+	s.prefixUsage = nil
+
+	for _, keyStr := range staged.removed {
+		s.notify(opDelete, []byte(keyStr), nil)
+	}
+	for keyStr := range staged.write {
+		position, _ := s.cache.get(keyStr)
+		if err := s.notifyStream([]byte(keyStr), position); err != nil {
+			return err
+		}
+	}
+	return nil
+}
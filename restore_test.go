@@ -0,0 +1,231 @@
+package skv
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// setupRestoreTest creates a backup of {a, b, c} and a target database
+// holding {a (different value), d, tmp:x}
+func setupRestoreTest(t *testing.T, name string) (*SKV, string) {
+	t.Helper()
+
+	srcFile := "test_restore_" + name + "_src.skv"
+	dstFile := "test_restore_" + name + ".skv"
+	backupFile := "test_restore_" + name + ".json"
+	t.Cleanup(func() {
+		os.Remove(srcFile)
+		os.Remove(dstFile)
+		os.Remove(backupFile)
+	})
+
+	src, err := Open(srcFile)
+	if err != nil {
+		t.Fatalf("Failed to open source database: %v", err)
+	}
+	src.PutString("a", "backup a")
+	src.PutString("b", "backup b")
+	src.PutString("c", "backup c")
+	if err := src.Backup(backupFile); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	src.Close()
+
+	db, err := Open(dstFile)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.PutString("a", "local a")
+	db.PutString("d", "local d")
+	db.PutString("tmp:x", "local x")
+
+	return db, backupFile
+}
+
+// dumpStrings returns all key-value pairs as strings
+func dumpStrings(db *SKV) map[string]string {
+	result := make(map[string]string)
+	db.ForEachString(func(key string, value string) error {
+		result[key] = value
+		return nil
+	})
+	return result
+}
+
+func TestRestoreModes(t *testing.T) {
+	tests := []struct {
+		mode     RestoreMode
+		report   RestoreReport
+		expected map[string]string
+	}{
+		{
+			mode: RestoreMerge,
+			report: RestoreReport{
+				Added: []string{"b", "c"}, Overwritten: []string{"a"},
+				Skipped: []string{}, Removed: []string{},
+			},
+			expected: map[string]string{"a": "backup a", "b": "backup b", "c": "backup c", "d": "local d", "tmp:x": "local x"},
+		},
+		{
+			mode: RestoreSkipExisting,
+			report: RestoreReport{
+				Added: []string{"b", "c"}, Overwritten: []string{},
+				Skipped: []string{"a"}, Removed: []string{},
+			},
+			expected: map[string]string{"a": "local a", "b": "backup b", "c": "backup c", "d": "local d", "tmp:x": "local x"},
+		},
+		{
+			mode: RestoreReplace,
+			report: RestoreReport{
+				Added: []string{"b", "c"}, Overwritten: []string{"a"},
+				Skipped: []string{}, Removed: []string{"d", "tmp:x"},
+			},
+			expected: map[string]string{"a": "backup a", "b": "backup b", "c": "backup c"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode.String(), func(t *testing.T) {
+			db, backupFile := setupRestoreTest(t, tt.mode.String())
+			before := dumpStrings(db)
+
+			// A dry run reports the same changes without applying them
+			dry, err := db.RestoreWithOptions(RestoreOptions{Mode: tt.mode, DryRun: true}, backupFile)
+			if err != nil {
+				t.Fatalf("Dry run failed: %v", err)
+			}
+			if !reflect.DeepEqual(*dry, tt.report) {
+				t.Errorf("Dry run report: expected %+v, got %+v", tt.report, *dry)
+			}
+			if !reflect.DeepEqual(dumpStrings(db), before) {
+				t.Error("Dry run must not modify the database")
+			}
+
+			report, err := db.RestoreWithOptions(RestoreOptions{Mode: tt.mode}, backupFile)
+			if err != nil {
+				t.Fatalf("Restore failed: %v", err)
+			}
+			if !reflect.DeepEqual(*report, tt.report) {
+				t.Errorf("Report: expected %+v, got %+v", tt.report, *report)
+			}
+			if got := dumpStrings(db); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+
+			// The database still works and survives a reopen
+			if err := db.PutString("after", "restore"); err != nil {
+				t.Errorf("Put after restore failed: %v", err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+			reopened, err := Open(db.filePath)
+			if err != nil {
+				t.Fatalf("Failed to reopen: %v", err)
+			}
+			defer reopened.Close()
+			tt.expected["after"] = "restore"
+			if got := dumpStrings(reopened); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("After reopen: expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestRestoreKeyFilter(t *testing.T) {
+	db, backupFile := setupRestoreTest(t, "filter")
+
+	// Replace only the keys that don't start with "tmp:"
+	report, err := db.RestoreWithOptions(RestoreOptions{
+		Mode:      RestoreReplace,
+		KeyFilter: func(key []byte) bool { return !strings.HasPrefix(string(key), "tmp:") },
+	}, backupFile)
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	if !reflect.DeepEqual(report.Removed, []string{"d"}) {
+		t.Errorf("Expected only d removed, got %v", report.Removed)
+	}
+	expected := map[string]string{"a": "backup a", "b": "backup b", "c": "backup c", "tmp:x": "local x"}
+	if got := dumpStrings(db); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
+
+func TestRestoreReplaceAtomic(t *testing.T) {
+	db, backupFile := setupRestoreTest(t, "atomic")
+	before := dumpStrings(db)
+
+	// Make the temporary file impossible to create
+	tmpPath := db.filePath + ".restore.tmp"
+	if err := os.Mkdir(tmpPath, 0755); err != nil {
+		t.Fatalf("Failed to create blocking directory: %v", err)
+	}
+	defer os.Remove(tmpPath)
+
+	if _, err := db.RestoreWithOptions(RestoreOptions{Mode: RestoreReplace}, backupFile); err == nil {
+		t.Fatal("Expected replace to fail")
+	}
+	if got := dumpStrings(db); !reflect.DeepEqual(got, before) {
+		t.Errorf("Failed replace must leave the database unchanged, got %v", got)
+	}
+}
+
+// countdownContext reports itself canceled once Err has been called n times
+type countdownContext struct {
+	context.Context
+	n int
+}
+
+func (c *countdownContext) Err() error {
+	c.n--
+	if c.n < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestRestoreReplaceCancelKeepsIndexes(t *testing.T) {
+	db, backupFile := setupRestoreTest(t, "cancel")
+	if err := db.CreateFieldIndex("by-name", "name"); err != nil {
+		t.Fatalf("CreateFieldIndex failed: %v", err)
+	}
+	position := db.indexes["by-name"].position
+	before := dumpStrings(db)
+
+	// Cancel at every point of the restore until it gets through
+	for n := 0; ; n++ {
+		ctx := &countdownContext{Context: context.Background(), n: n}
+		_, err := db.RestoreWithOptionsContext(ctx, RestoreOptions{Mode: RestoreReplace}, backupFile)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Expected context.Canceled, got %v", err)
+		}
+		if got := db.indexes["by-name"].position; got != position {
+			t.Fatalf("Cancelled restore moved the index definition from %d to %d", position, got)
+		}
+		if got := dumpStrings(db); !reflect.DeepEqual(got, before) {
+			t.Fatalf("Cancelled restore must leave the database unchanged, got %v", got)
+		}
+	}
+
+	// The definition record is the one DropIndex deletes
+	if err := db.DropIndex("by-name"); err != nil {
+		t.Fatalf("DropIndex failed: %v", err)
+	}
+	want := map[string]string{"a": "backup a", "b": "backup b", "c": "backup c"}
+	if got := dumpStrings(db); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v after DropIndex, got %v", want, got)
+	}
+	if findings, err := db.VerifyDeep(); err != nil || len(findings) != 0 {
+		t.Errorf("Expected a healthy database, got %v (%v)", findings, err)
+	}
+}
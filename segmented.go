@@ -0,0 +1,640 @@
+package skv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Segmented databases
+//
+// A segmented database is a directory of size-capped segment files named
+// segment-000001.skv, segment-000002.skv, ... Each segment is an ordinary
+// database. New records only go to the active segment, the one with the
+// highest number; once it reaches MaxSegmentSize a new segment is started and
+// the previous one is sealed. Records of a sealed segment are never rewritten
+// in place: updating a key writes the new record to the active segment before
+// the old one is marked deleted, so a key found in several segments after a
+// crash belongs to the newest of them.
+//
+// Deleted records make up the garbage of a segment. Merge rewrites the live
+// records of the sealed segments with the most garbage into the active
+// segment and removes their files, instead of rewriting the whole database
+// like Compact does for a single file.
+
+const (
+	// DefaultMaxSegmentSize is the size of a segment before it's sealed
+	DefaultMaxSegmentSize = 64 * 1024 * 1024
+	// DefaultMergeThreshold is the percentage of garbage of a sealed segment
+	// above which Merge rewrites it
+	DefaultMergeThreshold = 50.0
+)
+
+// SegmentOptions configures a segmented database
+type SegmentOptions struct {
+	Options                      // Options every segment is opened with
+	MaxSegmentSize int64         // Size at which the active segment is sealed, DefaultMaxSegmentSize if 0
+	MergeThreshold float64       // Percentage of garbage to merge a segment, DefaultMergeThreshold if 0
+	MergeInterval  time.Duration // Interval of the background merge, disabled if 0
+}
+
+// SegmentedSKV is a database stored as a directory of segment files
+// It offers the key/value API of the default keyspace and is safe for
+// concurrent use. Writes are serialized across segments.
+type SegmentedSKV struct {
+	dir      string
+	opts     SegmentOptions
+	mu       sync.RWMutex
+	segments []*segment // Oldest first, the last one is active
+	shadowed int        // Keys superseded by a newer segment, read-only only
+
+	stop     chan struct{}
+	merging  sync.WaitGroup
+	mergeErr error // First error of the background merge
+	closed   bool  // Set by Close
+}
+
+// segment is one file of a segmented database
+type segment struct {
+	id int
+	db *SKV
+}
+
+// SegmentedStats contains the statistics of a segmented database
+type SegmentedStats struct {
+	Stats                   // Totals across all segments
+	Segments []SegmentStats // Statistics of every segment, oldest first
+}
+
+// SegmentStats contains the statistics of one segment
+type SegmentStats struct {
+	ID     int  // Number of the segment
+	Active bool // Whether new records go to the segment
+	*Stats
+}
+
+// segmentFileName returns the file name of segment id
+func segmentFileName(id int) string {
+	return fmt.Sprintf("segment-%06d.skv", id)
+}
+
+// listSegments returns the numbers of the segment files in dir, in order
+func listSegments(dir string) ([]int, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "segment-*.skv"))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0, len(matches))
+	for _, match := range matches {
+		var id int
+		if _, err := fmt.Sscanf(filepath.Base(match), "segment-%06d.skv", &id); err != nil || id <= 0 {
+			return nil, fmt.Errorf("unexpected segment file %s", match)
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// IsSegmented reports whether dir holds a segmented database
+func IsSegmented(dir string) bool {
+	ids, err := listSegments(dir)
+	return err == nil && len(ids) > 0
+}
+
+// OpenSegmented opens or creates a segmented database in the directory dir
+// Keys left in several segments by an interrupted write or merge are removed
+// from all but the newest one, unless the database is opened read-only.
+func OpenSegmented(dir string, opts SegmentOptions) (*SegmentedSKV, error) {
+	if opts.MaxSegmentSize <= 0 {
+		opts.MaxSegmentSize = DefaultMaxSegmentSize
+	}
+	if opts.MergeThreshold <= 0 {
+		opts.MergeThreshold = DefaultMergeThreshold
+	}
+
+	ids, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		if opts.ReadOnly {
+			return nil, fmt.Errorf("no segments in %s", dir)
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("error creating directory %s: %w", dir, err)
+		}
+		ids = []int{1}
+	}
+
+	db := &SegmentedSKV{dir: dir, opts: opts, segments: make([]*segment, 0, len(ids))}
+	for _, id := range ids {
+		if err := db.openSegment(id); err != nil {
+			db.closeSegments()
+			return nil, err
+		}
+	}
+	if err := db.removeShadowed(); err != nil {
+		db.closeSegments()
+		return nil, err
+	}
+
+	if opts.MergeInterval > 0 && !opts.ReadOnly {
+		db.stop = make(chan struct{})
+		db.merging.Add(1)
+		go db.mergeLoop()
+	}
+	return db, nil
+}
+
+// openSegment opens or creates segment id and appends it to the segments
+func (db *SegmentedSKV) openSegment(id int) error {
+	sdb, err := OpenWithOptions(filepath.Join(db.dir, segmentFileName(id)), db.opts.Options)
+	if err != nil {
+		return fmt.Errorf("error opening segment %d: %w", id, err)
+	}
+	db.segments = append(db.segments, &segment{id: id, db: sdb})
+	return nil
+}
+
+// removeShadowed deletes the keys of a segment that a newer segment also
+// holds, or counts them if the database is read-only
+func (db *SegmentedSKV) removeShadowed() error {
+	for _, seg := range db.segments[:len(db.segments)-1] {
+		keys, err := seg.db.KeysString()
+		if err != nil {
+			return fmt.Errorf("segment %d: %w", seg.id, err)
+		}
+		for _, key := range keys {
+			if db.find([]byte(key)) == seg {
+				continue
+			}
+			if db.opts.ReadOnly {
+				db.shadowed++
+				continue
+			}
+			if err := seg.db.DeleteString(key); err != nil {
+				return fmt.Errorf("segment %d: error removing superseded key %q: %w", seg.id, key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// active returns the segment new records go to
+// Must be called with the lock held
+func (db *SegmentedSKV) active() *segment {
+	return db.segments[len(db.segments)-1]
+}
+
+// find returns the newest segment holding a key, nil if there is none
+// Must be called with the lock held
+func (db *SegmentedSKV) find(key []byte) *segment {
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		if db.segments[i].db.Exists(key) {
+			return db.segments[i]
+		}
+	}
+	return nil
+}
+
+// rollover seals the active segment once it reaches the maximum size
+// Must be called with the write lock held
+func (db *SegmentedSKV) rollover() error {
+	size, err := db.active().db.fileSize()
+	if err != nil {
+		return err
+	}
+	if size < db.opts.MaxSegmentSize {
+		return nil
+	}
+	return db.openSegment(db.active().id + 1)
+}
+
+// write stores the value of a key found in seg, or a new key if seg is nil
+// The old record is deleted only once the new one is written.
+// Must be called with the write lock held
+func (db *SegmentedSKV) write(seg *segment, key []byte, data []byte) error {
+	active := db.active()
+	switch seg {
+	case nil:
+		if err := active.db.Put(key, data); err != nil {
+			return err
+		}
+	case active:
+		if err := active.db.Update(key, data); err != nil {
+			return err
+		}
+	default:
+		if err := active.db.Put(key, data); err != nil {
+			return err
+		}
+		if err := seg.db.Delete(key); err != nil {
+			return fmt.Errorf("segment %d: %w", seg.id, err)
+		}
+	}
+	return db.rollover()
+}
+
+// Segments returns the number of segments
+func (db *SegmentedSKV) Segments() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return len(db.segments)
+}
+
+// Put stores a new key-value pair
+// Returns ErrKeyExists if the key already exists in any segment
+func (db *SegmentedSKV) Put(key []byte, data []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.find(key) != nil {
+		return ErrKeyExists
+	}
+	return db.write(nil, key, data)
+}
+
+// Update replaces the value of an existing key
+// Returns ErrKeyNotFound if the key doesn't exist
+func (db *SegmentedSKV) Update(key []byte, data []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	seg := db.find(key)
+	if seg == nil {
+		return ErrKeyNotFound
+	}
+	return db.write(seg, key, data)
+}
+
+// Set stores a key, creating it or replacing its value
+func (db *SegmentedSKV) Set(key []byte, data []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.write(db.find(key), key, data)
+}
+
+// Delete deletes a key
+// Returns ErrKeyNotFound if the key doesn't exist
+func (db *SegmentedSKV) Delete(key []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	seg := db.find(key)
+	if seg == nil {
+		return ErrKeyNotFound
+	}
+	return seg.db.Delete(key)
+}
+
+// Get retrieves the value of a key
+// Returns ErrKeyNotFound if the key doesn't exist
+func (db *SegmentedSKV) Get(key []byte) ([]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	seg := db.find(key)
+	if seg == nil {
+		return nil, ErrKeyNotFound
+	}
+	return seg.db.Get(key)
+}
+
+// Exists checks if a key exists
+func (db *SegmentedSKV) Exists(key []byte) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.find(key) != nil
+}
+
+// Count returns the number of keys
+func (db *SegmentedSKV) Count() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	count := -db.shadowed
+	for _, seg := range db.segments {
+		count += seg.db.Count()
+	}
+	return count
+}
+
+// Keys returns all keys, sorted
+func (db *SegmentedSKV) Keys() ([][]byte, error) {
+	keys, err := db.KeysString()
+	return toByteKeys(keys), err
+}
+
+// ForEach calls fn for every key-value pair, one segment after the other
+// The database is locked while the keys are visited, fn must not modify it.
+func (db *SegmentedSKV) ForEach(fn func(key []byte, value []byte) error) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for _, seg := range db.segments {
+		err := seg.db.ForEach(func(key []byte, value []byte) error {
+			if db.shadowed > 0 && db.find(key) != seg {
+				return nil
+			}
+			return fn(key, value)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Merge rewrites the sealed segments whose garbage reaches MergeThreshold,
+// those with the most garbage first, and returns how many were merged
+// Their live records are copied to the active segment, then their files
+// are removed.
+func (db *SegmentedSKV) Merge() (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.merge(db.opts.MergeThreshold)
+}
+
+// merge rewrites the sealed segments with at least threshold percent of
+// garbage, see Merge
+// Must be called with the write lock held
+func (db *SegmentedSKV) merge(threshold float64) (int, error) {
+	if db.opts.ReadOnly {
+		return 0, ErrReadOnly
+	}
+
+	type candidate struct {
+		seg     *segment
+		garbage float64
+	}
+	candidates := make([]candidate, 0)
+	for _, seg := range db.segments[:len(db.segments)-1] {
+		garbage, err := seg.db.garbagePercent()
+		if err != nil {
+			return 0, fmt.Errorf("segment %d: %w", seg.id, err)
+		}
+		if garbage > 0 && garbage >= threshold {
+			candidates = append(candidates, candidate{seg, garbage})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].garbage > candidates[j].garbage })
+
+	for i, c := range candidates {
+		if err := db.mergeSegment(c.seg); err != nil {
+			return i, fmt.Errorf("error merging segment %d: %w", c.seg.id, err)
+		}
+	}
+	return len(candidates), nil
+}
+
+// mergeSegment copies the keys of a sealed segment to the active segment and
+// removes the sealed one
+// Each key is deleted from the sealed segment once copied, as write does, so
+// a merge that fails partway leaves every key in a single segment.
+// Must be called with the write lock held
+func (db *SegmentedSKV) mergeSegment(seg *segment) error {
+	keys, err := seg.db.KeysString()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := seg.db.copyKeyTo(db.active().db, key); err != nil {
+			return err
+		}
+		if err := seg.db.DeleteString(key); err != nil {
+			return fmt.Errorf("segment %d: %w", seg.id, err)
+		}
+		if err := db.rollover(); err != nil {
+			return err
+		}
+	}
+
+	for i, s := range db.segments {
+		if s == seg {
+			db.segments = append(db.segments[:i], db.segments[i+1:]...)
+			break
+		}
+	}
+	path := seg.db.filePath
+	if err := seg.db.Close(); err != nil {
+		return err
+	}
+	if err := os.Remove(path + ".idx"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// mergeLoop runs Merge every MergeInterval until the database is closed
+func (db *SegmentedSKV) mergeLoop() {
+	defer db.merging.Done()
+
+	ticker := time.NewTicker(db.opts.MergeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.stop:
+			return
+		case <-ticker.C:
+			db.mu.Lock()
+			if _, err := db.merge(db.opts.MergeThreshold); err != nil && db.mergeErr == nil {
+				db.mergeErr = err
+			}
+			db.mu.Unlock()
+		}
+	}
+}
+
+// Compact merges every sealed segment holding garbage and compacts the
+// active segment
+func (db *SegmentedSKV) Compact() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, err := db.merge(0); err != nil {
+		return err
+	}
+	return db.active().db.Compact()
+}
+
+// Verify checks every segment and returns their statistics with the totals
+func (db *SegmentedSKV) Verify() (*SegmentedStats, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	stats := &SegmentedStats{Segments: make([]SegmentStats, len(db.segments))}
+	parts := make([]*Stats, len(db.segments))
+	for i, seg := range db.segments {
+		segStats, err := seg.db.Verify()
+		if err != nil {
+			return nil, fmt.Errorf("segment %d: %w", seg.id, err)
+		}
+		stats.Segments[i] = SegmentStats{ID: seg.id, Active: i == len(db.segments)-1, Stats: segStats}
+		parts[i] = segStats
+	}
+	sumStats(&stats.Stats, parts)
+	return stats, nil
+}
+
+// Close stops the background merge and closes every segment
+// Returns the first error of the background merge, if any. Closing a closed
+// database does nothing.
+func (db *SegmentedSKV) Close() error {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return nil
+	}
+	db.closed = true
+	db.mu.Unlock()
+
+	// The merge takes the lock, it is stopped without holding it
+	if db.stop != nil {
+		close(db.stop)
+		db.merging.Wait()
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return errors.Join(db.mergeErr, db.closeSegments())
+}
+
+// closeSegments closes every segment
+func (db *SegmentedSKV) closeSegments() error {
+	errs := make([]error, 0)
+	for _, seg := range db.segments {
+		errs = append(errs, seg.db.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// String-based convenience functions
+
+// PutString stores a new key-value pair using strings
+func (db *SegmentedSKV) PutString(key string, value string) error {
+	return db.Put([]byte(key), []byte(value))
+}
+
+// GetString retrieves the value for a key using strings
+func (db *SegmentedSKV) GetString(key string) (string, error) {
+	value, err := db.Get([]byte(key))
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// UpdateString updates an existing key using strings
+func (db *SegmentedSKV) UpdateString(key string, value string) error {
+	return db.Update([]byte(key), []byte(value))
+}
+
+// SetString stores a key using strings, creating it or replacing its value
+func (db *SegmentedSKV) SetString(key string, value string) error {
+	return db.Set([]byte(key), []byte(value))
+}
+
+// DeleteString deletes a key using a string
+func (db *SegmentedSKV) DeleteString(key string) error {
+	return db.Delete([]byte(key))
+}
+
+// ExistsString checks if a key exists using a string
+func (db *SegmentedSKV) ExistsString(key string) bool {
+	return db.Exists([]byte(key))
+}
+
+// KeysString returns all keys as strings, sorted
+func (db *SegmentedSKV) KeysString() ([]string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	keys := make([]string, 0)
+	for _, seg := range db.segments {
+		segKeys, err := seg.db.KeysString()
+		if err != nil {
+			return nil, fmt.Errorf("segment %d: %w", seg.id, err)
+		}
+		for _, key := range segKeys {
+			if db.shadowed == 0 || db.find([]byte(key)) == seg {
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// ForEachString iterates over all key-value pairs as strings, see ForEach
+func (db *SegmentedSKV) ForEachString(fn func(key string, value string) error) error {
+	return db.ForEach(func(key []byte, value []byte) error {
+		return fn(string(key), string(value))
+	})
+}
+
+// fileSize returns the size of the database file
+func (s *SKV) fileSize() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	info, err := s.file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("error getting file info: %w", err)
+	}
+	return info.Size(), nil
+}
+
+// garbagePercent returns the percentage of the file taken by free space,
+// without reading the file
+// Free space covers deleted records and the padding that follows them.
+// Padding after live records isn't tracked and isn't counted.
+func (s *SKV) garbagePercent() (float64, error) {
+	size, err := s.fileSize()
+	if err != nil || size <= HeaderSize {
+		return 0, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var garbage uint64
+	for _, free := range s.freeSpace {
+		garbage += free.size
+	}
+	return float64(garbage) / float64(size-HeaderSize) * 100.0, nil
+}
+
+// copyKeyTo copies the record of a key of the default keyspace to dst,
+// keeping its metadata
+func (s *SKV) copyKeyTo(dst *SKV, key string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	position, exists := s.cache.get(key)
+	if !exists {
+		return ErrKeyNotFound
+	}
+
+	dst.mu.Lock()
+	defer dst.mu.Unlock()
+
+	if _, exists := dst.cache.get(key); exists {
+		return fmt.Errorf("key %q: %w", key, ErrKeyExists)
+	}
+	copied, err := s.copyRecord(dst, position)
+	if err != nil {
+		return fmt.Errorf("error copying key %q: %w", key, err)
+	}
+	dst.prefixUsage = nil
+	return dst.cache.set(key, copied)
+}
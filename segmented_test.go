@@ -0,0 +1,263 @@
+package skv
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// checkSegmented fails unless db holds exactly want
+func checkSegmented(t *testing.T, db *SegmentedSKV, want map[string]string) {
+	t.Helper()
+	if db.Count() != len(want) {
+		t.Errorf("Expected %d keys, got %d", len(want), db.Count())
+	}
+	keys, err := db.KeysString()
+	if err != nil || len(keys) != len(want) {
+		t.Errorf("Expected %d keys, got %d (%v)", len(want), len(keys), err)
+	}
+	for key, value := range want {
+		if got, err := db.GetString(key); err != nil || got != value {
+			t.Fatalf("Key %q: got %q (%v), want %q", key, got, err, value)
+		}
+	}
+}
+
+func TestSegmented(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db")
+	opts := SegmentOptions{MaxSegmentSize: 512}
+	db, err := OpenSegmented(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open segmented database: %v", err)
+	}
+
+	want := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		key, value := fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%d", i)
+		if err := db.PutString(key, value); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		want[key] = value
+	}
+	if db.Segments() < 5 {
+		t.Fatalf("Expected the database to roll over, got %d segments", db.Segments())
+	}
+	if err := db.PutString("key-000", "again"); err != ErrKeyExists {
+		t.Errorf("Expected ErrKeyExists for a key of a sealed segment, got %v", err)
+	}
+
+	// Rewrite most keys of the oldest segments
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+		if i%2 == 0 {
+			db.DeleteString(key)
+			delete(want, key)
+		} else {
+			db.UpdateString(key, "updated")
+			want[key] = "updated"
+		}
+	}
+	checkSegmented(t, db, want)
+
+	before, err := db.Verify()
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if len(before.Segments) != db.Segments() || !before.Segments[len(before.Segments)-1].Active {
+		t.Fatalf("Expected stats of %d segments, the last one active", db.Segments())
+	}
+	var active int
+	for _, seg := range before.Segments {
+		active += seg.ActiveRecords
+	}
+	if before.ActiveRecords != active || active != len(want) {
+		t.Errorf("Expected %d active records in total, got %d (sum %d)", len(want), before.ActiveRecords, active)
+	}
+
+	// Only the segments full of garbage are rewritten
+	merged, err := db.Merge()
+	if err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if merged == 0 {
+		t.Fatal("Expected segments to be merged")
+	}
+	after, _ := db.Verify()
+	if after.Segments[0].ID == before.Segments[0].ID {
+		t.Error("Expected the oldest segment to be merged")
+	}
+	if after.WastedSpace >= before.WastedSpace {
+		t.Errorf("Expected less wasted space after merging, %d before, %d after", before.WastedSpace, after.WastedSpace)
+	}
+	for _, seg := range after.Segments[:len(after.Segments)-1] {
+		if seg.WastedPercent >= DefaultMergeThreshold {
+			t.Errorf("Segment %d left with %.1f%% garbage", seg.ID, seg.WastedPercent)
+		}
+	}
+	checkSegmented(t, db, want)
+
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	checkSegmented(t, db, want)
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	db, err = OpenSegmented(dir, SegmentOptions{Options: Options{ReadOnly: true}})
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	checkSegmented(t, db, want)
+	if err := db.PutString("new", "x"); err != ErrReadOnly {
+		t.Errorf("Expected ErrReadOnly, got %v", err)
+	}
+}
+
+func TestSegmentedInterruptedWrite(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db")
+	db, err := OpenSegmented(dir, SegmentOptions{MaxSegmentSize: 64})
+	if err != nil {
+		t.Fatalf("Failed to open segmented database: %v", err)
+	}
+	db.PutString("a", "old value of a")
+	db.PutString("b", "old value of b")
+	db.Close()
+
+	// An update that stopped after writing the new record leaves the key in
+	// two segments
+	ids, _ := listSegments(dir)
+	if len(ids) < 2 {
+		t.Fatalf("Expected the keys in different segments, got %d segments", len(ids))
+	}
+	newest, err := Open(filepath.Join(dir, segmentFileName(ids[len(ids)-1])))
+	if err != nil {
+		t.Fatalf("Failed to open segment: %v", err)
+	}
+	newest.PutString("a", "new")
+	newest.Close()
+
+	db, err = OpenSegmented(dir, SegmentOptions{Options: Options{ReadOnly: true}})
+	if err != nil {
+		t.Fatalf("Failed to open read-only: %v", err)
+	}
+	checkSegmented(t, db, map[string]string{"a": "new", "b": "old value of b"})
+	db.Close()
+
+	db, err = OpenSegmented(dir, SegmentOptions{MaxSegmentSize: 64})
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	checkSegmented(t, db, map[string]string{"a": "new", "b": "old value of b"})
+	var records int
+	for _, seg := range db.segments {
+		records += seg.db.Count()
+	}
+	if records != 2 {
+		t.Errorf("Expected the superseded record to be removed, %d records left", records)
+	}
+}
+
+func TestSegmentedMergeFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db")
+	db, err := OpenSegmented(dir, SegmentOptions{MaxSegmentSize: 256})
+	if err != nil {
+		t.Fatalf("Failed to open segmented database: %v", err)
+	}
+	defer db.Close()
+
+	want := make(map[string]string)
+	for i := 0; i < 40; i++ {
+		key := fmt.Sprintf("key-%02d", i)
+		db.PutString(key, "some value")
+		want[key] = "some value"
+	}
+	for i := 0; i < 40; i += 4 {
+		key := fmt.Sprintf("key-%02d", i)
+		db.DeleteString(key)
+		delete(want, key)
+	}
+
+	// The next segment can't be created, the merge fails at the first
+	// rollover after copying some keys
+	ids, _ := listSegments(dir)
+	blocked := filepath.Join(dir, segmentFileName(ids[len(ids)-1]+1))
+	if err := os.Mkdir(blocked, 0755); err != nil {
+		t.Fatalf("Failed to create blocking directory: %v", err)
+	}
+	if err := db.Compact(); err == nil {
+		t.Fatal("Expected the merge to fail")
+	}
+
+	checkSegmented(t, db, want)
+	seen := make(map[string]int)
+	db.ForEachString(func(key string, value string) error {
+		seen[key]++
+		if seen[key] > 1 {
+			t.Errorf("Key %q visited twice", key)
+		}
+		return nil
+	})
+	if len(seen) != len(want) {
+		t.Errorf("Expected ForEach to visit %d keys, got %d", len(want), len(seen))
+	}
+
+	// Deleting a key leaves no older copy behind
+	for key := range want {
+		if err := db.DeleteString(key); err != nil {
+			t.Fatalf("Delete %q failed: %v", key, err)
+		}
+		if db.ExistsString(key) {
+			t.Errorf("Key %q is still there after Delete", key)
+		}
+	}
+
+	os.Remove(blocked)
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed once the segment can be created: %v", err)
+	}
+	checkSegmented(t, db, map[string]string{})
+}
+
+func TestSegmentedBackgroundMerge(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db")
+	db, err := OpenSegmented(dir, SegmentOptions{MaxSegmentSize: 256, MergeInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to open segmented database: %v", err)
+	}
+	for i := 0; i < 40; i++ {
+		db.PutString(fmt.Sprintf("key-%02d", i), "some value")
+	}
+	first, _ := listSegments(dir)
+	for i := 0; i < 20; i++ {
+		db.DeleteString(fmt.Sprintf("key-%02d", i))
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ids, _ := listSegments(dir)
+		if ids[0] != first[0] {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Background merge didn't remove the oldest segment")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if db.Count() != 20 {
+		t.Errorf("Expected 20 keys, got %d", db.Count())
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Errorf("Close isn't idempotent: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, segmentFileName(first[0]))); !os.IsNotExist(err) {
+		t.Errorf("Merged segment file not removed: %v", err)
+	}
+}
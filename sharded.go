@@ -0,0 +1,552 @@
+package skv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// ErrShardCount is returned when a sharded database has another number of
+// shards than requested, use Reshard to change it
+var ErrShardCount = errors.New("shard count mismatch")
+
+// ShardedSKV spreads keys across several .skv files by key hash
+// Every shard has its own file and lock, so writes to different shards run
+// in parallel. Shards are ordinary databases named shard-000.skv,
+// shard-001.skv, ... in the database directory, and only hold the default
+// keyspace of this API.
+type ShardedSKV struct {
+	dir    string
+	shards []*SKV
+}
+
+// ShardedStats contains the statistics of a sharded database
+type ShardedStats struct {
+	Stats           // Totals across all shards
+	Shards []*Stats // Statistics of every shard, in shard order
+}
+
+// shardFileName returns the file name of shard i
+func shardFileName(i int) string {
+	return fmt.Sprintf("shard-%03d.skv", i)
+}
+
+// countShards returns the number of shard files in dir
+// The shards must be numbered from 0 without gaps
+func countShards(dir string) (int, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "shard-*.skv"))
+	if err != nil {
+		return 0, err
+	}
+	for i := range matches {
+		if _, err := os.Stat(filepath.Join(dir, shardFileName(i))); err != nil {
+			return 0, fmt.Errorf("%w: %s has %d shard files but no %s", ErrShardCount, dir, len(matches), shardFileName(i))
+		}
+	}
+	return len(matches), nil
+}
+
+// OpenSharded opens or creates a database of n shards in the directory dir
+// n may be 0 to open an existing database with any number of shards.
+func OpenSharded(dir string, n int) (*ShardedSKV, error) {
+	return OpenShardedWithOptions(dir, n, Options{})
+}
+
+// OpenShardedWithOptions opens or creates a sharded database, opening every
+// shard with the given options
+func OpenShardedWithOptions(dir string, n int, opts Options) (*ShardedSKV, error) {
+	existing, err := countShards(dir)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case existing == 0 && n <= 0:
+		return nil, fmt.Errorf("no shards in %s, the number of shards must be positive", dir)
+	case existing > 0 && n > 0 && n != existing:
+		return nil, fmt.Errorf("%w: %s has %d shards, not %d", ErrShardCount, dir, existing, n)
+	case existing > 0:
+		n = existing
+	}
+	if existing == 0 && !opts.ReadOnly {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("error creating directory %s: %w", dir, err)
+		}
+	}
+
+	db := &ShardedSKV{dir: dir, shards: make([]*SKV, 0, n)}
+	for i := 0; i < n; i++ {
+		shard, err := OpenWithOptions(filepath.Join(dir, shardFileName(i)), opts)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("error opening shard %d: %w", i, err)
+		}
+		db.shards = append(db.shards, shard)
+	}
+	return db, nil
+}
+
+// Shards returns the number of shards
+func (db *ShardedSKV) Shards() int {
+	return len(db.shards)
+}
+
+// Shard returns the database of shard i
+func (db *ShardedSKV) Shard(i int) *SKV {
+	return db.shards[i]
+}
+
+// shardIndex returns the shard of a key among n shards
+func shardIndex(key []byte, n int) int {
+	return int(hashKey(string(key)) % uint64(n))
+}
+
+// shardFor returns the shard holding a key
+func (db *ShardedSKV) shardFor(key []byte) *SKV {
+	return db.shards[shardIndex(key, len(db.shards))]
+}
+
+// eachShard runs fn on every shard in parallel and joins the errors
+func (db *ShardedSKV) eachShard(fn func(i int, shard *SKV) error) error {
+	errs := make([]error, len(db.shards))
+	var wg sync.WaitGroup
+	for i, shard := range db.shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fn(i, shard); err != nil {
+				errs[i] = fmt.Errorf("shard %d: %w", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Put stores a new key-value pair, see SKV.Put
+func (db *ShardedSKV) Put(key []byte, data []byte) error {
+	return db.shardFor(key).Put(key, data)
+}
+
+// Get retrieves the value of a key, see SKV.Get
+func (db *ShardedSKV) Get(key []byte) ([]byte, error) {
+	return db.shardFor(key).Get(key)
+}
+
+// Update replaces the value of an existing key, see SKV.Update
+func (db *ShardedSKV) Update(key []byte, data []byte) error {
+	return db.shardFor(key).Update(key, data)
+}
+
+// Set stores a key, creating it or replacing its value, see SKV.Set
+func (db *ShardedSKV) Set(key []byte, data []byte) error {
+	return db.shardFor(key).Set(key, data)
+}
+
+// Delete deletes a key, see SKV.Delete
+func (db *ShardedSKV) Delete(key []byte) error {
+	return db.shardFor(key).Delete(key)
+}
+
+// Exists checks if a key exists
+func (db *ShardedSKV) Exists(key []byte) bool {
+	return db.shardFor(key).Exists(key)
+}
+
+// Count returns the number of keys in all shards
+func (db *ShardedSKV) Count() int {
+	count := 0
+	for _, shard := range db.shards {
+		count += shard.Count()
+	}
+	return count
+}
+
+// Keys returns the keys of all shards, sorted
+func (db *ShardedSKV) Keys() ([][]byte, error) {
+	keys, err := db.KeysString()
+	result := make([][]byte, len(keys))
+	for i, key := range keys {
+		result[i] = []byte(key)
+	}
+	return result, err
+}
+
+// ForEach calls fn for every key-value pair, one shard after the other
+// Each shard is locked while its keys are visited
+func (db *ShardedSKV) ForEach(fn func(key []byte, value []byte) error) error {
+	for _, shard := range db.shards {
+		if err := shard.ForEach(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compact compacts all shards in parallel
+func (db *ShardedSKV) Compact() error {
+	return db.eachShard(func(i int, shard *SKV) error {
+		return shard.Compact()
+	})
+}
+
+// Clear removes all keys from every shard
+func (db *ShardedSKV) Clear() error {
+	return db.eachShard(func(i int, shard *SKV) error {
+		return shard.Clear()
+	})
+}
+
+// Verify checks every shard in parallel and returns their statistics with
+// the totals
+func (db *ShardedSKV) Verify() (*ShardedStats, error) {
+	stats := &ShardedStats{Shards: make([]*Stats, len(db.shards))}
+	err := db.eachShard(func(i int, shard *SKV) error {
+		var err error
+		stats.Shards[i], err = shard.Verify()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sumStats(&stats.Stats, stats.Shards)
+	return stats, nil
+}
+
+// sumStats sets total to the sum of the statistics of several files, with
+// the percentages and averages of the whole
+func sumStats(total *Stats, parts []*Stats) {
+	var activeDataSize, totalKeySize, totalDataSize float64
+	for _, s := range parts {
+		total.TotalRecords += s.TotalRecords
+		total.ActiveRecords += s.ActiveRecords
+		total.DeletedRecords += s.DeletedRecords
+		total.FileSize += s.FileSize
+		total.HeaderSize += s.HeaderSize
+		total.DataSize += s.DataSize
+		total.WastedSpace += s.WastedSpace
+		total.PaddingBytes += s.PaddingBytes
+		activeDataSize += float64(s.DataSize - s.WastedSpace)
+		totalKeySize += s.AverageKeySize * float64(s.TotalRecords)
+		totalDataSize += s.AverageDataSize * float64(s.TotalRecords)
+	}
+	if usableSpace := total.FileSize - total.HeaderSize; usableSpace > 0 {
+		total.WastedPercent = float64(total.WastedSpace+total.PaddingBytes) / float64(usableSpace) * 100.0
+		total.Efficiency = activeDataSize / float64(usableSpace) * 100.0
+	}
+	if total.TotalRecords > 0 {
+		total.AverageKeySize = totalKeySize / float64(total.TotalRecords)
+		total.AverageDataSize = totalDataSize / float64(total.TotalRecords)
+	}
+}
+
+// Backup writes a full JSON backup of all shards to filename
+// The backup is an ordinary SKV backup, it can be restored into a sharded
+// database with any number of shards or into a single database. Shards are
+// read one after the other, so writes running meanwhile may be partly included.
+func (db *ShardedSKV) Backup(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("error creating backup file: %w", err)
+	}
+	defer file.Close()
+
+	if err := db.BackupJSONTo(file); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// BackupJSONTo writes a full JSON backup of all shards to w, see Backup
+func (db *ShardedSKV) BackupJSONTo(w io.Writer) error {
+	records := make([]BackupRecord, 0)
+	for i, shard := range db.shards {
+		shardRecords, err := shard.backupRecords(context.Background())
+		if err != nil {
+			return fmt.Errorf("shard %d: %w", i, err)
+		}
+		records = append(records, shardRecords...)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Key < records[j].Key })
+
+	doc := backupDocument{
+		Manifest: db.shards[0].newBackupManifest(BackupKindFull),
+		Records:  records,
+	}
+	if source, err := filepath.Abs(db.dir); err == nil {
+		doc.Manifest.Source = source
+	}
+	doc.Manifest.Records = len(records)
+
+	return writeBackupDocument(w, &doc)
+}
+
+// Restore loads a backup chain into the shards, see SKV.Restore
+func (db *ShardedSKV) Restore(filenames ...string) error {
+	_, err := db.RestoreWithOptions(RestoreOptions{}, filenames...)
+	return err
+}
+
+// RestoreWithOptions restores a backup chain into every shard in parallel,
+// each shard taking the keys it holds, see SKV.RestoreWithOptions
+// The reports of the shards are merged. RestoreReplace rebuilds every shard
+// in a temporary file and replaces the shards only once all of them are
+// rebuilt, so a failed restore leaves every shard unchanged. Only a failure
+// renaming the files into place can leave earlier shards replaced, the error
+// lists them.
+func (db *ShardedSKV) RestoreWithOptions(opts RestoreOptions, filenames ...string) (*RestoreReport, error) {
+	if opts.Mode == RestoreReplace && !opts.DryRun {
+		return db.restoreReplace(opts, filenames...)
+	}
+
+	reports := make([]*RestoreReport, len(db.shards))
+	err := db.eachShard(func(i int, shard *SKV) error {
+		var err error
+		reports[i], err = shard.RestoreWithOptions(db.shardRestoreOptions(i, opts), filenames...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mergeRestoreReports(reports), nil
+}
+
+// restoreReplace stages a RestoreReplace in every shard, then commits them
+func (db *ShardedSKV) restoreReplace(opts RestoreOptions, filenames ...string) (*RestoreReport, error) {
+	// Every shard stays locked until all are replaced, so no write lands
+	// between staging a shard and committing it
+	for _, shard := range db.shards {
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+	}
+	for i, shard := range db.shards {
+		if err := shard.checkWritable(); err != nil {
+			return nil, fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+
+	chain, err := loadBackupChain(filenames)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	reports := make([]*RestoreReport, len(db.shards))
+	staged := make([]*stagedReplace, len(db.shards))
+	err = db.eachShard(func(i int, shard *SKV) error {
+		shardOpts := db.shardRestoreOptions(i, opts)
+		report, write, err := shard.planRestore(ctx, chain, shardOpts)
+		if err != nil {
+			return err
+		}
+		if err := shard.checkRestore(chain, write, report.Removed); err != nil {
+			return err
+		}
+		reports[i] = report
+		staged[i], err = shard.stageReplace(ctx, chain, write, report.Removed, shardOpts)
+		return err
+	})
+	if err != nil {
+		for _, st := range staged {
+			if st != nil {
+				st.discard()
+			}
+		}
+		return nil, err
+	}
+
+	for i, shard := range db.shards {
+		if err := shard.commitReplace(staged[i]); err != nil {
+			for _, st := range staged[i+1:] {
+				st.discard()
+			}
+			if i == 0 {
+				return nil, fmt.Errorf("shard 0: %w", err)
+			}
+			return nil, fmt.Errorf("shard %d: %w (shards 0-%d were already replaced)", i, err, i-1)
+		}
+	}
+	return mergeRestoreReports(reports), nil
+}
+
+// shardRestoreOptions returns opts limited to the keys held by shard i
+func (db *ShardedSKV) shardRestoreOptions(i int, opts RestoreOptions) RestoreOptions {
+	shardOpts := opts
+	shardOpts.KeyFilter = func(key []byte) bool {
+		return shardIndex(key, len(db.shards)) == i && opts.matches(key)
+	}
+	return shardOpts
+}
+
+// mergeRestoreReports merges the reports of the shards into one
+func mergeRestoreReports(reports []*RestoreReport) *RestoreReport {
+	report := &RestoreReport{
+		Added:       make([]string, 0),
+		Overwritten: make([]string, 0),
+		Skipped:     make([]string, 0),
+		Removed:     make([]string, 0),
+	}
+	for _, r := range reports {
+		report.Added = append(report.Added, r.Added...)
+		report.Overwritten = append(report.Overwritten, r.Overwritten...)
+		report.Skipped = append(report.Skipped, r.Skipped...)
+		report.Removed = append(report.Removed, r.Removed...)
+	}
+	for _, keys := range [][]string{report.Added, report.Overwritten, report.Skipped, report.Removed} {
+		sort.Strings(keys)
+	}
+	return report
+}
+
+// Close closes every shard
+func (db *ShardedSKV) Close() error {
+	errs := make([]error, 0)
+	for _, shard := range db.shards {
+		errs = append(errs, shard.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// String-based convenience functions
+
+// PutString stores a new key-value pair using strings
+func (db *ShardedSKV) PutString(key string, value string) error {
+	return db.Put([]byte(key), []byte(value))
+}
+
+// GetString retrieves the value for a key using strings
+func (db *ShardedSKV) GetString(key string) (string, error) {
+	value, err := db.Get([]byte(key))
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// UpdateString updates an existing key using strings
+func (db *ShardedSKV) UpdateString(key string, value string) error {
+	return db.Update([]byte(key), []byte(value))
+}
+
+// SetString stores a key using strings, creating it or replacing its value
+func (db *ShardedSKV) SetString(key string, value string) error {
+	return db.Set([]byte(key), []byte(value))
+}
+
+// DeleteString deletes a key using a string
+func (db *ShardedSKV) DeleteString(key string) error {
+	return db.Delete([]byte(key))
+}
+
+// ExistsString checks if a key exists using a string
+func (db *ShardedSKV) ExistsString(key string) bool {
+	return db.Exists([]byte(key))
+}
+
+// KeysString returns the keys of all shards as strings, sorted
+func (db *ShardedSKV) KeysString() ([]string, error) {
+	keys := make([]string, 0)
+	for i, shard := range db.shards {
+		shardKeys, err := shard.KeysString()
+		if err != nil {
+			return nil, fmt.Errorf("shard %d: %w", i, err)
+		}
+		keys = append(keys, shardKeys...)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// ForEachString iterates over all key-value pairs as strings, see ForEach
+func (db *ShardedSKV) ForEachString(fn func(key string, value string) error) error {
+	return db.ForEach(func(key []byte, value []byte) error {
+		return fn(string(key), string(value))
+	})
+}
+
+// Reshard changes the number of shards of the sharded database in dir to n
+// The keys are copied unchanged, with their metadata, into a new set of
+// shards in dir + ".reshard", which then replaces dir. The database must not
+// be open while it's resharded.
+func Reshard(dir string, n int) error {
+	if n <= 0 {
+		return fmt.Errorf("the number of shards must be positive, got %d", n)
+	}
+	src, err := OpenSharded(dir, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmpDir := dir + ".reshard"
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return fmt.Errorf("error removing %s: %w", tmpDir, err)
+	}
+	dst, err := OpenSharded(tmpDir, n)
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			dst.Close()
+			os.RemoveAll(tmpDir)
+		}
+	}()
+
+	for i, shard := range src.shards {
+		if err := shard.copyKeysTo(dst); err != nil {
+			return fmt.Errorf("error copying shard %d: %w", i, err)
+		}
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	if err := src.Close(); err != nil {
+		return err
+	}
+
+	// Swap the directories, the old one is only removed once the new one
+	// is in place
+	oldDir := dir + ".old"
+	if err := os.RemoveAll(oldDir); err != nil {
+		return fmt.Errorf("error removing %s: %w", oldDir, err)
+	}
+	if err := os.Rename(dir, oldDir); err != nil {
+		return fmt.Errorf("error moving %s: %w", dir, err)
+	}
+	if err := os.Rename(tmpDir, dir); err != nil {
+		os.Rename(oldDir, dir)
+		return fmt.Errorf("error moving %s: %w", tmpDir, err)
+	}
+	committed = true
+	return os.RemoveAll(oldDir)
+}
+
+// copyKeysTo copies every key of the default keyspace to its shard in dst,
+// keeping the records' metadata
+func (s *SKV) copyKeysTo(dst *ShardedSKV) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.cache.each(func(key string, position int64) error {
+		shard := dst.shardFor([]byte(key))
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+
+		if _, exists := shard.cache.get(key); exists {
+			return fmt.Errorf("key %q: %w", key, ErrKeyExists)
+		}
+		copied, err := s.copyRecord(shard, position)
+		if err != nil {
+			return fmt.Errorf("error copying key %q: %w", key, err)
+		}
+		shard.prefixUsage = nil
+		return shard.cache.set(key, copied)
+	})
+}
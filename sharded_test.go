@@ -0,0 +1,157 @@
+package skv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestSharded(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "sharded")
+	db, err := OpenSharded(dir, 4)
+	if err != nil {
+		t.Fatalf("Failed to open sharded database: %v", err)
+	}
+
+	// Writers on many goroutines
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				db.PutString(fmt.Sprintf("w%d-%d", w, i), fmt.Sprintf("value-%d", i))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if db.Count() != 400 {
+		t.Errorf("Expected 400 keys, got %d", db.Count())
+	}
+	for i, shard := range db.shards {
+		if shard.Count() == 0 {
+			t.Errorf("Shard %d is empty", i)
+		}
+	}
+	if err := db.PutString("w0-0", "again"); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("Expected ErrKeyExists, got %v", err)
+	}
+	db.UpdateString("w0-0", "updated")
+	db.DeleteString("w0-1")
+	if value, _ := db.GetString("w0-0"); value != "updated" {
+		t.Errorf("Unexpected value: %q", value)
+	}
+	if db.ExistsString("w0-1") {
+		t.Error("Deleted key still exists")
+	}
+
+	stats, err := db.Verify()
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if len(stats.Shards) != 4 || stats.ActiveRecords != 399 || stats.DeletedRecords != 1 {
+		t.Errorf("Unexpected stats: %+v", stats.Stats)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+
+	backup := filepath.Join(t.TempDir(), "backup.json")
+	if err := db.Backup(backup); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	db.Close()
+
+	// Shards are ordinary databases
+	shard, err := Open(filepath.Join(dir, "shard-002.skv"))
+	if err != nil {
+		t.Fatalf("Failed to open a shard: %v", err)
+	}
+	shard.Close()
+
+	if _, err := OpenSharded(dir, 8); !errors.Is(err, ErrShardCount) {
+		t.Errorf("Expected ErrShardCount, got %v", err)
+	}
+	if err := Reshard(dir, 3); err != nil {
+		t.Fatalf("Reshard failed: %v", err)
+	}
+	db, err = OpenSharded(dir, 0)
+	if err != nil {
+		t.Fatalf("Failed to reopen resharded database: %v", err)
+	}
+	defer db.Close()
+	if db.Shards() != 3 || db.Count() != 399 {
+		t.Errorf("Expected 399 keys in 3 shards, got %d in %d", db.Count(), db.Shards())
+	}
+	if value, _ := db.GetString("w0-0"); value != "updated" {
+		t.Errorf("Unexpected value after Reshard: %q", value)
+	}
+	if _, err := os.Stat(dir + ".old"); !os.IsNotExist(err) {
+		t.Errorf("Old shards left behind: %v", err)
+	}
+
+	// The backup restores into any number of shards
+	db.Clear()
+	report, err := db.RestoreWithOptions(RestoreOptions{}, backup)
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if len(report.Added) != 399 || db.Count() != 399 {
+		t.Errorf("Expected 399 restored keys, got %d (%d added)", db.Count(), len(report.Added))
+	}
+}
+
+func TestShardedRestoreReplaceFailure(t *testing.T) {
+	dir := t.TempDir()
+	db, err := OpenSharded(filepath.Join(dir, "sharded"), 4)
+	if err != nil {
+		t.Fatalf("Failed to open sharded database: %v", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 40; i++ {
+		db.PutString(fmt.Sprintf("key%d", i), "backed up")
+	}
+	backup := filepath.Join(dir, "backup.json")
+	if err := db.Backup(backup); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	for i := 0; i < 40; i++ {
+		db.SetString(fmt.Sprintf("key%d", i), "changed")
+	}
+
+	// One shard can't create its temporary file: no shard may be replaced
+	blocked := db.shards[2].filePath + ".restore.tmp"
+	if err := os.Mkdir(blocked, 0755); err != nil {
+		t.Fatalf("Failed to block shard 2: %v", err)
+	}
+	if _, err := db.RestoreWithOptions(RestoreOptions{Mode: RestoreReplace}, backup); err == nil {
+		t.Fatal("Expected the restore to fail")
+	}
+	for i := 0; i < 40; i++ {
+		if value, _ := db.GetString(fmt.Sprintf("key%d", i)); value != "changed" {
+			t.Fatalf("key%d was restored by a failed restore: %q", i, value)
+		}
+	}
+	for i, shard := range db.shards {
+		if _, err := os.Stat(shard.filePath + ".restore.tmp"); i != 2 && !os.IsNotExist(err) {
+			t.Errorf("Shard %d left its temporary file behind: %v", i, err)
+		}
+	}
+
+	os.Remove(blocked)
+	report, err := db.RestoreWithOptions(RestoreOptions{Mode: RestoreReplace}, backup)
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if len(report.Overwritten) != 40 || db.Count() != 40 {
+		t.Errorf("Expected 40 restored keys, got %d (%d overwritten)", db.Count(), len(report.Overwritten))
+	}
+	if value, _ := db.GetString("key7"); value != "backed up" {
+		t.Errorf("Expected the backed-up value, got %q", value)
+	}
+}
@@ -1,15 +1,14 @@
 package skv
 
 import (
-	"encoding/base64"
-	"encoding/binary"
-	"encoding/json"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"sort"
 	"sync"
-	"unicode/utf8"
 )
 
 // File header constants
@@ -17,8 +16,10 @@ const (
 	HeaderMagic  = "SKV" // Magic bytes to identify SKV files
 	HeaderSize   = 6     // Total header size: 3 bytes magic + 3 bytes version
 	VersionMajor = 0     // Major version number
-	VersionMinor = 1     // Minor version number
+	VersionMinor = 2     // Minor version number, 2 added record metadata (MetaFlag)
 	VersionPatch = 0     // Patch version number
+
+	versionMinorPlain = 1 // Minor version of files without metadata records
 )
 
 // Record type based on the size of the data field
@@ -31,6 +32,9 @@ const (
 	// Deleted flag (bit 7)
 	DeletedFlag byte = 0x80 // When this bit is set, the record is deleted
 
+	// Metadata flag (bit 6)
+	MetaFlag byte = 0x40 // When this bit is set, a metadata block follows the key
+
 	// Padding byte for filling small gaps
 	PaddingByte byte = 0x80 // Used to fill gaps too small for a deleted record
 
@@ -43,9 +47,9 @@ func isDeleted(recordType byte) bool {
 	return (recordType & DeletedFlag) != 0
 }
 
-// getBaseType returns the base type without the deleted bit
+// getBaseType returns the base type without the deleted and metadata bits
 func getBaseType(recordType byte) byte {
-	return recordType & ^DeletedFlag
+	return recordType & ^(DeletedFlag | MetaFlag)
 }
 
 // getRecordType determines the record type based on data size
@@ -147,20 +151,95 @@ type FreeSpace struct {
 type SKV struct {
 	file      *os.File
 	filePath  string
-	cache     map[string]int64 // Cache: key -> file position
-	freeSpace []FreeSpace      // List of free spaces (deleted records)
-	mu        sync.RWMutex     // Mutex for thread-safe operations
+	cache     keyIndex     // Cache: key -> file position
+	freeSpace []FreeSpace  // List of free spaces (deleted records)
+	mu        sync.RWMutex // Mutex for thread-safe operations
+	readOnly  bool         // Reject all modifications with ErrReadOnly
+	closed    bool         // Set by Close, every method then returns ErrClosed
+
+	observers      map[uint64]observer // Change observers (see addObserver)
+	nextObserverID uint64              // ID assigned to the next registered observer
+
+	readers map[*ValueReader]struct{} // Open value readers (see Open)
+
+	revision uint64 // Highest record version in the file (see nextVersion)
+
+	headerMinor byte // Minor version in the file header (see markMetadata)
+
+	buckets      map[string]*bucketState // Named buckets (see Bucket)
+	lastBucketID uint64                  // Highest bucket ID in the file
+
+	indexes map[string]*index // Secondary indexes (see CreateIndex)
+
+	values *valueCache // Cached values of hot keys, nil if disabled
+
+	limits      Limits           // Limits checked before writes (see Limits)
+	prefixUsage map[string]int64 // Bytes used per quota prefix, nil until loaded
+}
+
+// Options configures how a database is opened
+type Options struct {
+	// ReadOnly opens the file without write access. Every method that would
+	// modify the database returns ErrReadOnly. The file must already exist.
+	ReadOnly bool
+
+	// ValueCacheSize is the number of bytes of recently read values kept in
+	// memory, so that Get and GetBatch of hot keys don't read the file.
+	// Zero disables the value cache.
+	ValueCacheSize int64
+
+	// DiskKeyIndex keeps the positions of the keys in a hash file next to
+	// the database (name + ".idx") instead of memory, for databases with
+	// more keys than fit in memory. Buckets are still kept in memory.
+	DiskKeyIndex bool
+
+	// KeyIndexCacheSize is the number of bytes of index pages kept in memory
+	// with DiskKeyIndex. Zero means 4 MiB.
+	KeyIndexCacheSize int64
+
+	// Limits rejects writes that would exceed a maximum value size, key
+	// count or file size, or a prefix quota, with a *QuotaError.
+	Limits Limits
 }
 
+// Change operations reported to observers
+const (
+	opSet          byte = 0x01 // A key was written (put, update, restore)
+	opDelete       byte = 0x02 // A key was deleted
+	opClear        byte = 0x03 // All keys and buckets were removed
+	opCreateBucket byte = 0x04 // A bucket was created
+	opDeleteBucket byte = 0x05 // A bucket and all its keys were deleted
+	opWriteAt      byte = 0x06 // Part of a value was overwritten in place (WriteAt)
+	opResize       byte = 0x07 // A value was truncated or extended in place
+)
+
+// observer is called after every committed change while the write lock is held
+// bucket is empty for the default keyspace and for opClear. key and value are
+// nil for opClear and the bucket operations, value is nil for opDelete.
+// In-place changes only carry what changed: for opWriteAt the value is the
+// offset (8 bytes, little endian) followed by the bytes written, for opResize
+// the new size (8 bytes, little endian).
+type observer func(op byte, bucket string, key []byte, value []byte)
+
 // Open opens or creates a .skv file and returns an SKV object
 func Open(name string) (*SKV, error) {
+	return OpenWithOptions(name, Options{})
+}
+
+// OpenWithOptions opens or creates a .skv file using the given options
+func OpenWithOptions(name string, opts Options) (*SKV, error) {
 	// Add .skv extension if it doesn't have it
 	if len(name) < 4 || name[len(name)-4:] != ".skv" {
 		name += ".skv"
 	}
 
 	// Open or create the file with read/write permissions
-	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	// Read-only databases must already exist
+	flag := os.O_RDWR | os.O_CREATE
+	if opts.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(name, flag, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("error opening file %s: %w", name, err)
 	}
@@ -168,8 +247,11 @@ func Open(name string) (*SKV, error) {
 	skv := &SKV{
 		file:      file,
 		filePath:  name,
-		cache:     make(map[string]int64),
+		cache:     make(memoryKeys),
 		freeSpace: make([]FreeSpace, 0),
+		readOnly:  opts.ReadOnly,
+		values:    newValueCache(opts.ValueCacheSize),
+		limits:    opts.Limits,
 	}
 
 	// Check if file is new or existing
@@ -179,7 +261,7 @@ func Open(name string) (*SKV, error) {
 		return nil, fmt.Errorf("error getting file info: %w", err)
 	}
 
-	if info.Size() == 0 {
+	if info.Size() == 0 && !opts.ReadOnly {
 		// New file - write header
 		if err := skv.writeHeader(); err != nil {
 			file.Close()
@@ -193,8 +275,26 @@ func Open(name string) (*SKV, error) {
 		}
 	}
 
+	// Open the key index, a clean one doesn't need the keys from the file
+	loadKeys := true
+	if opts.DiskKeyIndex {
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("error getting file info: %w", err)
+		}
+		keys, trusted, err := openDiskKeys(name+".idx", opts.ReadOnly, opts.KeyIndexCacheSize, info)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		skv.cache = keys
+		loadKeys = !trusted
+	}
+
 	// Build cache by scanning the file
-	if err := skv.rebuildCache(); err != nil {
+	if err := skv.rebuildCache(loadKeys); err != nil {
+		skv.cache.close()
 		file.Close()
 		return nil, fmt.Errorf("error building cache: %w", err)
 	}
@@ -203,14 +303,9 @@ func Open(name string) (*SKV, error) {
 }
 
 // writeHeader writes the SKV file header (magic bytes + version)
+// The file has no metadata records yet, see markMetadata
 func (s *SKV) writeHeader() error {
-	header := make([]byte, HeaderSize)
-	// Write magic bytes "SKV"
-	copy(header[0:3], HeaderMagic)
-	// Write version (3 bytes: major, minor, patch)
-	header[3] = byte(VersionMajor)
-	header[4] = byte(VersionMinor)
-	header[5] = byte(VersionPatch)
+	header := fileHeader(versionMinorPlain)
 
 	// Write header at the beginning of the file
 	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
@@ -222,6 +317,33 @@ func (s *SKV) writeHeader() error {
 	if err := s.file.Sync(); err != nil {
 		return fmt.Errorf("error syncing header: %w", err)
 	}
+	s.headerMinor = versionMinorPlain
+	return nil
+}
+
+// fileHeader returns the header every SKV file starts with
+func fileHeader(minor byte) []byte {
+	header := make([]byte, HeaderSize)
+	// Write magic bytes "SKV"
+	copy(header[0:3], HeaderMagic)
+	// Write version (3 bytes: major, minor, patch)
+	header[3] = byte(VersionMajor)
+	header[4] = minor
+	header[5] = byte(VersionPatch)
+	return header
+}
+
+// markMetadata raises the minor version in the file header before the first
+// record with a metadata block is written, so that versions that don't know
+// metadata reject the file
+func (s *SKV) markMetadata(recordType byte) error {
+	if recordType&MetaFlag == 0 || s.headerMinor >= VersionMinor {
+		return nil
+	}
+	if _, err := s.file.WriteAt([]byte{VersionMinor}, 4); err != nil {
+		return fmt.Errorf("error writing header: %w", err)
+	}
+	s.headerMinor = VersionMinor
 	return nil
 }
 
@@ -243,58 +365,132 @@ func (s *SKV) verifyHeader() error {
 		return fmt.Errorf("invalid SKV file: expected magic bytes %q, got %q", HeaderMagic, string(header[0:3]))
 	}
 
+	// Files written by a newer version may hold records this one can't read
+	if header[3] > VersionMajor || (header[3] == VersionMajor && header[4] > VersionMinor) {
+		return fmt.Errorf("unsupported SKV file version %d.%d.%d, newer than %d.%d.%d",
+			header[3], header[4], header[5], VersionMajor, VersionMinor, VersionPatch)
+	}
+	s.headerMinor = header[4]
+
 	// Header is valid - file position is now after header, ready to read records
 	return nil
 }
 
+// addObserver registers a function to be called after every committed change
+// Returns an ID that can be passed to removeObserver
+func (s *SKV) addObserver(fn observer) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.observers == nil {
+		s.observers = make(map[uint64]observer)
+	}
+	s.nextObserverID++
+	s.observers[s.nextObserverID] = fn
+	return s.nextObserverID
+}
+
+// removeObserver unregisters an observer previously added with addObserver
+func (s *SKV) removeObserver(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.observers, id)
+}
+
+// notify reports a committed change to all indexes and observers
+// Must be called with the write lock held
+func (s *SKV) notify(op byte, key []byte, value []byte) {
+	switch op {
+	case opClear:
+		s.values.purge()
+		s.prefixUsage = nil
+	case opSet:
+		s.values.remove(string(key))
+		s.trackUsage(key, int64(len(value)))
+	default:
+		s.values.remove(string(key))
+	}
+	s.updateIndexes(op, key, value)
+	for _, fn := range s.observers {
+		fn(op, "", key, value)
+	}
+}
+
+// notifyBucket reports a committed change of a bucket to all observers
+// Indexes and the value cache only hold the default keyspace.
+// Must be called with the write lock held
+func (s *SKV) notifyBucket(op byte, bucket string, key []byte, value []byte) {
+	for _, fn := range s.observers {
+		fn(op, bucket, key, value)
+	}
+}
+
 // Close closes the database file
+// Closing a closed database does nothing, every other method returns ErrClosed
 func (s *SKV) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if s.file != nil {
-		return s.file.Close()
+	if s.file == nil || s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.closeFiles()
+}
+
+// closeFiles closes the database file and its key index
+// A disk key index is marked clean only if the synced file matches it
+func (s *SKV) closeFiles() error {
+	err := s.file.Sync()
+	if keys, ok := s.cache.(*diskKeys); ok && err == nil {
+		var info os.FileInfo
+		if info, err = s.file.Stat(); err == nil {
+			err = keys.markClean(info)
+		}
 	}
-	return nil
+	if closeErr := s.cache.close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
 // CloseWithCompact compacts the database before closing to remove deleted records
 // This is useful to optimize the file size when closing the database
+// A read-only database can't be compacted and is closed as Close does
 func (s *SKV) CloseWithCompact() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if s.file == nil {
+	if s.file == nil || s.closed {
 		return nil
 	}
+	s.closed = true
+	if s.readOnly {
+		return s.closeFiles()
+	}
 
 	// Compact the database to remove deleted records
 	// Note: compactInternal is called without lock since we already have it
-	if err := s.compactInternal(); err != nil {
+	if err := s.compactInternal(context.Background()); err != nil {
 		// Even if compact fails, try to close the file
+		s.cache.close()
 		s.file.Close()
 		return fmt.Errorf("error compacting before close: %w", err)
 	}
 
-	return s.file.Close()
+	return s.closeFiles()
 }
 
-// writeRecordAtPosition writes a complete record (type, key, data) at the current file position
+// writeRecordAtPosition writes a complete record (type, key, metadata, data) at the current file position
 // Returns the position where the record was written
-func (s *SKV) writeRecordAtPosition(key []byte, data []byte) (int64, error) {
-	// Determine the type based on the data size
-	var recordType byte
-	dataSize := uint64(len(data))
-
-	switch {
-	case dataSize <= 0xFF: // 255 bytes
-		recordType = Type1Byte
-	case dataSize <= 0xFFFF: // 64KB
-		recordType = Type2Bytes
-	case dataSize <= 0xFFFFFFFF: // 4GB
-		recordType = Type4Bytes
-	default:
-		recordType = Type8Bytes
+func (s *SKV) writeRecordAtPosition(key []byte, meta *recordMeta, data []byte) (int64, error) {
+	header, err := encodeRecordHeader(key, meta, uint64(len(data)))
+	if err != nil {
+		return 0, err
 	}
 
 	// Save position before writing
@@ -303,46 +499,12 @@ func (s *SKV) writeRecordAtPosition(key []byte, data []byte) (int64, error) {
 		return 0, fmt.Errorf("error getting current position: %w", err)
 	}
 
-	// Write the type
-	if _, err := s.file.Write([]byte{recordType}); err != nil {
-		return 0, fmt.Errorf("error writing type: %w", err)
+	// Write type, key size, key, metadata and data size
+	if err := s.markMetadata(header[0]); err != nil {
+		return 0, err
 	}
-
-	// Write the key size
-	keySize := byte(len(key))
-	if _, err := s.file.Write([]byte{keySize}); err != nil {
-		return 0, fmt.Errorf("error writing key size: %w", err)
-	}
-
-	// Write the key
-	if _, err := s.file.Write(key); err != nil {
-		return 0, fmt.Errorf("error writing key: %w", err)
-	}
-
-	// Write the data size according to the type
-	switch recordType {
-	case Type1Byte:
-		if _, err := s.file.Write([]byte{byte(dataSize)}); err != nil {
-			return 0, fmt.Errorf("error writing data size: %w", err)
-		}
-	case Type2Bytes:
-		buf := make([]byte, 2)
-		binary.LittleEndian.PutUint16(buf, uint16(dataSize))
-		if _, err := s.file.Write(buf); err != nil {
-			return 0, fmt.Errorf("error writing data size: %w", err)
-		}
-	case Type4Bytes:
-		buf := make([]byte, 4)
-		binary.LittleEndian.PutUint32(buf, uint32(dataSize))
-		if _, err := s.file.Write(buf); err != nil {
-			return 0, fmt.Errorf("error writing data size: %w", err)
-		}
-	case Type8Bytes:
-		buf := make([]byte, 8)
-		binary.LittleEndian.PutUint64(buf, dataSize)
-		if _, err := s.file.Write(buf); err != nil {
-			return 0, fmt.Errorf("error writing data size: %w", err)
-		}
+	if _, err := s.file.Write(header); err != nil {
+		return 0, fmt.Errorf("error writing record header: %w", err)
 	}
 
 	// Write the data
@@ -363,10 +525,14 @@ func (s *SKV) writeRecordAtPosition(key []byte, data []byte) (int64, error) {
 // writeRecord writes a complete record (type, key, data)
 // Returns the position where the record was written
 // Tries to reuse free space if available, otherwise appends to end of file
-func (s *SKV) writeRecord(key []byte, data []byte) (int64, error) {
+func (s *SKV) writeRecord(key []byte, meta *recordMeta, data []byte) (int64, error) {
+	meta = s.stampVersion(meta)
+
 	// Calculate total size needed for this record
-	recordType := getRecordType(uint64(len(data)))
-	neededSize := calculateRecordSize(byte(len(key)), uint64(len(data)), recordType)
+	neededSize, err := recordSizeWithMeta(key, meta, uint64(len(data)))
+	if err != nil {
+		return 0, err
+	}
 
 	// Try to find suitable free space
 	freeIdx := s.findBestFreeSpace(neededSize)
@@ -382,7 +548,7 @@ func (s *SKV) writeRecord(key []byte, data []byte) (int64, error) {
 		}
 
 		// Write the record
-		if _, err := s.writeRecordAtPosition(key, data); err != nil {
+		if _, err := s.writeRecordAtPosition(key, meta, data); err != nil {
 			return 0, err
 		}
 
@@ -426,89 +592,87 @@ func (s *SKV) writeRecord(key []byte, data []byte) (int64, error) {
 		}
 	}
 
-	return s.writeRecordAtPosition(key, data)
+	return s.writeRecordAtPosition(key, meta, data)
+}
+
+// recordSizeWithMeta returns the total size of a record holding key, meta
+// and dataSize bytes of data
+func recordSizeWithMeta(key []byte, meta *recordMeta, dataSize uint64) (uint64, error) {
+	block, err := meta.encode()
+	if err != nil {
+		return 0, err
+	}
+	recordType := getRecordType(dataSize)
+	return calculateRecordSize(byte(len(key)), dataSize, recordType) + uint64(len(block)), nil
 }
 
 // readRecord reads a complete record from the current file position
 // If readData is false, the data portion is skipped for efficiency
 // Returns: recordType, key, data, recordSize, error
 func (s *SKV) readRecord(readData bool) (recordType byte, key []byte, data []byte, recordSize uint64, err error) {
-	// Read type
-	typeBuf := make([]byte, 1)
-	if _, err := io.ReadFull(s.file, typeBuf); err != nil {
-		if err == io.EOF {
-			return 0, nil, nil, 0, io.EOF // Return EOF directly
-		}
-		return 0, nil, nil, 0, fmt.Errorf("error reading type: %w", err)
+	position, err := s.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, nil, nil, 0, fmt.Errorf("error getting current position: %w", err)
 	}
-	recordType = typeBuf[0]
+	recordType, key, data, recordSize, err = readRecordFrom(s.file, readData)
+	return recordType, key, data, recordSize, corruptAt(err, position)
+}
 
-	// Read key size
-	keySizeBuf := make([]byte, 1)
-	if _, err := io.ReadFull(s.file, keySizeBuf); err != nil {
-		return 0, nil, nil, 0, fmt.Errorf("error reading key size: %w", err)
-	}
-	keySize := keySizeBuf[0]
+// readRecordAt reads a complete record at the given position without moving
+// the shared file offset, so it is safe to call with only the read lock held
+func (s *SKV) readRecordAt(position int64) (recordType byte, key []byte, data []byte, err error) {
+	r := io.NewSectionReader(s.file, position, 1<<62)
+	recordType, key, data, _, err = readRecordFrom(r, true)
+	return recordType, key, data, corruptAt(err, position)
+}
 
-	// Read key
-	key = make([]byte, keySize)
-	if _, err := io.ReadFull(s.file, key); err != nil {
-		return 0, nil, nil, 0, fmt.Errorf("error reading key: %w", err)
-	}
+// recordHeaderAt reads the header of the record at the given position without
+// moving the shared file offset
+// The data of the record starts at position + headerSize
+func (s *SKV) recordHeaderAt(position int64) (recordHeader, error) {
+	h, err := readRecordHeader(io.NewSectionReader(s.file, position, 1<<62))
+	return h, corruptAt(err, position)
+}
 
-	// Read data size
-	baseType := getBaseType(recordType)
-	var dataSize uint64
-	switch baseType {
-	case Type1Byte:
-		buf := make([]byte, 1)
-		if _, err := io.ReadFull(s.file, buf); err != nil {
-			return 0, nil, nil, 0, fmt.Errorf("error reading data size: %w", err)
-		}
-		dataSize = uint64(buf[0])
-	case Type2Bytes:
-		buf := make([]byte, 2)
-		if _, err := io.ReadFull(s.file, buf); err != nil {
-			return 0, nil, nil, 0, fmt.Errorf("error reading data size: %w", err)
-		}
-		dataSize = uint64(binary.LittleEndian.Uint16(buf))
-	case Type4Bytes:
-		buf := make([]byte, 4)
-		if _, err := io.ReadFull(s.file, buf); err != nil {
-			return 0, nil, nil, 0, fmt.Errorf("error reading data size: %w", err)
-		}
-		dataSize = uint64(binary.LittleEndian.Uint32(buf))
-	case Type8Bytes:
-		buf := make([]byte, 8)
-		if _, err := io.ReadFull(s.file, buf); err != nil {
-			return 0, nil, nil, 0, fmt.Errorf("error reading data size: %w", err)
-		}
-		dataSize = binary.LittleEndian.Uint64(buf)
-	default:
-		return 0, nil, nil, 0, fmt.Errorf("unknown record type: 0x%02X", recordType)
+// recordDataAt reads the header of the record at the given position and
+// returns it with a reader over the record's data
+// Neither moves the shared file offset
+func (s *SKV) recordDataAt(position int64) (recordHeader, *io.SectionReader, error) {
+	h, err := s.recordHeaderAt(position)
+	if err != nil {
+		return h, nil, err
 	}
+	return h, io.NewSectionReader(s.file, position+int64(h.headerSize), int64(h.dataSize)), nil
+}
 
-	// Calculate total record size
-	recordSize = calculateRecordSize(keySize, dataSize, recordType)
+// readRecordFrom reads a complete record from the current position of r
+func readRecordFrom(r io.ReadSeeker, readData bool) (recordType byte, key []byte, data []byte, recordSize uint64, err error) {
+	h, err := readRecordHeader(r)
+	if err != nil {
+		return 0, nil, nil, 0, err
+	}
 
 	// Read or skip data depending on readData parameter
 	if readData {
-		data = make([]byte, dataSize)
-		if dataSize > 0 {
-			if _, err := io.ReadFull(s.file, data); err != nil {
+		data = make([]byte, h.dataSize)
+		if h.dataSize > 0 {
+			if _, err := io.ReadFull(r, data); err != nil {
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					return 0, nil, nil, 0, &CorruptionError{Key: string(h.key), Reason: "truncated record, missing data"}
+				}
 				return 0, nil, nil, 0, fmt.Errorf("error reading data: %w", err)
 			}
 		}
 	} else {
 		// Skip data by seeking forward for efficiency
-		if dataSize > 0 {
-			if _, err := s.file.Seek(int64(dataSize), io.SeekCurrent); err != nil {
+		if h.dataSize > 0 {
+			if _, err := r.Seek(int64(h.dataSize), io.SeekCurrent); err != nil {
 				return 0, nil, nil, 0, fmt.Errorf("error skipping data: %w", err)
 			}
 		}
 	}
 
-	return recordType, key, data, recordSize, nil
+	return h.recordType, h.key, data, h.size(), nil
 }
 
 // Put stores a new key with its value
@@ -517,26 +681,32 @@ func (s *SKV) Put(key []byte, data []byte) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if len(key) == 0 {
-		return fmt.Errorf("key cannot be empty")
+	if err := s.checkWritable(); err != nil {
+		return err
 	}
-	if len(key) > 255 {
-		return fmt.Errorf("key too long (max 255 bytes)")
+	if err := checkKey(key); err != nil {
+		return err
 	}
 
 	// Check if the key already exists in cache
-	if _, exists := s.cache[string(key)]; exists {
+	if _, exists := s.cache.get(string(key)); exists {
 		return ErrKeyExists
 	}
+	if err := s.checkPut(key, nil, uint64(len(data))); err != nil {
+		return err
+	}
 
 	// Write the record
-	recordPos, err := s.writeRecord(key, data)
+	recordPos, err := s.writeRecord(key, nil, data)
 	if err != nil {
 		return err
 	}
 
 	// Update cache with record start position
-	s.cache[string(key)] = recordPos
+	if err := s.cache.set(string(key), recordPos); err != nil {
+		return err
+	}
+	s.notify(opSet, key, data)
 
 	return nil
 }
@@ -544,30 +714,33 @@ func (s *SKV) Put(key []byte, data []byte) error {
 // putInternal writes or overwrites a key without acquiring the lock
 // Used internally when the lock is already held (e.g., in Restore)
 func (s *SKV) putInternal(key []byte, data []byte) error {
-	if len(key) == 0 {
-		return fmt.Errorf("key cannot be empty")
-	}
-	if len(key) > 255 {
-		return fmt.Errorf("key too long (max 255 bytes)")
+	if err := checkKey(key); err != nil {
+		return err
 	}
 
 	keyStr := string(key)
+	if err := s.checkPut(key, nil, uint64(len(data))); err != nil {
+		return err
+	}
 
 	// If key exists, delete it first
-	if _, exists := s.cache[keyStr]; exists {
+	if _, exists := s.cache.get(keyStr); exists {
 		if err := s.deleteInternal(key); err != nil {
 			return err
 		}
 	}
 
 	// Write the record
-	recordPos, err := s.writeRecord(key, data)
+	recordPos, err := s.writeRecord(key, nil, data)
 	if err != nil {
 		return err
 	}
 
 	// Update cache with record start position
-	s.cache[keyStr] = recordPos
+	if err := s.cache.set(keyStr, recordPos); err != nil {
+		return err
+	}
+	s.notify(opSet, key, data)
 
 	return nil
 }
@@ -578,14 +751,20 @@ func (s *SKV) Update(key []byte, data []byte) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
 	if len(key) == 0 {
-		return fmt.Errorf("key cannot be empty")
+		return ErrEmptyKey
 	}
 
 	// Check if the key exists in cache
-	if _, exists := s.cache[string(key)]; !exists {
+	if _, exists := s.cache.get(string(key)); !exists {
 		return ErrKeyNotFound
 	}
+	if err := s.checkPut(key, nil, uint64(len(data))); err != nil {
+		return err
+	}
 
 	// Key exists, delete it first (internal version without lock)
 	if err := s.deleteInternal(key); err != nil {
@@ -593,22 +772,35 @@ func (s *SKV) Update(key []byte, data []byte) error {
 	}
 
 	// Write the record
-	recordPos, err := s.writeRecord(key, data)
+	recordPos, err := s.writeRecord(key, nil, data)
 	if err != nil {
 		return err
 	}
 
 	// Update cache with record start position
-	s.cache[string(key)] = recordPos
+	if err := s.cache.set(string(key), recordPos); err != nil {
+		return err
+	}
+	s.notify(opSet, key, data)
 
 	return nil
 }
 
 // rebuildCache scans the entire file and builds the cache
-func (s *SKV) rebuildCache() error {
+// The keys of the default keyspace are only added if loadKeys is set
+func (s *SKV) rebuildCache(loadKeys bool) error {
 	// Clear existing cache and free space list
-	s.cache = make(map[string]int64)
+	if loadKeys {
+		if err := s.cache.reset(); err != nil {
+			return err
+		}
+	}
 	s.freeSpace = make([]FreeSpace, 0)
+	s.revision = 0
+	s.buckets = nil
+	s.lastBucketID = 0
+	bucketsByID := make(map[uint64]*bucketState)
+	indexes := make(map[string]int64)
 
 	// Move to the beginning of the file
 	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
@@ -622,43 +814,55 @@ func (s *SKV) rebuildCache() error {
 
 	// Read all records
 	for {
-		// Save current position
+		// Skip padding bytes, the record starts after them
+		if _, err := s.skipPaddingBytes(); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+
 		currentPos, err := s.file.Seek(0, io.SeekCurrent)
 		if err != nil {
 			return fmt.Errorf("error getting current position: %w", err)
 		}
 
-		// Check for padding bytes
-		paddingSize, err := s.skipPaddingBytes()
+		// Read only the record header, skip data for efficiency
+		h, err := readRecordHeader(s.file)
 		if err != nil {
 			if err == io.EOF {
-				break
+				break // End of file
 			}
-			return err
+			return fmt.Errorf("error reading record metadata: %w", corruptAt(err, currentPos))
 		}
-
-		// If we found padding, update current position
-		if paddingSize > 0 {
-			currentPos, err = s.file.Seek(0, io.SeekCurrent)
-			if err != nil {
-				return fmt.Errorf("error getting current position after padding: %w", err)
+		if h.dataSize > 0 {
+			if _, err := s.file.Seek(int64(h.dataSize), io.SeekCurrent); err != nil {
+				return fmt.Errorf("error skipping data: %w", err)
 			}
 		}
 
-		// Read only record metadata (type and key), skip data for efficiency
-		recordType, key, _, recordSize, err := s.readRecord(false)
-		if err != nil {
-			if err == io.EOF {
-				break // End of file
+		// Deleted versions are never handed out again
+		if h.meta.version > s.revision {
+			s.revision = h.meta.version
+		}
+
+		for _, id := range []uint64{h.meta.bucket, h.meta.bucketDef} {
+			if id > s.lastBucketID {
+				s.lastBucketID = id
 			}
-			return fmt.Errorf("error reading record metadata: %w", err)
 		}
 
-		// Update cache (last occurrence wins)
-		keyStr := string(key)
-		if isDeleted(recordType) {
-			// Remove from cache if deleted
-			delete(s.cache, keyStr)
+		keyStr := string(h.key)
+		var cache keyIndex
+		if h.meta.bucket != 0 {
+			cache = loadBucket(bucketsByID, h.meta.bucket).cache
+		} else if loadKeys {
+			cache = s.cache
+		}
+
+		if isDeleted(h.recordType) {
+			// A live record of the same key may have been written earlier
+			// in the file into reused free space, so the cache is left alone
 
 			// Check for padding bytes after this deleted record
 			postPaddingSize, err := s.skipPaddingBytes()
@@ -667,39 +871,79 @@ func (s *SKV) rebuildCache() error {
 			}
 
 			// Add to free space list (record + padding)
-			totalFreeSize := recordSize + uint64(postPaddingSize)
+			totalFreeSize := h.size() + uint64(postPaddingSize)
 			s.freeSpace = append(s.freeSpace, FreeSpace{
-				position: currentPos + int64(paddingSize),
+				position: currentPos,
 				size:     totalFreeSize,
 			})
-		} else {
-			// Add or update in cache
-			s.cache[keyStr] = currentPos + int64(paddingSize)
+		} else if h.meta.bucketDef != 0 {
+			b := loadBucket(bucketsByID, h.meta.bucketDef)
+			b.name = keyStr
+			b.position = currentPos
+		} else if h.meta.indexDef {
+			indexes[keyStr] = currentPos
+		} else if cache != nil {
+			// Add or update in cache (newest version, then last occurrence wins)
+			if seenPos, seen := cache.get(keyStr); seen {
+				seenHeader, err := s.recordHeaderAt(seenPos)
+				if err != nil {
+					return fmt.Errorf("error reading record metadata: %w", err)
+				}
+				if h.meta.version < seenHeader.meta.version {
+					continue
+				}
+			}
+			if err := cache.set(keyStr, currentPos); err != nil {
+				return err
+			}
 		}
 	}
 
-	return nil
-} // ErrKeyNotFound is returned when the key is not found
+	// Records of buckets without a definition are left out
+	for _, b := range bucketsByID {
+		if b.position == 0 {
+			continue
+		}
+		if s.buckets == nil {
+			s.buckets = make(map[string]*bucketState)
+		}
+		s.buckets[b.name] = b
+	}
+
+	return s.loadIndexes(indexes)
+}
+
+// ErrKeyNotFound is returned when the key is not found
 var ErrKeyNotFound = errors.New("key not found")
 
 // ErrKeyExists is returned when trying to insert a key that already exists
 var ErrKeyExists = errors.New("key already exists")
 
+// ErrReadOnly is returned when trying to modify a database opened read-only
+var ErrReadOnly = errors.New("database is read-only")
+
 // Get retrieves the value associated with a key
 // Returns ErrKeyNotFound if the key doesn't exist or is deleted
 func (s *SKV) Get(key []byte) ([]byte, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+
 	if len(key) == 0 {
-		return nil, fmt.Errorf("key cannot be empty")
+		return nil, ErrEmptyKey
 	}
 
 	// Check cache for position
-	position, found := s.cache[string(key)]
+	position, found := s.cache.get(string(key))
 	if !found {
 		return nil, ErrKeyNotFound
 	}
+	if data, ok := s.values.get(string(key)); ok {
+		return data, nil
+	}
 
 	// Read from file at cached position
 	if _, err := s.file.Seek(position, io.SeekStart); err != nil {
@@ -711,6 +955,7 @@ func (s *SKV) Get(key []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	s.values.add(string(key), data)
 
 	return data, nil
 }
@@ -720,19 +965,47 @@ func (s *SKV) Delete(key []byte) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	return s.deleteInternal(key)
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+	if err := s.deleteInternal(key); err != nil {
+		return err
+	}
+	s.notify(opDelete, key, nil)
+
+	return nil
 }
 
 // deleteInternal is the internal implementation of Delete without locking
 // Used by Update to avoid deadlock
 func (s *SKV) deleteInternal(key []byte) error {
+	var size int64
+	if s.prefixUsage != nil {
+		if position, exists := s.cache.get(string(key)); exists {
+			h, err := s.recordHeaderAt(position)
+			if err != nil {
+				return fmt.Errorf("error reading record: %w", err)
+			}
+			size = int64(h.dataSize)
+		}
+	}
+
+	if err := s.deleteFrom(s.cache, key); err != nil {
+		return err
+	}
+	s.trackUsage(key, -size)
+	return nil
+}
+
+// deleteFrom deletes a key of the keyspace whose cache is given
+func (s *SKV) deleteFrom(cache keyIndex, key []byte) error {
 	if len(key) == 0 {
-		return fmt.Errorf("key cannot be empty")
+		return ErrEmptyKey
 	}
 
 	// Check if key exists in cache and get its position
 	keyStr := string(key)
-	position, found := s.cache[keyStr]
+	position, found := cache.get(keyStr)
 	if !found {
 		return ErrKeyNotFound
 	}
@@ -767,7 +1040,10 @@ func (s *SKV) deleteInternal(key []byte) error {
 	}
 
 	// Remove from cache
-	delete(s.cache, keyStr)
+	if err := cache.remove(keyStr); err != nil {
+		return err
+	}
+	s.invalidateReaders(position)
 
 	// Check for padding after this record
 	afterRecordPos := position + int64(recordSize)
@@ -804,13 +1080,34 @@ type Stats struct {
 	Efficiency      float64 // Percentage of space used by active records
 	AverageKeySize  float64 // Average key size in bytes
 	AverageDataSize float64 // Average data value size in bytes
+
+	Buckets map[string]*BucketStats // Statistics per bucket, nil if there are none
+	Usage   *Usage                  // Usage of the limits, nil if the database has none
+}
+
+// BucketStats contains statistics about a bucket
+type BucketStats struct {
+	ActiveRecords  int   // Number of keys in the bucket
+	DeletedRecords int   // Number of deleted records of the bucket
+	DataSize       int64 // Size of the bucket's active records in bytes
+	WastedSpace    int64 // Space occupied by the bucket's deleted records in bytes
 }
 
 // Verify checks the file integrity and returns statistics
 func (s *SKV) Verify() (*Stats, error) {
+	return s.VerifyContext(context.Background())
+}
+
+// VerifyContext is Verify, stopping with the context's error once ctx is
+// done. The context is checked between records.
+func (s *SKV) VerifyContext(ctx context.Context) (*Stats, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+
 	stats := &Stats{
 		HeaderSize: HeaderSize,
 	}
@@ -831,8 +1128,32 @@ func (s *SKV) Verify() (*Stats, error) {
 	var totalDataSize int64
 	var activeDataSize int64
 
+	bucketStats := make(map[uint64]*BucketStats)
+	for name, b := range s.buckets {
+		if stats.Buckets == nil {
+			stats.Buckets = make(map[string]*BucketStats)
+		}
+		stats.Buckets[name] = &BucketStats{}
+		bucketStats[b.id] = stats.Buckets[name]
+	}
+	if s.limits.enabled() {
+		stats.Usage = &Usage{
+			Keys:      QuotaUsage{Max: int64(s.limits.MaxKeys)},
+			FileSize:  QuotaUsage{Used: stats.FileSize, Max: s.limits.MaxFileSize},
+			ValueSize: QuotaUsage{Max: s.limits.MaxValueSize},
+			Prefixes:  make(map[string]QuotaUsage),
+		}
+		for prefix, quota := range s.limits.PrefixQuotas {
+			stats.Usage.Prefixes[prefix] = QuotaUsage{Max: quota}
+		}
+	}
+
 	// Read all records in the file
 	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		// Skip any padding bytes
 		paddingCount, err := s.skipPaddingBytes()
 		if err != nil {
@@ -850,25 +1171,44 @@ func (s *SKV) Verify() (*Stats, error) {
 		}
 
 		// Read record metadata and data
-		recordType, key, data, recordSize, err := s.readRecord(true)
+		h, err := readRecordHeader(s.file)
 		if err != nil {
 			if err == io.EOF {
 				break // End of file
 			}
-			return nil, fmt.Errorf("error reading record: %w", err)
+			return nil, fmt.Errorf("error reading record: %w", corruptAt(err, posAfterPadding))
 		}
+		if _, err := io.CopyN(io.Discard, s.file, int64(h.dataSize)); err != nil {
+			if err == io.EOF {
+				return nil, fmt.Errorf("error reading record: %w", &CorruptionError{Offset: posAfterPadding, Key: string(h.key), Reason: "truncated record, missing data"})
+			}
+			return nil, fmt.Errorf("error reading record: error reading data: %w", err)
+		}
+		recordSize := h.size()
 
 		// Count the record
 		stats.TotalRecords++
-		totalKeySize += int64(len(key))
-		totalDataSize += int64(len(data))
+		totalKeySize += int64(len(h.key))
+		totalDataSize += int64(h.dataSize)
 
-		if isDeleted(recordType) {
+		bucket := bucketStats[h.meta.bucket]
+		if isDeleted(h.recordType) {
 			stats.DeletedRecords++
 			stats.WastedSpace += int64(recordSize)
+			if bucket != nil {
+				bucket.DeletedRecords++
+				bucket.WastedSpace += int64(recordSize)
+			}
 		} else {
 			stats.ActiveRecords++
 			activeDataSize += int64(recordSize)
+			if bucket != nil {
+				bucket.ActiveRecords++
+				bucket.DataSize += int64(recordSize)
+			}
+			if stats.Usage != nil && h.meta.bucket == 0 && h.meta.bucketDef == 0 && !h.meta.indexDef {
+				stats.Usage.count(string(h.key), int64(h.dataSize))
+			}
 		}
 	}
 
@@ -895,36 +1235,60 @@ func (s *SKV) Verify() (*Stats, error) {
 // Compact removes deleted records by creating a new file with only active records
 // For keys that appear multiple times, only the last occurrence is kept
 func (s *SKV) Compact() error {
+	return s.CompactContext(context.Background())
+}
+
+// CompactContext is Compact, stopping with the context's error once ctx is
+// done. The context is checked while the live records are read; once the
+// file is being rewritten the compaction runs to the end, so the file is
+// never left half compacted.
+func (s *SKV) CompactContext(ctx context.Context) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	return s.compactInternal()
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+	return s.compactInternal(ctx)
 }
 
 // compactInternal is the internal implementation of Compact without locking
 // Used by CloseWithCompact to avoid deadlock
-func (s *SKV) compactInternal() error {
+func (s *SKV) compactInternal(ctx context.Context) error {
 	// Collect all active keys and their data from cache
 	type keyData struct {
 		key  []byte
+		meta recordMeta
 		data []byte
 	}
-	activeData := make([]keyData, 0, len(s.cache))
+	activeData := make([]keyData, 0, s.cache.len())
 
 	// Read all active records using cache positions
-	for _, position := range s.cache {
+	positions, err := s.livePositions()
+	if err != nil {
+		return err
+	}
+	for _, position := range positions {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		// Seek to record position
 		if _, err := s.file.Seek(position, io.SeekStart); err != nil {
 			return fmt.Errorf("error seeking to position: %w", err)
 		}
 
 		// Read record
-		_, key, data, _, err := s.readRecord(true)
+		h, err := readRecordHeader(s.file)
 		if err != nil {
+			return fmt.Errorf("error reading record: %w", corruptAt(err, position))
+		}
+		data := make([]byte, h.dataSize)
+		if _, err := io.ReadFull(s.file, data); err != nil {
 			return fmt.Errorf("error reading record: %w", err)
 		}
 
-		activeData = append(activeData, keyData{key: key, data: data})
+		activeData = append(activeData, keyData{key: h.key, meta: h.meta, data: data})
 	}
 
 	// Seek to beginning of file
@@ -938,13 +1302,31 @@ func (s *SKV) compactInternal() error {
 	}
 
 	// Write all active records in-place using writeRecordAtPosition
-	newCache := make(map[string]int64)
+	if err := s.cache.reset(); err != nil {
+		return err
+	}
+	bucketsByID := make(map[uint64]*bucketState)
+	for _, b := range s.buckets {
+		bucketsByID[b.id] = b
+		b.cache = make(memoryKeys)
+	}
 	for _, kd := range activeData {
-		pos, err := s.writeRecordAtPosition(kd.key, kd.data)
+		pos, err := s.writeRecordAtPosition(kd.key, &kd.meta, kd.data)
 		if err != nil {
 			return fmt.Errorf("error writing record: %w", err)
 		}
-		newCache[string(kd.key)] = pos
+		switch {
+		case kd.meta.bucketDef != 0:
+			bucketsByID[kd.meta.bucketDef].position = pos
+		case kd.meta.bucket != 0:
+			bucketsByID[kd.meta.bucket].cache[string(kd.key)] = pos
+		case kd.meta.indexDef:
+			s.indexes[string(kd.key)].position = pos
+		default:
+			if err := s.cache.set(string(kd.key), pos); err != nil {
+				return err
+			}
+		}
 	}
 
 	// Get current position (end of compacted data)
@@ -963,8 +1345,8 @@ func (s *SKV) compactInternal() error {
 		return fmt.Errorf("error syncing file: %w", err)
 	}
 
-	// Update cache with new positions
-	s.cache = newCache
+	s.invalidateAllReaders()
+	s.values.purge()
 
 	// Clear free space list (compaction eliminates all deleted records)
 	s.freeSpace = make([]FreeSpace, 0)
@@ -974,13 +1356,21 @@ func (s *SKV) compactInternal() error {
 
 // Keys returns a list of all active keys in the database
 func (s *SKV) Keys() ([][]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+
 	// Convert cache keys to slice
-	keys := make([][]byte, 0, len(s.cache))
-	for keyStr := range s.cache {
+	keyStrs, err := indexKeys(s.cache, "")
+	keys := make([][]byte, 0, len(keyStrs))
+	for _, keyStr := range keyStrs {
 		keys = append(keys, []byte(keyStr))
 	}
 
-	return keys, nil
+	return keys, err
 }
 
 // String-based convenience functions
@@ -1011,11 +1401,13 @@ func (s *SKV) DeleteString(key string) error {
 
 // KeysString returns a list of all active keys as strings
 func (s *SKV) KeysString() ([]string, error) {
-	keys := make([]string, 0, len(s.cache))
-	for keyStr := range s.cache {
-		keys = append(keys, keyStr)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.checkOpen(); err != nil {
+		return nil, err
 	}
-	return keys, nil
+	return indexKeys(s.cache, "")
 }
 
 // Exists checks if a key exists in the database
@@ -1023,7 +1415,10 @@ func (s *SKV) Exists(key []byte) bool {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	_, exists := s.cache[string(key)]
+	if s.closed {
+		return false
+	}
+	_, exists := s.cache.get(string(key))
 	return exists
 }
 
@@ -1047,7 +1442,10 @@ func (s *SKV) Count() int {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	return len(s.cache)
+	if s.closed {
+		return 0
+	}
+	return s.cache.len()
 }
 
 // Clear removes all keys from the database by truncating the file
@@ -1055,6 +1453,14 @@ func (s *SKV) Clear() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+	return s.clearInternal()
+}
+
+// clearInternal is the internal implementation of Clear without locking
+func (s *SKV) clearInternal() error {
 	// Truncate the file to 0 bytes
 	if err := s.file.Truncate(0); err != nil {
 		return fmt.Errorf("error truncating file: %w", err)
@@ -1071,8 +1477,19 @@ func (s *SKV) Clear() error {
 	}
 
 	// Clear the cache and free space list
-	s.cache = make(map[string]int64)
+	if err := s.cache.reset(); err != nil {
+		return err
+	}
 	s.freeSpace = make([]FreeSpace, 0)
+	s.buckets = nil
+	s.invalidateAllReaders()
+	s.values.purge()
+
+	// Indexes stay defined
+	if err := s.writeIndexDefinitions(); err != nil {
+		return err
+	}
+	s.notify(opClear, nil, nil)
 
 	return nil
 }
@@ -1099,11 +1516,25 @@ func (s *SKV) GetOrDefaultString(key string, defaultValue string) string {
 // The callback function receives each key-value pair
 // If the callback returns an error, iteration stops and the error is returned
 func (s *SKV) ForEach(fn func(key []byte, value []byte) error) error {
+	return s.ForEachContext(context.Background(), fn)
+}
+
+// ForEachContext is ForEach, stopping with the context's error once ctx is
+// done. The context is checked before each key.
+func (s *SKV) ForEachContext(ctx context.Context, fn func(key []byte, value []byte) error) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+
 	// Iterate over all cached keys
-	for _, position := range s.cache {
+	return s.cache.each(func(_ string, position int64) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		// Seek to the record position
 		if _, err := s.file.Seek(position, io.SeekStart); err != nil {
 			return fmt.Errorf("error seeking to position: %w", err)
@@ -1116,12 +1547,8 @@ func (s *SKV) ForEach(fn func(key []byte, value []byte) error) error {
 		}
 
 		// Call the callback function
-		if err := fn(key, data); err != nil {
-			return err
-		}
-	}
-
-	return nil
+		return fn(key, data)
+	})
 }
 
 // ForEachString iterates over all active keys and values as strings
@@ -1137,30 +1564,43 @@ func (s *SKV) PutBatch(items map[string][]byte) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Check if any key already exists
-	for key := range items {
-		if _, exists := s.cache[key]; exists {
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+
+	// Check if any key already exists, and the limits for the whole batch
+	limits := s.newLimitCheck()
+	for key, data := range items {
+		if _, exists := s.cache.get(key); exists {
 			return fmt.Errorf("key %q already exists: %w", key, ErrKeyExists)
 		}
+		if len(key) > 0 && len(key) <= 255 {
+			if err := limits.put([]byte(key), nil, uint64(len(data))); err != nil {
+				return err
+			}
+		}
+	}
+	if err := limits.check(); err != nil {
+		return err
 	}
 
 	// Write all records
 	for key, data := range items {
 		keyBytes := []byte(key)
 
-		if len(keyBytes) == 0 {
-			return fmt.Errorf("key cannot be empty")
-		}
-		if len(keyBytes) > 255 {
-			return fmt.Errorf("key %q too long (max 255 bytes)", key)
+		if err := checkKey(keyBytes); err != nil {
+			return fmt.Errorf("key %q: %w", key, err)
 		}
 
-		recordPos, err := s.writeRecord(keyBytes, data)
+		recordPos, err := s.writeRecord(keyBytes, nil, data)
 		if err != nil {
 			return fmt.Errorf("error writing key %q: %w", key, err)
 		}
 
-		s.cache[key] = recordPos
+		if err := s.cache.set(key, recordPos); err != nil {
+			return err
+		}
+		s.notify(opSet, keyBytes, data)
 	}
 
 	return nil
@@ -1182,14 +1622,22 @@ func (s *SKV) GetBatch(keys [][]byte) (map[string][]byte, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+
 	result := make(map[string][]byte, len(keys))
 
 	for _, key := range keys {
 		keyStr := string(key)
-		position, found := s.cache[keyStr]
+		position, found := s.cache.get(keyStr)
 		if !found {
 			continue // Skip missing keys
 		}
+		if data, ok := s.values.get(keyStr); ok {
+			result[keyStr] = data
+			continue
+		}
 
 		// Seek to the record position
 		if _, err := s.file.Seek(position, io.SeekStart); err != nil {
@@ -1201,6 +1649,7 @@ func (s *SKV) GetBatch(keys [][]byte) (map[string][]byte, error) {
 		if err != nil {
 			return nil, fmt.Errorf("error reading record: %w", err)
 		}
+		s.values.add(keyStr, data)
 
 		result[keyStr] = data
 	}
@@ -1214,49 +1663,23 @@ type BackupRecord struct {
 	Value    string `json:"value,omitempty"`     // Used when data is valid UTF-8 string
 	ValueB64 string `json:"value_b64,omitempty"` // Used when data is binary (base64 encoded)
 	IsBinary bool   `json:"is_binary"`           // True if ValueB64 is used
+	Checksum string `json:"checksum,omitempty"`  // CRC-64 of the value (absent in old backups)
 }
 
 // Backup creates a JSON backup of all key-value pairs in the database
 // For values <= 256 bytes, it attempts to store them as strings if they are valid UTF-8,
 // otherwise stores them as base64-encoded data
 // For values > 256 bytes, always uses base64 encoding
+// The backup starts with a manifest (see BackupManifest) and carries
+// checksums of every value and of the whole document, see VerifyBackup.
 func (s *SKV) Backup(filename string) error {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	records := make([]BackupRecord, 0, len(s.cache))
-
-	// Iterate through all cached keys
-	for key, position := range s.cache {
-		// Seek to the record position
-		if _, err := s.file.Seek(position, io.SeekStart); err != nil {
-			return fmt.Errorf("error seeking to position for key %q: %w", key, err)
-		}
-
-		// Read the record
-		_, _, data, _, err := s.readRecord(true)
-		if err != nil {
-			return fmt.Errorf("error reading record for key %q: %w", key, err)
-		}
-
-		record := BackupRecord{
-			Key: key,
-		}
-
-		// Decide how to encode the value
-		if len(data) <= 256 && utf8.Valid(data) {
-			// Try to store as string if it's valid UTF-8 and small enough
-			record.Value = string(data)
-			record.IsBinary = false
-		} else {
-			// Store as base64
-			record.ValueB64 = base64.StdEncoding.EncodeToString(data)
-			record.IsBinary = true
-		}
-
-		records = append(records, record)
-	}
+	return s.BackupContext(context.Background(), filename)
+}
 
+// BackupContext is Backup, stopping with the context's error once ctx is
+// done. The context is checked between records, the backup file of a
+// cancelled backup is removed.
+func (s *SKV) BackupContext(ctx context.Context, filename string) error {
 	// Create the backup file
 	file, err := os.Create(filename)
 	if err != nil {
@@ -1264,60 +1687,89 @@ func (s *SKV) Backup(filename string) error {
 	}
 	defer file.Close()
 
-	// Encode to JSON with indentation for readability
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(records); err != nil {
-		return fmt.Errorf("error encoding backup to JSON: %w", err)
+	if err := s.backupJSON(ctx, file); err != nil {
+		if ctx.Err() != nil {
+			file.Close()
+			os.Remove(filename)
+		}
+		return err
 	}
 
-	return nil
+	return file.Close()
 }
 
-// Restore loads key-value pairs from a JSON backup file
-// This will overwrite existing keys with the same name
-// The database is not cleared before restore - existing keys not in the backup remain
-func (s *SKV) Restore(filename string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// BackupJSONTo writes a JSON backup of all key-value pairs to w
+// The format is the same as Backup. Use BackupTo for large databases.
+func (s *SKV) BackupJSONTo(w io.Writer) error {
+	return s.backupJSON(context.Background(), w)
+}
 
-	// Open the backup file
-	file, err := os.Open(filename)
+// backupJSON writes a JSON backup to w, see BackupJSONTo
+func (s *SKV) backupJSON(ctx context.Context, w io.Writer) error {
+	records, err := s.backupRecords(ctx)
 	if err != nil {
-		return fmt.Errorf("error opening backup file: %w", err)
+		return err
 	}
-	defer file.Close()
+	sort.Slice(records, func(i, j int) bool { return records[i].Key < records[j].Key })
 
-	// Decode JSON
-	var records []BackupRecord
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&records); err != nil {
-		return fmt.Errorf("error decoding backup JSON: %w", err)
+	doc := backupDocument{
+		Manifest: s.newBackupManifest(BackupKindFull),
+		Records:  records,
 	}
+	doc.Manifest.Records = len(records)
 
-	// Restore each record
-	for _, record := range records {
-		var data []byte
+	return writeBackupDocument(w, &doc)
+}
 
-		if record.IsBinary {
-			// Decode from base64
-			data, err = base64.StdEncoding.DecodeString(record.ValueB64)
-			if err != nil {
-				return fmt.Errorf("error decoding base64 for key %q: %w", record.Key, err)
-			}
-		} else {
-			// Use string value directly
-			data = []byte(record.Value)
+// backupRecords returns the backup records of all keys, in no particular order
+func (s *SKV) backupRecords(ctx context.Context) ([]BackupRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	records := make([]BackupRecord, 0, s.cache.len())
+
+	// Iterate through all cached keys
+	err := s.cache.each(func(key string, position int64) error {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
 
-		// Write the record to the database
-		key := []byte(record.Key)
-		if err := s.putInternal(key, data); err != nil {
-			return fmt.Errorf("error restoring key %q: %w", record.Key, err)
+		// Read the record
+		_, _, data, err := s.readRecordAt(position)
+		if err != nil {
+			return fmt.Errorf("error reading record for key %q: %w", key, err)
 		}
+
+		records = append(records, newBackupRecord(key, data))
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return records, nil
+}
 
-	return nil
+// Restore loads key-value pairs from a backup file (JSON or binary)
+// This will overwrite existing keys with the same name
+// The database is not cleared before restore - existing keys not in the backup remain
+// Incremental backups created with BackupIncremental can be passed after the
+// full backup, in the order they were taken. The whole chain is checked
+// before anything is applied.
+// Use RestoreWithOptions for the other restore modes and a report.
+func (s *SKV) Restore(filenames ...string) error {
+	_, err := s.RestoreWithOptions(RestoreOptions{}, filenames...)
+	return err
+}
+
+// RestoreContext is Restore, stopping with the context's error once ctx is
+// done, see RestoreWithOptionsContext
+func (s *SKV) RestoreContext(ctx context.Context, filenames ...string) error {
+	_, err := s.RestoreWithOptionsContext(ctx, RestoreOptions{}, filenames...)
+	return err
 }
 
 // GetBatchString retrieves multiple keys using strings
@@ -1343,41 +1795,30 @@ func (s *SKV) GetBatchString(keys []string) (map[string]string, error) {
 }
 
 // PutFile stores a file from disk into the database
-// The file contents are read and stored as the value for the given key
+// The file contents are streamed and stored as the value for the given key,
+// together with the file's mode and modification time (see StatFile)
 // Returns error if file cannot be read or if key already exists
 func (s *SKV) PutFile(key string, filePath string) error {
-	data, err := os.ReadFile(filePath)
-	if err != nil {
-		return fmt.Errorf("error reading file %s: %w", filePath, err)
-	}
-	return s.Put([]byte(key), data)
+	_, err := s.storeFile([]byte(key), filePath, storeCreate)
+	return err
 }
 
 // GetFile retrieves a value from the database and writes it to a file
 // Creates the file if it doesn't exist, overwrites if it does
+// The mode and modification time stored by PutFile are applied to the file,
+// values stored without them are written with mode 0644
 // Returns error if key not found or if file cannot be written
 func (s *SKV) GetFile(key string, filePath string) error {
-	data, err := s.Get([]byte(key))
-	if err != nil {
-		return err
-	}
-
-	err = os.WriteFile(filePath, data, 0644)
-	if err != nil {
-		return fmt.Errorf("error writing file %s: %w", filePath, err)
-	}
-
-	return nil
+	_, err := s.restoreFile(key, filePath)
+	return err
 }
 
 // UpdateFile updates an existing key with the contents of a file
+// The file's mode and modification time replace the stored ones
 // Returns error if file cannot be read or if key doesn't exist
 func (s *SKV) UpdateFile(key string, filePath string) error {
-	data, err := os.ReadFile(filePath)
-	if err != nil {
-		return fmt.Errorf("error reading file %s: %w", filePath, err)
-	}
-	return s.Update([]byte(key), data)
+	_, err := s.storeFile([]byte(key), filePath, storeReplace)
+	return err
 }
 
 // PutStream stores a new key by reading its value from an io.Reader
@@ -1385,34 +1826,46 @@ func (s *SKV) UpdateFile(key string, filePath string) error {
 // The size parameter must be the exact number of bytes that will be read from the reader
 // Returns ErrKeyExists if the key already exists
 func (s *SKV) PutStream(key []byte, reader io.Reader, size int64) error {
+	return s.PutStreamContext(context.Background(), key, reader, size)
+}
+
+// PutStreamContext is PutStream, stopping with the context's error once ctx
+// is done. The context is checked between chunks of the value, a partly
+// written record is rolled back into free space.
+func (s *SKV) PutStreamContext(ctx context.Context, key []byte, reader io.Reader, size int64) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if len(key) == 0 {
-		return fmt.Errorf("key cannot be empty")
+	if err := s.checkWritable(); err != nil {
+		return err
 	}
-	if len(key) > 255 {
-		return fmt.Errorf("key too long (max 255 bytes)")
+	if err := checkKey(key); err != nil {
+		return err
 	}
 	if size < 0 {
 		return fmt.Errorf("size cannot be negative")
 	}
 
 	// Check if the key already exists in cache
-	if _, exists := s.cache[string(key)]; exists {
+	if _, exists := s.cache.get(string(key)); exists {
 		return ErrKeyExists
 	}
+	if err := s.checkPut(key, nil, uint64(size)); err != nil {
+		return err
+	}
 
 	// Write the record using streaming approach
-	recordPos, err := s.writeRecordStream(key, reader, uint64(size))
+	recordPos, err := s.writeRecordStreamContext(ctx, key, nil, reader, uint64(size))
 	if err != nil {
 		return err
 	}
 
 	// Update cache with record start position
-	s.cache[string(key)] = recordPos
+	if err := s.cache.set(string(key), recordPos); err != nil {
+		return err
+	}
 
-	return nil
+	return s.notifyStream(key, recordPos)
 }
 
 // PutStreamString is a convenience wrapper for PutStream using string keys
@@ -1428,17 +1881,23 @@ func (s *SKV) UpdateStream(key []byte, reader io.Reader, size int64) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
 	if len(key) == 0 {
-		return fmt.Errorf("key cannot be empty")
+		return ErrEmptyKey
 	}
 	if size < 0 {
 		return fmt.Errorf("size cannot be negative")
 	}
 
 	// Check if the key exists in cache
-	if _, exists := s.cache[string(key)]; !exists {
+	if _, exists := s.cache.get(string(key)); !exists {
 		return ErrKeyNotFound
 	}
+	if err := s.checkPut(key, nil, uint64(size)); err != nil {
+		return err
+	}
 
 	// Key exists, delete it first (internal version without lock)
 	if err := s.deleteInternal(key); err != nil {
@@ -1446,15 +1905,17 @@ func (s *SKV) UpdateStream(key []byte, reader io.Reader, size int64) error {
 	}
 
 	// Write the record using streaming approach
-	recordPos, err := s.writeRecordStream(key, reader, uint64(size))
+	recordPos, err := s.writeRecordStream(key, nil, reader, uint64(size))
 	if err != nil {
 		return err
 	}
 
 	// Update cache with record start position
-	s.cache[string(key)] = recordPos
+	if err := s.cache.set(string(key), recordPos); err != nil {
+		return err
+	}
 
-	return nil
+	return s.notifyStream(key, recordPos)
 }
 
 // UpdateStreamString is a convenience wrapper for UpdateStream using string keys
@@ -1462,13 +1923,80 @@ func (s *SKV) UpdateStreamString(key string, reader io.Reader, size int64) error
 	return s.UpdateStream([]byte(key), reader, size)
 }
 
+// notifyStream reports a streamed write to observers and indexes
+// The value is only read back from the file when someone is observing
+func (s *SKV) notifyStream(key []byte, position int64) error {
+	s.values.remove(string(key))
+	if len(s.observers) == 0 && len(s.indexes) == 0 {
+		if s.prefixUsage != nil {
+			h, err := s.recordHeaderAt(position)
+			if err != nil {
+				return fmt.Errorf("error reading streamed record: %w", err)
+			}
+			s.trackUsage(key, int64(h.dataSize))
+		}
+		return nil
+	}
+
+	if _, err := s.file.Seek(position, io.SeekStart); err != nil {
+		return fmt.Errorf("error seeking to position: %w", err)
+	}
+	_, _, data, _, err := s.readRecord(true)
+	if err != nil {
+		return fmt.Errorf("error reading streamed record: %w", err)
+	}
+
+	s.notify(opSet, key, data)
+	return nil
+}
+
+// notifyInPlace reports a value changed in place without reading it: the
+// value cache drops the key and observers receive change (see observer).
+// Only indexes need the whole value, it is read back if one is defined.
+// Must be called with the write lock held
+func (s *SKV) notifyInPlace(op byte, key []byte, oldSize uint64, newSize uint64, change []byte) error {
+	s.values.remove(string(key))
+	s.trackUsage(key, int64(newSize)-int64(oldSize))
+	for _, idx := range s.indexes {
+		if idx.extractor == nil {
+			continue
+		}
+		position, _ := s.cache.get(string(key))
+		data, err := s.valueAt(position)
+		if err != nil {
+			return fmt.Errorf("error reading changed record: %w", err)
+		}
+		s.updateIndexes(opSet, key, data)
+		break
+	}
+	for _, fn := range s.observers {
+		fn(op, "", key, change)
+	}
+	return nil
+}
+
 // writeRecordStream writes a complete record by reading data from an io.Reader
 // This is used internally by PutStream and UpdateStream
 // Returns the position where the record was written
-func (s *SKV) writeRecordStream(key []byte, reader io.Reader, dataSize uint64) (int64, error) {
-	// Determine the type based on the data size
-	recordType := getRecordType(dataSize)
-	neededSize := calculateRecordSize(byte(len(key)), dataSize, recordType)
+func (s *SKV) writeRecordStream(key []byte, meta *recordMeta, reader io.Reader, dataSize uint64) (int64, error) {
+	return s.writeRecordStreamContext(context.Background(), key, meta, reader, dataSize)
+}
+
+// writeRecordStreamContext is writeRecordStream, stopping with the context's
+// error once ctx is done. The context is checked between chunks.
+// If the data can't be written in full, the partly written record is rolled
+// back into free space and the file stays consistent.
+func (s *SKV) writeRecordStreamContext(ctx context.Context, key []byte, meta *recordMeta, reader io.Reader, dataSize uint64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	meta = s.stampVersion(meta)
+	header, err := encodeRecordHeader(key, meta, dataSize)
+	if err != nil {
+		return 0, err
+	}
+	neededSize := uint64(len(header)) + dataSize
 
 	// Try to find suitable free space
 	freeIdx := s.findBestFreeSpace(neededSize)
@@ -1476,31 +2004,12 @@ func (s *SKV) writeRecordStream(key []byte, reader io.Reader, dataSize uint64) (
 	var recordPos int64
 	if freeIdx >= 0 {
 		// Reuse free space
-		freeSlot := s.freeSpace[freeIdx]
-		recordPos = freeSlot.position
+		recordPos = s.freeSpace[freeIdx].position
 
 		// Seek to the free space position
 		if _, err := s.file.Seek(recordPos, io.SeekStart); err != nil {
 			return 0, fmt.Errorf("error seeking to free space: %w", err)
 		}
-
-		// Remove this free space from the list
-		defer func() {
-			s.freeSpace = append(s.freeSpace[:freeIdx], s.freeSpace[freeIdx+1:]...)
-		}()
-
-		// Calculate leftover space for later
-		leftover := freeSlot.size - neededSize
-		defer func() {
-			if leftover > 0 {
-				padding := make([]byte, leftover)
-				for i := range padding {
-					padding[i] = PaddingByte
-				}
-				s.file.Write(padding)
-				s.file.Sync()
-			}
-		}()
 	} else {
 		// No suitable free space, append to end of file
 		if _, err := s.file.Seek(0, io.SeekEnd); err != nil {
@@ -1525,46 +2034,42 @@ func (s *SKV) writeRecordStream(key []byte, reader io.Reader, dataSize uint64) (
 		}
 	}
 
-	// Write the type
-	if _, err := s.file.Write([]byte{recordType}); err != nil {
-		return 0, fmt.Errorf("error writing type: %w", err)
+	if err := s.markMetadata(header[0]); err != nil {
+		return 0, err
 	}
+	if err := s.streamRecord(ctx, header, reader, dataSize); err != nil {
+		if rollbackErr := s.rollbackRecord(recordPos, header[0], neededSize, freeIdx); rollbackErr != nil {
+			return 0, errors.Join(err, rollbackErr)
+		}
+		return 0, err
+	}
+
+	if freeIdx >= 0 {
+		// If there's leftover space, fill with padding
+		if leftover := s.freeSpace[freeIdx].size - neededSize; leftover > 0 {
+			if _, err := s.file.Write(bytes.Repeat([]byte{PaddingByte}, int(leftover))); err != nil {
+				return 0, fmt.Errorf("error writing padding: %w", err)
+			}
+		}
 
-	// Write the key size
-	keySize := byte(len(key))
-	if _, err := s.file.Write([]byte{keySize}); err != nil {
-		return 0, fmt.Errorf("error writing key size: %w", err)
+		// Remove this free space from the list
+		s.freeSpace = append(s.freeSpace[:freeIdx], s.freeSpace[freeIdx+1:]...)
 	}
 
-	// Write the key
-	if _, err := s.file.Write(key); err != nil {
-		return 0, fmt.Errorf("error writing key: %w", err)
+	// Sync to disk
+	if err := s.file.Sync(); err != nil {
+		return 0, fmt.Errorf("error syncing to disk: %w", err)
 	}
 
-	// Write the data size according to the type
-	switch recordType {
-	case Type1Byte:
-		if _, err := s.file.Write([]byte{byte(dataSize)}); err != nil {
-			return 0, fmt.Errorf("error writing data size: %w", err)
-		}
-	case Type2Bytes:
-		buf := make([]byte, 2)
-		binary.LittleEndian.PutUint16(buf, uint16(dataSize))
-		if _, err := s.file.Write(buf); err != nil {
-			return 0, fmt.Errorf("error writing data size: %w", err)
-		}
-	case Type4Bytes:
-		buf := make([]byte, 4)
-		binary.LittleEndian.PutUint32(buf, uint32(dataSize))
-		if _, err := s.file.Write(buf); err != nil {
-			return 0, fmt.Errorf("error writing data size: %w", err)
-		}
-	case Type8Bytes:
-		buf := make([]byte, 8)
-		binary.LittleEndian.PutUint64(buf, dataSize)
-		if _, err := s.file.Write(buf); err != nil {
-			return 0, fmt.Errorf("error writing data size: %w", err)
-		}
+	return recordPos, nil
+}
+
+// streamRecord writes a record header and then its data read from reader at
+// the current position, checking ctx between chunks
+func (s *SKV) streamRecord(ctx context.Context, header []byte, reader io.Reader, dataSize uint64) error {
+	// Write type, key size, key, metadata and data size
+	if _, err := s.file.Write(header); err != nil {
+		return fmt.Errorf("error writing record header: %w", err)
 	}
 
 	// Stream the data from reader in chunks
@@ -1573,6 +2078,10 @@ func (s *SKV) writeRecordStream(key []byte, reader io.Reader, dataSize uint64) (
 	remaining := dataSize
 
 	for remaining > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		chunkSize := bufferSize
 		if remaining < bufferSize {
 			chunkSize = int(remaining)
@@ -1582,17 +2091,17 @@ func (s *SKV) writeRecordStream(key []byte, reader io.Reader, dataSize uint64) (
 		n, err := io.ReadFull(reader, chunk)
 		if err != nil {
 			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				return 0, fmt.Errorf("reader provided less data than specified size: expected %d, got %d", dataSize, totalRead+int64(n))
+				return fmt.Errorf("%w: reader provided less data than specified size: expected %d, got %d", ErrSizeMismatch, dataSize, totalRead+int64(n))
 			}
-			return 0, fmt.Errorf("error reading data chunk: %w", err)
+			return fmt.Errorf("error reading data chunk: %w", err)
 		}
 
 		written, err := s.file.Write(chunk[:n])
 		if err != nil {
-			return 0, fmt.Errorf("error writing data chunk: %w", err)
+			return fmt.Errorf("error writing data chunk: %w", err)
 		}
 		if written != n {
-			return 0, fmt.Errorf("incomplete write: expected %d, wrote %d", n, written)
+			return fmt.Errorf("incomplete write: expected %d, wrote %d", n, written)
 		}
 
 		totalRead += int64(n)
@@ -1603,30 +2112,59 @@ func (s *SKV) writeRecordStream(key []byte, reader io.Reader, dataSize uint64) (
 	extraCheck := make([]byte, 1)
 	n, err := reader.Read(extraCheck)
 	if err == nil && n > 0 {
-		return 0, fmt.Errorf("reader provided more data than specified size: expected %d bytes", dataSize)
+		return fmt.Errorf("%w: reader provided more data than specified size: expected %d bytes", ErrSizeMismatch, dataSize)
 	}
 
-	// Sync to disk
-	if err := s.file.Sync(); err != nil {
-		return 0, fmt.Errorf("error syncing to disk: %w", err)
+	return nil
+}
+
+// rollbackRecord turns a partly written record back into free space
+// A record appended to the file is cut off. A record written into the free
+// slot freeIdx is marked deleted and the rest of the slot padded, so the
+// slot stays in the free space list.
+func (s *SKV) rollbackRecord(recordPos int64, recordType byte, neededSize uint64, freeIdx int) error {
+	if freeIdx < 0 {
+		if err := s.file.Truncate(recordPos); err != nil {
+			return fmt.Errorf("error removing partial record: %w", err)
+		}
+		return s.file.Sync()
 	}
 
-	return recordPos, nil
+	if leftover := s.freeSpace[freeIdx].size - neededSize; leftover > 0 {
+		padding := bytes.Repeat([]byte{PaddingByte}, int(leftover))
+		if _, err := s.file.WriteAt(padding, recordPos+int64(neededSize)); err != nil {
+			return fmt.Errorf("error padding partial record: %w", err)
+		}
+	}
+	if _, err := s.file.WriteAt([]byte{recordType | DeletedFlag}, recordPos); err != nil {
+		return fmt.Errorf("error marking partial record as deleted: %w", err)
+	}
+	return s.file.Sync()
 }
 
 // GetStream retrieves the value for a key and writes it to an io.Writer
 // This is useful for large values that shouldn't be loaded entirely into memory
 // Returns the number of bytes written and any error encountered
 func (s *SKV) GetStream(key []byte, writer io.Writer) (int64, error) {
+	return s.GetStreamContext(context.Background(), key, writer)
+}
+
+// GetStreamContext is GetStream, stopping with the context's error once ctx
+// is done. The context is checked between chunks of the value.
+func (s *SKV) GetStreamContext(ctx context.Context, key []byte, writer io.Writer) (int64, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if err := s.checkOpen(); err != nil {
+		return 0, err
+	}
+
 	if len(key) == 0 {
-		return 0, fmt.Errorf("key cannot be empty")
+		return 0, ErrEmptyKey
 	}
 
 	// Check cache for position
-	position, found := s.cache[string(key)]
+	position, found := s.cache.get(string(key))
 	if !found {
 		return 0, ErrKeyNotFound
 	}
@@ -1636,56 +2174,12 @@ func (s *SKV) GetStream(key []byte, writer io.Writer) (int64, error) {
 		return 0, fmt.Errorf("error seeking to position: %w", err)
 	}
 
-	// Read record type
-	typeBuf := make([]byte, 1)
-	if _, err := io.ReadFull(s.file, typeBuf); err != nil {
-		return 0, fmt.Errorf("error reading type: %w", err)
-	}
-	recordType := typeBuf[0]
-
-	// Read key size
-	keySizeBuf := make([]byte, 1)
-	if _, err := io.ReadFull(s.file, keySizeBuf); err != nil {
-		return 0, fmt.Errorf("error reading key size: %w", err)
-	}
-	keySize := keySizeBuf[0]
-
-	// Skip the key
-	if _, err := s.file.Seek(int64(keySize), io.SeekCurrent); err != nil {
-		return 0, fmt.Errorf("error skipping key: %w", err)
-	}
-
-	// Read data size
-	baseType := getBaseType(recordType)
-	var dataSize uint64
-	switch baseType {
-	case Type1Byte:
-		buf := make([]byte, 1)
-		if _, err := io.ReadFull(s.file, buf); err != nil {
-			return 0, fmt.Errorf("error reading data size: %w", err)
-		}
-		dataSize = uint64(buf[0])
-	case Type2Bytes:
-		buf := make([]byte, 2)
-		if _, err := io.ReadFull(s.file, buf); err != nil {
-			return 0, fmt.Errorf("error reading data size: %w", err)
-		}
-		dataSize = uint64(binary.LittleEndian.Uint16(buf))
-	case Type4Bytes:
-		buf := make([]byte, 4)
-		if _, err := io.ReadFull(s.file, buf); err != nil {
-			return 0, fmt.Errorf("error reading data size: %w", err)
-		}
-		dataSize = uint64(binary.LittleEndian.Uint32(buf))
-	case Type8Bytes:
-		buf := make([]byte, 8)
-		if _, err := io.ReadFull(s.file, buf); err != nil {
-			return 0, fmt.Errorf("error reading data size: %w", err)
-		}
-		dataSize = binary.LittleEndian.Uint64(buf)
-	default:
-		return 0, fmt.Errorf("unknown record type: 0x%02X", recordType)
+	// Read the record header
+	h, err := readRecordHeader(s.file)
+	if err != nil {
+		return 0, corruptAt(err, position)
 	}
+	dataSize := h.dataSize
 
 	// Stream the data in chunks to avoid loading everything into memory
 	const bufferSize = 64 * 1024 // 64KB buffer
@@ -1693,6 +2187,10 @@ func (s *SKV) GetStream(key []byte, writer io.Writer) (int64, error) {
 	remaining := dataSize
 
 	for remaining > 0 {
+		if err := ctx.Err(); err != nil {
+			return totalWritten, err
+		}
+
 		chunkSize := bufferSize
 		if remaining < bufferSize {
 			chunkSize = int(remaining)
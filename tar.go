@@ -0,0 +1,214 @@
+package skv
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// TarOptions configures ExportTarWithOptions and ImportTarWithOptions
+type TarOptions struct {
+	// PathForKey returns the archive path of a key, or false to leave the key out
+	// Defaults to the key without the prefix
+	PathForKey func(key string) (string, bool)
+
+	// KeyForPath returns the key for an archive path, or false to skip the entry
+	// Defaults to the prefix followed by the path
+	KeyForPath func(path string) (string, bool)
+}
+
+// ExportTar writes the keys starting with prefix to w as a tar archive
+// Entry paths are the keys without the prefix. Keys stored by PutDir become
+// directories and symlinks again, and every entry keeps the mode and
+// modification time stored with it (0644 and the export time otherwise).
+func (s *SKV) ExportTar(w io.Writer, prefix string) (*DirStats, error) {
+	return s.ExportTarWithOptions(w, prefix, TarOptions{})
+}
+
+// ExportTarWithOptions writes the keys starting with prefix to w as a tar
+// archive, mapping keys to paths with opts.PathForKey
+// Values are streamed from the database file, so memory use doesn't depend
+// on the value sizes. The archive is not closed on error.
+func (s *SKV) ExportTarWithOptions(w io.Writer, prefix string, opts TarOptions) (*DirStats, error) {
+	pathForKey := opts.PathForKey
+	if pathForKey == nil {
+		pathForKey = func(key string) (string, bool) {
+			path := key[len(prefix):]
+			return path, path != "" && path != "/"
+		}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	keys, err := indexKeys(s.cache, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tw := tar.NewWriter(w)
+	stats := &DirStats{}
+
+	for _, key := range keys {
+		path, ok := pathForKey(key)
+		if !ok {
+			stats.Skipped++
+			continue
+		}
+
+		position, _ := s.cache.get(key)
+		h, value, err := s.recordDataAt(position)
+		if err != nil {
+			return stats, fmt.Errorf("error reading record for key %q: %w", key, err)
+		}
+
+		mode := fs.FileMode(h.meta.mode)
+		hdr := &tar.Header{
+			Name:    path,
+			ModTime: time.Unix(0, h.meta.modTime),
+			Format:  tar.FormatPAX, // Keeps sub-second modification times
+		}
+		if !h.meta.hasFile {
+			hdr.ModTime = now
+		}
+
+		switch {
+		case mode.IsDir() || strings.HasSuffix(key, "/"):
+			if mode == 0 {
+				mode = fs.ModeDir | 0755
+			}
+			hdr.Typeflag = tar.TypeDir
+			if !strings.HasSuffix(hdr.Name, "/") {
+				hdr.Name += "/"
+			}
+			stats.Dirs++
+
+		case mode&fs.ModeSymlink != 0:
+			target := make([]byte, h.dataSize)
+			if _, err := io.ReadFull(value, target); err != nil {
+				return stats, fmt.Errorf("error reading value for key %q: %w", key, err)
+			}
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = string(target)
+			stats.Links++
+
+		default:
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(h.dataSize)
+			stats.Files++
+			stats.Bytes += hdr.Size
+		}
+		hdr.Mode = tarMode(mode)
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return stats, fmt.Errorf("error writing tar header for key %q: %w", key, err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := io.Copy(tw, value); err != nil {
+				return stats, fmt.Errorf("error writing value for key %q: %w", key, err)
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return stats, fmt.Errorf("error closing tar archive: %w", err)
+	}
+	return stats, nil
+}
+
+// tarMode returns the tar header mode for a stored file mode
+// Regular files stored without a mode get 0644
+func tarMode(mode fs.FileMode) int64 {
+	perm := int64(filePerm(mode).Perm())
+	if mode&fs.ModeSetuid != 0 {
+		perm |= 04000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		perm |= 02000
+	}
+	if mode&fs.ModeSticky != 0 {
+		perm |= 01000
+	}
+	return perm
+}
+
+// ImportTar stores the entries of the tar archive read from r under prefix
+// Keys are the prefix followed by the entry path, directories end with "/".
+// Existing keys are overwritten. Entries other than regular files,
+// directories and symlinks are skipped.
+func (s *SKV) ImportTar(r io.Reader, prefix string) (*DirStats, error) {
+	return s.ImportTarWithOptions(r, prefix, TarOptions{})
+}
+
+// ImportTarWithOptions stores the entries of the tar archive read from r,
+// mapping paths to keys with opts.KeyForPath
+// File contents are streamed into the database one entry at a time.
+// On error the entries imported so far remain stored.
+func (s *SKV) ImportTarWithOptions(r io.Reader, prefix string, opts TarOptions) (*DirStats, error) {
+	keyForPath := opts.KeyForPath
+	if keyForPath == nil {
+		keyForPath = func(path string) (string, bool) {
+			return prefix + path, true
+		}
+	}
+
+	tr := tar.NewReader(r)
+	stats := &DirStats{}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return stats, nil
+		}
+		if err != nil {
+			return stats, fmt.Errorf("error reading tar archive: %w", err)
+		}
+
+		path := strings.TrimPrefix(hdr.Name, "./")
+		if hdr.Typeflag == tar.TypeDir && !strings.HasSuffix(path, "/") {
+			path += "/"
+		}
+		if path == "" || path == "/" {
+			continue // The archive root
+		}
+
+		key, ok := keyForPath(path)
+		if !ok {
+			stats.Skipped++
+			continue
+		}
+
+		meta := &recordMeta{
+			hasFile: true,
+			mode:    uint32(hdr.FileInfo().Mode()),
+			modTime: hdr.ModTime.UnixNano(),
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			err = s.storeValue([]byte(key), meta, tr, hdr.Size, storeUpsert)
+			stats.Files++
+			stats.Bytes += hdr.Size
+		case tar.TypeDir:
+			err = s.storeValue([]byte(key), meta, bytes.NewReader(nil), 0, storeUpsert)
+			stats.Dirs++
+		case tar.TypeSymlink:
+			err = s.storeValue([]byte(key), meta, strings.NewReader(hdr.Linkname), int64(len(hdr.Linkname)), storeUpsert)
+			stats.Links++
+		default:
+			stats.Skipped++
+		}
+		if err != nil {
+			return stats, fmt.Errorf("error importing %s: %w", hdr.Name, err)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package skv
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTarRoundTrip(t *testing.T) {
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "src")
+	modTime := writeTestTree(t, src)
+
+	large := filepath.Join("examples", "02-advanced", "file_operations", "data", "files", "large3.bin")
+	largeData, err := os.ReadFile(large)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", large, err)
+	}
+
+	db, err := Open(filepath.Join(tmpDir, "test.skv"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := db.PutDir("site/", src); err != nil {
+		t.Fatalf("PutDir failed: %v", err)
+	}
+	if err := db.PutFile("site/large3.bin", large); err != nil {
+		t.Fatalf("PutFile failed: %v", err)
+	}
+	db.PutString("site/plain.txt", "no metadata")
+	db.PutString("other", "not exported")
+
+	archive := filepath.Join(tmpDir, "site.tar")
+	file, err := os.Create(archive)
+	if err != nil {
+		t.Fatalf("Failed to create archive: %v", err)
+	}
+	stats, err := db.ExportTar(file, "site/")
+	file.Close()
+	if err != nil {
+		t.Fatalf("ExportTar failed: %v", err)
+	}
+	if stats.Files != 4 || stats.Dirs != 1 || stats.Links != 1 {
+		t.Errorf("Expected 4 files, 1 dir and 1 link, got %+v", stats)
+	}
+
+	// The archive can be read by any tar reader
+	file, _ = os.Open(archive)
+	tr := tar.NewReader(file)
+	names := make([]string, 0)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Invalid archive: %v", err)
+		}
+		names = append(names, hdr.Name)
+		if hdr.Name == "bin/run.sh" && (hdr.Mode != 0755 || !hdr.ModTime.Equal(modTime)) {
+			t.Errorf("Expected mode 0755 and time %v, got %o and %v", modTime, hdr.Mode, hdr.ModTime)
+		}
+	}
+	file.Close()
+	expected := "a.txt bin/ bin/run.sh large3.bin link plain.txt"
+	if got := strings.Join(names, " "); got != expected {
+		t.Errorf("Expected entries %q, got %q", expected, got)
+	}
+
+	// Import under another prefix
+	file, _ = os.Open(archive)
+	defer file.Close()
+	if _, err := db.ImportTar(file, "copy/"); err != nil {
+		t.Fatalf("ImportTar failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := db.GetStreamString("copy/large3.bin", &buf); err != nil {
+		t.Fatalf("GetStream failed: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), largeData) {
+		t.Errorf("large3.bin changed in the round trip (%d bytes, expected %d)", buf.Len(), len(largeData))
+	}
+	if value, _ := db.GetString("copy/plain.txt"); value != "no metadata" {
+		t.Errorf("Unexpected value %q", value)
+	}
+	info, err := db.StatFile("copy/bin/")
+	if err != nil || !info.Mode.IsDir() || info.Mode.Perm() != 0750 || !info.ModTime.Equal(modTime) {
+		t.Errorf("Expected directory metadata to be kept, got %+v (%v)", info, err)
+	}
+	if target, _ := db.GetString("copy/link"); target != "a.txt" {
+		t.Errorf("Expected link target a.txt, got %q", target)
+	}
+}
+
+func TestTarMapping(t *testing.T) {
+	tmpDir := t.TempDir()
+	db, err := Open(filepath.Join(tmpDir, "test.skv"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	db.PutString("scripts:main.js", "js")
+	db.PutString("scripts:skip.tmp", "tmp")
+
+	var buf bytes.Buffer
+	_, err = db.ExportTarWithOptions(&buf, "scripts:", TarOptions{
+		PathForKey: func(key string) (string, bool) {
+			return "js/" + strings.TrimPrefix(key, "scripts:"), !strings.HasSuffix(key, ".tmp")
+		},
+	})
+	if err != nil {
+		t.Fatalf("ExportTar failed: %v", err)
+	}
+
+	stats, err := db.ImportTarWithOptions(&buf, "", TarOptions{
+		KeyForPath: func(path string) (string, bool) {
+			return "assets:" + strings.ReplaceAll(path, "/", ":"), true
+		},
+	})
+	if err != nil {
+		t.Fatalf("ImportTar failed: %v", err)
+	}
+	if stats.Files != 1 {
+		t.Errorf("Expected 1 file, got %+v", stats)
+	}
+	if value, _ := db.GetString("assets:js:main.js"); value != "js" {
+		t.Errorf("Expected mapped key, got %q", value)
+	}
+	if db.ExistsString("assets:js:skip.tmp") {
+		t.Error("Keys mapped out should not be exported")
+	}
+
+	// Keys without metadata get a regular mode and a recent time
+	info, _ := db.StatFile("assets:js:main.js")
+	if info.Mode != 0644 || time.Since(info.ModTime) > time.Minute {
+		t.Errorf("Expected mode 0644 and a recent time, got %v and %v", info.Mode, info.ModTime)
+	}
+}
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"compress/gzip"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/jncss/skv"
 )
@@ -40,13 +46,14 @@ func handlePut() {
 
 // handleGet retrieves a value
 func handleGet() {
-	if len(os.Args) != 4 {
-		fmt.Fprintln(os.Stderr, "Usage: skv get <database> <key>")
+	args, options, err := splitArgs(os.Args[2:])
+	if err != nil || len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: skv get <database> <key> [--show-version]")
 		os.Exit(1)
 	}
 
-	dbPath := os.Args[2]
-	key := os.Args[3]
+	dbPath := args[0]
+	key := args[1]
 
 	db, err := skv.Open(dbPath)
 	if err != nil {
@@ -55,7 +62,7 @@ func handleGet() {
 	}
 	defer db.Close()
 
-	value, err := db.GetString(key)
+	value, version, err := db.GetWithVersionString(key)
 	if err != nil {
 		if err == skv.ErrKeyNotFound {
 			fmt.Fprintf(os.Stderr, "Error: Key '%s' not found\n", key)
@@ -65,19 +72,29 @@ func handleGet() {
 		os.Exit(1)
 	}
 
+	if _, ok := options["--show-version"]; ok {
+		fmt.Fprintf(os.Stderr, "Version: %d\n", version)
+	}
 	fmt.Print(value)
 }
 
 // handleUpdate updates an existing key
 func handleUpdate() {
-	if len(os.Args) != 5 {
-		fmt.Fprintln(os.Stderr, "Usage: skv update <database> <key> <value>")
+	args, options, err := splitArgs(os.Args[2:], "--if-version")
+	if err != nil || len(args) != 3 {
+		fmt.Fprintln(os.Stderr, "Usage: skv update <database> <key> <value> [--if-version N]")
 		os.Exit(1)
 	}
 
-	dbPath := os.Args[2]
-	key := os.Args[3]
-	value := os.Args[4]
+	dbPath := args[0]
+	key := args[1]
+	value := args[2]
+
+	expected, checkVersion, err := versionOption(options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
 
 	db, err := skv.Open(dbPath)
 	if err != nil {
@@ -86,7 +103,11 @@ func handleUpdate() {
 	}
 	defer db.Close()
 
-	err = db.UpdateString(key, value)
+	if checkVersion {
+		_, err = db.CompareAndSwapString(key, expected, value)
+	} else {
+		err = db.UpdateString(key, value)
+	}
 	if err != nil {
 		if err == skv.ErrKeyNotFound {
 			fmt.Fprintf(os.Stderr, "Error: Key '%s' not found. Use 'put' to create it.\n", key)
@@ -96,13 +117,95 @@ func handleUpdate() {
 		os.Exit(1)
 	}
 
-	fmt.Printf("✓ Updated key '%s'\n", key)
+	version, _ := db.VersionString(key)
+	fmt.Printf("✓ Updated key '%s' (version %d)\n", key, version)
 }
 
 // handleDelete deletes a key
 func handleDelete() {
+	args, options, err := splitArgs(os.Args[2:], "--if-version")
+	if err != nil || len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: skv delete <database> <key> [--if-version N]")
+		os.Exit(1)
+	}
+
+	dbPath := args[0]
+	key := args[1]
+
+	expected, checkVersion, err := versionOption(options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	db, err := skv.Open(dbPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening database: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	if checkVersion {
+		err = db.DeleteIfVersionString(key, expected)
+	} else {
+		err = db.DeleteString(key)
+	}
+	if err != nil {
+		if err == skv.ErrKeyNotFound {
+			fmt.Fprintf(os.Stderr, "Error: Key '%s' not found\n", key)
+		} else {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+		os.Exit(1)
+	}
+
+	fmt.Printf("✓ Deleted key '%s'\n", key)
+}
+
+// versionOption parses the --if-version option
+// Returns false if the option wasn't given
+func versionOption(options map[string]string) (uint64, bool, error) {
+	value, ok := options["--if-version"]
+	if !ok {
+		return 0, false, nil
+	}
+	var version uint64
+	if _, err := fmt.Sscan(value, &version); err != nil {
+		return 0, false, fmt.Errorf("invalid version %q", value)
+	}
+	return version, true, nil
+}
+
+// handleSet stores a key, creating it or replacing its value
+func handleSet() {
+	if len(os.Args) != 5 {
+		fmt.Fprintln(os.Stderr, "Usage: skv set <database> <key> <value>")
+		os.Exit(1)
+	}
+
+	dbPath := os.Args[2]
+	key := os.Args[3]
+	value := os.Args[4]
+
+	db, err := skv.Open(dbPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening database: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	if err := db.SetString(key, value); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("✓ Set key '%s'\n", key)
+}
+
+// handleGetDel retrieves a value and deletes its key
+func handleGetDel() {
 	if len(os.Args) != 4 {
-		fmt.Fprintln(os.Stderr, "Usage: skv delete <database> <key>")
+		fmt.Fprintln(os.Stderr, "Usage: skv getdel <database> <key>")
 		os.Exit(1)
 	}
 
@@ -116,7 +219,7 @@ func handleDelete() {
 	}
 	defer db.Close()
 
-	err = db.DeleteString(key)
+	value, err := db.GetAndDeleteString(key)
 	if err != nil {
 		if err == skv.ErrKeyNotFound {
 			fmt.Fprintf(os.Stderr, "Error: Key '%s' not found\n", key)
@@ -126,7 +229,7 @@ func handleDelete() {
 		os.Exit(1)
 	}
 
-	fmt.Printf("✓ Deleted key '%s'\n", key)
+	fmt.Print(value)
 }
 
 // handleExists checks if a key exists
@@ -249,6 +352,45 @@ func handleForEach() {
 	}
 }
 
+// handleQuery prints the key-value pairs matching a filter
+func handleQuery() {
+	args, options, err := splitArgs(os.Args[2:], "--prefix", "--fields", "--limit")
+	if err != nil || len(args) < 1 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, "Usage: skv query <database> [filter] [--prefix P] [--fields f1,f2] [--limit N]")
+		os.Exit(1)
+	}
+
+	q := skv.Query{Prefix: options["--prefix"]}
+	if len(args) == 2 {
+		q.Filter = args[1]
+	}
+	if fields, ok := options["--fields"]; ok {
+		q.Fields = strings.Split(fields, ",")
+	}
+	if limit, ok := options["--limit"]; ok {
+		if _, err := fmt.Sscan(limit, &q.Limit); err != nil || q.Limit < 0 {
+			fmt.Fprintf(os.Stderr, "Error: invalid limit %q\n", limit)
+			os.Exit(1)
+		}
+	}
+
+	db, err := skv.Open(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening database: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	err = db.QueryString(q, func(key string, value string) error {
+		fmt.Printf("%s=%s\n", key, value)
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
 // handlePutFile stores file contents
 func handlePutFile() {
 	if len(os.Args) != 5 {
@@ -346,6 +488,59 @@ func handleUpdateFile() {
 	fmt.Printf("✓ Updated key '%s' with file '%s' (%d bytes)\n", key, filePath, info.Size())
 }
 
+// handlePutDir stores a directory tree under a key prefix
+func handlePutDir() {
+	handleDirCommand("putdir", func(db *skv.SKV, prefix string, dir string, opts skv.DirOptions) (*skv.DirStats, error) {
+		return db.PutDirWithOptions(prefix, dir, opts)
+	})
+}
+
+// handleGetDir writes the keys under a prefix to a directory tree
+func handleGetDir() {
+	handleDirCommand("getdir", func(db *skv.SKV, prefix string, dir string, opts skv.DirOptions) (*skv.DirStats, error) {
+		return db.GetDirWithOptions(prefix, dir, opts)
+	})
+}
+
+// handleDirCommand parses the arguments shared by putdir and getdir and runs copy
+func handleDirCommand(name string, copy func(*skv.SKV, string, string, skv.DirOptions) (*skv.DirStats, error)) {
+	args, options, err := splitArgs(os.Args[2:])
+	if err != nil || len(args) != 3 {
+		fmt.Fprintf(os.Stderr, "Usage: skv %s <database> <prefix> <directory> [--sync] [--delete]\n", name)
+		os.Exit(1)
+	}
+
+	dbPath, prefix, dir := args[0], args[1], args[2]
+	var opts skv.DirOptions
+	_, opts.Sync = options["--sync"]
+	_, opts.Delete = options["--delete"]
+
+	db, err := skv.Open(dbPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening database: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	stats, err := copy(db, prefix, dir, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		if errors.Is(err, skv.ErrKeyExists) {
+			fmt.Fprintln(os.Stderr, "Use --sync to update existing keys.")
+		}
+		os.Exit(1)
+	}
+
+	fmt.Printf("✓ Copied %d files, %d directories and %d symlinks (%d bytes)\n",
+		stats.Files, stats.Dirs, stats.Links, stats.Bytes)
+	if opts.Sync {
+		fmt.Printf("  %d unchanged\n", stats.Unchanged)
+	}
+	if opts.Delete {
+		fmt.Printf("  %d removed\n", stats.Removed)
+	}
+}
+
 // handlePutStream streams file to database
 func handlePutStream() {
 	if len(os.Args) != 5 {
@@ -536,16 +731,29 @@ func handleGetBatch() {
 	}
 }
 
-// handleBackup creates JSON backup
+// handleBackup creates a JSON or binary backup
+// Writing to "-" streams a binary backup to stdout unless --format json is given
 func handleBackup() {
-	if len(os.Args) != 4 {
-		fmt.Fprintln(os.Stderr, "Usage: skv backup <database> <json-file>")
+	if len(os.Args) != 4 && !(len(os.Args) == 6 && os.Args[4] == "--format") {
+		fmt.Fprintln(os.Stderr, "Usage: skv backup <database> <file|-> [--format json|binary]")
 		os.Exit(1)
 	}
 
 	dbPath := os.Args[2]
 	backupPath := os.Args[3]
 
+	format := "json"
+	if backupPath == "-" {
+		format = "binary"
+	}
+	if len(os.Args) == 6 {
+		format = os.Args[5]
+	}
+	if format != "json" && format != "binary" {
+		fmt.Fprintf(os.Stderr, "Unknown backup format %q (use json or binary)\n", format)
+		os.Exit(1)
+	}
+
 	db, err := skv.Open(dbPath)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error opening database: %v\n", err)
@@ -553,7 +761,26 @@ func handleBackup() {
 	}
 	defer db.Close()
 
-	err = db.Backup(backupPath)
+	if backupPath == "-" {
+		if format == "binary" {
+			err = db.BackupTo(os.Stdout)
+		} else {
+			err = db.BackupJSONTo(os.Stdout)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating backup: %v\n", err)
+			os.Exit(1)
+		}
+		// Status goes to stderr so stdout only carries the backup
+		fmt.Fprintf(os.Stderr, "✓ Backup written to stdout (%d keys, %s)\n", db.Count(), format)
+		return
+	}
+
+	if format == "binary" {
+		err = backupBinaryFile(db, backupPath)
+	} else {
+		err = db.Backup(backupPath)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error creating backup: %v\n", err)
 		os.Exit(1)
@@ -564,15 +791,83 @@ func handleBackup() {
 	fmt.Printf("✓ Backup created: %s (%d keys, %d bytes)\n", backupPath, count, info.Size())
 }
 
-// handleRestore restores from JSON backup
+// backupBinaryFile writes a binary backup to a file
+func backupBinaryFile(db *skv.SKV, backupPath string) error {
+	file, err := os.Create(backupPath)
+	if err != nil {
+		return err
+	}
+	if err := db.BackupTo(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// handleBackupIncremental creates an incremental JSON backup
+func handleBackupIncremental() {
+	if len(os.Args) != 5 {
+		fmt.Fprintln(os.Stderr, "Usage: skv backupinc <database> <base-backup> <json-file>")
+		os.Exit(1)
+	}
+
+	dbPath := os.Args[2]
+	basePath := os.Args[3]
+	backupPath := os.Args[4]
+
+	db, err := skv.Open(dbPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening database: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	err = db.BackupIncremental(basePath, backupPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating incremental backup: %v\n", err)
+		os.Exit(1)
+	}
+
+	info, _ := os.Stat(backupPath)
+	fmt.Printf("✓ Incremental backup created: %s (based on %s, %d bytes)\n", backupPath, basePath, info.Size())
+}
+
+// handleRestore restores from a backup file, a backup chain or stdin
 func handleRestore() {
-	if len(os.Args) != 4 {
-		fmt.Fprintln(os.Stderr, "Usage: skv restore <database> <json-file>")
+	usage := "Usage: skv restore <database> <file|-> [incremental-file ...] [--mode merge|replace|skip-existing] [--dry-run] [--prefix <prefix>]"
+	if len(os.Args) < 4 {
+		fmt.Fprintln(os.Stderr, usage)
 		os.Exit(1)
 	}
 
 	dbPath := os.Args[2]
-	backupPath := os.Args[3]
+
+	// Separate options from backup files
+	backupPaths, options, err := splitArgs(os.Args[3:], "--mode", "--prefix")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(1)
+	}
+	opts := skv.RestoreOptions{}
+	_, opts.DryRun = options["--dry-run"]
+	if prefix, ok := options["--prefix"]; ok {
+		opts.KeyFilter = func(key []byte) bool { return strings.HasPrefix(string(key), prefix) }
+	}
+	switch mode := options["--mode"]; mode {
+	case "", "merge":
+		opts.Mode = skv.RestoreMerge
+	case "replace":
+		opts.Mode = skv.RestoreReplace
+	case "skip-existing":
+		opts.Mode = skv.RestoreSkipExisting
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown restore mode %q (use merge, replace or skip-existing)\n", mode)
+		os.Exit(1)
+	}
+	if len(backupPaths) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(1)
+	}
 
 	db, err := skv.Open(dbPath)
 	if err != nil {
@@ -581,24 +876,364 @@ func handleRestore() {
 	}
 	defer db.Close()
 
-	err = db.Restore(backupPath)
+	if backupPaths[0] == "-" {
+		if len(backupPaths) > 1 || len(options) > 0 {
+			fmt.Fprintln(os.Stderr, "Incremental backups and restore options cannot be combined with stdin")
+			os.Exit(1)
+		}
+		err = db.RestoreFrom(os.Stdin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error restoring backup: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("✓ Restored from backup (%d keys)\n", db.Count())
+		return
+	}
+
+	report, err := db.RestoreWithOptions(opts, backupPaths...)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error restoring backup: %v\n", err)
 		os.Exit(1)
 	}
 
-	count := db.Count()
-	fmt.Printf("✓ Restored from backup (%d keys)\n", count)
+	if opts.DryRun {
+		fmt.Printf("Dry run (%s), no changes made:\n", opts.Mode)
+		for _, key := range report.Added {
+			fmt.Printf("  + %s\n", key)
+		}
+		for _, key := range report.Overwritten {
+			fmt.Printf("  ~ %s\n", key)
+		}
+		for _, key := range report.Skipped {
+			fmt.Printf("  = %s\n", key)
+		}
+		for _, key := range report.Removed {
+			fmt.Printf("  - %s\n", key)
+		}
+	} else {
+		fmt.Printf("✓ Restored from backup (%d keys)\n", db.Count())
+	}
+	fmt.Printf("  Added: %d, Overwritten: %d, Skipped: %d, Removed: %d\n",
+		len(report.Added), len(report.Overwritten), len(report.Skipped), len(report.Removed))
+}
+
+// handleExport writes all key-value pairs as NDJSON or CSV
+func handleExport() {
+	usage := "Usage: skv export <database> [file|-] [--format ndjson|csv] [--prefix <prefix>] [--binary base64|hex|skip|error]"
+	args, options, err := splitArgs(os.Args[2:], "--format", "--prefix", "--binary")
+	if err != nil || len(args) < 1 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(1)
+	}
+
+	dbPath := args[0]
+	outPath := "-"
+	if len(args) == 2 {
+		outPath = args[1]
+	}
+
+	format, err := exportFormat(options["--format"], outPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	opts := skv.ExportOptions{Prefix: options["--prefix"]}
+	switch mode := options["--binary"]; mode {
+	case "", "base64":
+		opts.Binary = skv.BinaryBase64
+	case "hex":
+		opts.Binary = skv.BinaryHex
+	case "skip":
+		opts.Binary = skv.BinarySkip
+	case "error":
+		opts.Binary = skv.BinaryError
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown binary mode %q (use base64, hex, skip or error)\n", mode)
+		os.Exit(1)
+	}
+
+	db, err := skv.Open(dbPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening database: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	out := os.Stdout
+	if outPath != "-" {
+		out, err = os.Create(outPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating file: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	err = db.ExportWithOptions(out, format, opts)
+	if outPath != "-" {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error exporting: %v\n", err)
+		os.Exit(1)
+	}
+
+	if outPath != "-" {
+		fmt.Printf("✓ Exported to %s (%s)\n", outPath, format)
+	}
+}
+
+// handleImport reads key-value pairs from NDJSON or CSV
+func handleImport() {
+	usage := "Usage: skv import <database> [file|-] [--format ndjson|csv] [--prefix <prefix>] [--skip-existing]"
+	args, options, err := splitArgs(os.Args[2:], "--format", "--prefix")
+	if err != nil || len(args) < 1 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(1)
+	}
+
+	dbPath := args[0]
+	inPath := "-"
+	if len(args) == 2 {
+		inPath = args[1]
+	}
+
+	format, err := exportFormat(options["--format"], inPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	opts := skv.ImportOptions{Prefix: options["--prefix"]}
+	_, opts.SkipExisting = options["--skip-existing"]
+
+	db, err := skv.Open(dbPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening database: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	in := os.Stdin
+	if inPath != "-" {
+		in, err = os.Open(inPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening file: %v\n", err)
+			os.Exit(1)
+		}
+		defer in.Close()
+	}
+
+	stats, err := db.Import(in, format, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error importing: %v\n", err)
+		if stats != nil {
+			fmt.Fprintf(os.Stderr, "%d keys imported before the error\n", stats.Imported)
+		}
+		os.Exit(1)
+	}
+
+	fmt.Printf("✓ Imported %d keys (%d skipped)\n", stats.Imported, stats.Skipped)
+}
+
+// exportFormat returns the format given with --format, or guesses it from the file extension
+func exportFormat(name string, path string) (skv.ExportFormat, error) {
+	if name == "" {
+		if strings.HasSuffix(strings.ToLower(path), ".csv") {
+			return skv.FormatCSV, nil
+		}
+		return skv.FormatNDJSON, nil
+	}
+	switch format := skv.ExportFormat(name); format {
+	case skv.FormatNDJSON, skv.FormatCSV:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown format %q (use ndjson or csv)", name)
+	}
+}
+
+// handleTar creates or extracts tar archives
+// Archive names ending in .gz or .tgz are gzip compressed
+func handleTar() {
+	usage := "Usage: skv tar create|extract <database> <archive|-> [--prefix <prefix>]"
+	args, options, err := splitArgs(os.Args[2:], "--prefix")
+	if err != nil || len(args) != 3 || (args[0] != "create" && args[0] != "extract") {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(1)
+	}
+
+	action, dbPath, archivePath := args[0], args[1], args[2]
+	prefix := options["--prefix"]
+	compressed := strings.HasSuffix(archivePath, ".gz") || strings.HasSuffix(archivePath, ".tgz")
+
+	db, err := skv.Open(dbPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening database: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	var stats *skv.DirStats
+	if action == "create" {
+		out := os.Stdout
+		if archivePath != "-" {
+			out, err = os.Create(archivePath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error creating archive: %v\n", err)
+				os.Exit(1)
+			}
+			defer out.Close()
+		}
+
+		var w io.Writer = out
+		var gz *gzip.Writer
+		if compressed {
+			gz = gzip.NewWriter(out)
+			w = gz
+		}
+		stats, err = db.ExportTar(w, prefix)
+		if err == nil && gz != nil {
+			err = gz.Close()
+		}
+		if err == nil && archivePath != "-" {
+			err = out.Close()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating archive: %v\n", err)
+			os.Exit(1)
+		}
+	} else {
+		in := os.Stdin
+		if archivePath != "-" {
+			in, err = os.Open(archivePath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error opening archive: %v\n", err)
+				os.Exit(1)
+			}
+			defer in.Close()
+		}
+
+		var r io.Reader = in
+		if compressed {
+			gz, err := gzip.NewReader(in)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error opening archive: %v\n", err)
+				os.Exit(1)
+			}
+			r = gz
+		}
+		stats, err = db.ImportTar(r, prefix)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error extracting archive: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Keep stdout clean when the archive is written there
+	status := os.Stdout
+	if archivePath == "-" {
+		status = os.Stderr
+	}
+	fmt.Fprintf(status, "✓ %d files, %d directories and %d symlinks (%d bytes)\n",
+		stats.Files, stats.Dirs, stats.Links, stats.Bytes)
+	if stats.Skipped > 0 {
+		fmt.Fprintf(status, "  %d entries skipped\n", stats.Skipped)
+	}
+}
+
+// handleVerifyBackup checks backup files without opening a database
+func handleVerifyBackup() {
+	if len(os.Args) < 3 {
+		fmt.Fprintln(os.Stderr, "Usage: skv verifybackup <file> [file ...]")
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, path := range os.Args[2:] {
+		info, err := skv.VerifyBackup(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "✗ %s: %v\n", path, err)
+			failed = true
+			continue
+		}
+
+		format := "json"
+		if info.Binary {
+			format = "binary"
+		}
+		fmt.Printf("✓ %s: valid %s backup (%d bytes)\n", path, format, info.Size)
+		if info.Manifest == nil {
+			fmt.Println("  No manifest (written by an older version), structure checked only")
+		} else {
+			m := info.Manifest
+			fmt.Printf("  Kind:     %s (version %d)\n", m.Kind, m.Version)
+			fmt.Printf("  Created:  %s\n", m.Created.Format(time.RFC3339))
+			if m.Source != "" {
+				fmt.Printf("  Source:   %s", m.Source)
+				if m.Host != "" {
+					fmt.Printf(" on %s", m.Host)
+				}
+				fmt.Println()
+			}
+			if m.Parent != "" {
+				fmt.Printf("  Parent:   %s", m.Parent)
+				if m.ParentFile != "" {
+					fmt.Printf(" (%s)", m.ParentFile)
+				}
+				fmt.Println()
+			}
+		}
+		fmt.Printf("  Records:  %d\n", info.Records)
+		if info.Deleted > 0 {
+			fmt.Printf("  Deleted:  %d\n", info.Deleted)
+		}
+		fmt.Printf("  Checksum: %s\n", info.Checksum)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// verifyDeep checks the structure of a database and lists the findings
+// Exits with status 1 if there are any.
+func verifyDeep(db *skv.SKV) {
+	findings, err := db.VerifyDeep()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error verifying database: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(findings) == 0 {
+		fmt.Println("✓ No structural problems found")
+		return
+	}
+	for _, f := range findings {
+		fmt.Printf("✗ %s\n", f)
+	}
+	fmt.Printf("%d problem(s) found\n", len(findings))
+	db.Close()
+	os.Exit(1)
 }
 
 // handleVerify checks database integrity
 func handleVerify() {
-	if len(os.Args) != 3 {
-		fmt.Fprintln(os.Stderr, "Usage: skv verify <database>")
+	args, options, err := splitArgs(os.Args[2:])
+	if err != nil || len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: skv verify <database> [--deep]")
 		os.Exit(1)
 	}
 
-	dbPath := os.Args[2]
+	dbPath := args[0]
+	_, deep := options["--deep"]
+	if skv.IsSegmented(dbPath) {
+		if deep {
+			fmt.Fprintln(os.Stderr, "Error: --deep checks a database file, e.g. a segment of the directory")
+			os.Exit(1)
+		}
+		verifySegmented(dbPath)
+		return
+	}
 
 	db, err := skv.Open(dbPath)
 	if err != nil {
@@ -607,6 +1242,11 @@ func handleVerify() {
 	}
 	defer db.Close()
 
+	if deep {
+		verifyDeep(db)
+		return
+	}
+
 	stats, err := db.Verify()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error verifying database: %v\n", err)
@@ -632,6 +1272,16 @@ func handleVerify() {
 	fmt.Printf("Avg Data Size:    %.2f bytes\n", stats.AverageDataSize)
 	fmt.Println()
 
+	if len(stats.Buckets) > 0 {
+		fmt.Println("Buckets:")
+		for _, name := range db.ListBuckets() {
+			bucket := stats.Buckets[name]
+			fmt.Printf("  %-20s %d keys, %d bytes, %d deleted (%d bytes)\n",
+				name, bucket.ActiveRecords, bucket.DataSize, bucket.DeletedRecords, bucket.WastedSpace)
+		}
+		fmt.Println()
+	}
+
 	if stats.WastedPercent > 30 {
 		fmt.Println("⚠ Warning: Wasted space > 30%. Consider running 'skv compact' to optimize.")
 	} else {
@@ -639,6 +1289,238 @@ func handleVerify() {
 	}
 }
 
+// verifySegmented prints the statistics of every segment of a segmented
+// database and the totals
+func verifySegmented(dir string) {
+	db, err := skv.OpenSegmented(dir, skv.SegmentOptions{Options: skv.Options{ReadOnly: true}})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening segmented database: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	stats, err := db.Verify()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error verifying database: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("%-10s %10s %10s %14s %10s\n", "Segment", "Active", "Deleted", "File Size", "Wasted")
+	for _, seg := range stats.Segments {
+		name := fmt.Sprintf("%d", seg.ID)
+		if seg.Active {
+			name += "*"
+		}
+		fmt.Printf("%-10s %10d %10d %14d %9.2f%%\n", name, seg.ActiveRecords, seg.DeletedRecords, seg.FileSize, seg.WastedPercent)
+	}
+	fmt.Printf("%-10s %10d %10d %14d %9.2f%%\n", "Total", stats.ActiveRecords, stats.DeletedRecords, stats.FileSize, stats.WastedPercent)
+	fmt.Println("(* active segment)")
+	fmt.Println()
+
+	if stats.WastedPercent > 30 {
+		fmt.Println("⚠ Warning: Wasted space > 30%. Consider running 'skv merge' to optimize.")
+	} else {
+		fmt.Println("✓ Database health: Good")
+	}
+}
+
+// handleMerge rewrites the segments of a segmented database with the most
+// garbage
+func handleMerge() {
+	args, options, err := splitArgs(os.Args[2:], "--threshold")
+	if err != nil || len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: skv merge <directory> [--threshold <percent>]")
+		os.Exit(1)
+	}
+
+	dir := args[0]
+	opts := skv.SegmentOptions{}
+	if value, ok := options["--threshold"]; ok {
+		if _, err := fmt.Sscan(value, &opts.MergeThreshold); err != nil || opts.MergeThreshold <= 0 {
+			fmt.Fprintf(os.Stderr, "Error: invalid threshold %q\n", value)
+			os.Exit(1)
+		}
+	}
+	if !skv.IsSegmented(dir) {
+		fmt.Fprintf(os.Stderr, "Error: %s is not a segmented database\n", dir)
+		os.Exit(1)
+	}
+
+	db, err := skv.OpenSegmented(dir, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening segmented database: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	merged, err := db.Merge()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error merging segments: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("✓ Merged %d segments, %d left\n", merged, db.Segments())
+}
+
+// handleQuota prints the usage of a database against the given limits
+func handleQuota() {
+	args, options, err := splitArgs(os.Args[2:], "--max-value", "--max-keys", "--max-file", "--quota")
+	if err != nil || len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: skv quota <database> [--max-value <bytes>] [--max-keys <n>] [--max-file <bytes>] [--quota <prefix=bytes,...>]")
+		os.Exit(1)
+	}
+
+	limits := skv.Limits{PrefixQuotas: make(map[string]int64)}
+	for name, target := range map[string]*int64{"--max-value": &limits.MaxValueSize, "--max-file": &limits.MaxFileSize} {
+		if value, ok := options[name]; ok {
+			if _, err := fmt.Sscan(value, target); err != nil || *target < 0 {
+				fmt.Fprintf(os.Stderr, "Error: invalid %s %q\n", name, value)
+				os.Exit(1)
+			}
+		}
+	}
+	if value, ok := options["--max-keys"]; ok {
+		if _, err := fmt.Sscan(value, &limits.MaxKeys); err != nil || limits.MaxKeys < 0 {
+			fmt.Fprintf(os.Stderr, "Error: invalid --max-keys %q\n", value)
+			os.Exit(1)
+		}
+	}
+	if value, ok := options["--quota"]; ok {
+		for _, quota := range strings.Split(value, ",") {
+			prefix, bytes, found := strings.Cut(quota, "=")
+			var size int64
+			if _, err := fmt.Sscan(bytes, &size); !found || err != nil || size < 0 {
+				fmt.Fprintf(os.Stderr, "Error: invalid quota %q, expected prefix=bytes\n", quota)
+				os.Exit(1)
+			}
+			limits.PrefixQuotas[prefix] = size
+		}
+	}
+
+	db, err := skv.OpenWithOptions(args[0], skv.Options{ReadOnly: true, Limits: limits})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening database: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	usage, err := db.Usage()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading usage: %v\n", err)
+		os.Exit(1)
+	}
+
+	exceeded := false
+	printUsage := func(name string, u skv.QuotaUsage) {
+		if u.Max == 0 {
+			fmt.Printf("%-24s %14d %14s\n", name, u.Used, "-")
+			return
+		}
+		mark := ""
+		if u.Used > u.Max {
+			mark = "  ⚠ exceeded"
+			exceeded = true
+		}
+		fmt.Printf("%-24s %14d %14d %7.1f%%%s\n", name, u.Used, u.Max, float64(u.Used)/float64(u.Max)*100, mark)
+	}
+
+	fmt.Printf("%-24s %14s %14s %8s\n", "Limit", "Used", "Max", "Usage")
+	printUsage("Keys", usage.Keys)
+	printUsage("File size", usage.FileSize)
+	printUsage("Largest value", usage.ValueSize)
+	prefixes := make([]string, 0, len(usage.Prefixes))
+	for prefix := range usage.Prefixes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		printUsage(fmt.Sprintf("Prefix %q", prefix), usage.Prefixes[prefix])
+	}
+
+	if exceeded {
+		os.Exit(1)
+	}
+}
+
+// handleShards prints the statistics of a sharded database
+func handleShards() {
+	if len(os.Args) != 3 {
+		fmt.Fprintln(os.Stderr, "Usage: skv shards <directory>")
+		os.Exit(1)
+	}
+
+	db, err := skv.OpenShardedWithOptions(os.Args[2], 0, skv.Options{ReadOnly: true})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening sharded database: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	stats, err := db.Verify()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error verifying database: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("%-8s %10s %10s %14s %10s\n", "Shard", "Active", "Deleted", "File Size", "Wasted")
+	for i, shard := range stats.Shards {
+		fmt.Printf("%-8d %10d %10d %14d %9.2f%%\n", i, shard.ActiveRecords, shard.DeletedRecords, shard.FileSize, shard.WastedPercent)
+	}
+	fmt.Printf("%-8s %10d %10d %14d %9.2f%%\n", "Total", stats.ActiveRecords, stats.DeletedRecords, stats.FileSize, stats.WastedPercent)
+}
+
+// handleReshard changes the number of shards of a sharded database
+func handleReshard() {
+	if len(os.Args) != 4 {
+		fmt.Fprintln(os.Stderr, "Usage: skv reshard <directory> <shards>")
+		os.Exit(1)
+	}
+
+	dir := os.Args[2]
+	var n int
+	if _, err := fmt.Sscan(os.Args[3], &n); err != nil || n <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: invalid number of shards %q\n", os.Args[3])
+		os.Exit(1)
+	}
+
+	if err := skv.Reshard(dir, n); err != nil {
+		fmt.Fprintf(os.Stderr, "Error resharding database: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("✓ Resharded '%s' into %d shards\n", dir, n)
+}
+
+// handleRepair salvages the readable records of a damaged database
+func handleRepair() {
+	args, options, err := splitArgs(os.Args[2:], "--quarantine")
+	if err != nil || len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: skv repair <database> <repaired> [--quarantine <file>]")
+		os.Exit(1)
+	}
+
+	src, dst := args[0], args[1]
+	report, err := skv.Repair(src, dst, skv.RepairOptions{QuarantinePath: options["--quarantine"]})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error repairing database: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Records found:    %d\n", report.Records)
+	fmt.Printf("Salvaged:         %d\n", report.Salvaged)
+	fmt.Printf("Superseded:       %d\n", report.Superseded)
+	fmt.Printf("Orphaned:         %d\n", report.Orphaned)
+	fmt.Printf("Damaged regions:  %d (%d bytes)\n", len(report.Damaged), report.DamagedBytes)
+	for _, region := range report.Damaged {
+		fmt.Printf("  offset %-10d %8d bytes  %s\n", region.Offset, region.Size, region.Reason)
+	}
+	if report.Quarantine != "" {
+		fmt.Printf("Quarantine:       %s\n", report.Quarantine)
+	}
+	fmt.Println()
+	fmt.Printf("✓ Repaired '%s' into '%s'\n", src, dst)
+}
+
 // handleCompact removes deleted records
 func handleCompact() {
 	if len(os.Args) != 3 {
@@ -647,6 +1529,10 @@ func handleCompact() {
 	}
 
 	dbPath := os.Args[2]
+	if skv.IsSegmented(dbPath) {
+		compactSegmented(dbPath)
+		return
+	}
 
 	db, err := skv.Open(dbPath)
 	if err != nil {
@@ -679,3 +1565,56 @@ func handleCompact() {
 	fmt.Printf("Size after:  %d bytes (%.2f MB)\n", sizeAfter, float64(sizeAfter)/1024/1024)
 	fmt.Printf("Saved:       %d bytes (%.2f MB, %.1f%%)\n", saved, float64(saved)/1024/1024, savedPercent)
 }
+
+// compactSegmented merges every segment with deleted records and compacts
+// the active segment of a segmented database
+func compactSegmented(dir string) {
+	db, err := skv.OpenSegmented(dir, skv.SegmentOptions{})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening segmented database: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	if err := db.Compact(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error compacting database: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("✓ Database compacted, %d segments left\n", db.Segments())
+}
+
+// splitArgs separates --options from positional arguments
+// Options listed in valueOptions take the next argument as their value,
+// any other option is a flag and maps to an empty string
+func splitArgs(args []string, valueOptions ...string) ([]string, map[string]string, error) {
+	positional := make([]string, 0, len(args))
+	options := make(map[string]string)
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "--") {
+			positional = append(positional, arg)
+			continue
+		}
+
+		takesValue := false
+		for _, name := range valueOptions {
+			if arg == name {
+				takesValue = true
+				break
+			}
+		}
+		if !takesValue {
+			options[arg] = ""
+			continue
+		}
+		if i+1 >= len(args) {
+			return nil, nil, fmt.Errorf("option %s needs a value", arg)
+		}
+		i++
+		options[arg] = args[i]
+	}
+
+	return positional, options, nil
+}
@@ -22,6 +22,12 @@ func main() {
 		handleUpdate()
 	case "delete":
 		handleDelete()
+	case "query":
+		handleQuery()
+	case "set":
+		handleSet()
+	case "getdel":
+		handleGetDel()
 	case "exists":
 		handleExists()
 	case "count":
@@ -38,6 +44,10 @@ func main() {
 		handleGetFile()
 	case "updatefile":
 		handleUpdateFile()
+	case "putdir":
+		handlePutDir()
+	case "getdir":
+		handleGetDir()
 	case "putstream":
 		handlePutStream()
 	case "getstream":
@@ -50,12 +60,32 @@ func main() {
 		handleGetBatch()
 	case "backup":
 		handleBackup()
+	case "backupinc":
+		handleBackupIncremental()
 	case "restore":
 		handleRestore()
+	case "export":
+		handleExport()
+	case "import":
+		handleImport()
+	case "tar":
+		handleTar()
+	case "verifybackup":
+		handleVerifyBackup()
 	case "verify":
 		handleVerify()
 	case "compact":
 		handleCompact()
+	case "quota":
+		handleQuota()
+	case "repair":
+		handleRepair()
+	case "merge":
+		handleMerge()
+	case "shards":
+		handleShards()
+	case "reshard":
+		handleReshard()
 	case "help":
 		printHelp()
 	default:
@@ -76,16 +106,21 @@ func printUsage() {
 	fmt.Println("    get <db> <key>                   Retrieve a value")
 	fmt.Println("    update <db> <key> <value>        Update an existing key")
 	fmt.Println("    delete <db> <key>                Delete a key")
+	fmt.Println("    set <db> <key> <value>           Create or replace a key")
+	fmt.Println("    getdel <db> <key>                Retrieve a value and delete it")
 	fmt.Println("    exists <db> <key>                Check if key exists")
 	fmt.Println("    count <db>                       Count active keys")
 	fmt.Println("    keys <db>                        List all keys")
 	fmt.Println("    clear <db>                       Remove all keys")
 	fmt.Println("    foreach <db>                     Iterate over all keys")
+	fmt.Println("    query <db> <filter>              Find JSON values matching a filter")
 	fmt.Println()
 	fmt.Println("  File Operations:")
 	fmt.Println("    putfile <db> <key> <file>        Store file contents")
 	fmt.Println("    getfile <db> <key> <file>        Retrieve to file")
 	fmt.Println("    updatefile <db> <key> <file>     Update with file contents")
+	fmt.Println("    putdir <db> <prefix> <dir>       Store a directory tree")
+	fmt.Println("    getdir <db> <prefix> <dir>       Extract a directory tree")
 	fmt.Println()
 	fmt.Println("  Streaming Operations (for large values):")
 	fmt.Println("    putstream <db> <key> <file>      Stream file to database")
@@ -97,10 +132,20 @@ func printUsage() {
 	fmt.Println("    getbatch <db> <key1> <key2> ...  Retrieve multiple keys")
 	fmt.Println()
 	fmt.Println("  Backup & Maintenance:")
-	fmt.Println("    backup <db> <json-file>          Create JSON backup")
-	fmt.Println("    restore <db> <json-file>         Restore from backup")
-	fmt.Println("    verify <db>                      Check integrity & stats")
+	fmt.Println("    backup <db> <file|-> [--format]  Create JSON or binary backup")
+	fmt.Println("    backupinc <db> <base> <file>     Backup changes since base")
+	fmt.Println("    restore <db> <file|-> [...]      Restore from backup chain")
+	fmt.Println("    verifybackup <file> [...]        Check backup files")
+	fmt.Println("    export <db> [file|-]             Export as NDJSON or CSV")
+	fmt.Println("    import <db> [file|-]             Import NDJSON or CSV")
+	fmt.Println("    tar create|extract <db> <file|-> Write or read a tar archive")
+	fmt.Println("    verify <db> [--deep]             Check integrity & stats")
 	fmt.Println("    compact <db>                     Remove deleted records")
+	fmt.Println("    merge <dir>                      Merge the segments with the most garbage")
+	fmt.Println("    quota <db> [limits]              Show usage against limits")
+	fmt.Println("    repair <db> <repaired>           Salvage the records of a damaged database")
+	fmt.Println("    shards <dir>                     Show statistics of a sharded database")
+	fmt.Println("    reshard <dir> <n>                Change the number of shards")
 	fmt.Println()
 	fmt.Println("  Help:")
 	fmt.Println("    help                             Show detailed help")
@@ -122,15 +167,25 @@ func printHelp() {
 	fmt.Println("  Note: Returns error if key already exists. Use 'update' to modify.")
 	fmt.Println()
 	fmt.Println("GET - Retrieve a value")
-	fmt.Println("  Usage: skv get <database> <key>")
+	fmt.Println("  Usage: skv get <database> <key> [--show-version]")
 	fmt.Println("  Output: Prints the value to stdout")
+	fmt.Println("  Options: --show-version also prints the version of the key to stderr")
 	fmt.Println()
 	fmt.Println("UPDATE - Update an existing key")
-	fmt.Println("  Usage: skv update <database> <key> <value>")
+	fmt.Println("  Usage: skv update <database> <key> <value> [--if-version N]")
 	fmt.Println("  Note: Returns error if key doesn't exist. Use 'put' for new keys.")
+	fmt.Println("  Options: --if-version only updates if the key is still at version N")
 	fmt.Println()
 	fmt.Println("DELETE - Delete a key")
-	fmt.Println("  Usage: skv delete <database> <key>")
+	fmt.Println("  Usage: skv delete <database> <key> [--if-version N]")
+	fmt.Println("  Options: --if-version only deletes if the key is still at version N")
+	fmt.Println()
+	fmt.Println("SET - Create or replace a key")
+	fmt.Println("  Usage: skv set <database> <key> <value>")
+	fmt.Println()
+	fmt.Println("GETDEL - Retrieve a value and delete its key")
+	fmt.Println("  Usage: skv getdel <database> <key>")
+	fmt.Println("  Output: Prints the value to stdout")
 	fmt.Println()
 	fmt.Println("EXISTS - Check if a key exists")
 	fmt.Println("  Usage: skv exists <database> <key>")
@@ -152,17 +207,35 @@ func printHelp() {
 	fmt.Println("  Usage: skv foreach <database>")
 	fmt.Println("  Output: key=value (one per line)")
 	fmt.Println()
+	fmt.Println("QUERY - Find JSON values matching a filter")
+	fmt.Println("  Usage: skv query <database> [filter] [--prefix P] [--fields f1,f2] [--limit N]")
+	fmt.Println("  Filter: field paths compared with == != < <= > >= ^= (prefix), combined with && || ! and parentheses")
+	fmt.Println("  Example: skv query jobs.skv 'status == \"failed\" && attempts > 3'")
+	fmt.Println("  Output: key=value (one per line)")
+	fmt.Println()
 	fmt.Println("PUTFILE - Store file contents as a value")
 	fmt.Println("  Usage: skv putfile <database> <key> <filepath>")
-	fmt.Println("  Note: Reads entire file into memory")
+	fmt.Println("  Note: Keeps the file mode and modification time")
 	fmt.Println()
 	fmt.Println("GETFILE - Retrieve value to a file")
 	fmt.Println("  Usage: skv getfile <database> <key> <filepath>")
-	fmt.Println("  Note: Creates or overwrites the file")
+	fmt.Println("  Note: Creates or overwrites the file, restoring its mode and modification time")
 	fmt.Println()
 	fmt.Println("UPDATEFILE - Update key with file contents")
 	fmt.Println("  Usage: skv updatefile <database> <key> <filepath>")
 	fmt.Println()
+	fmt.Println("PUTDIR - Store a directory tree")
+	fmt.Println("  Usage: skv putdir <database> <prefix> <directory> [--sync] [--delete]")
+	fmt.Println("  Note: Keys are <prefix><relative path>, directories end with \"/\"")
+	fmt.Println("  --sync:   Only store files whose size, mode or time changed")
+	fmt.Println("  --delete: Remove keys under the prefix missing from the directory")
+	fmt.Println("  Example: skv putdir site.skv www/ ./public --sync --delete")
+	fmt.Println()
+	fmt.Println("GETDIR - Extract the keys under a prefix to a directory")
+	fmt.Println("  Usage: skv getdir <database> <prefix> <directory> [--sync] [--delete]")
+	fmt.Println("  --sync:   Only write files whose size, mode or time differ")
+	fmt.Println("  --delete: Remove files missing from the database")
+	fmt.Println()
 	fmt.Println("PUTSTREAM - Stream large file to database")
 	fmt.Println("  Usage: skv putstream <database> <key> <filepath>")
 	fmt.Println("  Note: Memory-efficient for large files")
@@ -182,20 +255,83 @@ func printHelp() {
 	fmt.Println("  Usage: skv getbatch <database> <key1> <key2> <key3> ...")
 	fmt.Println("  Output: key=value (one per line)")
 	fmt.Println()
-	fmt.Println("BACKUP - Create JSON backup")
-	fmt.Println("  Usage: skv backup <database> <json-file>")
-	fmt.Println("  Note: Creates human-readable JSON backup")
+	fmt.Println("BACKUP - Create JSON or binary backup")
+	fmt.Println("  Usage: skv backup <database> <file|-> [--format json|binary]")
+	fmt.Println("  Note: Files default to human-readable JSON, \"-\" streams binary to stdout")
+	fmt.Println("  Example: skv backup mydb.skv - | gzip > backup.skvb.gz")
 	fmt.Println()
-	fmt.Println("RESTORE - Restore from JSON backup")
-	fmt.Println("  Usage: skv restore <database> <json-file>")
+	fmt.Println("BACKUPINC - Create incremental JSON backup")
+	fmt.Println("  Usage: skv backupinc <database> <base-backup> <json-file>")
+	fmt.Println("  Note: Stores only keys changed or deleted since the base backup")
+	fmt.Println()
+	fmt.Println("RESTORE - Restore from backup")
+	fmt.Println("  Usage: skv restore <database> <file|-> [incremental-file ...]")
 	fmt.Println("  Note: Overwrites existing keys with same name")
+	fmt.Println("  Note: Incremental backups follow the full backup in the order taken")
+	fmt.Println("  Options: --mode merge|replace|skip-existing (default merge)")
+	fmt.Println("           --dry-run            Show the changes without applying them")
+	fmt.Println("           --prefix <prefix>    Only restore (and remove) keys with this prefix")
+	fmt.Println()
+	fmt.Println("VERIFYBACKUP - Check backup files")
+	fmt.Println("  Usage: skv verifybackup <file> [file ...]")
+	fmt.Println("  Note: Checks manifest and checksums without opening any database")
+	fmt.Println()
+	fmt.Println("EXPORT - Export key-value pairs as NDJSON or CSV")
+	fmt.Println("  Usage: skv export <database> [file|-] [--format ndjson|csv] [--prefix <prefix>] [--binary base64|hex|skip|error]")
+	fmt.Println("  Note: Writes to stdout by default, the format follows a .csv extension")
+	fmt.Println("  Example: skv export mydb.skv --prefix user: | jq .value")
+	fmt.Println()
+	fmt.Println("IMPORT - Import key-value pairs from NDJSON or CSV")
+	fmt.Println("  Usage: skv import <database> [file|-] [--format ndjson|csv] [--prefix <prefix>] [--skip-existing]")
+	fmt.Println("  Note: Reads stdin by default, existing keys are overwritten unless --skip-existing")
+	fmt.Println()
+	fmt.Println("TAR - Create or extract tar archives")
+	fmt.Println("  Usage: skv tar create <database> <archive|-> [--prefix <prefix>]")
+	fmt.Println("         skv tar extract <database> <archive|-> [--prefix <prefix>]")
+	fmt.Println("  Note: create archives the keys under the prefix, with the prefix removed;")
+	fmt.Println("        extract stores each entry under <prefix><path>")
+	fmt.Println("  Note: Archives ending in .gz or .tgz are gzip compressed")
+	fmt.Println("  Example: skv tar create files.skv docs.tar.gz --prefix docs/")
 	fmt.Println()
 	fmt.Println("VERIFY - Check database integrity")
-	fmt.Println("  Usage: skv verify <database>")
+	fmt.Println("  Usage: skv verify <database|directory>")
 	fmt.Println("  Output: Database statistics and health info")
+	fmt.Println("         skv verify <database> --deep")
+	fmt.Println("  Note: For a segmented database directory, statistics per segment")
+	fmt.Println("  Note: --deep checks the structure instead: index entries, duplicate keys,")
+	fmt.Println("        free space and padding; exits with status 1 if anything is wrong")
 	fmt.Println()
 	fmt.Println("COMPACT - Remove deleted records")
-	fmt.Println("  Usage: skv compact <database>")
+	fmt.Println("  Usage: skv compact <database|directory>")
 	fmt.Println("  Note: Reduces file size by removing wasted space")
+	fmt.Println("  Note: A segmented database merges every segment with deleted records")
+	fmt.Println()
+	fmt.Println("QUOTA - Show the usage of a database against limits")
+	fmt.Println("  Usage: skv quota <database> [--max-value <bytes>] [--max-keys <n>]")
+	fmt.Println("                              [--max-file <bytes>] [--quota <prefix=bytes,...>]")
+	fmt.Println("  Output: Keys, file size, largest value and bytes per prefix, with the limits")
+	fmt.Println("  Note: Exits with status 1 if the database exceeds a limit")
+	fmt.Println("  Example: skv quota mydb.skv --max-keys 10000 --quota user/=1048576")
+	fmt.Println()
+	fmt.Println("REPAIR - Salvage the records of a damaged database")
+	fmt.Println("  Usage: skv repair <database> <repaired> [--quarantine <file>]")
+	fmt.Println("  Output: Records salvaged and the damaged regions skipped")
+	fmt.Println("  Note: Writes the readable records, newest version of each key, to a new")
+	fmt.Println("        database; the damaged bytes go to <repaired>.quarantine by default")
+	fmt.Println("  Example: skv repair broken.skv fixed.skv")
+	fmt.Println()
+	fmt.Println("MERGE - Merge the segments of a segmented database")
+	fmt.Println("  Usage: skv merge <directory> [--threshold <percent>]")
+	fmt.Println("  Note: Rewrites the sealed segments with at least the threshold of garbage")
+	fmt.Println("        (default 50%) into the active segment, most garbage first")
+	fmt.Println()
+	fmt.Println("SHARDS - Show statistics of a sharded database")
+	fmt.Println("  Usage: skv shards <directory>")
+	fmt.Println("  Output: Records, file size and wasted space per shard, and totals")
+	fmt.Println("  Note: Shards are ordinary databases, e.g. 'skv verify <directory>/shard-000.skv'")
+	fmt.Println()
+	fmt.Println("RESHARD - Change the number of shards of a sharded database")
+	fmt.Println("  Usage: skv reshard <directory> <shards>")
+	fmt.Println("  Note: The database must not be in use while it's resharded")
 	fmt.Println()
 }
@@ -0,0 +1,206 @@
+package skv
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Codec converts values of type T to and from bytes
+type Codec[T any] interface {
+	Encode(v T) ([]byte, error)
+	Decode(data []byte) (T, error)
+}
+
+// JSONCodec returns a codec that stores values as JSON
+func JSONCodec[T any]() Codec[T] {
+	return jsonCodec[T]{}
+}
+
+type jsonCodec[T any] struct{}
+
+func (jsonCodec[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+// GobCodec returns a codec that stores values with encoding/gob
+// Each value is encoded on its own, so it carries its type description.
+func GobCodec[T any]() Codec[T] {
+	return gobCodec[T]{}
+}
+
+type gobCodec[T any] struct{}
+
+func (gobCodec[T]) Encode(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v)
+	return v, err
+}
+
+// BinaryCodec returns a codec for types whose pointer implements
+// encoding.BinaryMarshaler and encoding.BinaryUnmarshaler, e.g.
+// BinaryCodec[time.Time]()
+func BinaryCodec[T any, PT interface {
+	*T
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}]() Codec[T] {
+	return binaryCodec[T, PT]{}
+}
+
+type binaryCodec[T any, PT interface {
+	*T
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}] struct{}
+
+func (binaryCodec[T, PT]) Encode(v T) ([]byte, error) {
+	return PT(&v).MarshalBinary()
+}
+
+func (binaryCodec[T, PT]) Decode(data []byte) (T, error) {
+	var v T
+	err := PT(&v).UnmarshalBinary(data)
+	return v, err
+}
+
+// TypedStore stores values of type T in a database through a Codec
+// A TypedStore only sees the keys under its prefix, so one database can hold
+// several typed collections side by side (see WithPrefix). Keys passed to and
+// returned by its methods don't include the prefix.
+type TypedStore[T any] struct {
+	db     *SKV
+	codec  Codec[T]
+	prefix string
+}
+
+// Typed returns a store of T values in db using codec
+func Typed[T any](db *SKV, codec Codec[T]) *TypedStore[T] {
+	return &TypedStore[T]{db: db, codec: codec}
+}
+
+// WithPrefix returns a view of the store limited to keys under prefix
+// Prefixes nest: s.WithPrefix("a:").WithPrefix("b:") uses "a:b:".
+func (t *TypedStore[T]) WithPrefix(prefix string) *TypedStore[T] {
+	return &TypedStore[T]{db: t.db, codec: t.codec, prefix: t.prefix + prefix}
+}
+
+// Prefix returns the prefix of the store's keys in the database
+func (t *TypedStore[T]) Prefix() string {
+	return t.prefix
+}
+
+// Get retrieves and decodes the value of key
+// Returns ErrKeyNotFound if the key doesn't exist
+func (t *TypedStore[T]) Get(key string) (T, error) {
+	var zero T
+	data, err := t.db.Get([]byte(t.prefix + key))
+	if err != nil {
+		return zero, err
+	}
+	return t.decode(key, data)
+}
+
+// Put encodes and stores a new key
+// Returns ErrKeyExists if the key already exists
+func (t *TypedStore[T]) Put(key string, v T) error {
+	data, err := t.encode(key, v)
+	if err != nil {
+		return err
+	}
+	return t.db.Put([]byte(t.prefix+key), data)
+}
+
+// Update encodes and stores a new value for an existing key
+// Returns ErrKeyNotFound if the key doesn't exist
+func (t *TypedStore[T]) Update(key string, v T) error {
+	data, err := t.encode(key, v)
+	if err != nil {
+		return err
+	}
+	return t.db.Update([]byte(t.prefix+key), data)
+}
+
+// Set encodes and stores a value, creating the key or replacing its value
+func (t *TypedStore[T]) Set(key string, v T) error {
+	data, err := t.encode(key, v)
+	if err != nil {
+		return err
+	}
+	return t.db.Set([]byte(t.prefix+key), data)
+}
+
+// Delete deletes a key
+// Returns ErrKeyNotFound if the key doesn't exist
+func (t *TypedStore[T]) Delete(key string) error {
+	return t.db.Delete([]byte(t.prefix + key))
+}
+
+// All returns every value of the store by key
+// Stops at the first value that fails to decode.
+func (t *TypedStore[T]) All() (map[string]T, error) {
+	t.db.mu.RLock()
+	defer t.db.mu.RUnlock()
+
+	if err := t.db.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]T)
+	err := t.db.cache.each(func(fullKey string, position int64) error {
+		key, ok := strings.CutPrefix(fullKey, t.prefix)
+		if !ok {
+			return nil
+		}
+		data, err := t.db.valueAt(position)
+		if err != nil {
+			return err
+		}
+		v, err := t.decode(key, data)
+		if err != nil {
+			return err
+		}
+		values[key] = v
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+// encode encodes v, wrapping errors with the key
+func (t *TypedStore[T]) encode(key string, v T) ([]byte, error) {
+	data, err := t.codec.Encode(v)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding key %q: %w", t.prefix+key, err)
+	}
+	return data, nil
+}
+
+// decode decodes data, wrapping errors with the key
+func (t *TypedStore[T]) decode(key string, data []byte) (T, error) {
+	v, err := t.codec.Decode(data)
+	if err != nil {
+		return v, fmt.Errorf("error decoding key %q: %w", t.prefix+key, err)
+	}
+	return v, nil
+}
@@ -0,0 +1,98 @@
+package skv
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testUser struct {
+	Name string
+	Age  int
+}
+
+func TestTypedStore(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.skv"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	for name, codec := range map[string]Codec[testUser]{
+		"json": JSONCodec[testUser](),
+		"gob":  GobCodec[testUser](),
+	} {
+		users := Typed(db, codec).WithPrefix(name + ":")
+
+		if err := users.Put("alice", testUser{"Alice", 30}); err != nil {
+			t.Fatalf("%s: Put failed: %v", name, err)
+		}
+		if err := users.Put("alice", testUser{"Alice", 31}); !errors.Is(err, ErrKeyExists) {
+			t.Errorf("%s: Expected ErrKeyExists, got %v", name, err)
+		}
+		users.Set("bob", testUser{"Bob", 25})
+		users.Update("bob", testUser{"Bob", 26})
+
+		got, err := users.Get("bob")
+		if err != nil || got != (testUser{"Bob", 26}) {
+			t.Errorf("%s: Get returned %+v (%v)", name, got, err)
+		}
+		if _, err := users.Get("carol"); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("%s: Expected ErrKeyNotFound, got %v", name, err)
+		}
+
+		all, err := users.All()
+		if err != nil || len(all) != 2 || all["alice"].Age != 30 {
+			t.Errorf("%s: All returned %+v (%v)", name, all, err)
+		}
+
+		users.Delete("alice")
+		if all, _ := users.All(); len(all) != 1 {
+			t.Errorf("%s: Expected 1 value after Delete, got %d", name, len(all))
+		}
+	}
+
+	// Both collections live side by side in one database
+	if !db.ExistsString("json:bob") || !db.ExistsString("gob:bob") || db.Count() != 2 {
+		t.Errorf("Unexpected keys: %d", db.Count())
+	}
+
+	// BinaryMarshaler codec
+	times := Typed(db, BinaryCodec[time.Time]()).WithPrefix("time:")
+	now := time.Now().Round(0)
+	times.Put("now", now)
+	if got, err := times.Get("now"); err != nil || !got.Equal(now) {
+		t.Errorf("Expected %v, got %v (%v)", now, got, err)
+	}
+
+	db.Close()
+	if _, err := times.All(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from All after Close, got %v", err)
+	}
+}
+
+func TestTypedStoreDecodeError(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.skv"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	db.PutString("user:broken", "{not json")
+	users := Typed(db, JSONCodec[testUser]()).WithPrefix("user:")
+
+	_, err = users.Get("broken")
+	var syntaxErr *json.SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		t.Fatalf("Expected a wrapped JSON error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), `"user:broken"`) {
+		t.Errorf("Expected the error to name the key, got %v", err)
+	}
+	if _, err := users.All(); err == nil {
+		t.Error("Expected All to fail on an undecodable value")
+	}
+}
@@ -0,0 +1,221 @@
+package skv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// ErrValueChanged is returned by a ValueReader whose value was updated,
+// deleted or moved by Compact since it was opened
+var ErrValueChanged = errors.New("value changed since it was opened")
+
+// ValueReader reads a value directly from the database file without loading
+// it into memory. It implements io.Reader, io.Seeker, io.ReaderAt and io.Closer,
+// so io.NewSectionReader can be used for sub-ranges.
+//
+// A ValueReader only ever returns bytes of the value it was opened on: once
+// the key is updated, deleted or moved by Compact, Restore or Clear, every
+// read fails with ErrValueChanged. ReadAt may be called concurrently,
+// Read and Seek may not.
+type ValueReader struct {
+	db       *SKV
+	key      string
+	position int64 // Position of the record
+	offset   int64 // Position of the data
+	size     int64
+	pos      int64 // Offset used by Read and Seek
+
+	// Guarded by db.mu
+	stale  bool
+	closed bool
+}
+
+// Open returns a reader over the value of key
+// The reader must be closed when no longer needed.
+// Returns ErrKeyNotFound if the key doesn't exist
+func (s *SKV) Open(key []byte) (*ValueReader, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+
+	position, exists := s.cache.get(string(key))
+	if !exists {
+		return nil, ErrKeyNotFound
+	}
+
+	h, err := s.recordHeaderAt(position)
+	if err != nil {
+		return nil, fmt.Errorf("error reading record: %w", err)
+	}
+
+	v := &ValueReader{
+		db:       s,
+		key:      string(key),
+		position: position,
+		offset:   position + int64(h.headerSize),
+		size:     int64(h.dataSize),
+	}
+	if s.readers == nil {
+		s.readers = make(map[*ValueReader]struct{})
+	}
+	s.readers[v] = struct{}{}
+
+	return v, nil
+}
+
+// OpenString is a convenience wrapper for Open using string keys
+func (s *SKV) OpenString(key string) (*ValueReader, error) {
+	return s.Open([]byte(key))
+}
+
+// Key returns the key the reader was opened on
+func (v *ValueReader) Key() string {
+	return v.key
+}
+
+// Size returns the size of the value in bytes
+func (v *ValueReader) Size() int64 {
+	return v.size
+}
+
+// ReadAt reads len(p) bytes of the value starting at off
+func (v *ValueReader) ReadAt(p []byte, off int64) (int, error) {
+	v.db.mu.RLock()
+	defer v.db.mu.RUnlock()
+
+	switch {
+	case v.closed:
+		return 0, fs.ErrClosed
+	case v.db.closed:
+		return 0, ErrClosed
+	case v.stale:
+		return 0, ErrValueChanged
+	case off < 0:
+		return 0, fmt.Errorf("negative offset %d", off)
+	case off >= v.size:
+		return 0, io.EOF
+	}
+
+	n := int64(len(p))
+	if remaining := v.size - off; n > remaining {
+		n = remaining
+	}
+	read, err := v.db.file.ReadAt(p[:n], v.offset+off)
+	if err == nil && read < len(p) {
+		err = io.EOF
+	}
+	return read, err
+}
+
+// Read reads from the current offset, see Seek
+func (v *ValueReader) Read(p []byte) (int, error) {
+	n, err := v.ReadAt(p, v.pos)
+	v.pos += int64(n)
+	return n, err
+}
+
+// Seek sets the offset for the next Read
+func (v *ValueReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += v.pos
+	case io.SeekEnd:
+		offset += v.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %d", offset)
+	}
+	v.pos = offset
+	return offset, nil
+}
+
+// Close releases the reader
+func (v *ValueReader) Close() error {
+	v.db.mu.Lock()
+	defer v.db.mu.Unlock()
+
+	if v.closed {
+		return nil
+	}
+	v.closed = true
+	delete(v.db.readers, v)
+	return nil
+}
+
+// invalidateReaders marks the readers open on the record at position as stale
+// Must be called with the write lock held whenever a record is deleted
+func (s *SKV) invalidateReaders(position int64) {
+	for v := range s.readers {
+		if v.position == position {
+			v.stale = true
+			delete(s.readers, v)
+		}
+	}
+}
+
+// invalidateAllReaders marks every open reader as stale
+// Must be called with the write lock held whenever records are moved
+func (s *SKV) invalidateAllReaders() {
+	for v := range s.readers {
+		v.stale = true
+	}
+	s.readers = nil
+}
+
+// GetRange returns up to n bytes of the value of key starting at off
+// Fewer bytes are returned when the value ends first, as with HTTP range
+// requests. Returns ErrKeyNotFound if the key doesn't exist
+func (s *SKV) GetRange(key []byte, off int64, n int64) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+	if off < 0 || n < 0 {
+		return nil, fmt.Errorf("invalid range: offset %d, length %d", off, n)
+	}
+
+	position, exists := s.cache.get(string(key))
+	if !exists {
+		return nil, ErrKeyNotFound
+	}
+
+	h, value, err := s.recordDataAt(position)
+	if err != nil {
+		return nil, fmt.Errorf("error reading record: %w", err)
+	}
+	if off > int64(h.dataSize) {
+		return nil, fmt.Errorf("offset %d beyond value size %d", off, h.dataSize)
+	}
+	if remaining := int64(h.dataSize) - off; n > remaining {
+		n = remaining
+	}
+
+	data := make([]byte, n)
+	if _, err := value.ReadAt(data, off); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error reading data: %w", err)
+	}
+	return data, nil
+}
+
+// GetRangeString is a convenience wrapper for GetRange using string keys
+func (s *SKV) GetRangeString(key string, off int64, n int64) ([]byte, error) {
+	return s.GetRange([]byte(key), off, n)
+}
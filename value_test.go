@@ -0,0 +1,127 @@
+package skv
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenValue(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.skv"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	value := make([]byte, 200000)
+	for i := range value {
+		value[i] = byte(i % 251)
+	}
+	db.Put([]byte("blob"), value)
+
+	v, err := db.OpenString("blob")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer v.Close()
+
+	if v.Size() != int64(len(value)) {
+		t.Errorf("Expected size %d, got %d", len(value), v.Size())
+	}
+
+	// ReadAt
+	buf := make([]byte, 100)
+	if _, err := v.ReadAt(buf, 70000); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(buf, value[70000:70100]) {
+		t.Error("ReadAt returned wrong bytes")
+	}
+	if n, err := v.ReadAt(buf, int64(len(value))-10); n != 10 || err != io.EOF {
+		t.Errorf("Expected 10 bytes and io.EOF at the end, got %d and %v", n, err)
+	}
+
+	// Seek and Read
+	if _, err := v.Seek(-50, io.SeekEnd); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	rest, err := io.ReadAll(v)
+	if err != nil || !bytes.Equal(rest, value[len(value)-50:]) {
+		t.Errorf("Read after Seek returned %d bytes (%v)", len(rest), err)
+	}
+
+	// Sections
+	section := io.NewSectionReader(v, 1000, 10)
+	part, _ := io.ReadAll(section)
+	if !bytes.Equal(part, value[1000:1010]) {
+		t.Error("SectionReader returned wrong bytes")
+	}
+
+	// GetRange clips to the end of the value
+	data, err := db.GetRangeString("blob", int64(len(value))-5, 100)
+	if err != nil || !bytes.Equal(data, value[len(value)-5:]) {
+		t.Errorf("GetRange returned %v (%v)", data, err)
+	}
+	if _, err := db.GetRangeString("blob", int64(len(value))+1, 1); err == nil {
+		t.Error("Expected error for an offset beyond the value")
+	}
+	if _, err := db.GetRangeString("missing", 0, 1); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestOpenValueInvalidation(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.skv"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	db.PutString("a", "first value")
+	db.PutString("b", "other value")
+	db.PutString("c", "third value")
+
+	a, _ := db.OpenString("a")
+	b, _ := db.OpenString("b")
+	c, _ := db.OpenString("c")
+	defer a.Close()
+	defer b.Close()
+	defer c.Close()
+
+	// Updating a key with a value of the same size reuses its slot, the
+	// reader must still notice
+	db.UpdateString("a", "FIRST VALUE")
+	buf := make([]byte, 5)
+	if _, err := a.ReadAt(buf, 0); !errors.Is(err, ErrValueChanged) {
+		t.Errorf("Expected ErrValueChanged after update, got %v", err)
+	}
+
+	// Other keys are unaffected
+	if _, err := b.ReadAt(buf, 0); err != nil || string(buf) != "other" {
+		t.Errorf("Expected reader on b to stay valid, got %q (%v)", buf, err)
+	}
+
+	// Compaction moves every record
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if _, err := c.ReadAt(buf, 0); !errors.Is(err, ErrValueChanged) {
+		t.Errorf("Expected ErrValueChanged after compaction, got %v", err)
+	}
+
+	// A new reader sees the current value
+	fresh, err := db.OpenString("a")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	all, _ := io.ReadAll(fresh)
+	if string(all) != "FIRST VALUE" {
+		t.Errorf("Expected updated value, got %q", all)
+	}
+	fresh.Close()
+	if _, err := fresh.ReadAt(buf, 0); err == nil {
+		t.Error("Expected error reading a closed reader")
+	}
+}
@@ -0,0 +1,133 @@
+package skv
+
+import "container/list"
+
+// CacheStats contains statistics about the value cache
+type CacheStats struct {
+	Hits     uint64 // Reads answered from the cache
+	Misses   uint64 // Reads of existing keys that went to the file
+	Entries  int    // Number of cached values
+	Size     int64  // Bytes held by cached values
+	Capacity int64  // Maximum bytes held (Options.ValueCacheSize)
+}
+
+// valueEntry is a cached value, stored in the LRU list
+type valueEntry struct {
+	key   string
+	value []byte
+}
+
+// valueCache is a least recently used cache of values bounded in bytes
+// A nil cache is disabled: lookups miss without counting and the rest is a no-op
+// All methods must be called with the write lock held
+type valueCache struct {
+	capacity int64
+	size     int64
+	order    *list.List               // Front is the most recently used
+	entries  map[string]*list.Element // key -> element holding a *valueEntry
+	hits     uint64
+	misses   uint64
+}
+
+// newValueCache returns a cache holding up to capacity bytes of values
+// Returns nil if capacity is not positive
+func newValueCache(capacity int64) *valueCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &valueCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// entrySize is the number of bytes an entry counts against the capacity
+func entrySize(key string, value []byte) int64 {
+	return int64(len(key) + len(value))
+}
+
+// get returns a copy of the cached value of a key
+func (c *valueCache) get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	elem, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(elem)
+	value := elem.Value.(*valueEntry).value
+	return append(make([]byte, 0, len(value)), value...), true
+}
+
+// add caches a copy of a value, evicting the least recently used values
+// Values larger than the whole cache are not cached
+func (c *valueCache) add(key string, value []byte) {
+	if c == nil {
+		return
+	}
+	c.remove(key)
+	size := entrySize(key, value)
+	if size > c.capacity {
+		return
+	}
+	for c.size+size > c.capacity {
+		c.removeElement(c.order.Back())
+	}
+	entry := &valueEntry{key: key, value: append([]byte(nil), value...)}
+	c.entries[key] = c.order.PushFront(entry)
+	c.size += size
+}
+
+// remove drops the cached value of a key
+func (c *valueCache) remove(key string) {
+	if c == nil {
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.removeElement(elem)
+	}
+}
+
+// removeElement drops an entry from the list and the map
+func (c *valueCache) removeElement(elem *list.Element) {
+	entry := c.order.Remove(elem).(*valueEntry)
+	delete(c.entries, entry.key)
+	c.size -= entrySize(entry.key, entry.value)
+}
+
+// purge drops every cached value, keeping the counters
+func (c *valueCache) purge() {
+	if c == nil {
+		return
+	}
+	c.order.Init()
+	c.entries = make(map[string]*list.Element)
+	c.size = 0
+}
+
+// stats returns the counters and the current usage of the cache
+func (c *valueCache) stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	return CacheStats{
+		Hits:     c.hits,
+		Misses:   c.misses,
+		Entries:  len(c.entries),
+		Size:     c.size,
+		Capacity: c.capacity,
+	}
+}
+
+// CacheStats returns the hit and miss counters and the usage of the value cache
+// All fields are zero if the cache is disabled (see Options.ValueCacheSize)
+func (s *SKV) CacheStats() CacheStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.values.stats()
+}
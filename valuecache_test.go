@@ -0,0 +1,111 @@
+package skv
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestValueCache(t *testing.T) {
+	db, err := OpenWithOptions(filepath.Join(t.TempDir(), "test.skv"), Options{ValueCacheSize: 20})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	db.PutString("a", "123456789") // 10 bytes with the key
+	db.PutString("b", "123456789")
+	db.PutString("c", "123456789")
+
+	db.GetString("a")
+	db.GetString("a")
+	db.GetString("missing")
+	if stats := db.CacheStats(); stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 1 || stats.Size != 10 {
+		t.Errorf("Unexpected stats after the first reads: %+v", stats)
+	}
+
+	// Reading c evicts b, the least recently used
+	db.GetString("b")
+	db.GetString("a")
+	db.GetString("c")
+	db.GetBatch([][]byte{[]byte("a"), []byte("b")})
+	if stats := db.CacheStats(); stats.Hits != 3 || stats.Misses != 4 || stats.Size != 20 {
+		t.Errorf("Unexpected stats after eviction: %+v", stats)
+	}
+
+	// Every write path drops stale values
+	db.GetString("a")
+	checks := []struct {
+		name  string
+		write func()
+		want  string
+	}{
+		{"Update", func() { db.UpdateString("a", "updated") }, "updated"},
+		{"WriteAt", func() { db.WriteAtString("a", 0, []byte("U")) }, "Updated"},
+		{"Set", func() { db.SetString("a", "set") }, "set"},
+	}
+	for _, c := range checks {
+		db.GetString("a")
+		c.write()
+		if got, _ := db.GetString("a"); got != c.want {
+			t.Errorf("Stale value after %s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+
+	db.GetString("b")
+	db.DeleteString("b")
+	if _, err := db.GetString("b"); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound after Delete, got %v", err)
+	}
+
+	db.Compact()
+	if stats := db.CacheStats(); stats.Entries != 0 {
+		t.Errorf("Compact should empty the cache, got %+v", stats)
+	}
+	db.GetString("a")
+	db.Clear()
+	if _, err := db.GetString("a"); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound after Clear, got %v", err)
+	}
+
+	// Values larger than the cache are never cached
+	db.PutString("big", "this value does not fit")
+	db.GetString("big")
+	if stats := db.CacheStats(); stats.Entries != 0 {
+		t.Errorf("Oversized value was cached: %+v", stats)
+	}
+}
+
+func TestValueCacheRestore(t *testing.T) {
+	dir := t.TempDir()
+	db, err := OpenWithOptions(filepath.Join(dir, "test.skv"), Options{ValueCacheSize: 1024})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	db.PutString("key", "backed up")
+	backup := filepath.Join(dir, "backup.json")
+	if err := db.Backup(backup); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	db.UpdateString("key", "changed")
+	db.GetString("key")
+	if err := db.Restore(backup); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if got, _ := db.GetString("key"); got != "backed up" {
+		t.Errorf("Stale value after Restore: %q", got)
+	}
+
+	disabled, err := Open(filepath.Join(dir, "other.skv"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer disabled.Close()
+	disabled.PutString("key", "value")
+	disabled.GetString("key")
+	if stats := disabled.CacheStats(); stats != (CacheStats{}) {
+		t.Errorf("Disabled cache should report zero stats, got %+v", stats)
+	}
+}
@@ -0,0 +1,238 @@
+package skv
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// Deep verification
+//
+// Verify reads every record and gathers statistics. VerifyDeep also checks
+// the file against the state Open built from it: every key index entry must
+// point at a live record of its key, every live record must be the one its
+// key points at, free space slots must cover deleted records and nothing
+// else, and padding must follow a record. Each problem is reported as a
+// Finding with the offset it is about, so a file can be checked as a whole
+// instead of stopping at the first damaged record.
+
+// FindingKind classifies a problem found by VerifyDeep
+type FindingKind string
+
+// Kinds of findings
+const (
+	FindingCorrupt      FindingKind = "corrupt"        // Bytes that aren't a readable record
+	FindingDanglingKey  FindingKind = "dangling key"   // An index entry doesn't point at a live record
+	FindingKeyMismatch  FindingKind = "key mismatch"   // An index entry points at a record of another key
+	FindingMissingKey   FindingKind = "missing key"    // A live record isn't in the key index
+	FindingDuplicateKey FindingKind = "duplicate key"  // A key has more than one live record
+	FindingBadFreeSpace FindingKind = "bad free space" // A free space slot doesn't hold a deleted record
+	FindingFreeOverlap  FindingKind = "free overlap"   // A free space slot overlaps a live record or another slot
+	FindingLostSpace    FindingKind = "lost space"     // A deleted record isn't in any free space slot
+	FindingBadPadding   FindingKind = "bad padding"    // Padding that doesn't follow a record
+)
+
+// Finding is a problem found by VerifyDeep
+type Finding struct {
+	Kind   FindingKind
+	Offset int64  // Position in the file the finding is about
+	Key    string // Key involved, empty if none
+	Detail string // Description of the problem
+}
+
+func (f Finding) String() string {
+	if f.Key != "" {
+		return fmt.Sprintf("%s at offset %d (key %q): %s", f.Kind, f.Offset, f.Key, f.Detail)
+	}
+	return fmt.Sprintf("%s at offset %d: %s", f.Kind, f.Offset, f.Detail)
+}
+
+// deepRecord is a record found by VerifyDeep
+type deepRecord struct {
+	position int64
+	h        recordHeader
+}
+
+// end returns the position right after the record
+func (r *deepRecord) end() int64 {
+	return r.position + int64(r.h.size())
+}
+
+// VerifyDeep checks the structure of the database file and returns the
+// problems found, sorted by offset. A healthy database has none.
+// Unlike Verify, damaged records don't stop the check: they are reported
+// as FindingCorrupt and the scan resumes at the next plausible record, as
+// Repair does. The error is only set if the file can't be read.
+func (s *SKV) VerifyDeep() ([]Finding, error) {
+	return s.VerifyDeepContext(context.Background())
+}
+
+// VerifyDeepContext is VerifyDeep, stopping with the context's error once
+// ctx is done. The context is checked between records.
+func (s *SKV) VerifyDeepContext(ctx context.Context) ([]Finding, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	info, err := s.file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("error getting file info: %w", err)
+	}
+	scan := &repairScan{file: s.file, size: info.Size()}
+
+	var findings []Finding
+	add := func(kind FindingKind, offset int64, key string, format string, args ...any) {
+		findings = append(findings, Finding{Kind: kind, Offset: offset, Key: key, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	header := make([]byte, HeaderSize)
+	if _, err := s.file.ReadAt(header, 0); err != nil || string(header[0:3]) != HeaderMagic {
+		add(FindingCorrupt, 0, "", "invalid file header")
+	}
+
+	// Read every record
+	records := make(map[int64]*deepRecord)
+	var live, deleted []*deepRecord
+	err = scan.walk(scanVisitor{
+		record: func(position int64, h recordHeader) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			record := &deepRecord{position: position, h: h}
+			records[position] = record
+			if isDeleted(h.recordType) {
+				deleted = append(deleted, record)
+			} else {
+				live = append(live, record)
+			}
+			return nil
+		},
+		damaged: func(offset int64, end int64, reason string) error {
+			add(FindingCorrupt, offset, "", "%d unreadable bytes: %s", end-offset, reason)
+			return nil
+		},
+		padding: func(offset int64, end int64) error {
+			// Padding fills the end of a slot after the record written in it
+			if offset == HeaderSize {
+				add(FindingBadPadding, offset, "", "%d padding bytes before the first record", end-offset)
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The index entries, and how to name the entry in a finding
+	index := make(map[repairKey]int64)
+	err = s.cache.each(func(key string, position int64) error {
+		index[repairKey{key: key}] = position
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	bucketNames := make(map[uint64]string)
+	for name, b := range s.buckets {
+		bucketNames[b.id] = name
+		index[repairKey{bucketDef: true, key: name}] = b.position
+		for key, position := range b.cache {
+			index[repairKey{bucket: b.id, key: key}] = position
+		}
+	}
+	for name, idx := range s.indexes {
+		index[repairKey{indexDef: true, key: name}] = idx.position
+	}
+	describe := func(id repairKey) string {
+		switch {
+		case id.bucketDef:
+			return fmt.Sprintf("definition of bucket %q", id.key)
+		case id.indexDef:
+			return fmt.Sprintf("definition of index %q", id.key)
+		case id.bucket != 0:
+			return fmt.Sprintf("key %q of bucket %q", id.key, bucketNames[id.bucket])
+		}
+		return fmt.Sprintf("key %q", id.key)
+	}
+
+	// Every index entry points at a live record of its key
+	for id, position := range index {
+		record, ok := records[position]
+		switch {
+		case !ok:
+			add(FindingDanglingKey, position, id.key, "%s points where no record starts", describe(id))
+		case isDeleted(record.h.recordType):
+			add(FindingDanglingKey, position, id.key, "%s points at a deleted record", describe(id))
+		case recordKeyOf(record.h) != id:
+			add(FindingKeyMismatch, position, id.key, "%s points at the record of the %s", describe(id), describe(recordKeyOf(record.h)))
+		}
+	}
+
+	// Every live record is the one its key points at
+	for _, record := range live {
+		id := recordKeyOf(record.h)
+		position, ok := index[id]
+		switch {
+		case !ok && id.bucket != 0 && bucketNames[id.bucket] == "":
+			add(FindingMissingKey, record.position, id.key, "record of bucket %d, which has no definition", id.bucket)
+		case !ok:
+			add(FindingMissingKey, record.position, id.key, "%s isn't in the index", describe(id))
+		case position != record.position:
+			add(FindingDuplicateKey, record.position, id.key, "%s also has the record at offset %d", describe(id), position)
+		}
+	}
+
+	// Free space slots hold a deleted record, and overlap nothing live
+	slots := append([]FreeSpace(nil), s.freeSpace...)
+	sort.Slice(slots, func(i, j int) bool {
+		return slots[i].position < slots[j].position
+	})
+	var previousEnd int64
+	for i, slot := range slots {
+		end := slot.position + int64(slot.size)
+		if record, ok := records[slot.position]; !ok || !isDeleted(record.h.recordType) {
+			add(FindingBadFreeSpace, slot.position, "", "free space of %d bytes doesn't start at a deleted record", slot.size)
+		} else if end < record.end() {
+			add(FindingBadFreeSpace, slot.position, string(record.h.key), "free space of %d bytes is smaller than the deleted record (%d bytes)", slot.size, record.h.size())
+		}
+		if end > scan.size {
+			add(FindingBadFreeSpace, slot.position, "", "free space of %d bytes runs past the end of the file", slot.size)
+		}
+		if i > 0 && slot.position < previousEnd {
+			add(FindingFreeOverlap, slot.position, "", "free space overlaps the free space at offset %d", slots[i-1].position)
+		}
+		previousEnd = max(previousEnd, end)
+
+		// live is in file order, find the first record ending after the slot
+		first := sort.Search(len(live), func(j int) bool {
+			return live[j].end() > slot.position
+		})
+		for _, record := range live[first:] {
+			if record.position >= end {
+				break
+			}
+			add(FindingFreeOverlap, slot.position, string(record.h.key), "free space of %d bytes overlaps the live record at offset %d", slot.size, record.position)
+		}
+	}
+
+	// Every deleted record can be reused
+	for _, record := range deleted {
+		i := sort.Search(len(slots), func(j int) bool {
+			return slots[j].position > record.position
+		})
+		if i == 0 || slots[i-1].position+int64(slots[i-1].size) <= record.position {
+			add(FindingLostSpace, record.position, string(record.h.key), "deleted record of %d bytes isn't in the free space list", record.h.size())
+		}
+	}
+
+	sort.Slice(findings, func(i, j int) bool {
+		if findings[i].Offset != findings[j].Offset {
+			return findings[i].Offset < findings[j].Offset
+		}
+		return findings[i].String() < findings[j].String()
+	})
+	return findings, nil
+}
@@ -0,0 +1,156 @@
+package skv
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// findingKinds counts the findings of each kind
+func findingKinds(findings []Finding) map[FindingKind]int {
+	kinds := make(map[FindingKind]int)
+	for _, f := range findings {
+		kinds[f.Kind]++
+	}
+	return kinds
+}
+
+func TestVerifyDeep(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.skv")
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+
+	// Every way records are written, moved and freed
+	for i := 0; i < 100; i++ {
+		db.PutString(fmt.Sprintf("key-%03d", i), fmt.Sprintf(`{"n": %d}`, i%5))
+	}
+	for i := 0; i < 100; i += 3 {
+		db.UpdateString(fmt.Sprintf("key-%03d", i), "a longer updated value")
+	}
+	for i := 1; i < 100; i += 4 {
+		db.DeleteString(fmt.Sprintf("key-%03d", i))
+	}
+	db.PutString("short", "x") // Reuses a slot, leaving padding
+	db.TruncateString("key-002", 2)
+	bucket, _ := db.Bucket("users")
+	bucket.PutString("alice", "admin")
+	bucket.PutString("bob", "user")
+	bucket.DeleteString("bob")
+	db.Bucket("gone")
+	db.DeleteBucket("gone")
+	if err := db.CreateFieldIndex("by-n", "n"); err != nil {
+		t.Fatalf("CreateFieldIndex failed: %v", err)
+	}
+
+	findings, err := db.VerifyDeep()
+	if err != nil || len(findings) != 0 {
+		t.Fatalf("Expected a healthy database, got %v (%v)", findings, err)
+	}
+	db.Close()
+
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	if findings, err := db.VerifyDeep(); err != nil || len(findings) != 0 {
+		t.Fatalf("Expected a healthy database after reopening, got %v (%v)", findings, err)
+	}
+
+	// Damage the state Open built
+	pos4, _ := db.cache.get("key-004")
+	pos6, _ := db.cache.get("key-006")
+	db.cache.set("key-004", pos6)
+	db.cache.set("key-006", pos6+1)
+	db.cache.remove("key-008")
+	db.freeSpace = append(db.freeSpace, FreeSpace{position: pos4, size: 10})
+	duplicate, err := db.writeRecord([]byte("key-010"), nil, []byte("again"))
+	if err != nil {
+		t.Fatalf("writeRecord failed: %v", err)
+	}
+
+	findings, err = db.VerifyDeep()
+	if err != nil {
+		t.Fatalf("VerifyDeep failed: %v", err)
+	}
+	want := map[FindingKind]int{
+		FindingKeyMismatch:  1, // key-004 points at key-006
+		FindingDanglingKey:  1, // key-006 points inside a record
+		FindingMissingKey:   1, // key-008
+		FindingDuplicateKey: 3, // key-004 and key-006 at key-006, the new key-010
+		FindingBadFreeSpace: 1, // The slot at key-004 holds a live record
+		FindingFreeOverlap:  1,
+	}
+	if kinds := findingKinds(findings); fmt.Sprint(kinds) != fmt.Sprint(want) {
+		t.Fatalf("Expected %v, got %v", want, findings)
+	}
+	for _, f := range findings {
+		if f.Kind == FindingDuplicateKey && f.Key == "key-010" && f.Offset != duplicate {
+			t.Errorf("Expected the duplicate at offset %d, got %v", duplicate, f)
+		}
+		if f.Kind == FindingDanglingKey && f.Offset != pos6+1 {
+			t.Errorf("Expected the dangling entry at offset %d, got %v", pos6+1, f)
+		}
+	}
+	for i := 1; i < len(findings); i++ {
+		if findings[i].Offset < findings[i-1].Offset {
+			t.Errorf("Findings aren't sorted by offset: %v", findings)
+		}
+	}
+}
+
+func TestVerifyDeepFile(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.skv")
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		db.PutString(fmt.Sprintf("key-%d", i), "value")
+	}
+	db.Close()
+
+	// Padding right after the header, which Open skips
+	data, _ := os.ReadFile(dbPath)
+	data = append(data[:HeaderSize:HeaderSize], append(bytes.Repeat([]byte{PaddingByte}, 3), data[HeaderSize:]...)...)
+	os.WriteFile(dbPath, data, 0644)
+
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	// A record damaged after Open, and a deleted record the free space list
+	// doesn't know about
+	pos3, _ := db.cache.get("key-3")
+	db.file.WriteAt([]byte{0x03}, pos3)
+	pos5, _ := db.cache.get("key-5")
+	recordType := make([]byte, 1)
+	db.file.ReadAt(recordType, pos5)
+	db.file.WriteAt([]byte{recordType[0] | DeletedFlag}, pos5)
+
+	findings, err := db.VerifyDeep()
+	if err != nil {
+		t.Fatalf("VerifyDeep failed: %v", err)
+	}
+	want := []Finding{
+		{Kind: FindingBadPadding, Offset: HeaderSize},
+		{Kind: FindingCorrupt, Offset: pos3},
+		{Kind: FindingDanglingKey, Offset: pos3, Key: "key-3"},
+		{Kind: FindingDanglingKey, Offset: pos5, Key: "key-5"},
+		{Kind: FindingLostSpace, Offset: pos5, Key: "key-5"},
+	}
+	if len(findings) != len(want) {
+		t.Fatalf("Expected %d findings, got %v", len(want), findings)
+	}
+	for i, f := range findings {
+		if f.Kind != want[i].Kind || f.Offset != want[i].Offset || f.Key != want[i].Key {
+			t.Errorf("Finding %d: expected %s at %d (%q), got %v", i, want[i].Kind, want[i].Offset, want[i].Key, f)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package skv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrVersionMismatch is returned by CompareAndSwap and DeleteIfVersion when
+// the key was modified since the expected version was read
+var ErrVersionMismatch = errors.New("version mismatch")
+
+// nextVersion returns a new record version
+// Versions increase across all keys, so a key that is deleted and created
+// again never gets a version it had before.
+// Must be called with the write lock held
+func (s *SKV) nextVersion() uint64 {
+	s.revision++
+	return s.revision
+}
+
+// stampVersion returns meta with a new version if it has none yet
+// Records carried over unchanged (e.g. by Restore) keep their version.
+// Must be called with the write lock held
+func (s *SKV) stampVersion(meta *recordMeta) *recordMeta {
+	if meta != nil && meta.version != 0 {
+		return meta
+	}
+	stamped := recordMeta{}
+	if meta != nil {
+		stamped = *meta
+	}
+	stamped.version = s.nextVersion()
+	return &stamped
+}
+
+// bumpVersion gives the record at position a new version in place, used
+// after its value is modified in place
+// The record must have a version, see versionRecord.
+// Must be called with the write lock held
+func (s *SKV) bumpVersion(position int64, h recordHeader) error {
+	offset := h.versionOffset()
+	if offset == 0 {
+		return fmt.Errorf("record of key %q has no version field", h.key)
+	}
+
+	field := binary.LittleEndian.AppendUint64(nil, s.nextVersion())
+	if _, err := s.file.WriteAt(field, position+offset); err != nil {
+		return fmt.Errorf("error writing version: %w", err)
+	}
+	return nil
+}
+
+// versionRecord rewrites a record written before versions existed with a
+// version, so in-place changes can bump it. Otherwise such a key would keep
+// version 0 and CompareAndSwap against 0 would succeed after it changed. The
+// value is copied unchanged and isn't reported to observers.
+// Returns the position and header of the new record.
+// Must be called with the write lock held
+func (s *SKV) versionRecord(key []byte, position int64, h recordHeader) (int64, recordHeader, error) {
+	meta := h.meta
+	data := io.NewSectionReader(s.file, position+int64(h.headerSize), int64(h.dataSize))
+	recordPos, err := s.writeRecordStream(key, &meta, data, h.dataSize)
+	if err != nil {
+		return 0, recordHeader{}, fmt.Errorf("error adding a version to key %q: %w", key, err)
+	}
+	if err := s.deleteFrom(s.cache, key); err != nil {
+		return 0, recordHeader{}, err
+	}
+	if err := s.cache.set(string(key), recordPos); err != nil {
+		return 0, recordHeader{}, err
+	}
+
+	h, err = s.recordHeaderAt(recordPos)
+	if err != nil {
+		return 0, recordHeader{}, fmt.Errorf("error reading record: %w", err)
+	}
+	return recordPos, h, nil
+}
+
+// versionAt returns the version of the record of an existing key
+// Must be called with the lock held
+func (s *SKV) versionAt(key []byte) (uint64, error) {
+	position, exists := s.cache.get(string(key))
+	if !exists {
+		return 0, ErrKeyNotFound
+	}
+	h, err := s.recordHeaderAt(position)
+	if err != nil {
+		return 0, fmt.Errorf("error reading record: %w", err)
+	}
+	return h.meta.version, nil
+}
+
+// Version returns the current version of a key
+// Every write to a key gives it a new, higher version. Keys written by
+// versions of skv without record versions report 0 until they are rewritten.
+// Returns ErrKeyNotFound if the key doesn't exist
+func (s *SKV) Version(key []byte) (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.checkOpen(); err != nil {
+		return 0, err
+	}
+
+	if len(key) == 0 {
+		return 0, ErrEmptyKey
+	}
+	return s.versionAt(key)
+}
+
+// VersionString is a convenience wrapper for Version using string keys
+func (s *SKV) VersionString(key string) (uint64, error) {
+	return s.Version([]byte(key))
+}
+
+// GetWithVersion retrieves the value of a key together with its version,
+// for use with CompareAndSwap and DeleteIfVersion
+// Returns ErrKeyNotFound if the key doesn't exist
+func (s *SKV) GetWithVersion(key []byte) ([]byte, uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.checkOpen(); err != nil {
+		return nil, 0, err
+	}
+
+	if len(key) == 0 {
+		return nil, 0, ErrEmptyKey
+	}
+
+	position, exists := s.cache.get(string(key))
+	if !exists {
+		return nil, 0, ErrKeyNotFound
+	}
+
+	h, value, err := s.recordDataAt(position)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error reading record: %w", err)
+	}
+	data := make([]byte, h.dataSize)
+	if _, err := io.ReadFull(value, data); err != nil {
+		return nil, 0, fmt.Errorf("error reading data: %w", err)
+	}
+
+	return data, h.meta.version, nil
+}
+
+// GetWithVersionString is a convenience wrapper for GetWithVersion using string keys
+func (s *SKV) GetWithVersionString(key string) (string, uint64, error) {
+	data, version, err := s.GetWithVersion([]byte(key))
+	return string(data), version, err
+}
+
+// CompareAndSwap replaces the value of an existing key only if its version
+// is still expectedVersion, and returns the new version
+// Returns ErrVersionMismatch if the key was modified in between,
+// ErrKeyNotFound if the key doesn't exist
+func (s *SKV) CompareAndSwap(key []byte, expectedVersion uint64, newValue []byte) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkWritable(); err != nil {
+		return 0, err
+	}
+	if len(key) == 0 {
+		return 0, ErrEmptyKey
+	}
+
+	version, err := s.versionAt(key)
+	if err != nil {
+		return 0, err
+	}
+	if version != expectedVersion {
+		return 0, fmt.Errorf("%w: key %q is at version %d, expected %d", ErrVersionMismatch, key, version, expectedVersion)
+	}
+	if err := s.checkPut(key, nil, uint64(len(newValue))); err != nil {
+		return 0, err
+	}
+
+	if err := s.deleteInternal(key); err != nil {
+		return 0, err
+	}
+	recordPos, err := s.writeRecord(key, nil, newValue)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.cache.set(string(key), recordPos); err != nil {
+		return 0, err
+	}
+	s.notify(opSet, key, newValue)
+
+	return s.revision, nil
+}
+
+// CompareAndSwapString is a convenience wrapper for CompareAndSwap using string keys
+func (s *SKV) CompareAndSwapString(key string, expectedVersion uint64, newValue string) (uint64, error) {
+	return s.CompareAndSwap([]byte(key), expectedVersion, []byte(newValue))
+}
+
+// DeleteIfVersion deletes a key only if its version is still expectedVersion
+// Returns ErrVersionMismatch if the key was modified in between,
+// ErrKeyNotFound if the key doesn't exist
+func (s *SKV) DeleteIfVersion(key []byte, expectedVersion uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+
+	version, err := s.versionAt(key)
+	if err != nil {
+		return err
+	}
+	if version != expectedVersion {
+		return fmt.Errorf("%w: key %q is at version %d, expected %d", ErrVersionMismatch, key, version, expectedVersion)
+	}
+
+	if err := s.deleteInternal(key); err != nil {
+		return err
+	}
+	s.notify(opDelete, key, nil)
+
+	return nil
+}
+
+// DeleteIfVersionString is a convenience wrapper for DeleteIfVersion using string keys
+func (s *SKV) DeleteIfVersionString(key string, expectedVersion uint64) error {
+	return s.DeleteIfVersion([]byte(key), expectedVersion)
+}
@@ -0,0 +1,175 @@
+package skv
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompareAndSwap(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.skv")
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	db.PutString("counter", "1")
+	value, v1, err := db.GetWithVersionString("counter")
+	if err != nil || value != "1" || v1 == 0 {
+		t.Fatalf("GetWithVersion returned %q, version %d (%v)", value, v1, err)
+	}
+
+	v2, err := db.CompareAndSwapString("counter", v1, "2")
+	if err != nil {
+		t.Fatalf("CompareAndSwap failed: %v", err)
+	}
+	if v2 <= v1 {
+		t.Errorf("Expected a higher version than %d, got %d", v1, v2)
+	}
+
+	// A stale version is rejected and the value is kept
+	if _, err := db.CompareAndSwapString("counter", v1, "3"); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("Expected ErrVersionMismatch, got %v", err)
+	}
+	if value, _ := db.GetString("counter"); value != "2" {
+		t.Errorf("Expected value to stay 2, got %q", value)
+	}
+	if _, err := db.CompareAndSwapString("missing", 0, "x"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+
+	// Plain writes and in-place writes also change the version
+	db.UpdateString("counter", "4")
+	v3, _ := db.VersionString("counter")
+	if v3 <= v2 {
+		t.Errorf("Expected Update to raise the version above %d, got %d", v2, v3)
+	}
+	db.WriteAtString("counter", 0, []byte("5"))
+	v4, _ := db.VersionString("counter")
+	if v4 <= v3 {
+		t.Errorf("Expected WriteAt to raise the version above %d, got %d", v3, v4)
+	}
+
+	// A key deleted and created again never gets an old version back
+	if err := db.DeleteIfVersionString("counter", v3); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("Expected ErrVersionMismatch, got %v", err)
+	}
+	if err := db.DeleteIfVersionString("counter", v4); err != nil {
+		t.Fatalf("DeleteIfVersion failed: %v", err)
+	}
+	db.PutString("counter", "6")
+	v5, _ := db.VersionString("counter")
+	if v5 <= v4 {
+		t.Errorf("Expected recreated key above version %d, got %d", v4, v5)
+	}
+
+	// Versions survive a reopen and keep increasing
+	db.Close()
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	if v, _ := db.VersionString("counter"); v != v5 {
+		t.Errorf("Expected version %d after reopen, got %d", v5, v)
+	}
+	db.PutString("other", "x")
+	if v, _ := db.VersionString("other"); v <= v5 {
+		t.Errorf("Expected new versions above %d after reopen, got %d", v5, v)
+	}
+
+	// Compaction keeps versions
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if v, _ := db.VersionString("counter"); v != v5 {
+		t.Errorf("Expected version %d after compaction, got %d", v5, v)
+	}
+}
+
+func TestReopenAfterUpdateIntoFreeSpace(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.skv")
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	// The update of b lands in a's free slot, before b's deleted record
+	db.PutString("a", "a longer value")
+	db.PutString("b", "b")
+	db.DeleteString("a")
+	db.UpdateString("b", "b updated")
+
+	db.Close()
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+
+	if value, err := db.GetString("b"); err != nil || value != "b updated" {
+		t.Errorf("Expected updated value after reopen, got %q (%v)", value, err)
+	}
+}
+
+func TestInPlaceWriteVersionsLegacyRecord(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.skv")
+
+	// A file written before records had versions
+	header, err := encodeRecordHeader([]byte("doc"), nil, 8)
+	if err != nil {
+		t.Fatalf("Failed to encode record: %v", err)
+	}
+	file := append(fileHeader(versionMinorPlain), header...)
+	file = append(file, "01234567"...)
+	if err := os.WriteFile(dbPath, file, 0644); err != nil {
+		t.Fatalf("Failed to write legacy file: %v", err)
+	}
+
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	if v, _ := db.VersionString("doc"); v != 0 {
+		t.Fatalf("Expected version 0 for a legacy record, got %d", v)
+	}
+
+	// The first in-place write gives the record a version, so a client
+	// holding version 0 can't overwrite the change
+	if err := db.WriteAtString("doc", 2, []byte("xy")); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	v, _ := db.VersionString("doc")
+	if v == 0 {
+		t.Error("Expected a version after an in-place write")
+	}
+	if _, err := db.CompareAndSwap([]byte("doc"), 0, []byte("lost")); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("Expected ErrVersionMismatch for version 0, got %v", err)
+	}
+	if err := db.DeleteIfVersion([]byte("doc"), 0); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("Expected ErrVersionMismatch deleting version 0, got %v", err)
+	}
+	if err := db.TruncateString("doc", 6); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if v2, _ := db.VersionString("doc"); v2 <= v {
+		t.Errorf("Expected a version above %d after Truncate, got %d", v, v2)
+	}
+
+	db.Close()
+	db, err = Open(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+	if value, _ := db.GetString("doc"); value != "01xy45" || db.Count() != 1 {
+		t.Errorf("Expected 01xy45 after reopen, got %q with %d keys", value, db.Count())
+	}
+	if _, err := db.Verify(); err != nil {
+		t.Errorf("Verify failed: %v", err)
+	}
+}